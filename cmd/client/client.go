@@ -1,38 +1,58 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
 	"net/netip"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/mcombeau/dns-tools/pkg/dns"
 )
 
+// clientConfig holds the options parsed from the command line
+type clientConfig struct {
+	resolvConf   *dns.ResolvConf
+	domainOrIP   string
+	questionType uint16
+	reverseQuery bool
+	useTLS       bool
+	httpsURL     string
+	useHosts     bool
+	transport    *dns.Transport
+	printer      *dns.Printer
+}
+
 func main() {
-	dnsResolver, domainOrIP, questionType, reverseQuery, err := parseArgs()
+	config, err := parseArgs()
 	if err != nil {
 		log.Fatalf("Failed to parse args: %v\n", err)
 	}
+	printer := config.printer
 
-	domain, err := parseQueryDomain(domainOrIP, reverseQuery, questionType)
+	domain, err := parseQueryDomain(config.domainOrIP, config.reverseQuery, config.questionType)
 	if err != nil {
 		log.Fatalf("Bad DNS query: %v\n", err)
 	}
 
-	query, err := dns.CreateQuery(domain, questionType)
+	query, err := dns.CreateQuery(domain, config.questionType)
 	if err != nil {
 		log.Fatalf("Failed to create DNS query: %v\n", err)
 	}
 
 	startTime := time.Now()
 
-	tcpQuery := false
-	response, err := dns.QueryResponse("udp", dnsResolver, query)
+	response, server, protocol, err := answerFromHosts(config, query)
+	if response == nil && err == nil {
+		response, server, protocol, err = sendQuery(config, query)
+	}
 	if err != nil {
-		log.Fatalf("Failed to send DNS query over UDP: %v\n", err)
+		log.Fatalf("Failed to send DNS query over %s: %v\n", protocol, err)
 	}
 
 	decodedMessage, err := dns.DecodeMessage(response)
@@ -40,27 +60,59 @@ func main() {
 		log.Fatalf("Failed to decode DNS response: %v\n", err)
 	}
 
-	if decodedMessage.Header.Flags.Truncated {
-		// If UDP response is truncated (i.e. larger than 512 bytes)
-		// fall back to TCP
+	queryTime := time.Since(startTime)
 
-		tcpQuery = true
-		response, err := dns.QueryResponse("tcp", dnsResolver, query)
-		if err != nil {
-			log.Fatalf("Failed to send DNS query over TCP: %v\n", err)
-		}
+	printer.PrintBasicQueryInfo(domain, config.questionType)
+	printer.PrintMessage(decodedMessage)
+	printer.PrintQueryStats(server, protocol, queryTime, len(response))
+}
 
-		decodedMessage, err = dns.DecodeMessage(response)
-		if err != nil {
-			log.Fatalf("Failed to decode DNS response: %v\n", err)
-		}
+// sendQuery sends the query over HTTPS or TLS if requested, or over UDP with a
+// fallback to TCP if the UDP response is truncated. Name servers are tried in
+// turn until one of them answers.
+func sendQuery(config clientConfig, query []byte) (response []byte, server string, protocol string, err error) {
+	protocol = "udp"
+	if config.httpsURL != "" {
+		protocol = "https"
+	} else if config.useTLS {
+		protocol = "tls"
 	}
 
-	queryTime := time.Since(startTime)
+	response, serverAddrPort, usedProtocol, err := config.resolvConf.Query(context.Background(), config.transport, protocol, query)
+	if usedProtocol != "" {
+		protocol = usedProtocol
+	}
+
+	server = serverAddrPort.String()
+	if config.httpsURL != "" {
+		server = config.httpsURL
+	}
+	return response, server, strings.ToUpper(protocol), err
+}
 
-	dns.PrintBasicQueryInfo(domain, questionType)
-	dns.PrintMessage(decodedMessage)
-	dns.PrintQueryInfo(dnsResolver, queryTime, tcpQuery, len(response))
+// answerFromHosts answers the query from /etc/hosts if requested and if the
+// file has the name or address. The response is nil if the query must be sent.
+func answerFromHosts(config clientConfig, query []byte) (response []byte, server string, protocol string, err error) {
+	protocol = "hosts file"
+	if !config.useHosts {
+		return nil, "", protocol, nil
+	}
+
+	hosts, err := dns.ReadHosts(dns.DefaultHostsPath)
+	if err != nil {
+		return nil, "", protocol, err
+	}
+	request, err := dns.DecodeMessage(query)
+	if err != nil {
+		return nil, "", protocol, err
+	}
+
+	reply, found := hosts.Answer(request)
+	if !found {
+		return nil, "", protocol, nil
+	}
+	response, err = dns.EncodeMessage(reply)
+	return response, dns.DefaultHostsPath, "HOSTS", err
 }
 
 func parseQueryDomain(domainOrIP string, reverseQuery bool, questionType uint16) (fqdn string, err error) {
@@ -91,48 +143,176 @@ func parseQueryDomain(domainOrIP string, reverseQuery bool, questionType uint16)
 	return domain, nil
 }
 
-func parseArgs() (resolverAddrPort netip.AddrPort, domainOrIP string, questionType uint16, reverseQuery bool, err error) {
+func parseArgs() (config clientConfig, err error) {
 	reverseDNSQuery := flag.Bool("x", false, "Perform a reverse DNS query")
+	useTLS := flag.Bool("tls", false, "Send the query over TLS (DNS over TLS, port 853 by default)")
+	useHTTPSGet := flag.Bool("https-get", false, "Send DNS over HTTPS queries with GET requests instead of POST")
+	useHosts := flag.Bool("hosts", false, "Answer from /etc/hosts if it has the name or address, instead of sending the query")
 
 	var server string
 	var port string
+	var tlsServerName string
+	var spkiPin string
+	var httpsURL string
 	flag.StringVar(&server, "s", "", "Specify the DNS resolver server address")
 	flag.StringVar(&port, "p", "53", "Specify the DNS resolver server port")
+	flag.StringVar(&tlsServerName, "tls-name", "", "Verify the TLS server certificate against this name instead of the server IP")
+	flag.StringVar(&spkiPin, "spki", "", "Verify the TLS server public key against this base64 SHA-256 SPKI pin")
+	flag.StringVar(&httpsURL, "https", "", "Send the query over HTTPS to this URL (DNS over HTTPS), connecting to -s if given")
 
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: go run main.go [-s server] [-p port] [-x] <domain_or_ip> [question_type]\n")
+		fmt.Fprintf(os.Stderr, "Usage: go run main.go [-s server] [-p port] [-x] [-tls | -https url] [-hosts] <domain_or_ip> [question_type] [+print_option ...]\n")
 		fmt.Fprintf(os.Stderr, "Options:\n")
 		fmt.Fprintf(os.Stderr, "  -h\tDisplay this help message\n")
 		flag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "Print options:\n")
+		fmt.Fprintf(os.Stderr, "  +short, +multiline, +ttlunits\n")
+		fmt.Fprintf(os.Stderr, "  +[no]header, +[no]question, +[no]answer, +[no]authority, +[no]additional, +[no]stats\n")
 	}
 
 	flag.Parse()
 
-	if flag.NArg() < 1 || flag.NArg() > 2 {
+	config.printer = dns.NewPrinter(os.Stdout)
+	var args []string
+	for _, arg := range flag.Args() {
+		if !strings.HasPrefix(arg, "+") {
+			args = append(args, arg)
+			continue
+		}
+		if err := setPrintOption(config.printer, arg); err != nil {
+			return config, err
+		}
+	}
+
+	if len(args) < 1 || len(args) > 2 {
 		flag.Usage()
 		os.Exit(0)
 	}
 
-	domainOrIP = flag.Arg(0)
+	config.domainOrIP = args[0]
+
+	config.questionType = dns.A // Default to A
+	if len(args) == 2 {
+		config.questionType = dns.GetRecordTypeFromTypeString(args[1])
+		if config.questionType == 0 {
+			return config, fmt.Errorf("invalid query: unknown question type: %s", args[1])
+		}
+	}
+
+	config.reverseQuery = *reverseDNSQuery
+	config.useTLS = *useTLS
+	config.httpsURL = httpsURL
+	config.useHosts = *useHosts
+
+	if config.useTLS && config.httpsURL != "" {
+		return config, fmt.Errorf("invalid options: -tls and -https are mutually exclusive")
+	}
+
+	config.resolvConf, err = getResolvConf(server, port, config.useTLS, config.httpsURL != "")
+	if err != nil {
+		return config, fmt.Errorf("get DNS resolver: %w", err)
+	}
+
+	config.transport = dns.NewTransport()
+	if tlsServerName != "" {
+		config.transport.TLSConfig = &tls.Config{ServerName: tlsServerName}
+	}
+	if spkiPin != "" {
+		config.transport.SPKIPins = []string{spkiPin}
+	}
+	config.transport.HTTPSURL = httpsURL
+	config.transport.HTTPSUseGET = *useHTTPSGet
 
-	questionType = dns.A // Default to A
-	if flag.NArg() == 2 {
-		questionType = dns.GetRecordTypeFromTypeString(flag.Arg(1))
-		if questionType == 0 {
-			return resolverAddrPort, "", 0, false, fmt.Errorf("invalid query: unknown question type: %s", flag.Arg(1))
+	return config, nil
+}
+
+// getResolvConf returns the name servers to query: the given server, or
+// those of /etc/resolv.conf. Over TLS, the port defaults to 853. Over HTTPS,
+// the server is only a bootstrap address for the URL's host, and is optional.
+func getResolvConf(server string, port string, useTLS bool, useHTTPS bool) (conf *dns.ResolvConf, err error) {
+	portNumber, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %s: %w", port, err)
+	}
+	if !isFlagSet("p") {
+		if useTLS {
+			portNumber = dns.DefaultTLSPort
+		} else if useHTTPS {
+			portNumber = 443
 		}
 	}
 
-	reverseQuery = *reverseDNSQuery
+	if server != "" {
+		addrPort, err := dns.ParseIPToAddrPort(server)
+		if err != nil {
+			return nil, err
+		}
+		// Keep the port given with the server unless -p overrides it
+		if _, err := netip.ParseAddr(server); err == nil || isFlagSet("p") {
+			addrPort = netip.AddrPortFrom(addrPort.Addr(), uint16(portNumber))
+		}
+		return dns.NewResolvConf(addrPort), nil
+	}
 
-	if server == "" {
-		resolverAddrPort, err = dns.GetDefaultPublicResolver()
-	} else {
-		resolverAddrPort, err = dns.ParseIPToAddrPort(fmt.Sprintf("%s:%s", server, port))
+	if useHTTPS {
+		// Resolve the URL's host instead of connecting to a bootstrap address
+		return dns.NewResolvConf(netip.AddrPort{}), nil
 	}
+
+	conf, err = dns.ReadResolvConf(dns.DefaultResolvConfPath)
 	if err != nil {
-		return resolverAddrPort, "", 0, false, fmt.Errorf("get DNS resolver: %w", err)
+		return nil, err
+	}
+	if useTLS || isFlagSet("p") {
+		for i, nameserver := range conf.Nameservers {
+			conf.Nameservers[i] = netip.AddrPortFrom(nameserver.Addr(), uint16(portNumber))
+		}
 	}
+	return conf, nil
+}
+
+// isFlagSet returns true if the flag was given on the command line
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
 
-	return resolverAddrPort, domainOrIP, questionType, reverseQuery, nil
+// setPrintOption applies a dig-style print option (+short, +noquestion, etc.)
+// to the printer.
+func setPrintOption(printer *dns.Printer, option string) error {
+	name := strings.TrimPrefix(option, "+")
+	enable := true
+	if strings.HasPrefix(name, "no") {
+		name = strings.TrimPrefix(name, "no")
+		enable = false
+	}
+
+	switch name {
+	case "short":
+		printer.Short = enable
+	case "multiline":
+		printer.Multiline = enable
+	case "ttlunits":
+		printer.TTLUnits = enable
+	case "header":
+		printer.ShowHeader = enable
+	case "question":
+		printer.ShowQuestion = enable
+	case "answer":
+		printer.ShowAnswer = enable
+	case "authority":
+		printer.ShowAuthority = enable
+	case "additional":
+		printer.ShowAdditional = enable
+	case "stats":
+		printer.ShowStats = enable
+	default:
+		return fmt.Errorf("invalid print option: %s", option)
+	}
+	return nil
 }
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net"
@@ -18,16 +21,78 @@ const ServerIP = "0.0.0.0"
 const ServerPort = 5553
 
 func main() {
+	ipv4Only := flag.Bool("4", false, "Only query name servers over IPv4")
+	ipv6Only := flag.Bool("6", false, "Only query name servers over IPv6")
+	hostsPath := flag.String("hosts", dns.DefaultHostsPath, "Answer from this hosts file before resolving (empty to disable)")
+	cacheFile := flag.String("cache-file", "", "Load the cache from this file at startup, and save it there periodically and at shutdown")
+	cacheSize := flag.Int64("cache-size", dns.DefaultMaxCacheSize>>20, "Maximum size of the cache in MiB")
+	staleWindow := flag.Duration("stale", dns.DefaultStaleWindow, "Keep expired answers this long, to serve them when name servers can't be reached (0 to disable)")
+	staleAnswerTimeout := flag.Duration("stale-answer-timeout", dns.DefaultStaleAnswerTimeout, "Serve an expired answer if resolving it again takes longer than this (0 to only serve it when resolution fails)")
+	prefetch := flag.Float64("prefetch", dns.DefaultPrefetchFraction, "Refresh popular records when this fraction of their TTL is left (0 to disable)")
+	flag.Parse()
+
+	if *ipv4Only && *ipv6Only {
+		log.Fatalf("Invalid options: -4 and -6 are mutually exclusive")
+	}
 
 	resolver, err := dns.NewResolver(RootServerHintsFile)
 	if err != nil {
 		log.Fatalf("Failed to create resolver: %v", err)
 	}
 
+	if *cacheSize <= 0 {
+		log.Fatalf("Invalid option: -cache-size must be positive")
+	}
+	resolver.MaxCacheSize = *cacheSize << 20
+
+	if *prefetch < 0 || *prefetch >= 1 {
+		log.Fatalf("Invalid option: -prefetch must be between 0 and 1")
+	}
+	resolver.PrefetchFraction = *prefetch
+
+	if *staleWindow < 0 || *staleAnswerTimeout < 0 {
+		log.Fatalf("Invalid option: -stale and -stale-answer-timeout must not be negative")
+	}
+	resolver.StaleWindow = *staleWindow
+	resolver.StaleAnswerTimeout = *staleAnswerTimeout
+
+	if *ipv4Only {
+		resolver.AddressFamily = dns.IPv4Only
+	} else if *ipv6Only {
+		resolver.AddressFamily = dns.IPv6Only
+	}
+
+	if *hostsPath != "" {
+		resolver.Hosts, err = dns.ReadHosts(*hostsPath)
+		if err != nil {
+			log.Printf("Not using hosts file: %v", err)
+		}
+	}
+
+	ctx, stopCacheMaintenance := context.WithCancel(context.Background())
+	go resolver.RunCacheSweeper(ctx, dns.DefaultCacheSweepInterval)
+	if *cacheFile != "" {
+		if err := resolver.LoadCache(*cacheFile); err != nil {
+			log.Printf("Starting with an empty cache: %v", err)
+		}
+		go resolver.RunCacheSaver(ctx, *cacheFile, dns.DefaultCacheSaveInterval)
+	}
+
 	err = startUDPServer(resolver)
+	stopCacheMaintenance()
 	if err != nil {
 		log.Fatalf("Failed to start UDP server: %v", err)
 	}
+
+	if *cacheFile != "" {
+		if err := resolver.SaveCache(*cacheFile); err != nil {
+			log.Printf("Cache not saved: %v", err)
+		}
+	}
+
+	stats := resolver.CacheStats()
+	log.Printf("Cache: %d entries (%d bytes), %d hits, %d misses, %d evictions, %d expirations, %d prefetches, %d stale answers, %d coalesced",
+		stats.Entries, stats.Size, stats.Hits, stats.Misses, stats.Evictions, stats.Expirations, stats.Prefetches, stats.StaleAnswers, stats.Coalesced)
 }
 
 func startUDPServer(resolver *dns.Resolver) (err error) {
@@ -67,8 +132,9 @@ func startUDPServer(resolver *dns.Resolver) (err error) {
 			continue
 		}
 
+		// The buffer is overwritten by the next packet while the request is handled
 		wg.Add(1)
-		go handleRequest(resolver, &wg, conn, clientAddr, buffer[:n])
+		go handleRequest(resolver, &wg, conn, clientAddr, bytes.Clone(buffer[:n]))
 	}
 
 	wg.Wait()
@@ -83,6 +149,7 @@ func handleRequest(resolver *dns.Resolver, wg *sync.WaitGroup, conn *net.UDPConn
 	response, err := resolver.ResolveQuery(request)
 	if err != nil {
 		log.Printf("Failed to resolve DNS request from client %v: %v", clientAddr, err)
+		return
 	}
 
 	log.Printf("Sending response to client %v", clientAddr)
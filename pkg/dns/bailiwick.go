@@ -0,0 +1,115 @@
+package dns
+
+import "strings"
+
+// Bailiwick checks:
+// A name server is only trusted for the names of the zone it was found to
+// serve: the root zone for a root server, or the zone it was delegated by a
+// referral. Records a server sends about other names are dropped, so that a
+// server can't poison the cache with records for zones it doesn't serve.
+//
+// In an answer, only the records on the chain of CNAME and DNAME records from
+// the question name are kept, up to the first name out of the zone, where
+// resolution must go on from a root server. In a referral, the delegated zone
+// must be below the server's zone and hold the question name, and only the
+// addresses of the zone's name servers within the server's zone (its
+// bailiwick) are kept as glue: a root server's glue for the name servers of
+// com. may be in net.
+
+// inZone reports whether a name is a zone's apex or below it, ignoring case.
+func inZone(name string, zone string) bool {
+	return strings.EqualFold(name, zone) || isBelow(name, zone)
+}
+
+// chainAnswers returns the records of an answer section on the chain of
+// CNAME and DNAME records from a name, in their order in the section: the
+// records owned by each name of the chain and the DNAME records which
+// redirect them. The chain stops at the first name out of the zone.
+//
+// Parameters:
+//   - answers: the answer section of a response
+//   - name: the question name the chain starts from
+//   - zone: the zone of the server which sent the answers
+//
+// Returns:
+//   - chain: the records of the chain within the zone
+func chainAnswers(answers []ResourceRecord, name string, zone string) (chain []ResourceRecord) {
+	onChain := make([]bool, len(answers))
+	visited := make(map[string]bool)
+
+	for inZone(name, zone) && !visited[strings.ToLower(name)] && len(visited) <= MaxCNAMEChainLength {
+		visited[strings.ToLower(name)] = true
+
+		var alias string
+		dnameIndex := -1
+		for i, answer := range answers {
+			if strings.EqualFold(answer.Name, name) {
+				onChain[i] = true
+				if answer.RType == CNAME && alias == "" {
+					alias = answer.RData.String()
+				}
+				continue
+			}
+			// The closest DNAME applies, in the unlikely case there are several
+			if answer.RType == DNAME && isBelow(name, answer.Name) && inZone(answer.Name, zone) &&
+				(dnameIndex < 0 || len(answer.Name) > len(answers[dnameIndex].Name)) {
+				dnameIndex = i
+			}
+		}
+
+		if dnameIndex >= 0 {
+			onChain[dnameIndex] = true
+			if alias == "" {
+				dname := answers[dnameIndex]
+				alias, _ = substituteDNAME(name, dname.Name, dname.RData.String())
+			}
+		}
+		if alias == "" {
+			break
+		}
+		name = alias
+	}
+
+	for i, answer := range answers {
+		if onChain[i] {
+			chain = append(chain, answer)
+		}
+	}
+	return chain
+}
+
+// referralZone returns the zone a response delegates the question name to:
+// the owner of its NS records, if it is below the server's zone and holds
+// the name.
+func referralZone(response Message, zone string, name string) (delegatedZone string, found bool) {
+	for _, record := range response.NameServers {
+		if record.RType != NS {
+			continue
+		}
+		if !isBelow(record.Name, zone) || !inZone(name, record.Name) {
+			return "", false
+		}
+		return record.Name, true
+	}
+	return "", false
+}
+
+// referralGlue returns the addresses of a referral's additional section which
+// are glue for the delegated zone: owned by the zone's name servers, and
+// within the zone of the server which sent the referral.
+func referralGlue(response Message, delegatedZone string, zone string) (glue []ResourceRecord) {
+	nameServers := make(map[string]bool)
+	for _, record := range response.NameServers {
+		if record.RType == NS && strings.EqualFold(record.Name, delegatedZone) {
+			nameServers[strings.ToLower(record.RData.String())] = true
+		}
+	}
+
+	for _, record := range response.Additionals {
+		if (record.RType == A || record.RType == AAAA) &&
+			nameServers[strings.ToLower(record.Name)] && inZone(record.Name, zone) {
+			glue = append(glue, record)
+		}
+	}
+	return glue
+}
@@ -0,0 +1,148 @@
+package dns
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+// recordStrings returns the owner, type and data of records, for comparison.
+func recordStrings(records []ResourceRecord) (strings []string) {
+	for _, record := range records {
+		strings = append(strings, record.Name+" "+DNSType(record.RType).String()+" "+record.RData.String())
+	}
+	return strings
+}
+
+func TestChainAnswers(t *testing.T) {
+	address := func(name string, ip string) ResourceRecord {
+		return newResourceRecord(name, A, 300, &RDataA{IP: netip.MustParseAddr(ip)})
+	}
+	cname := func(name string, target string) ResourceRecord {
+		return newResourceRecord(name, CNAME, 300, &RDataCNAME{DomainName: target})
+	}
+	dname := func(owner string, target string) ResourceRecord {
+		return newResourceRecord(owner, DNAME, 300, &RDataDNAME{DomainName: target})
+	}
+
+	tests := []struct {
+		name    string
+		answers []ResourceRecord
+		zone    string
+		want    []ResourceRecord
+	}{
+		{
+			name:    "Unrelated record",
+			answers: []ResourceRecord{address("www.example.com.", "192.0.2.1"), address("bank.example.com.", "192.0.2.66")},
+			zone:    "example.com.",
+			want:    []ResourceRecord{address("www.example.com.", "192.0.2.1")},
+		},
+		{
+			name:    "CNAME chain",
+			answers: []ResourceRecord{cname("www.example.com.", "cdn.example.com."), address("CDN.example.com.", "192.0.2.1"), address("other.example.com.", "192.0.2.66")},
+			zone:    "example.com.",
+			want:    []ResourceRecord{cname("www.example.com.", "cdn.example.com."), address("CDN.example.com.", "192.0.2.1")},
+		},
+		{
+			name:    "CNAME out of the zone",
+			answers: []ResourceRecord{cname("www.example.com.", "cdn.example.net."), address("cdn.example.net.", "192.0.2.66")},
+			zone:    "example.com.",
+			want:    []ResourceRecord{cname("www.example.com.", "cdn.example.net.")},
+		},
+		{
+			name:    "DNAME without a CNAME",
+			answers: []ResourceRecord{dname("example.com.", "example.org."), address("www.example.org.", "192.0.2.1"), address("other.example.org.", "192.0.2.66")},
+			zone:    ".",
+			want:    []ResourceRecord{dname("example.com.", "example.org."), address("www.example.org.", "192.0.2.1")},
+		},
+		{
+			name:    "DNAME above the zone",
+			answers: []ResourceRecord{dname("com.", "org."), cname("www.example.com.", "www.example.org.")},
+			zone:    "example.com.",
+			want:    []ResourceRecord{cname("www.example.com.", "www.example.org.")},
+		},
+		{
+			name:    "CNAME loop",
+			answers: []ResourceRecord{cname("www.example.com.", "loop.example.com."), cname("loop.example.com.", "www.example.com.")},
+			zone:    "example.com.",
+			want:    []ResourceRecord{cname("www.example.com.", "loop.example.com."), cname("loop.example.com.", "www.example.com.")},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := chainAnswers(tt.answers, "www.example.com.", tt.zone)
+			if !slices.Equal(recordStrings(got), recordStrings(tt.want)) {
+				t.Errorf("chainAnswers() got = %v, want = %v", recordStrings(got), recordStrings(tt.want))
+			}
+		})
+	}
+}
+
+func TestReferral(t *testing.T) {
+	ns := func(zone string, name string) ResourceRecord {
+		return newResourceRecord(zone, NS, 300, &RDataNS{DomainName: name})
+	}
+	address := func(name string, ip string) ResourceRecord {
+		return newResourceRecord(name, A, 300, &RDataA{IP: netip.MustParseAddr(ip)})
+	}
+
+	tests := []struct {
+		name      string
+		zone      string
+		referral  Message
+		wantZone  string
+		wantFound bool
+		wantGlue  []ResourceRecord
+	}{
+		{
+			name:      "Glue out of the delegated zone",
+			zone:      ".",
+			referral:  Message{NameServers: []ResourceRecord{ns("com.", "a.gtld-servers.net.")}, Additionals: []ResourceRecord{address("a.gtld-servers.net.", "192.0.2.30")}},
+			wantZone:  "com.",
+			wantFound: true,
+			wantGlue:  []ResourceRecord{address("a.gtld-servers.net.", "192.0.2.30")},
+		},
+		{
+			name:      "Glue out of the server's zone",
+			zone:      "com.",
+			referral:  Message{NameServers: []ResourceRecord{ns("example.com.", "ns1.example.com."), ns("example.com.", "ns.example.net.")}, Additionals: []ResourceRecord{address("ns1.example.com.", "192.0.2.53"), address("ns.example.net.", "192.0.2.54")}},
+			wantZone:  "example.com.",
+			wantFound: true,
+			wantGlue:  []ResourceRecord{address("ns1.example.com.", "192.0.2.53")},
+		},
+		{
+			name:      "Address of another name",
+			zone:      "com.",
+			referral:  Message{NameServers: []ResourceRecord{ns("example.com.", "ns1.example.com.")}, Additionals: []ResourceRecord{address("ns1.example.com.", "192.0.2.53"), address("www.example.com.", "192.0.2.66")}},
+			wantZone:  "example.com.",
+			wantFound: true,
+			wantGlue:  []ResourceRecord{address("ns1.example.com.", "192.0.2.53")},
+		},
+		{
+			name:     "Zone above the server's zone",
+			zone:     "example.com.",
+			referral: Message{NameServers: []ResourceRecord{ns("com.", "ns.attacker.example.")}},
+		},
+		{
+			name:     "Zone without the question name",
+			zone:     "com.",
+			referral: Message{NameServers: []ResourceRecord{ns("example2.com.", "ns1.example2.com.")}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			zone, found := referralZone(tt.referral, tt.zone, "www.example.com.")
+			if zone != tt.wantZone || found != tt.wantFound {
+				t.Fatalf("referralZone() got = %s, %t, want = %s, %t", zone, found, tt.wantZone, tt.wantFound)
+			}
+			if !found {
+				return
+			}
+			if glue := referralGlue(tt.referral, zone, tt.zone); !slices.Equal(recordStrings(glue), recordStrings(tt.wantGlue)) {
+				t.Errorf("referralGlue() got = %v, want = %v", recordStrings(glue), recordStrings(tt.wantGlue))
+			}
+		})
+	}
+}
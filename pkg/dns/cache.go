@@ -1,6 +1,7 @@
 package dns
 
 import (
+	"strings"
 	"time"
 )
 
@@ -11,105 +12,308 @@ type CachedServer struct {
 	ExpiresAt time.Time
 }
 
-func (resolver *Resolver) cacheNameserver(server Server, ttl time.Duration) {
-	resolver.CacheMutex.Lock()
-	defer resolver.CacheMutex.Unlock()
+func (cached CachedServer) cacheSize() int {
+	return len(cached.Server.Fqdn) + 24*len(cached.Server.Addrs)
+}
+
+func (cached CachedServer) cacheExpiresAt() time.Time {
+	return cached.ExpiresAt
+}
 
-	resolver.NameServerCache[server.Fqdn] = CachedServer{
+func nameServerCacheKey(fqdn string) cacheKey {
+	return cacheKey{kind: cachedServerKind, name: strings.ToLower(fqdn)}
+}
+
+func (resolver *Resolver) cacheNameserver(server Server, ttl time.Duration) {
+	resolver.cache().set(nameServerCacheKey(server.Fqdn), CachedServer{
 		Server:    server,
 		ExpiresAt: time.Now().Add(ttl),
-	}
+	}, nil)
 }
 
 func (resolver *Resolver) getCachedNameServer(fqdn string) (server Server, success bool) {
-	resolver.CacheMutex.RLock()
-
-	cached, found := resolver.NameServerCache[fqdn]
-	if found && !time.Now().After(cached.ExpiresAt) {
-		resolver.CacheMutex.RUnlock()
-		return cached.Server, true
+	cached, found := resolver.cache().get(nameServerCacheKey(fqdn))
+	if !found {
+		return Server{}, false
 	}
+	return cached.(CachedServer).Server, true
+}
+
+// Answer caching:
+// Answers are cached as RRsets: all the records of a name, type and class,
+// which are replaced together when a new response has records for them
+// (RFC 2181 section 5). An RRset has a single TTL, the lowest of its records',
+// bounded by the resolver's minimum and maximum cache TTLs, and its records
+// are returned with the time left before the RRset expires.
+//
+// Data is ranked by where it came from (RFC 2181 section 5.4.1): an RRset
+// only replaces one of the same or lower credibility, unless the cached one
+// has expired. Data from an additional section, such as glue addresses for
+// name servers, is never returned as an answer to a client.
+
+// DefaultMaxCacheTTL is the longest time an RRset is cached, whatever its TTL.
+const DefaultMaxCacheTTL = 24 * time.Hour
+
+// Credibility ranks cached data by the section and response it came from.
+type Credibility uint8
+
+const (
+	// CredibilityAdditional is data from an additional section, such as glue.
+	CredibilityAdditional Credibility = iota + 1
+	// CredibilityNonAuthoritativeAnswer is data from the answer section of a
+	// non-authoritative response, or for another name than the question's in
+	// an authoritative response, such as the rest of a CNAME chain.
+	CredibilityNonAuthoritativeAnswer
+	// CredibilityAuthoritativeAnswer is data for the question's name from the
+	// answer section of an authoritative response.
+	CredibilityAuthoritativeAnswer
+)
 
-	// Cache miss or expired: upgrade to a write lock
-	resolver.CacheMutex.RUnlock()
-	resolver.CacheMutex.Lock()
-	defer resolver.CacheMutex.Unlock()
+type CachedRRset struct {
+	Records     []ResourceRecord
+	Credibility Credibility
+	ExpiresAt   time.Time
+	TTL         time.Duration // the time the RRset was cached for
+}
 
-	// Double-check the cache in case another goroutine updated it after we released the read lock
-	cached, found = resolver.NameServerCache[fqdn]
-	if found && !time.Now().After(cached.ExpiresAt) {
-		return cached.Server, true
+func (cached CachedRRset) cacheSize() int {
+	size := 0
+	for _, record := range cached.Records {
+		size += recordCacheSize(record)
 	}
+	return size
+}
 
-	// Cache miss or expired: remove from cache and return false
-	delete(resolver.NameServerCache, fqdn)
-	return Server{}, false
+func (cached CachedRRset) cacheExpiresAt() time.Time {
+	return cached.ExpiresAt
 }
 
-// Answer caching
+// recordCacheSize approximates the memory used by a cached record: its
+// name, fixed fields and data.
+func recordCacheSize(record ResourceRecord) int {
+	return len(record.Name) + 32 + int(record.RDLength)
+}
 
-type CachedAnswer struct {
-	Answers []CachedResourceRecord
+func rrsetCacheKey(fqdn string, rType uint16, rClass uint16) cacheKey {
+	return cacheKey{kind: cachedRRsetKind, name: strings.ToLower(fqdn), rType: rType, rClass: rClass}
 }
 
-type CachedResourceRecord struct {
-	Record    ResourceRecord
-	ExpiresAt time.Time
+// cacheTTL bounds a TTL by the resolver's minimum and maximum cache TTLs.
+func (resolver *Resolver) cacheTTL(ttl uint32) time.Duration {
+	maxTTL := resolver.MaxCacheTTL
+	if maxTTL <= 0 {
+		maxTTL = DefaultMaxCacheTTL
+	}
+	return min(max(time.Duration(ttl)*time.Second, resolver.MinCacheTTL), maxTTL)
 }
 
-func (resolver *Resolver) cacheAnswerRecord(fqdn string, answer ResourceRecord) {
-	resolver.CacheMutex.Lock()
-	defer resolver.CacheMutex.Unlock()
+// cacheRRsets groups records into RRsets and caches each of them, replacing
+// the cached RRset unless it is more credible and hasn't expired.
+func (resolver *Resolver) cacheRRsets(records []ResourceRecord, credibility Credibility) {
+	rrsets := make(map[cacheKey][]ResourceRecord)
+	var keys []cacheKey
+	for _, record := range records {
+		if record.RType == OPT {
+			continue
+		}
+		key := rrsetCacheKey(record.Name, record.RType, record.RClass)
+		if _, found := rrsets[key]; !found {
+			keys = append(keys, key)
+		}
+		rrsets[key] = append(rrsets[key], record)
+	}
+
+	moreCredible := func(cached cacheValue) bool {
+		return cached.(CachedRRset).Credibility > credibility
+	}
+
+	now := time.Now()
+	for _, key := range keys {
+		rrset := rrsets[key]
+
+		ttl := rrset[0].TTL
+		for _, record := range rrset[1:] {
+			ttl = min(ttl, record.TTL)
+		}
+
+		cachedFor := resolver.cacheTTL(ttl)
+		resolver.cache().set(key, CachedRRset{
+			Records:     rrset,
+			Credibility: credibility,
+			ExpiresAt:   now.Add(cachedFor),
+			TTL:         cachedFor,
+		}, moreCredible)
+	}
+}
 
-	cachedRecord := CachedResourceRecord{
-		Record:    answer,
-		ExpiresAt: time.Now().Add(time.Duration(answer.TTL) * time.Second),
+// cacheResponseAnswers caches the answer section of a response, which only
+// holds the records the server is trusted for (see chainAnswers). Per RFC
+// 1035, the AA flag only covers the records of the question's name.
+func (resolver *Resolver) cacheResponseAnswers(response Message) {
+	if len(response.Questions) != 1 {
+		return
 	}
 
-	// Check if the answer is already cached
-	if cached, found := resolver.AnswerCache[fqdn]; found {
-		// Append the new answer to the existing slice
-		cached.Answers = append(cached.Answers, cachedRecord)
-		resolver.AnswerCache[fqdn] = cached
-	} else {
-		// Create a new cache entry
-		resolver.AnswerCache[fqdn] = CachedAnswer{
-			Answers: []CachedResourceRecord{cachedRecord},
+	var authoritative, nonAuthoritative []ResourceRecord
+	for _, answer := range response.Answers {
+		if response.Header.Flags.Authoritative && strings.EqualFold(answer.Name, response.Questions[0].Name) {
+			authoritative = append(authoritative, answer)
+		} else {
+			nonAuthoritative = append(nonAuthoritative, answer)
 		}
 	}
+	resolver.cacheRRsets(authoritative, CredibilityAuthoritativeAnswer)
+	resolver.cacheRRsets(nonAuthoritative, CredibilityNonAuthoritativeAnswer)
 }
 
-// Retrieves all valid cached answer records for a given FQDN.
-func (resolver *Resolver) getCachedAnswerRecords(fqdn string, qType uint16) (records []ResourceRecord, success bool) {
-	resolver.CacheMutex.Lock()
-	defer resolver.CacheMutex.Unlock()
+// cacheGlue caches the addresses of a referral's glue (see referralGlue),
+// with the lowest credibility.
+func (resolver *Resolver) cacheGlue(additionals []ResourceRecord) {
+	var addresses []ResourceRecord
+	for _, record := range additionals {
+		if record.RType == A || record.RType == AAAA {
+			addresses = append(addresses, record)
+		}
+	}
+	resolver.cacheRRsets(addresses, CredibilityAdditional)
+}
 
-	cached, found := resolver.AnswerCache[fqdn]
+// getCachedRRset returns the records of a cached RRset, with the time left
+// before it expires as their TTL, if it is at least as credible as required.
+// A popular RRset close to expiring is refreshed in the background.
+func (resolver *Resolver) getCachedRRset(fqdn string, rType uint16, rClass uint16, minCredibility Credibility) (records []ResourceRecord, success bool) {
+	key := rrsetCacheKey(fqdn, rType, rClass)
+	value, hits, found := resolver.cache().getCounted(key)
 	if !found {
 		return nil, false
 	}
+	cached := value.(CachedRRset)
+	if cached.Credibility < minCredibility {
+		return nil, false
+	}
+	if resolver.shouldPrefetch(cached, hits) {
+		resolver.prefetch(key)
+	}
+
+	ttl := remainingTTL(cached.ExpiresAt)
+	records = make([]ResourceRecord, len(cached.Records))
+	for i, record := range cached.Records {
+		record.TTL = ttl
+		records[i] = record
+	}
+	return records, true
+}
+
+// Negative caching (RFC 2308):
+// An authoritative response without answers is negative: NXDOMAIN if the name
+// doesn't exist, or NODATA (NOERROR) if it has no record of the question type.
+// At the end of a chain of CNAME records, the negative answer is for the
+// chain's last name. The zone's SOA record in the authority section gives how
+// long the absence may be cached: the lower of the SOA record's TTL and its
+// MINIMUM field, bounded like an RRset's TTL by the resolver's minimum and
+// maximum cache TTLs. An NXDOMAIN is cached for the name and class, whatever
+// the type, and a NODATA for the name, type and class.
+
+type CachedNegativeAnswer struct {
+	ResponseCode uint16
+	SOA          ResourceRecord
+	ExpiresAt    time.Time
+}
+
+func (cached CachedNegativeAnswer) cacheSize() int {
+	return recordCacheSize(cached.SOA) + 64
+}
+
+func (cached CachedNegativeAnswer) cacheExpiresAt() time.Time {
+	return cached.ExpiresAt
+}
 
-	var updatedRecords []CachedResourceRecord
+// negativeCacheKey returns the key of an NXDOMAIN for a name and class, or
+// of a NODATA for a name, type and class if the type is set.
+func negativeCacheKey(fqdn string, qType uint16, qClass uint16) cacheKey {
+	return cacheKey{kind: cachedNegativeAnswerKind, name: strings.ToLower(fqdn), rType: qType, rClass: qClass}
+}
+
+// cacheNegativeAnswer caches an authoritative NXDOMAIN or NODATA response
+// with an SOA record. If the answer section has a chain of CNAME records, the
+// negative answer is for the last name of the chain, if it has no records of
+// the question type and is in the SOA record's zone.
+func (resolver *Resolver) cacheNegativeAnswer(response Message) {
+	if len(response.Questions) != 1 {
+		return
+	}
+	question := response.Questions[0]
 
-	for _, cachedRecord := range cached.Answers {
-		if time.Now().Before(cachedRecord.ExpiresAt) {
-			updatedRecords = append(updatedRecords, cachedRecord)
-			if qType == cachedRecord.Record.RType {
-				records = append(records, cachedRecord.Record)
-			}
+	name := question.Name
+	if len(response.Answers) > 0 {
+		answers, err := synthesizeDNAMECNAMEs(response.Answers, name)
+		if err != nil {
+			return
+		}
+		records, canonicalName, err := followCNAMEs(answers, name, question.QType, map[string]bool{strings.ToLower(name): true})
+		if err != nil || len(records) > 0 {
+			return
 		}
+		name = canonicalName
 	}
 
-	if len(updatedRecords) > 0 {
-		// Update the cache with only valid records
-		resolver.AnswerCache[fqdn] = CachedAnswer{Answers: updatedRecords}
+	var key cacheKey
+	switch responseCode := response.GetResponseCode(); responseCode {
+	case NXDOMAIN:
+		key = negativeCacheKey(name, 0, question.QClass)
+	case NOERROR:
+		key = negativeCacheKey(name, question.QType, question.QClass)
+	default:
+		return
+	}
+
+	for _, record := range response.NameServers {
+		soa, ok := record.RData.(*RDataSOA)
+		if !ok {
+			continue
+		}
+		// The last name of a chain may be in another zone than the SOA's
+		if !strings.EqualFold(name, question.Name) && !inZone(name, record.Name) {
+			return
+		}
+
+		ttl := min(record.TTL, soa.Minimum)
+		if ttl == 0 {
+			return
+		}
+
+		resolver.cache().set(key, CachedNegativeAnswer{
+			ResponseCode: response.GetResponseCode(),
+			SOA:          record,
+			ExpiresAt:    time.Now().Add(resolver.cacheTTL(ttl)),
+		}, nil)
+		return
 	}
+}
 
-	if len(records) > 0 {
-		return records, true
+// getCachedNegativeAnswer returns the cached NXDOMAIN for a name and class,
+// or else the cached NODATA for the name, type and class. The SOA record's TTL is the time
+// left before the negative answer expires.
+func (resolver *Resolver) getCachedNegativeAnswer(fqdn string, qType uint16, qClass uint16) (cached CachedNegativeAnswer, success bool) {
+	for _, key := range []cacheKey{negativeCacheKey(fqdn, 0, qClass), negativeCacheKey(fqdn, qType, qClass)} {
+		value, found := resolver.cache().get(key)
+		if !found {
+			continue
+		}
+
+		cached := value.(CachedNegativeAnswer)
+		cached.SOA.TTL = remainingTTL(cached.ExpiresAt)
+		return cached, true
 	}
+	return CachedNegativeAnswer{}, false
+}
 
-	// All records expired; remove the cache entry
-	delete(resolver.AnswerCache, fqdn)
-	return nil, false
+// remainingTTL returns the number of seconds left before an expiry time,
+// rounded up.
+func remainingTTL(expiresAt time.Time) uint32 {
+	remaining := time.Until(expiresAt)
+	if remaining <= 0 {
+		return 0
+	}
+	return uint32((remaining + time.Second - 1) / time.Second)
 }
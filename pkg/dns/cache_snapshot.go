@@ -0,0 +1,332 @@
+package dns
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Cache snapshots:
+// The resolver's cache can be exported to a JSON snapshot and imported back,
+// so that a restarted server doesn't start cold. Each entry holds its expiry
+// time rather than a TTL: the time elapsed since the snapshot counts down the
+// TTLs of imported records, and entries which have expired since are
+// discarded. Records are stored in wire format.
+//
+// A snapshot is imported whole or not at all: every entry is checked before
+// any is added to the cache, and none is kept longer than the resolver's
+// maximum cache TTL from the time it is imported.
+//
+//	{
+//	  "version": 1,
+//	  "created": "2024-05-01T12:00:00Z",
+//	  "entries": [
+//	    {"kind": "rrset", "name": "example.com.", "type": 1, "class": 1, "credibility": 3,
+//	     "expires": "2024-05-01T12:05:00Z", "records": ["B2V4YW1wbGUDY29tAAABAAEAAAEsAARduNcO"]}
+//	  ]
+//	}
+
+// CacheSnapshotVersion is the version of the cache snapshot format.
+const CacheSnapshotVersion = 1
+
+// DefaultCacheSaveInterval is how often the cache is saved to its snapshot
+// file.
+const DefaultCacheSaveInterval = 5 * time.Minute
+
+const (
+	snapshotRRsetKind          = "rrset"
+	snapshotNegativeAnswerKind = "negative"
+	snapshotServerKind         = "server"
+)
+
+// CacheSnapshot is a snapshot of a resolver's cache.
+type CacheSnapshot struct {
+	Version int                  `json:"version"`
+	Created time.Time            `json:"created"`
+	Entries []CacheSnapshotEntry `json:"entries"`
+}
+
+// CacheSnapshotEntry is a cache entry in a snapshot: an RRset, a negative
+// answer or a name server.
+type CacheSnapshotEntry struct {
+	Kind    string    `json:"kind"`
+	Name    string    `json:"name"`
+	Type    uint16    `json:"type,omitempty"` // for negative answers, 0 for an NXDOMAIN
+	Class   uint16    `json:"class,omitempty"`
+	Expires time.Time `json:"expires"`
+
+	Credibility  Credibility  `json:"credibility,omitempty"`   // for RRsets
+	TTL          uint32       `json:"ttl,omitempty"`           // for RRsets, the seconds they were cached for
+	ResponseCode uint16       `json:"response_code,omitempty"` // for negative answers
+	Records      [][]byte     `json:"records,omitempty"`       // the RRset or SOA record, in wire format
+	Addrs        []netip.Addr `json:"addrs,omitempty"`         // for name servers
+}
+
+// encodeSnapshotRecord encodes a record in wire format, with the length of
+// its data.
+func encodeSnapshotRecord(record ResourceRecord) []byte {
+	rdataWriter := &dnsWriter{}
+	record.RData.WriteRecordData(rdataWriter)
+	record.RDLength = uint16(len(rdataWriter.data))
+
+	writer := &dnsWriter{}
+	writer.writeResourceRecord(record)
+	return writer.data
+}
+
+func decodeSnapshotRecords(data [][]byte) (records []ResourceRecord, err error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("no records: %w", ErrInvalidLengthTooShort)
+	}
+	for _, recordData := range data {
+		reader := &dnsReader{data: recordData}
+		record, err := reader.readResourceRecord()
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// snapshotEntry converts a cache entry for a snapshot.
+func snapshotEntry(key cacheKey, value cacheValue) (entry CacheSnapshotEntry) {
+	entry = CacheSnapshotEntry{Name: key.name, Type: key.rType, Class: key.rClass, Expires: value.cacheExpiresAt()}
+
+	switch cached := value.(type) {
+	case CachedRRset:
+		entry.Kind = snapshotRRsetKind
+		entry.Credibility = cached.Credibility
+		entry.TTL = uint32(cached.TTL / time.Second)
+		for _, record := range cached.Records {
+			entry.Records = append(entry.Records, encodeSnapshotRecord(record))
+		}
+	case CachedNegativeAnswer:
+		entry.Kind = snapshotNegativeAnswerKind
+		entry.ResponseCode = cached.ResponseCode
+		entry.Records = [][]byte{encodeSnapshotRecord(cached.SOA)}
+	case CachedServer:
+		entry.Kind = snapshotServerKind
+		entry.Name = cached.Server.Fqdn
+		entry.Addrs = cached.Server.Addrs
+	}
+	return entry
+}
+
+// cacheEntry converts a snapshot entry back to a cache entry.
+func (entry CacheSnapshotEntry) cacheEntry() (key cacheKey, value cacheValue, err error) {
+	switch entry.Kind {
+	case snapshotRRsetKind:
+		if entry.Credibility < CredibilityAdditional || entry.Credibility > CredibilityAuthoritativeAnswer {
+			return cacheKey{}, nil, fmt.Errorf("invalid RRset %s: unknown credibility %d", entry.Name, entry.Credibility)
+		}
+		records, err := decodeSnapshotRecords(entry.Records)
+		if err != nil {
+			return cacheKey{}, nil, fmt.Errorf("invalid RRset %s: %w", entry.Name, err)
+		}
+		return rrsetCacheKey(entry.Name, entry.Type, entry.Class),
+			CachedRRset{Records: records, Credibility: entry.Credibility, ExpiresAt: entry.Expires, TTL: time.Duration(entry.TTL) * time.Second}, nil
+	case snapshotNegativeAnswerKind:
+		if entry.ResponseCode != NOERROR && entry.ResponseCode != NXDOMAIN {
+			return cacheKey{}, nil, fmt.Errorf("invalid negative answer %s: response code %d", entry.Name, entry.ResponseCode)
+		}
+		records, err := decodeSnapshotRecords(entry.Records)
+		if err != nil {
+			return cacheKey{}, nil, fmt.Errorf("invalid negative answer %s: %w", entry.Name, err)
+		}
+		return negativeCacheKey(entry.Name, entry.Type, entry.Class),
+			CachedNegativeAnswer{ResponseCode: entry.ResponseCode, SOA: records[0], ExpiresAt: entry.Expires}, nil
+	case snapshotServerKind:
+		return nameServerCacheKey(entry.Name),
+			CachedServer{Server: Server{Fqdn: entry.Name, Addrs: entry.Addrs}, ExpiresAt: entry.Expires}, nil
+	default:
+		return cacheKey{}, nil, fmt.Errorf("unknown cache entry kind %q", entry.Kind)
+	}
+}
+
+// snapshot returns the entries of the cache which haven't expired.
+func (cache *shardedCache) snapshot() (entries []CacheSnapshotEntry) {
+	entries = []CacheSnapshotEntry{}
+	now := time.Now()
+	for _, shard := range cache.shards {
+		shard.mutex.RLock()
+		for element := shard.clock.Front(); element != nil; element = element.Next() {
+			entry := element.Value.(*cacheEntry)
+			if now.Before(entry.value.cacheExpiresAt()) {
+				entries = append(entries, snapshotEntry(entry.key, entry.value))
+			}
+		}
+		shard.mutex.RUnlock()
+	}
+	return entries
+}
+
+// ExportCache writes a snapshot of the resolver's cache, without its expired
+// entries.
+//
+// Parameters:
+//   - writer: where to write the JSON snapshot
+//
+// Returns:
+//   - exported: the number of entries exported
+//   - err: an error if the snapshot could not be written
+func (resolver *Resolver) ExportCache(writer io.Writer) (exported int, err error) {
+	snapshot := CacheSnapshot{
+		Version: CacheSnapshotVersion,
+		Created: time.Now(),
+		Entries: resolver.cache().snapshot(),
+	}
+
+	if err = json.NewEncoder(writer).Encode(snapshot); err != nil {
+		return 0, fmt.Errorf("failed to write cache snapshot: %w", err)
+	}
+	return len(snapshot.Entries), nil
+}
+
+// ImportCache adds the entries of a snapshot to the resolver's cache. Entries
+// which have expired since the snapshot are discarded, those which would
+// outlive the maximum cache TTL expire with it, and an RRset doesn't replace a
+// more credible one already in the cache. Nothing is imported from an invalid
+// snapshot.
+//
+// Parameters:
+//   - reader: the JSON snapshot to read
+//
+// Returns:
+//   - imported: the number of entries imported
+//   - err: an error if the snapshot or one of its entries is invalid, or of an
+//     unsupported version
+func (resolver *Resolver) ImportCache(reader io.Reader) (imported int, err error) {
+	var snapshot CacheSnapshot
+	if err = json.NewDecoder(reader).Decode(&snapshot); err != nil {
+		return 0, fmt.Errorf("failed to read cache snapshot: %w", err)
+	}
+	if snapshot.Version != CacheSnapshotVersion {
+		return 0, fmt.Errorf("%w: version %d", ErrUnsupportedCacheSnapshot, snapshot.Version)
+	}
+
+	now := time.Now()
+	maxTTL := resolver.cacheTTL(math.MaxUint32)
+	type importedEntry struct {
+		key   cacheKey
+		value cacheValue
+	}
+	var entries []importedEntry
+	for _, entry := range snapshot.Entries {
+		if !now.Before(entry.Expires) {
+			continue
+		}
+		if latest := now.Add(maxTTL); entry.Expires.After(latest) {
+			entry.Expires = latest
+		}
+		entry.TTL = min(entry.TTL, uint32(maxTTL/time.Second))
+
+		key, value, err := entry.cacheEntry()
+		if err != nil {
+			return 0, fmt.Errorf("invalid cache snapshot: %w", err)
+		}
+		entries = append(entries, importedEntry{key: key, value: value})
+	}
+
+	for _, entry := range entries {
+		var keep func(cached cacheValue) bool
+		if rrset, ok := entry.value.(CachedRRset); ok {
+			keep = func(cached cacheValue) bool {
+				return cached.(CachedRRset).Credibility > rrset.Credibility
+			}
+		}
+		resolver.cache().set(entry.key, entry.value, keep)
+	}
+	return len(entries), nil
+}
+
+// SaveCache writes a snapshot of the resolver's cache to a file. The file is
+// replaced at once, so that it is never left half written.
+//
+// Parameters:
+//   - path: the path of the snapshot file
+//
+// Returns:
+//   - err: an error if the file could not be written
+func (resolver *Resolver) SaveCache(path string) (err error) {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to save cache: %w", err)
+	}
+	defer os.Remove(file.Name())
+
+	exported, err := resolver.ExportCache(file)
+	if closeErr := file.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("failed to save cache: %w", closeErr)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = os.Rename(file.Name(), path); err != nil {
+		return fmt.Errorf("failed to save cache: %w", err)
+	}
+	log.Printf("Cache: saved %d entries to %s", exported, path)
+	return nil
+}
+
+// LoadCache imports a snapshot file into the resolver's cache. A missing
+// file isn't an error: there is nothing to load.
+//
+// Parameters:
+//   - path: the path of the snapshot file
+//
+// Returns:
+//   - err: an error if the file could not be read or is invalid
+func (resolver *Resolver) LoadCache(path string) (err error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load cache: %w", err)
+	}
+	defer file.Close()
+
+	imported, err := resolver.ImportCache(file)
+	if err != nil {
+		return fmt.Errorf("failed to load cache from %s: %w", path, err)
+	}
+	log.Printf("Cache: loaded %d entries from %s", imported, path)
+	return nil
+}
+
+// RunCacheSaver saves the resolver's cache to a snapshot file at an interval
+// until the context is done.
+//
+// Parameters:
+//   - ctx: the context which stops the saver
+//   - path: the path of the snapshot file
+//   - interval: the time between saves, DefaultCacheSaveInterval if zero
+func (resolver *Resolver) RunCacheSaver(ctx context.Context, path string, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultCacheSaveInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := resolver.SaveCache(path); err != nil {
+				log.Printf("Cache: %v", err)
+			}
+		}
+	}
+}
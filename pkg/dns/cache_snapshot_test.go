@@ -0,0 +1,185 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSnapshotRecord is an A record of example.com. in wire format
+const testSnapshotRecord = "B2V4YW1wbGUDY29tAAABAAEAAAEsAARduNcO"
+
+func newTestSnapshotResolver() *Resolver {
+	resolver := &Resolver{}
+	resolver.cacheRRsets([]ResourceRecord{
+		newResourceRecord("www.example.com.", A, 300, &RDataA{IP: netip.MustParseAddr("192.0.2.1")}),
+		newResourceRecord("www.example.com.", A, 300, &RDataA{IP: netip.MustParseAddr("192.0.2.2")}),
+	}, CredibilityAuthoritativeAnswer)
+	resolver.cacheGlue([]ResourceRecord{newResourceRecord("ns.example.com.", AAAA, 300, &RDataAAAA{IP: netip.MustParseAddr("2001:db8::53")})})
+
+	response := NewErrorReply(Message{Questions: []Question{{Name: "missing.example.com.", QType: A, QClass: IN}}}, NXDOMAIN)
+	response.NameServers = []ResourceRecord{newResourceRecord("example.com.", SOA, 300, &RDataSOA{MName: "ns.example.com.", RName: "admin.example.com.", Minimum: 60})}
+	resolver.cacheNegativeAnswer(response)
+
+	resolver.cacheNameserver(Server{Fqdn: "NS.example.com.", Addrs: []netip.Addr{netip.MustParseAddr("192.0.2.53")}}, time.Hour)
+	return resolver
+}
+
+func TestCacheSnapshotRoundTrip(t *testing.T) {
+	resolver := newTestSnapshotResolver()
+	// Expired entries aren't exported
+	resolver.cacheNameserver(Server{Fqdn: "expired.example.com."}, -time.Second)
+
+	var snapshot bytes.Buffer
+	exported, err := resolver.ExportCache(&snapshot)
+	if err != nil {
+		t.Fatalf("ExportCache() error = %v", err)
+	}
+	if exported != 4 {
+		t.Errorf("ExportCache() exported = %d, want 4", exported)
+	}
+
+	imported := &Resolver{}
+	count, err := imported.ImportCache(&snapshot)
+	if err != nil {
+		t.Fatalf("ImportCache() error = %v", err)
+	}
+	if count != 4 {
+		t.Errorf("ImportCache() imported = %d, want 4", count)
+	}
+
+	records, found := imported.getCachedRRset("www.example.com.", A, IN, CredibilityAuthoritativeAnswer)
+	var ips []string
+	for _, record := range records {
+		ips = append(ips, record.RData.String())
+	}
+	if !found || !slices.Equal(ips, []string{"192.0.2.1", "192.0.2.2"}) {
+		t.Errorf("imported RRset got = %v, want both addresses", ips)
+	}
+	if rrset := peekCache(imported, rrsetCacheKey("www.example.com.", A, IN)).(CachedRRset); rrset.TTL != 300*time.Second {
+		t.Errorf("imported RRset was cached for %v, want its original TTL", rrset.TTL)
+	}
+	if _, found := imported.getCachedRRset("ns.example.com.", AAAA, IN, CredibilityNonAuthoritativeAnswer); found {
+		t.Errorf("imported glue is returned as an answer")
+	}
+	if records, found := imported.getCachedRRset("ns.example.com.", AAAA, IN, CredibilityAdditional); !found || records[0].RData.String() != "2001:db8::53" {
+		t.Errorf("imported glue got = %v", records)
+	}
+	if negative, found := imported.getCachedNegativeAnswer("missing.example.com.", TXT, IN); !found || negative.ResponseCode != NXDOMAIN || negative.SOA.RData.(*RDataSOA).Minimum != 60 {
+		t.Errorf("imported negative answer got = %+v", negative)
+	}
+	if server, found := imported.getCachedNameServer("ns.example.com."); !found || server.Fqdn != "NS.example.com." || !slices.Equal(server.Addrs, []netip.Addr{netip.MustParseAddr("192.0.2.53")}) {
+		t.Errorf("imported name server got = %+v", server)
+	}
+}
+
+func TestImportCacheElapsedTime(t *testing.T) {
+	var exported bytes.Buffer
+	if _, err := newTestSnapshotResolver().ExportCache(&exported); err != nil {
+		t.Fatalf("ExportCache() error = %v", err)
+	}
+
+	// The snapshot is loaded 200 seconds later: the negative answer has
+	// expired, and the RRset has 100 seconds left
+	var snapshot CacheSnapshot
+	if err := json.Unmarshal(exported.Bytes(), &snapshot); err != nil {
+		t.Fatalf("invalid snapshot: %v", err)
+	}
+	for i := range snapshot.Entries {
+		snapshot.Entries[i].Expires = snapshot.Entries[i].Expires.Add(-200 * time.Second)
+	}
+	aged, _ := json.Marshal(snapshot)
+
+	resolver := &Resolver{}
+	imported, err := resolver.ImportCache(bytes.NewReader(aged))
+	if err != nil {
+		t.Fatalf("ImportCache() error = %v", err)
+	}
+	if imported != 3 {
+		t.Errorf("ImportCache() imported = %d, want 3", imported)
+	}
+	if _, found := resolver.getCachedNegativeAnswer("missing.example.com.", A, IN); found {
+		t.Errorf("ImportCache() imported an expired negative answer")
+	}
+	if records, _ := resolver.getCachedRRset("www.example.com.", A, IN, CredibilityAuthoritativeAnswer); len(records) != 2 || records[0].TTL != 100 {
+		t.Errorf("imported RRset got = %v, want TTLs of 100", records)
+	}
+}
+
+func TestImportCacheInvalid(t *testing.T) {
+	future := time.Now().Add(time.Hour).Format(time.RFC3339)
+
+	tests := []struct {
+		name      string
+		snapshot  string
+		wantError error
+	}{
+		{name: "Unsupported version", snapshot: `{"version": 2, "entries": []}`, wantError: ErrUnsupportedCacheSnapshot},
+		{name: "Not JSON", snapshot: `cache`},
+		{name: "Unknown kind", snapshot: `{"version": 1, "entries": [{"kind": "other", "name": "example.com.", "expires": "` + future + `"}]}`},
+		{name: "Invalid record", snapshot: `{"version": 1, "entries": [{"kind": "rrset", "name": "example.com.", "expires": "` + future + `", "records": ["AAE="]}]}`},
+		{name: "Unknown credibility", snapshot: `{"version": 1, "entries": [{"kind": "rrset", "name": "example.com.", "type": 1, "class": 1, "credibility": 9, "expires": "` + future + `", "records": ["` + testSnapshotRecord + `"]}]}`},
+		{name: "Negative answer response code", snapshot: `{"version": 1, "entries": [{"kind": "negative", "name": "example.com.", "response_code": 2, "expires": "` + future + `", "records": ["` + testSnapshotRecord + `"]}]}`},
+		{name: "Valid entry before an invalid one", snapshot: `{"version": 1, "entries": [
+			{"kind": "rrset", "name": "example.com.", "type": 1, "class": 1, "credibility": 3, "expires": "` + future + `", "records": ["` + testSnapshotRecord + `"]},
+			{"kind": "other", "name": "example.com.", "expires": "` + future + `"}]}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver := &Resolver{}
+			imported, err := resolver.ImportCache(strings.NewReader(tt.snapshot))
+			if err == nil || (tt.wantError != nil && !errors.Is(err, tt.wantError)) {
+				t.Errorf("ImportCache() error = %v, want %v", err, tt.wantError)
+			}
+			if stats := resolver.CacheStats(); imported != 0 || stats.Entries != 0 {
+				t.Errorf("ImportCache() imported %d entries, cache has %d, want none from an invalid snapshot", imported, stats.Entries)
+			}
+		})
+	}
+}
+
+func TestImportCacheMaxTTL(t *testing.T) {
+	// The RRset was cached for two days, longer than the maximum cache TTL
+	farFuture := time.Now().Add(48 * time.Hour).Format(time.RFC3339)
+	snapshot := `{"version": 1, "entries": [{"kind": "rrset", "name": "example.com.", "type": 1, "class": 1, "credibility": 3, "ttl": 172800, "expires": "` + farFuture + `", "records": ["` + testSnapshotRecord + `"]}]}`
+
+	resolver := &Resolver{MaxCacheTTL: time.Hour}
+	if _, err := resolver.ImportCache(strings.NewReader(snapshot)); err != nil {
+		t.Fatalf("ImportCache() error = %v", err)
+	}
+	rrset := peekCache(resolver, rrsetCacheKey("example.com.", A, IN)).(CachedRRset)
+	if time.Until(rrset.ExpiresAt) > time.Hour || rrset.TTL != time.Hour {
+		t.Errorf("imported RRset expires in %v and was cached for %v, want at most the maximum cache TTL", time.Until(rrset.ExpiresAt), rrset.TTL)
+	}
+}
+
+func TestSaveLoadCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+
+	resolver := &Resolver{}
+	if err := resolver.LoadCache(path); err != nil {
+		t.Errorf("LoadCache() of a missing file error = %v", err)
+	}
+
+	if err := newTestSnapshotResolver().SaveCache(path); err != nil {
+		t.Fatalf("SaveCache() error = %v", err)
+	}
+	if err := resolver.LoadCache(path); err != nil {
+		t.Fatalf("LoadCache() error = %v", err)
+	}
+	if stats := resolver.CacheStats(); stats.Entries != 4 {
+		t.Errorf("LoadCache() loaded %d entries, want 4", stats.Entries)
+	}
+
+	// No temporary file is left behind
+	if files, _ := filepath.Glob(filepath.Join(filepath.Dir(path), "*")); len(files) != 1 {
+		t.Errorf("SaveCache() left files %v", files)
+	}
+}
@@ -0,0 +1,286 @@
+package dns
+
+import (
+	"net/netip"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// peekCache returns the value of a cache entry, expired or not, without
+// marking it as referenced.
+func peekCache(resolver *Resolver, key cacheKey) cacheValue {
+	shard := resolver.cache().shard(key)
+	shard.mutex.RLock()
+	defer shard.mutex.RUnlock()
+
+	if element, found := shard.entries[key]; found {
+		return element.Value.(*cacheEntry).value
+	}
+	return nil
+}
+
+// setCacheExpiry changes the expiry time of a cache entry.
+func setCacheExpiry(resolver *Resolver, key cacheKey, expiresAt time.Time) {
+	shard := resolver.cache().shard(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	entry := shard.entries[key].Value.(*cacheEntry)
+	switch value := entry.value.(type) {
+	case CachedRRset:
+		value.ExpiresAt = expiresAt
+		entry.value = value
+	case CachedNegativeAnswer:
+		value.ExpiresAt = expiresAt
+		entry.value = value
+	case CachedServer:
+		value.ExpiresAt = expiresAt
+		entry.value = value
+	}
+}
+
+func TestCacheRRsets(t *testing.T) {
+	address := func(name string, ip string, ttl uint32) ResourceRecord {
+		return newResourceRecord(name, A, ttl, &RDataA{IP: netip.MustParseAddr(ip)})
+	}
+	cachedAddresses := func(resolver *Resolver, name string, minCredibility Credibility) (ips []string, ttls []uint32) {
+		records, _ := resolver.getCachedRRset(name, A, IN, minCredibility)
+		for _, record := range records {
+			ips = append(ips, record.RData.String())
+			ttls = append(ttls, record.TTL)
+		}
+		return ips, ttls
+	}
+
+	t.Run("RRsets are replaced", func(t *testing.T) {
+		resolver := &Resolver{}
+		resolver.cacheRRsets([]ResourceRecord{address("www.example.com.", "192.0.2.1", 300), address("WWW.example.com.", "192.0.2.2", 60)}, CredibilityNonAuthoritativeAnswer)
+		resolver.cacheRRsets([]ResourceRecord{address("www.example.com.", "192.0.2.3", 300)}, CredibilityNonAuthoritativeAnswer)
+		resolver.cacheRRsets([]ResourceRecord{address("www.example.com.", "192.0.2.3", 300)}, CredibilityNonAuthoritativeAnswer)
+
+		if ips, _ := cachedAddresses(resolver, "www.example.com.", CredibilityNonAuthoritativeAnswer); !slices.Equal(ips, []string{"192.0.2.3"}) {
+			t.Errorf("getCachedRRset() got = %v, want the last RRset only", ips)
+		}
+		if _, found := resolver.getCachedRRset("www.example.com.", A, CH, CredibilityAdditional); found {
+			t.Errorf("getCachedRRset() found an RRset of another class")
+		}
+	})
+
+	t.Run("TTLs", func(t *testing.T) {
+		resolver := &Resolver{MinCacheTTL: 30 * time.Second, MaxCacheTTL: time.Hour}
+		resolver.cacheRRsets([]ResourceRecord{address("mixed.example.com.", "192.0.2.1", 300), address("mixed.example.com.", "192.0.2.2", 60)}, CredibilityNonAuthoritativeAnswer)
+		resolver.cacheRRsets([]ResourceRecord{address("short.example.com.", "192.0.2.1", 5)}, CredibilityNonAuthoritativeAnswer)
+		resolver.cacheRRsets([]ResourceRecord{address("long.example.com.", "192.0.2.1", 604800)}, CredibilityNonAuthoritativeAnswer)
+
+		tests := []struct {
+			name    string
+			wantTTL uint32
+		}{
+			{name: "mixed.example.com.", wantTTL: 60},
+			{name: "short.example.com.", wantTTL: 30},
+			{name: "long.example.com.", wantTTL: 3600},
+		}
+		for _, tt := range tests {
+			if _, ttls := cachedAddresses(resolver, tt.name, CredibilityNonAuthoritativeAnswer); len(ttls) == 0 || slices.ContainsFunc(ttls, func(ttl uint32) bool { return ttl != tt.wantTTL }) {
+				t.Errorf("getCachedRRset(%s) TTLs got = %v, want %d", tt.name, ttls, tt.wantTTL)
+			}
+		}
+
+		// TTLs are the time left in the cache
+		key := rrsetCacheKey("mixed.example.com.", A, IN)
+		setCacheExpiry(resolver, key, time.Now().Add(10*time.Second))
+		if _, ttls := cachedAddresses(resolver, "mixed.example.com.", CredibilityNonAuthoritativeAnswer); !slices.Equal(ttls, []uint32{10, 10}) {
+			t.Errorf("getCachedRRset() TTLs got = %v, want the time left", ttls)
+		}
+
+		setCacheExpiry(resolver, key, time.Now().Add(-time.Second))
+		if _, found := resolver.getCachedRRset("mixed.example.com.", A, IN, CredibilityAdditional); found {
+			t.Errorf("getCachedRRset() found an expired RRset")
+		}
+	})
+
+	t.Run("Credibility", func(t *testing.T) {
+		resolver := &Resolver{}
+		resolver.cacheGlue([]ResourceRecord{address("ns.example.com.", "192.0.2.53", 300), newResourceRecord("ns.example.com.", TXT, 300, &RDataTXT{})})
+
+		if _, found := resolver.getCachedRRset("ns.example.com.", A, IN, CredibilityNonAuthoritativeAnswer); found {
+			t.Errorf("getCachedRRset() returned glue as an answer")
+		}
+		if ips, _ := cachedAddresses(resolver, "ns.example.com.", CredibilityAdditional); !slices.Equal(ips, []string{"192.0.2.53"}) {
+			t.Errorf("getCachedRRset() glue got = %v", ips)
+		}
+		if _, found := resolver.getCachedRRset("ns.example.com.", TXT, IN, CredibilityAdditional); found {
+			t.Errorf("cacheGlue() cached a record which isn't an address")
+		}
+
+		response := NewReply(Message{Questions: []Question{{Name: "ns.example.com.", QType: A, QClass: IN}}})
+		response.Header.Flags.Authoritative = true
+		response.Answers = []ResourceRecord{address("ns.example.com.", "192.0.2.54", 300)}
+		resolver.cacheResponseAnswers(response)
+
+		response = NewReply(Message{Questions: []Question{{Name: "alias.example.com.", QType: A, QClass: IN}}})
+		response.Header.Flags.Authoritative = true
+		response.Answers = []ResourceRecord{
+			newResourceRecord("alias.example.com.", CNAME, 300, &RDataCNAME{DomainName: "target.example.com."}),
+			address("target.example.com.", "192.0.2.1", 300),
+		}
+		resolver.cacheResponseAnswers(response)
+		aliasCredibility := peekCache(resolver, rrsetCacheKey("alias.example.com.", CNAME, IN)).(CachedRRset).Credibility
+		targetCredibility := peekCache(resolver, rrsetCacheKey("target.example.com.", A, IN)).(CachedRRset).Credibility
+		if aliasCredibility != CredibilityAuthoritativeAnswer || targetCredibility != CredibilityNonAuthoritativeAnswer {
+			t.Errorf("cacheResponseAnswers() credibility got = %d and %d, want the AA flag to cover the question's name only", aliasCredibility, targetCredibility)
+		}
+
+		// Less credible data doesn't replace the authoritative answer
+		resolver.cacheGlue([]ResourceRecord{address("ns.example.com.", "192.0.2.55", 300)})
+		resolver.cacheRRsets([]ResourceRecord{address("ns.example.com.", "192.0.2.56", 300)}, CredibilityNonAuthoritativeAnswer)
+		if ips, _ := cachedAddresses(resolver, "ns.example.com.", CredibilityNonAuthoritativeAnswer); !slices.Equal(ips, []string{"192.0.2.54"}) {
+			t.Errorf("getCachedRRset() got = %v, want the authoritative answer", ips)
+		}
+
+		// Unless it has expired
+		setCacheExpiry(resolver, rrsetCacheKey("ns.example.com.", A, IN), time.Now().Add(-time.Second))
+		resolver.cacheGlue([]ResourceRecord{address("ns.example.com.", "192.0.2.55", 300)})
+		if ips, _ := cachedAddresses(resolver, "ns.example.com.", CredibilityAdditional); !slices.Equal(ips, []string{"192.0.2.55"}) {
+			t.Errorf("getCachedRRset() got = %v, want the new glue", ips)
+		}
+	})
+}
+
+func TestNegativeCache(t *testing.T) {
+	negativeResponse := func(name string, qType uint16, responseCode uint16, soaTTL uint32, minimum uint32) Message {
+		response := NewErrorReply(Message{Questions: []Question{{Name: name, QType: qType, QClass: IN}}}, responseCode)
+		response.NameServers = []ResourceRecord{
+			newResourceRecord("example.com.", SOA, soaTTL, &RDataSOA{MName: "ns.example.com.", RName: "admin.example.com.", Minimum: minimum}),
+		}
+		response.UpdateCounts()
+		return response
+	}
+
+	resolver := &Resolver{}
+	resolver.cacheNegativeAnswer(negativeResponse("missing.example.com.", A, NXDOMAIN, 3600, 300))
+	resolver.cacheNegativeAnswer(negativeResponse("www.example.com.", AAAA, NOERROR, 60, 300))
+	resolver.cacheNegativeAnswer(negativeResponse("zero.example.com.", A, NXDOMAIN, 3600, 0))
+	resolver.cacheNegativeAnswer(negativeResponse("fail.example.com.", A, SERVFAIL, 3600, 300))
+	resolver.cacheNegativeAnswer(Message{Questions: []Question{{Name: "nosoa.example.com.", QType: A, QClass: IN}}})
+
+	// At the end of a CNAME chain, the negative answer is for the chain's
+	// last name, if it is in the SOA record's zone
+	chainResponse := negativeResponse("alias.example.com.", A, NXDOMAIN, 3600, 120)
+	chainResponse.Answers = []ResourceRecord{newResourceRecord("alias.example.com.", CNAME, 300, &RDataCNAME{DomainName: "target.example.com."})}
+	resolver.cacheNegativeAnswer(chainResponse)
+	chainResponse.Questions[0].Name = "other.example.com."
+	chainResponse.Answers = []ResourceRecord{newResourceRecord("other.example.com.", CNAME, 300, &RDataCNAME{DomainName: "target.example.net."})}
+	resolver.cacheNegativeAnswer(chainResponse)
+
+	tests := []struct {
+		name             string
+		qType            uint16
+		wantFound        bool
+		wantResponseCode uint16
+		wantTTL          uint32
+	}{
+		{name: "missing.example.com.", qType: A, wantFound: true, wantResponseCode: NXDOMAIN, wantTTL: 300},
+		{name: "MISSING.example.com.", qType: MX, wantFound: true, wantResponseCode: NXDOMAIN, wantTTL: 300},
+		{name: "www.example.com.", qType: AAAA, wantFound: true, wantResponseCode: NOERROR, wantTTL: 60},
+		{name: "www.example.com.", qType: A},
+		{name: "zero.example.com.", qType: A},
+		{name: "fail.example.com.", qType: A},
+		{name: "nosoa.example.com.", qType: A},
+		{name: "target.example.com.", qType: A, wantFound: true, wantResponseCode: NXDOMAIN, wantTTL: 120},
+		{name: "alias.example.com.", qType: A},
+		{name: "target.example.net.", qType: A},
+		{name: "other.example.com.", qType: A},
+	}
+
+	for _, tt := range tests {
+		cached, found := resolver.getCachedNegativeAnswer(tt.name, tt.qType, IN)
+		if found != tt.wantFound {
+			t.Errorf("getCachedNegativeAnswer(%s, %d, IN) found = %t, want %t", tt.name, tt.qType, found, tt.wantFound)
+			continue
+		}
+		if found && (cached.ResponseCode != tt.wantResponseCode || cached.SOA.TTL != tt.wantTTL) {
+			t.Errorf("getCachedNegativeAnswer(%s, %d, IN) got %s with TTL %d, want %s with TTL %d",
+				tt.name, tt.qType, DNSRCode(cached.ResponseCode), cached.SOA.TTL, DNSRCode(tt.wantResponseCode), tt.wantTTL)
+		}
+	}
+
+	// Negative answers are cached for the question class
+	if _, found := resolver.getCachedNegativeAnswer("missing.example.com.", A, CH); found {
+		t.Errorf("getCachedNegativeAnswer() found an IN negative answer for class CH")
+	}
+
+	// Expired negative answers aren't returned
+	setCacheExpiry(resolver, negativeCacheKey("www.example.com.", AAAA, IN), time.Now().Add(-time.Second))
+	if _, found := resolver.getCachedNegativeAnswer("www.example.com.", AAAA, IN); found {
+		t.Errorf("getCachedNegativeAnswer() found an expired negative answer")
+	}
+	if removed := resolver.SweepCache(); removed != 1 {
+		t.Errorf("SweepCache() removed = %d, want the expired negative answer", removed)
+	}
+	if stats := resolver.CacheStats(); stats.Entries != 2 {
+		t.Errorf("cache has %d entries, want 2", stats.Entries)
+	}
+
+	// Negative answers are cached within the resolver's cache TTL bounds
+	bounded := &Resolver{MinCacheTTL: 30 * time.Second, MaxCacheTTL: time.Minute}
+	bounded.cacheNegativeAnswer(negativeResponse("missing.example.com.", A, NXDOMAIN, 3600, 300))
+	bounded.cacheNegativeAnswer(negativeResponse("www.example.com.", AAAA, NOERROR, 5, 300))
+	if cached, _ := bounded.getCachedNegativeAnswer("missing.example.com.", A, IN); cached.SOA.TTL != 60 {
+		t.Errorf("getCachedNegativeAnswer() got TTL %d, want the maximum cache TTL 60", cached.SOA.TTL)
+	}
+	if cached, _ := bounded.getCachedNegativeAnswer("www.example.com.", AAAA, IN); cached.SOA.TTL != 30 {
+		t.Errorf("getCachedNegativeAnswer() got TTL %d, want the minimum cache TTL 30", cached.SOA.TTL)
+	}
+}
+
+func TestResolverCacheHitsAndMisses(t *testing.T) {
+	resolver, err := NewResolver("")
+	if err != nil {
+		t.Fatalf("NewResolver() error = %v", err)
+	}
+	resolver.QueryFunc = func(_ string, _ netip.AddrPort, dnsRequest []byte) ([]byte, error) {
+		request, err := DecodeMessage(dnsRequest)
+		if err != nil {
+			return nil, err
+		}
+		reply := NewReply(request)
+		reply.Header.Flags.Authoritative = true
+		reply.Answers = []ResourceRecord{newResourceRecord(request.Questions[0].Name, A, 300, &RDataA{IP: netip.MustParseAddr("192.0.2.1")})}
+		reply.UpdateCounts()
+		return EncodeMessage(reply)
+	}
+
+	// A name with many ancestors is looked up in the cache many times, but
+	// counts as a single miss, then a single hit
+	for range 2 {
+		request, _ := CreateQuery("a.b.c.d.example.com.", A)
+		if _, err := resolver.ResolveQuery(request); err != nil {
+			t.Fatalf("ResolveQuery() error = %v", err)
+		}
+	}
+	if stats := resolver.CacheStats(); stats.Hits != 1 || stats.Misses != 1 {
+		t.Errorf("CacheStats() got %d hits and %d misses, want 1 of each", stats.Hits, stats.Misses)
+	}
+}
+
+func BenchmarkResolverGetCachedRRset(b *testing.B) {
+	resolver := &Resolver{}
+	var names []string
+	for i := range 1000 {
+		name := "host-" + strconv.Itoa(i) + ".example.com."
+		names = append(names, name)
+		resolver.cacheRRsets([]ResourceRecord{newResourceRecord(name, A, 3600, &RDataA{IP: netip.MustParseAddr("192.0.2.1")})}, CredibilityAuthoritativeAnswer)
+	}
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			resolver.getCachedRRset(names[i%len(names)], A, IN, CredibilityNonAuthoritativeAnswer)
+			i++
+		}
+	})
+}
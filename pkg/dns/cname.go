@@ -0,0 +1,62 @@
+package dns
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CNAME chains:
+// A CNAME record makes its owner an alias of another name, the canonical
+// name, which may itself be an alias. A response to a question for an alias
+// holds the chain of CNAME records from the alias to the canonical name,
+// followed by the records of the canonical name. The chain may span zones,
+// in which case it stops where the server's data stops, and resolution must
+// go on with the last name of the chain.
+
+// MaxCNAMEChainLength is the maximum number of CNAME records followed to
+// reach a canonical name.
+const MaxCNAMEChainLength = 8
+
+// followCNAMEs follows the CNAME records of an answer section from a name to
+// its canonical name, and returns the records of the question type owned by
+// that name. If none are in the answer section, the records are empty and
+// the canonical name is the last name of the chain.
+//
+// Parameters:
+//   - answers: the answer section of a response
+//   - name: the name to start from
+//   - questionType: the type of the records to return
+//   - visited: the names of the chain so far, lowercased, to detect loops
+//
+// Returns:
+//   - records: the records of the question type owned by the canonical name
+//   - canonicalName: the last name of the chain
+//   - err: ErrCNAMELoop or ErrCNAMEChainTooLong if the chain is invalid
+func followCNAMEs(answers []ResourceRecord, name string, questionType uint16, visited map[string]bool) (records []ResourceRecord, canonicalName string, err error) {
+	for {
+		var alias string
+		for _, answer := range answers {
+			if !strings.EqualFold(answer.Name, name) {
+				continue
+			}
+			if answer.RType == questionType {
+				records = append(records, answer)
+			} else if answer.RType == CNAME && alias == "" {
+				alias = answer.RData.String()
+			}
+		}
+		if len(records) > 0 || alias == "" {
+			return records, name, nil
+		}
+
+		key := strings.ToLower(alias)
+		if visited[key] {
+			return nil, name, fmt.Errorf("%w: %s", ErrCNAMELoop, alias)
+		}
+		visited[key] = true
+		if len(visited) > MaxCNAMEChainLength+1 {
+			return nil, name, ErrCNAMEChainTooLong
+		}
+		name = alias
+	}
+}
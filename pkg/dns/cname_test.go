@@ -0,0 +1,72 @@
+package dns
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+func TestFollowCNAMEs(t *testing.T) {
+	chain := func(names ...string) (records []ResourceRecord) {
+		for i := 0; i < len(names)-1; i++ {
+			records = append(records, newResourceRecord(names[i], CNAME, 300, &RDataCNAME{DomainName: names[i+1]}))
+		}
+		return records
+	}
+	address := newResourceRecord("c.example.com.", A, 300, &RDataA{IP: netip.MustParseAddr("192.0.2.1")})
+
+	longChain := []string{}
+	for i := 0; i <= MaxCNAMEChainLength+1; i++ {
+		longChain = append(longChain, string(rune('a'+i))+".example.com.")
+	}
+
+	tests := []struct {
+		name              string
+		answers           []ResourceRecord
+		wantRecords       int
+		wantCanonicalName string
+		wantError         error
+	}{
+		{
+			name:              "Whole chain in the answers",
+			answers:           append(chain("a.example.com.", "B.example.com.", "c.example.com."), address),
+			wantRecords:       1,
+			wantCanonicalName: "c.example.com.",
+		},
+		{
+			name:              "Chain stops before the records",
+			answers:           chain("a.example.com.", "b.example.com."),
+			wantCanonicalName: "b.example.com.",
+		},
+		{
+			name:      "Loop",
+			answers:   chain("a.example.com.", "b.example.com.", "A.example.com."),
+			wantError: ErrCNAMELoop,
+		},
+		{
+			name:      "Chain too long",
+			answers:   chain(longChain...),
+			wantError: ErrCNAMEChainTooLong,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			visited := map[string]bool{"a.example.com.": true}
+			records, canonicalName, err := followCNAMEs(tt.answers, "a.example.com.", A, visited)
+
+			if tt.wantError != nil {
+				if !errors.Is(err, tt.wantError) {
+					t.Fatalf("followCNAMEs() error = %v, want %v", err, tt.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("followCNAMEs() error = %v", err)
+			}
+			if len(records) != tt.wantRecords || canonicalName != tt.wantCanonicalName {
+				t.Errorf("followCNAMEs() got %d records for %s, want %d for %s", len(records), canonicalName, tt.wantRecords, tt.wantCanonicalName)
+			}
+		})
+	}
+}
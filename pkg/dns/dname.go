@@ -0,0 +1,143 @@
+package dns
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DNAME redirection (RFC 6672):
+// A DNAME record redirects the names below its owner, but not the owner
+// itself, to the same names below its target:
+//
+//	example.com.          DNAME  example.net.
+//	www.example.com.  ->  www.example.net.
+//
+// A response to a question for a name below the owner holds the DNAME record
+// followed by the CNAME record synthesized from it, from the name to the
+// substituted name. A resolver synthesizes the CNAME itself from the DNAME,
+// and goes on as for any other CNAME chain. If the substituted name is longer
+// than a domain name may be, the answer is YXDOMAIN.
+
+// MaxDomainNameLength is the maximum length of an encoded domain name.
+const MaxDomainNameLength = 255
+
+// isBelow reports whether a name is strictly below another, ignoring case.
+func isBelow(name string, owner string) bool {
+	if len(name) <= len(owner) || !strings.EqualFold(name[len(name)-len(owner):], owner) {
+		return false
+	}
+	return owner == "." || name[len(name)-len(owner)-1] == '.'
+}
+
+// substituteDNAME replaces the owner suffix of a name below a DNAME's owner
+// with the DNAME's target.
+//
+// Parameters:
+//   - name: a fully qualified name below the owner
+//   - owner: the owner name of the DNAME record
+//   - target: the target of the DNAME record
+//
+// Returns:
+//   - substitutedName: the name with its owner suffix replaced by the target
+//   - err: ErrDNAMEOverflow if the substituted name is too long
+func substituteDNAME(name string, owner string, target string) (substitutedName string, err error) {
+	prefix := name
+	if owner != "." {
+		prefix = name[:len(name)-len(owner)]
+	}
+
+	substitutedName = prefix
+	if target != "." {
+		substitutedName += target
+	}
+
+	// An encoded name has a length byte before each label and a final 0
+	if len(substitutedName)+1 > MaxDomainNameLength {
+		return "", fmt.Errorf("%w: %s", ErrDNAMEOverflow, name)
+	}
+	return substitutedName, nil
+}
+
+// synthesizeDNAMECNAMEs follows the chain of a name through an answer
+// section, and synthesizes a CNAME record for each name of the chain below a
+// DNAME's owner. The synthesized record takes the place of any CNAME record
+// the server sent for the name, right after the DNAME, and has the DNAME's
+// TTL.
+//
+// Parameters:
+//   - answers: the answer section of a response
+//   - name: the name to start from
+//
+// Returns:
+//   - synthesized: the answer section with the synthesized CNAME records
+//   - err: ErrDNAMEOverflow if a substituted name is too long, in which case
+//     the answer section is returned as is
+func synthesizeDNAMECNAMEs(answers []ResourceRecord, name string) (synthesized []ResourceRecord, err error) {
+	synthesized = answers
+
+	for range MaxCNAMEChainLength + 1 {
+		dnameIndex := -1
+		for i, answer := range synthesized {
+			if answer.RType != DNAME || !isBelow(name, answer.Name) {
+				continue
+			}
+			// The closest DNAME applies, in the unlikely case there are several
+			if dnameIndex < 0 || len(answer.Name) > len(synthesized[dnameIndex].Name) {
+				dnameIndex = i
+			}
+		}
+
+		if dnameIndex < 0 {
+			var alias string
+			for _, answer := range synthesized {
+				if answer.RType == CNAME && strings.EqualFold(answer.Name, name) {
+					alias = answer.RData.String()
+					break
+				}
+			}
+			if alias == "" {
+				return synthesized, nil
+			}
+			name = alias
+			continue
+		}
+
+		dname := synthesized[dnameIndex]
+		target, err := substituteDNAME(name, dname.Name, dname.RData.String())
+		if err != nil {
+			return answers, err
+		}
+
+		cname := newResourceRecord(name, CNAME, dname.TTL, &RDataCNAME{DomainName: target})
+		cname.RClass = dname.RClass
+
+		var records []ResourceRecord
+		for i, answer := range synthesized {
+			if answer.RType == CNAME && strings.EqualFold(answer.Name, name) {
+				continue
+			}
+			records = append(records, answer)
+			if i == dnameIndex {
+				records = append(records, cname)
+			}
+		}
+		synthesized = records
+		name = target
+	}
+
+	return synthesized, nil
+}
+
+// ancestorNames returns the names strictly above a fully qualified name,
+// closest first, down to the root.
+func ancestorNames(name string) (ancestors []string) {
+	for name != "." && name != "" {
+		_, parent, found := strings.Cut(name, ".")
+		if !found || parent == "" {
+			parent = "."
+		}
+		ancestors = append(ancestors, parent)
+		name = parent
+	}
+	return ancestors
+}
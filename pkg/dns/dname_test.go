@@ -0,0 +1,155 @@
+package dns
+
+import (
+	"errors"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSubstituteDNAME(t *testing.T) {
+	longLabel := strings.Repeat("a", 63)
+	longTarget := strings.Join([]string{longLabel, longLabel, longLabel}, ".") + "."
+
+	tests := []struct {
+		name      string
+		owner     string
+		target    string
+		want      string
+		wantError error
+	}{
+		{name: "www.example.com.", owner: "example.com.", target: "example.net.", want: "www.example.net."},
+		{name: "a.b.Example.COM.", owner: "example.com.", target: "example.net.", want: "a.b.example.net."},
+		{name: "10.2.0.192.in-addr.arpa.", owner: "2.0.192.in-addr.arpa.", target: "10.rev.example.net.", want: "10.10.rev.example.net."},
+		{name: "www.example.com.", owner: ".", target: "example.net.", want: "www.example.com.example.net."},
+		{name: "www.example.com.", owner: "example.com.", target: ".", want: "www."},
+		{name: longLabel + "." + longLabel + ".example.com.", owner: "example.com.", target: longTarget, wantError: ErrDNAMEOverflow},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !isBelow(tt.name, tt.owner) {
+				t.Fatalf("isBelow(%s, %s) = false, want true", tt.name, tt.owner)
+			}
+
+			got, err := substituteDNAME(tt.name, tt.owner, tt.target)
+			if tt.wantError != nil {
+				if !errors.Is(err, tt.wantError) {
+					t.Fatalf("substituteDNAME() error = %v, want %v", err, tt.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("substituteDNAME() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("substituteDNAME() got = %s, want = %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsBelow(t *testing.T) {
+	tests := []struct {
+		name  string
+		owner string
+		want  bool
+	}{
+		{name: "www.example.com.", owner: "example.com.", want: true},
+		{name: "www.EXAMPLE.com.", owner: "example.com.", want: true},
+		{name: "example.com.", owner: "example.com.", want: false},
+		{name: "wwwexample.com.", owner: "example.com.", want: false},
+		{name: "example.com.", owner: "www.example.com.", want: false},
+		{name: "com.", owner: ".", want: true},
+		{name: ".", owner: ".", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := isBelow(tt.name, tt.owner); got != tt.want {
+			t.Errorf("isBelow(%s, %s) got = %t, want = %t", tt.name, tt.owner, got, tt.want)
+		}
+	}
+}
+
+func TestSynthesizeDNAMECNAMEs(t *testing.T) {
+	dname := newResourceRecord("example.com.", DNAME, 3600, &RDataDNAME{DomainName: "example.net."})
+	serverCNAME := newResourceRecord("www.example.com.", CNAME, 0, &RDataCNAME{DomainName: "www.example.net."})
+	address := newResourceRecord("www.example.net.", A, 300, &RDataA{IP: netip.MustParseAddr("192.0.2.1")})
+	alias := newResourceRecord("alias.example.org.", CNAME, 300, &RDataCNAME{DomainName: "www.example.com."})
+	longDNAME := newResourceRecord("example.com.", DNAME, 3600, &RDataDNAME{DomainName: strings.Repeat("a.", 126)})
+
+	tests := []struct {
+		name      string
+		answers   []ResourceRecord
+		qname     string
+		want      []string
+		wantError error
+	}{
+		{
+			name:    "CNAME synthesized after the DNAME",
+			answers: []ResourceRecord{dname, address},
+			qname:   "www.example.com.",
+			want:    []string{"example.com. DNAME example.net. 3600", "www.example.com. CNAME www.example.net. 3600", "www.example.net. A 192.0.2.1 300"},
+		},
+		{
+			name:    "CNAME sent by the server replaced",
+			answers: []ResourceRecord{dname, serverCNAME, address},
+			qname:   "www.example.com.",
+			want:    []string{"example.com. DNAME example.net. 3600", "www.example.com. CNAME www.example.net. 3600", "www.example.net. A 192.0.2.1 300"},
+		},
+		{
+			name:    "DNAME after a CNAME",
+			answers: []ResourceRecord{alias, dname},
+			qname:   "alias.example.org.",
+			want:    []string{"alias.example.org. CNAME www.example.com. 300", "example.com. DNAME example.net. 3600", "www.example.com. CNAME www.example.net. 3600"},
+		},
+		{
+			name:    "DNAME owner not redirected",
+			answers: []ResourceRecord{dname},
+			qname:   "example.com.",
+			want:    []string{"example.com. DNAME example.net. 3600"},
+		},
+		{
+			name:      "Substituted name too long",
+			answers:   []ResourceRecord{longDNAME},
+			qname:     "www.example.com.",
+			wantError: ErrDNAMEOverflow,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, err := synthesizeDNAMECNAMEs(tt.answers, tt.qname)
+			if tt.wantError != nil {
+				if !errors.Is(err, tt.wantError) {
+					t.Fatalf("synthesizeDNAMECNAMEs() error = %v, want %v", err, tt.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("synthesizeDNAMECNAMEs() error = %v", err)
+			}
+
+			var got []string
+			for _, record := range records {
+				got = append(got, strings.Join([]string{record.Name, DNSType(record.RType).String(), record.RData.String(), strconv.Itoa(int(record.TTL))}, " "))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("synthesizeDNAMECNAMEs() got = %q, want = %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAncestorNames(t *testing.T) {
+	got := ancestorNames("www.example.com.")
+	want := []string{"example.com.", "com.", "."}
+	if !slices.Equal(got, want) {
+		t.Errorf("ancestorNames() got = %v, want = %v", got, want)
+	}
+	if got := ancestorNames("."); got != nil {
+		t.Errorf("ancestorNames(.) got = %v, want none", got)
+	}
+}
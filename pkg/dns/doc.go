@@ -6,6 +6,23 @@
 //   - PrintQueryInfo: Displays DNS query details including server and query time.
 //   - PrintBasicQueryInfo: Shows basic query details.
 //   - PrintMessage: Prints comprehensive DNS message information.
+//   - Transport: Sends DNS queries over UDP, TCP, TLS, HTTPS or QUIC with timeouts, retries and context cancellation.
+//   - Printer: Prints the above to any io.Writer, with dig-like options (+short, +multiline, etc.).
+//   - ResolvConf: Reads /etc/resolv.conf and queries its name servers in turn with its options.
+//   - StubResolver: Looks up addresses, MX, SRV and TXT records with the search list, following CNAMEs.
+//   - Hosts: Reads /etc/hosts to answer A, AAAA and PTR queries, reloading it when it changes.
+//   - CNAME chains: Follows aliases across zones when resolving, detecting loops and limiting the chain length.
+//   - DNAME: Decodes DNAME records and synthesizes CNAMEs from them when resolving (RFC 6672).
+//   - Resolver cache: Caches answers as RRsets ranked by credibility (RFC 2181), with TTLs counting down and bounded,
+//     and NXDOMAIN and NODATA answers for the SOA record's negative TTL (RFC 2308).
+//     The cache is sharded for concurrent lookups, bounded in size with CLOCK eviction, and swept for expired entries.
+//     It can be exported to and imported from versioned JSON snapshots, to be kept across restarts.
+//     Popular RRsets are prefetched: refreshed in the background shortly before they expire.
+//     Expired answers can be served stale when servers can't be reached or are slow to answer (RFC 8767).
+//     Only records of the zone a server serves, on the chain from the question name, and in-zone glue are trusted.
+//   - Server selection: Tracks the smoothed RTT of each server address, trying the fastest first and backing off from those which fail.
+//   - Query coalescing: Identical resolutions and name server lookups in flight at once share a single resolution.
+//   - NewNetResolver, NewInProcessNetResolver: Route Go's net.Resolver through a Transport or a Resolver.
 //
 // The package also includes constants for DNS record types and a function to map DNS type strings to their codes.
 package dns
@@ -206,6 +206,55 @@ func GetReverseDomainFromIP(ip netip.Addr) (reversedDomain string, err error) {
 	return reversedDomain, nil
 }
 
+// GetIPFromReverseDomain returns the IP address of a reverse DNS domain, the
+// opposite of GetReverseDomainFromIP. The domain must hold a full address:
+// 4 octets under in-addr.arpa. or 32 nibbles under ip6.arpa.
+//
+// Parameters:
+//   - reversedDomain: The reverse DNS domain, case-insensitive.
+//
+// Returns:
+//   - ip: The IP address.
+//   - error: ErrInvalidIP if the domain is not a full reverse domain.
+func GetIPFromReverseDomain(reversedDomain string) (ip netip.Addr, err error) {
+	domain := strings.ToLower(MakeFQDN(reversedDomain))
+
+	if labels, found := strings.CutSuffix(domain, ".in-addr.arpa."); found {
+		octets := strings.Split(labels, ".")
+		if len(octets) != 4 {
+			return netip.Addr{}, fmt.Errorf("%w: %s", ErrInvalidIP, reversedDomain)
+		}
+		var ip4 [4]byte
+		for i, octet := range octets {
+			value, err := strconv.ParseUint(octet, 10, 8)
+			if err != nil {
+				return netip.Addr{}, fmt.Errorf("%w: %s", ErrInvalidIP, reversedDomain)
+			}
+			ip4[3-i] = byte(value)
+		}
+		return netip.AddrFrom4(ip4), nil
+	}
+
+	if labels, found := strings.CutSuffix(domain, ".ip6.arpa."); found {
+		nibbles := strings.Split(labels, ".")
+		if len(nibbles) != 32 {
+			return netip.Addr{}, fmt.Errorf("%w: %s", ErrInvalidIP, reversedDomain)
+		}
+		var ip6 [16]byte
+		for i, nibble := range nibbles {
+			value, err := strconv.ParseUint(nibble, 16, 4)
+			if err != nil || len(nibble) != 1 {
+				return netip.Addr{}, fmt.Errorf("%w: %s", ErrInvalidIP, reversedDomain)
+			}
+			// Nibbles go from low to high, last byte first
+			ip6[15-i/2] |= byte(value) << (4 * (i % 2))
+		}
+		return netip.AddrFrom16(ip6), nil
+	}
+
+	return netip.Addr{}, fmt.Errorf("%w: %s", ErrInvalidIP, reversedDomain)
+}
+
 func reverseIPv4(parsedIP netip.Addr) string {
 	ip4 := parsedIP.As4()
 
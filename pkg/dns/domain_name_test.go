@@ -266,6 +266,65 @@ func TestGetReverseDNSDomain(t *testing.T) {
 	}
 }
 
+func TestGetIPFromReverseDomain(t *testing.T) {
+	tests := []struct {
+		name      string
+		domain    string
+		want      string
+		wantError error
+	}{
+		{
+			name:   "IPv4",
+			domain: "2.1.0.192.in-addr.arpa.",
+			want:   "192.0.1.2",
+		},
+		{
+			name:   "IPv6, not fully qualified, upper case",
+			domain: "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.B.D.0.1.0.0.2.IP6.ARPA",
+			want:   "2001:db8::1",
+		},
+		{
+			name:      "IPv4 network, not an address",
+			domain:    "0.192.in-addr.arpa.",
+			wantError: ErrInvalidIP,
+		},
+		{
+			name:      "IPv4 octet out of range",
+			domain:    "256.1.0.192.in-addr.arpa.",
+			wantError: ErrInvalidIP,
+		},
+		{
+			name:      "IPv6 label is not a nibble",
+			domain:    "10.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.",
+			wantError: ErrInvalidIP,
+		},
+		{
+			name:      "Not a reverse domain",
+			domain:    "www.example.com.",
+			wantError: ErrInvalidIP,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := GetIPFromReverseDomain(tt.domain)
+
+			if tt.wantError != nil {
+				if !errors.Is(err, tt.wantError) {
+					t.Fatalf("GetIPFromReverseDomain() error = %v, want error = %v", err, tt.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetIPFromReverseDomain() error = %v", err)
+			}
+			if got != netip.MustParseAddr(tt.want) {
+				t.Errorf("GetIPFromReverseDomain() got = %v, want = %s", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestIsFQDN(t *testing.T) {
 	tests := []struct {
 		name   string
@@ -0,0 +1,215 @@
+package dns
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// EDNS(0) OPT pseudo-record (RFC 6891):
+// The OPT record lives in the additional section. Its fields are repurposed:
+
+//     +------------+--------------+------------------------------+
+//     | Field Name | Field Type   | Description                  |
+//     +------------+--------------+------------------------------+
+//     | NAME       | domain name  | MUST be 0 (root domain)      |
+//     | TYPE       | u_int16_t    | OPT (41)                     |
+//     | CLASS      | u_int16_t    | requestor's UDP payload size |
+//     | TTL        | u_int32_t    | extended RCODE and flags     |
+//     | RDLEN      | u_int16_t    | length of all RDATA          |
+//     | RDATA      | octet stream | {attribute,value} pairs      |
+//     +------------+--------------+------------------------------+
+
+// The TTL field is split as follows:
+
+//                 +0 (MSB)                            +1 (LSB)
+//      +---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+
+//   0: |         EXTENDED-RCODE        |            VERSION            |
+//      +---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+
+//   2: | DO|                           Z                               |
+//      +---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+
+
+const DefaultEDNSUDPSize = 1232 // DNS flag day 2020 recommendation
+
+// EDNS option codes
+const (
+	EDNSOptionTCPKeepalive = 11 // edns-tcp-keepalive [RFC7828]
+	EDNSOptionPadding      = 12 // Padding [RFC7830]
+)
+
+// Queries over encrypted transports are padded to a multiple of this size [RFC8467]
+const queryPaddingBlockSize = 128
+
+const (
+	ednsExtendedRCodeMask = 0xFF000000
+	ednsVersionMask       = 0x00FF0000
+	ednsDOMask            = 0x00008000
+)
+
+// EDNS holds the decoded contents of an OPT pseudo-record.
+type EDNS struct {
+	UDPSize       uint16
+	ExtendedRCode uint8 // upper 8 bits of the 12-bit response code
+	Version       uint8
+	DnssecOk      bool
+	Options       []EDNSOption
+}
+
+// EDNSOption is a single {attribute, value} pair in OPT record data.
+type EDNSOption struct {
+	Code uint16
+	Data []byte
+}
+
+// -------------- OPT
+// OPT RDATA format
+// OPTION-CODE:		Assigned by the Expert Review process as defined by the DNSEXT working group and the IESG.
+// OPTION-LENGTH:	Size (in octets) of OPTION-DATA.
+// OPTION-DATA:		Varies per OPTION-CODE.  MUST be treated as a bit field.
+
+type RDataOPT struct {
+	Options []EDNSOption
+}
+
+func (rdata *RDataOPT) String() string {
+	options := make([]string, 0, len(rdata.Options))
+	for _, option := range rdata.Options {
+		options = append(options, strconv.Itoa(int(option.Code))+":"+hex.EncodeToString(option.Data))
+	}
+	return strings.Join(options, " ")
+}
+
+func (rdata *RDataOPT) WriteRecordData(writer *dnsWriter) error {
+	for _, option := range rdata.Options {
+		writer.writeUint16(option.Code)
+		writer.writeUint16(uint16(len(option.Data)))
+		writer.writeData(option.Data)
+	}
+	return nil
+}
+
+func (rdata *RDataOPT) ReadRecordData(reader *dnsReader, length uint16) (err error) {
+	end := reader.offset + int(length)
+	rdata.Options = nil
+
+	for reader.offset < end {
+		if reader.offset+4 > end {
+			return fmt.Errorf("invalid OPT record data: option header: %w", ErrInvalidLengthTooShort)
+		}
+		code := reader.readUint16()
+		optionLength := reader.readUint16()
+
+		if reader.offset+int(optionLength) > end {
+			return fmt.Errorf("invalid OPT record data: option %d: %w", code, ErrInvalidLengthTooShort)
+		}
+		data, err := reader.readUntil(int(optionLength))
+		if err != nil {
+			return fmt.Errorf("invalid OPT record data: %w", err)
+		}
+
+		rdata.Options = append(rdata.Options, EDNSOption{Code: code, Data: data})
+	}
+	return nil
+}
+
+func (rdata *RDataOPT) length() uint16 {
+	length := 0
+	for _, option := range rdata.Options {
+		length += 4 + len(option.Data)
+	}
+	return uint16(length)
+}
+
+// GetEDNS returns the EDNS information held in the message's OPT record.
+//
+// Returns:
+//   - edns: the decoded EDNS information
+//   - found: false if the message has no OPT record in its additional section
+func (message *Message) GetEDNS() (edns EDNS, found bool) {
+	for _, record := range message.Additionals {
+		if record.RType != OPT {
+			continue
+		}
+
+		edns = EDNS{
+			UDPSize:       record.RClass,
+			ExtendedRCode: uint8((record.TTL & ednsExtendedRCodeMask) >> 24),
+			Version:       uint8((record.TTL & ednsVersionMask) >> 16),
+			DnssecOk:      record.TTL&ednsDOMask != 0,
+		}
+		if rdata, ok := record.RData.(*RDataOPT); ok {
+			edns.Options = rdata.Options
+		}
+		return edns, true
+	}
+	return EDNS{}, false
+}
+
+// SetEDNS adds an OPT record holding the given EDNS information to the
+// message's additional section, replacing any existing one.
+func (message *Message) SetEDNS(edns EDNS) {
+	rdata := &RDataOPT{Options: edns.Options}
+
+	ttl := uint32(edns.ExtendedRCode)<<24 | uint32(edns.Version)<<16
+	if edns.DnssecOk {
+		ttl |= ednsDOMask
+	}
+
+	message.RemoveEDNS()
+	message.Additionals = append(message.Additionals, ResourceRecord{
+		Name:     ".",
+		RType:    OPT,
+		RClass:   edns.UDPSize,
+		TTL:      ttl,
+		RDLength: rdata.length(),
+		RData:    rdata,
+	})
+	message.UpdateCounts()
+}
+
+// RemoveEDNS removes the OPT record from the message's additional section.
+func (message *Message) RemoveEDNS() {
+	var additionals []ResourceRecord
+	for _, record := range message.Additionals {
+		if record.RType != OPT {
+			additionals = append(additionals, record)
+		}
+	}
+	message.Additionals = additionals
+	message.UpdateCounts()
+}
+
+// padQuery adds an EDNS padding option to an encoded query so that its length
+// is a multiple of 128 bytes, adding an OPT record if there isn't one.
+func padQuery(dnsRequest []byte) (paddedRequest []byte, err error) {
+	message, err := DecodeMessage(dnsRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	edns, found := message.GetEDNS()
+	if !found {
+		edns = EDNS{UDPSize: DefaultEDNSUDPSize}
+	}
+
+	var options []EDNSOption
+	for _, option := range edns.Options {
+		if option.Code != EDNSOptionPadding {
+			options = append(options, option)
+		}
+	}
+	edns.Options = append(options, EDNSOption{Code: EDNSOptionPadding})
+
+	message.SetEDNS(edns)
+	unpaddedRequest, err := EncodeMessage(message)
+	if err != nil {
+		return nil, err
+	}
+
+	paddingLength := (queryPaddingBlockSize - len(unpaddedRequest)%queryPaddingBlockSize) % queryPaddingBlockSize
+	edns.Options[len(edns.Options)-1].Data = make([]byte, paddingLength)
+
+	message.SetEDNS(edns)
+	return EncodeMessage(message)
+}
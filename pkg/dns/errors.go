@@ -7,9 +7,24 @@ import (
 var (
 	ErrInvalidIP                       = errors.New("invalid IP address")
 	ErrInvalidLengthTooShort           = errors.New("length too short")
+	ErrMessageTooLong                  = errors.New("message too long")
 	ErrNoRootServersFound              = errors.New("no root servers found")
 	ErrOffsetOutOfBounds               = errors.New("offset out of bounds")
 	ErrTooManyPointersCompressedDomain = errors.New("too many pointers in compressed domain")
 	ErrServFailToResolveQuery          = errors.New("failed to resolve DNS query")
 	ErrServFailToResolveQueryRefused   = errors.New("failed to resolve DNS query: query refused")
+	ErrUnsupportedTransmissionProtocol = errors.New("unsupported transmission protocol")
+	ErrResponseMismatch                = errors.New("response does not match query")
+	ErrInvalidSPKIPin                  = errors.New("invalid SPKI pin")
+	ErrSPKIPinMismatch                 = errors.New("server public key does not match any SPKI pin")
+	ErrInvalidHTTPSURL                 = errors.New("invalid DNS over HTTPS URL")
+	ErrInvalidHTTPSResponse            = errors.New("invalid DNS over HTTPS response")
+	ErrNoNameservers                   = errors.New("no name servers configured")
+	ErrNXDomain                        = errors.New("no such domain")
+	ErrNoData                          = errors.New("no record of the requested type")
+	ErrLookupFailed                    = errors.New("name server failed to answer")
+	ErrCNAMELoop                       = errors.New("CNAME loop")
+	ErrCNAMEChainTooLong               = errors.New("CNAME chain too long")
+	ErrDNAMEOverflow                   = errors.New("name too long after DNAME substitution")
+	ErrUnsupportedCacheSnapshot        = errors.New("unsupported cache snapshot")
 )
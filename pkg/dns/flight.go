@@ -0,0 +1,70 @@
+package dns
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// In-flight coalescing:
+// When many clients ask for the same name at once, a single resolution runs
+// and its result is shared by all of them, as with golang.org/x/sync's
+// singleflight. Resolutions of the same question are coalesced, as are the
+// lookups of the same name server's addresses while following referrals.
+//
+// A name server lookup may need the addresses of other name servers, and
+// with cyclic delegations, of the very name server it is looking up. To
+// never wait for itself, a lookup only joins a flight started at its own
+// depth of recursion or deeper: waiting always goes to deeper flights, so it
+// can't go round in a cycle.
+
+// flight is a call in flight, and its result once done is closed.
+type flight[V any] struct {
+	done  chan struct{}
+	depth int
+	value V
+	err   error
+}
+
+// flightGroup coalesces the calls in flight with the same key. The zero value
+// is ready to use.
+type flightGroup[V any] struct {
+	mutex   sync.Mutex
+	flights map[cacheKey]*flight[V]
+	// coalesced counts the calls which shared a call in flight
+	coalesced atomic.Uint64
+}
+
+// do calls fn and returns its result, unless a call with the same key, at
+// the same depth or deeper, is in flight: then it waits for that call and
+// returns its result, shared with the other callers.
+func (group *flightGroup[V]) do(key cacheKey, depth int, fn func() (V, error)) (value V, err error, shared bool) {
+	group.mutex.Lock()
+	if call, found := group.flights[key]; found && call.depth >= depth {
+		group.coalesced.Add(1)
+		group.mutex.Unlock()
+		<-call.done
+		return call.value, call.err, true
+	}
+
+	call := &flight[V]{done: make(chan struct{}), depth: depth}
+	_, inFlight := group.flights[key]
+	if !inFlight {
+		if group.flights == nil {
+			group.flights = make(map[cacheKey]*flight[V])
+		}
+		group.flights[key] = call
+	}
+	group.mutex.Unlock()
+
+	defer func() {
+		close(call.done)
+		if !inFlight {
+			group.mutex.Lock()
+			delete(group.flights, key)
+			group.mutex.Unlock()
+		}
+	}()
+
+	call.value, call.err = fn()
+	return call.value, call.err, false
+}
@@ -0,0 +1,148 @@
+package dns
+
+import (
+	"errors"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitForCoalesced waits until the given number of calls shared a call in
+// flight of the group.
+func waitForCoalesced[V any](t *testing.T, group *flightGroup[V], coalesced uint64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for group.coalesced.Load() < coalesced {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d calls shared a call in flight, want %d", group.coalesced.Load(), coalesced)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFlightGroup(t *testing.T) {
+	var group flightGroup[int]
+	key := testCacheKey("example.com.")
+	errFailed := errors.New("failed")
+
+	var calls atomic.Int32
+	release := make(chan struct{})
+	fn := func() (int, error) {
+		calls.Add(1)
+		<-release
+		return 42, errFailed
+	}
+
+	var wg sync.WaitGroup
+	results := make(chan int, 10)
+	var sharedCount atomic.Int32
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, err, shared := group.do(key, 1, fn)
+			if value != 42 || !errors.Is(err, errFailed) {
+				t.Errorf("do() got %d, %v, want the call's result", value, err)
+			}
+			if shared {
+				sharedCount.Add(1)
+			}
+			results <- value
+		}()
+		if i == 0 {
+			// The first call is in flight before the others
+			for calls.Load() == 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+	waitForCoalesced(t, &group, 9)
+
+	// A shallower call joins, a deeper one doesn't
+	if _, _, shared := group.do(key, 2, func() (int, error) { return 0, nil }); shared {
+		t.Errorf("do() from a deeper call joined a shallower flight")
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if _, _, shared := group.do(key, 0, fn); shared {
+			sharedCount.Add(1)
+		}
+	}()
+	waitForCoalesced(t, &group, 10)
+
+	close(release)
+	wg.Wait()
+	if calls.Load() != 1 || sharedCount.Load() != 10 {
+		t.Errorf("do() made %d calls shared %d times, want 1 call shared 10 times", calls.Load(), sharedCount.Load())
+	}
+	if len(group.flights) != 0 {
+		t.Errorf("flight group has %d calls in flight once done", len(group.flights))
+	}
+}
+
+func TestResolverCoalescesResolutions(t *testing.T) {
+	resolver, err := NewResolver("")
+	if err != nil {
+		t.Fatalf("NewResolver() error = %v", err)
+	}
+	// A single address per server, not raced while the query is blocked
+	resolver.AddressFamily = IPv4Only
+
+	var queriedServers atomic.Int32
+	release := make(chan struct{})
+	resolver.QueryFunc = func(_ string, _ netip.AddrPort, dnsRequest []byte) ([]byte, error) {
+		queriedServers.Add(1)
+		<-release
+		request, err := DecodeMessage(dnsRequest)
+		if err != nil {
+			return nil, err
+		}
+		reply := NewReply(request)
+		reply.Header.Flags.Authoritative = true
+		reply.Answers = []ResourceRecord{newResourceRecord(request.Questions[0].Name, A, 300, &RDataA{IP: netip.MustParseAddr("192.0.2.1")})}
+		reply.UpdateCounts()
+		return EncodeMessage(reply)
+	}
+
+	const clients = 20
+	var wg sync.WaitGroup
+	for i := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Names differ in case only
+			name := "www.example.com."
+			if i%2 == 1 {
+				name = "WWW.example.com."
+			}
+			request, _ := CreateQuery(name, A)
+			response, err := resolver.ResolveQuery(request)
+			if err != nil {
+				t.Errorf("ResolveQuery() error = %v", err)
+				return
+			}
+			reply, err := DecodeMessage(response)
+			if err != nil || reply.Header.Id != binaryID(request) || len(reply.Answers) != 1 {
+				t.Errorf("ResolveQuery() got %+v, %v, want a reply to the client's request", reply, err)
+			}
+		}()
+	}
+	waitForCoalesced(t, &resolver.resolutions, clients-1)
+
+	close(release)
+	wg.Wait()
+	if queries := queriedServers.Load(); queries != 1 {
+		t.Errorf("servers were queried %d times, want 1", queries)
+	}
+	if stats := resolver.CacheStats(); stats.Coalesced != clients-1 {
+		t.Errorf("CacheStats() coalesced = %d, want %d", stats.Coalesced, clients-1)
+	}
+}
+
+// binaryID returns the ID of an encoded message.
+func binaryID(message []byte) uint16 {
+	return uint16(message[0])<<8 | uint16(message[1])
+}
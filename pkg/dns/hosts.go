@@ -0,0 +1,227 @@
+package dns
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Hosts file (hosts(5)):
+// The hosts file maps host names to addresses, one address per line followed
+// by its canonical name and aliases:
+//
+//	127.0.0.1	localhost
+//	192.0.2.10	dev.example.com dev
+//	2001:db8::10	dev.example.com
+//
+// Lookups answer A and AAAA questions with the addresses of a name, and PTR
+// questions with the names of an address, the canonical name first.
+
+const DefaultHostsPath = "/etc/hosts"
+
+// DefaultHostsTTL is the TTL of the records answered from the hosts file.
+// It is short, since the file may change at any time.
+const DefaultHostsTTL = 60
+
+// DefaultHostsCheckInterval is how often the hosts file is checked for
+// changes, as in Go's resolver.
+const DefaultHostsCheckInterval = 5 * time.Second
+
+// Hosts holds the entries of a hosts file, and reloads them when the file
+// changes. It is safe for concurrent use.
+type Hosts struct {
+	// Path is the path of the hosts file.
+	Path string
+	// TTL is the TTL of the records answered from the file.
+	TTL uint32
+	// CheckInterval is the minimum time between checks of the file for
+	// changes. DefaultHostsCheckInterval if zero.
+	CheckInterval time.Duration
+
+	mutex     sync.RWMutex
+	addrs     map[string][]netip.Addr // by lowercase FQDN
+	names     map[netip.Addr][]string // FQDNs, canonical name first
+	modTime   time.Time
+	size      int64
+	lastCheck time.Time
+}
+
+// ReadHosts reads a hosts file. The file is read again on lookups when it
+// changes.
+//
+// Parameters:
+//   - path: the path of the file, usually DefaultHostsPath
+//
+// Returns:
+//   - hosts: the file's entries
+//   - err: an error if the file could not be read
+func ReadHosts(path string) (hosts *Hosts, err error) {
+	hosts = &Hosts{Path: path, TTL: DefaultHostsTTL, lastCheck: time.Now()}
+	if err = hosts.reload(); err != nil {
+		return nil, err
+	}
+	return hosts, nil
+}
+
+// reload reads the file again if its modification time or size changed.
+func (hosts *Hosts) reload() (err error) {
+	info, err := os.Stat(hosts.Path)
+	if err != nil {
+		return fmt.Errorf("cannot read hosts file %s: %w", hosts.Path, err)
+	}
+
+	hosts.mutex.RLock()
+	unchanged := hosts.addrs != nil && info.ModTime().Equal(hosts.modTime) && info.Size() == hosts.size
+	hosts.mutex.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	file, err := os.Open(hosts.Path)
+	if err != nil {
+		return fmt.Errorf("cannot open hosts file %s: %w", hosts.Path, err)
+	}
+	defer file.Close()
+
+	addrs, names, err := parseHosts(file)
+	if err != nil {
+		return fmt.Errorf("error reading hosts file %s: %w", hosts.Path, err)
+	}
+
+	hosts.mutex.Lock()
+	defer hosts.mutex.Unlock()
+	hosts.addrs, hosts.names = addrs, names
+	hosts.modTime, hosts.size = info.ModTime(), info.Size()
+	return nil
+}
+
+// reloadIfStale checks the file for changes if it hasn't been checked
+// recently. If the file can no longer be read, the last entries are kept.
+func (hosts *Hosts) reloadIfStale() {
+	checkInterval := hosts.CheckInterval
+	if checkInterval <= 0 {
+		checkInterval = DefaultHostsCheckInterval
+	}
+
+	hosts.mutex.Lock()
+	stale := time.Since(hosts.lastCheck) >= checkInterval
+	if stale {
+		hosts.lastCheck = time.Now()
+	}
+	hosts.mutex.Unlock()
+
+	if stale {
+		hosts.reload()
+	}
+}
+
+// parseHosts parses hosts file contents. Comments start with '#', and lines
+// with an invalid address are ignored.
+func parseHosts(reader io.Reader) (addrs map[string][]netip.Addr, names map[netip.Addr][]string, err error) {
+	addrs = make(map[string][]netip.Addr)
+	names = make(map[netip.Addr][]string)
+	scanner := bufio.NewScanner(reader)
+
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		addr, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			continue
+		}
+		addr = addr.Unmap()
+
+		for _, name := range fields[1:] {
+			fqdn := MakeFQDN(name)
+			key := strings.ToLower(fqdn)
+			if !slices.Contains(addrs[key], addr) {
+				addrs[key] = append(addrs[key], addr)
+			}
+			if unzoned := addr.WithZone(""); !slices.Contains(names[unzoned], fqdn) {
+				names[unzoned] = append(names[unzoned], fqdn)
+			}
+		}
+	}
+
+	if err = scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	return addrs, names, nil
+}
+
+// LookupAddrs returns the addresses of a host name in the hosts file.
+func (hosts *Hosts) LookupAddrs(name string) (addrs []netip.Addr) {
+	hosts.reloadIfStale()
+
+	hosts.mutex.RLock()
+	defer hosts.mutex.RUnlock()
+	return append(addrs, hosts.addrs[strings.ToLower(MakeFQDN(name))]...)
+}
+
+// LookupNames returns the host names of an address in the hosts file, the
+// canonical name first.
+func (hosts *Hosts) LookupNames(addr netip.Addr) (names []string) {
+	hosts.reloadIfStale()
+
+	hosts.mutex.RLock()
+	defer hosts.mutex.RUnlock()
+	return append(names, hosts.names[addr.Unmap().WithZone("")]...)
+}
+
+// Answer answers a query from the hosts file: A and AAAA questions with the
+// addresses of the name, and PTR questions for reverse domains with the names
+// of the address. Other questions, and names or addresses which aren't in the
+// file, aren't answered.
+//
+// Parameters:
+//   - request: the query to answer
+//
+// Returns:
+//   - reply: an authoritative reply with the records from the hosts file
+//   - found: true if the hosts file has records to answer with
+func (hosts *Hosts) Answer(request Message) (reply Message, found bool) {
+	if len(request.Questions) != 1 || request.Questions[0].QClass != IN {
+		return Message{}, false
+	}
+	question := request.Questions[0]
+
+	var answers []ResourceRecord
+	switch question.QType {
+	case A, AAAA:
+		for _, addr := range hosts.LookupAddrs(question.Name) {
+			if addr.Is4() && question.QType == A {
+				answers = append(answers, newResourceRecord(question.Name, A, hosts.TTL, &RDataA{IP: addr}))
+			} else if addr.Is6() && question.QType == AAAA {
+				answers = append(answers, newResourceRecord(question.Name, AAAA, hosts.TTL, &RDataAAAA{IP: addr.WithZone("")}))
+			}
+		}
+	case PTR:
+		addr, err := GetIPFromReverseDomain(question.Name)
+		if err != nil {
+			return Message{}, false
+		}
+		for _, name := range hosts.LookupNames(addr) {
+			answers = append(answers, newResourceRecord(question.Name, PTR, hosts.TTL, &RDataPTR{DomainName: name}))
+		}
+	}
+
+	if len(answers) == 0 {
+		return Message{}, false
+	}
+
+	reply = NewReply(request)
+	reply.Header.Flags.Authoritative = true
+	reply.Answers = answers
+	reply.UpdateCounts()
+	return reply, true
+}
@@ -0,0 +1,225 @@
+package dns
+
+import (
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+const testHostsFile = `# Static table lookup for hostnames
+127.0.0.1	localhost
+::1		localhost ip6-localhost
+
+192.0.2.10	dev.example.com dev	# development server
+192.0.2.11	Build.Example.com
+2001:db8::10	dev.example.com
+fe80::1%eth0	router.local
+not-an-ip	broken.example.com
+192.0.2.12
+`
+
+func writeTestHostsFile(t *testing.T, contents string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "hosts")
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatalf("failed to write test hosts file: %v", err)
+	}
+	return path
+}
+
+func TestHostsLookup(t *testing.T) {
+	hosts, err := ReadHosts(writeTestHostsFile(t, testHostsFile))
+	if err != nil {
+		t.Fatalf("ReadHosts() error = %v", err)
+	}
+
+	addrTests := []struct {
+		name string
+		want []netip.Addr
+	}{
+		{name: "localhost", want: []netip.Addr{netip.MustParseAddr("127.0.0.1"), netip.MustParseAddr("::1")}},
+		{name: "dev.example.com.", want: []netip.Addr{netip.MustParseAddr("192.0.2.10"), netip.MustParseAddr("2001:db8::10")}},
+		{name: "DEV", want: []netip.Addr{netip.MustParseAddr("192.0.2.10")}},
+		{name: "build.example.com", want: []netip.Addr{netip.MustParseAddr("192.0.2.11")}},
+		{name: "router.local", want: []netip.Addr{netip.MustParseAddr("fe80::1%eth0")}},
+		{name: "broken.example.com"},
+	}
+	for _, tt := range addrTests {
+		if got := hosts.LookupAddrs(tt.name); !slices.Equal(got, tt.want) {
+			t.Errorf("LookupAddrs(%s) got = %v, want = %v", tt.name, got, tt.want)
+		}
+	}
+
+	nameTests := []struct {
+		addr string
+		want []string
+	}{
+		{addr: "192.0.2.10", want: []string{"dev.example.com.", "dev."}},
+		{addr: "::ffff:192.0.2.11", want: []string{"Build.Example.com."}},
+		{addr: "::1", want: []string{"localhost.", "ip6-localhost."}},
+		{addr: "fe80::1", want: []string{"router.local."}},
+		{addr: "192.0.2.12"},
+	}
+	for _, tt := range nameTests {
+		if got := hosts.LookupNames(netip.MustParseAddr(tt.addr)); !slices.Equal(got, tt.want) {
+			t.Errorf("LookupNames(%s) got = %v, want = %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestHostsAnswer(t *testing.T) {
+	hosts, err := ReadHosts(writeTestHostsFile(t, testHostsFile))
+	if err != nil {
+		t.Fatalf("ReadHosts() error = %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		questionName string
+		questionType uint16
+		want         []string
+	}{
+		{name: "A", questionName: "dev.example.com.", questionType: A, want: []string{"192.0.2.10"}},
+		{name: "AAAA", questionName: "dev.example.com.", questionType: AAAA, want: []string{"2001:db8::10"}},
+		{name: "AAAA with zone", questionName: "router.local.", questionType: AAAA, want: []string{"fe80::1"}},
+		{name: "PTR for IPv4", questionName: "10.2.0.192.in-addr.arpa.", questionType: PTR, want: []string{"dev.example.com.", "dev."}},
+		{name: "PTR for IPv6", questionName: "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa.", questionType: PTR, want: []string{"localhost.", "ip6-localhost."}},
+		{name: "No address of the type", questionName: "build.example.com.", questionType: AAAA},
+		{name: "Name not in the file", questionName: "www.example.com.", questionType: A},
+		{name: "Address not in the file", questionName: "99.2.0.192.in-addr.arpa.", questionType: PTR},
+		{name: "Other type", questionName: "dev.example.com.", questionType: MX},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := Message{
+				Header:    Header{Id: 1234, QuestionCount: 1},
+				Questions: []Question{{Name: tt.questionName, QType: tt.questionType, QClass: IN}},
+			}
+
+			reply, found := hosts.Answer(request)
+			if found != (tt.want != nil) {
+				t.Fatalf("Answer() found = %t, want %t", found, tt.want != nil)
+			}
+			if !found {
+				return
+			}
+
+			if reply.Header.Id != request.Header.Id || !reply.Header.Flags.Authoritative || reply.Header.AnswerRRCount != uint16(len(tt.want)) {
+				t.Errorf("Answer() got header %+v, want authoritative reply to %d with %d answers", reply.Header, request.Header.Id, len(tt.want))
+			}
+			var got []string
+			for _, answer := range reply.Answers {
+				if answer.Name != tt.questionName || answer.RType != tt.questionType || answer.TTL != DefaultHostsTTL {
+					t.Errorf("Answer() got record %s %d %d, want %s %d %d", answer.Name, answer.RType, answer.TTL, tt.questionName, tt.questionType, DefaultHostsTTL)
+				}
+				got = append(got, answer.RData.String())
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Answer() got = %v, want = %v", got, tt.want)
+			}
+
+			// The reply can be sent as is
+			if _, err := EncodeMessage(reply); err != nil {
+				t.Errorf("EncodeMessage() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestHostsReload(t *testing.T) {
+	path := writeTestHostsFile(t, "192.0.2.10 dev.example.com\n")
+	hosts, err := ReadHosts(path)
+	if err != nil {
+		t.Fatalf("ReadHosts() error = %v", err)
+	}
+	hosts.CheckInterval = 10 * time.Millisecond
+
+	if err := os.WriteFile(path, []byte("192.0.2.20 dev.example.com\n192.0.2.21 new.example.com\n"), 0644); err != nil {
+		t.Fatalf("failed to update test hosts file: %v", err)
+	}
+
+	// Not checked again before the check interval
+	if got := hosts.LookupAddrs("dev.example.com"); !slices.Equal(got, []netip.Addr{netip.MustParseAddr("192.0.2.10")}) {
+		t.Errorf("LookupAddrs() before check interval got = %v, want the old address", got)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if got := hosts.LookupAddrs("dev.example.com"); !slices.Equal(got, []netip.Addr{netip.MustParseAddr("192.0.2.20")}) {
+		t.Errorf("LookupAddrs() after change got = %v, want the new address", got)
+	}
+
+	// The last entries are kept if the file disappears
+	os.Remove(path)
+	time.Sleep(20 * time.Millisecond)
+	if got := hosts.LookupAddrs("new.example.com"); !slices.Equal(got, []netip.Addr{netip.MustParseAddr("192.0.2.21")}) {
+		t.Errorf("LookupAddrs() after removal got = %v, want the last address", got)
+	}
+}
+
+func TestReadHostsMissingFile(t *testing.T) {
+	if _, err := ReadHosts(filepath.Join(t.TempDir(), "missing")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("ReadHosts() error = %v, want %v", err, os.ErrNotExist)
+	}
+}
+
+func TestResolverResolveQueryHosts(t *testing.T) {
+	resolver, err := NewResolver("")
+	if err != nil {
+		t.Fatalf("NewResolver() error = %v", err)
+	}
+	resolver.Hosts, err = ReadHosts(writeTestHostsFile(t, testHostsFile))
+	if err != nil {
+		t.Fatalf("ReadHosts() error = %v", err)
+	}
+
+	var queriedServers int
+	resolver.QueryFunc = func(_ string, _ netip.AddrPort, dnsRequest []byte) ([]byte, error) {
+		queriedServers++
+		request, err := DecodeMessage(dnsRequest)
+		if err != nil {
+			return nil, err
+		}
+		reply := NewReply(request)
+		reply.Header.Flags.Authoritative = true
+		return EncodeMessage(reply)
+	}
+
+	tests := []struct {
+		name              string
+		questionName      string
+		wantAnswers       uint16
+		wantServerQueries int
+	}{
+		{name: "Answered from the hosts file", questionName: "dev.example.com.", wantAnswers: 1, wantServerQueries: 0},
+		{name: "Not in the hosts file", questionName: "www.example.com.", wantAnswers: 0, wantServerQueries: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queriedServers = 0
+			request, _ := CreateQuery(tt.questionName, A)
+
+			response, err := resolver.ResolveQuery(request)
+			if err != nil {
+				t.Fatalf("ResolveQuery() error = %v", err)
+			}
+			reply, err := DecodeMessage(response)
+			if err != nil {
+				t.Fatalf("ResolveQuery() response cannot be decoded: %v", err)
+			}
+
+			if reply.Header.AnswerRRCount != tt.wantAnswers || !reply.Header.Flags.RecursionAvailable {
+				t.Errorf("ResolveQuery() got %d answers, want %d", reply.Header.AnswerRRCount, tt.wantAnswers)
+			}
+			if queriedServers != tt.wantServerQueries {
+				t.Errorf("ResolveQuery() queried %d servers, want %d", queriedServers, tt.wantServerQueries)
+			}
+		})
+	}
+}
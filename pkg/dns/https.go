@@ -0,0 +1,258 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DNS over HTTPS (RFC 8484):
+// Wire format DNS messages are sent to a URI template such as
+// https://dns.example/dns-query{?dns}, over HTTP/2 when the server supports it.
+//   - GET requests carry the message base64url encoded (without padding)
+//     in the "dns" query parameter. The message ID is set to 0 so that
+//     identical queries can be answered from HTTP caches.
+//   - POST requests carry the message in the body, with the
+//     application/dns-message content type.
+// As with DNS over TLS, queries are padded (RFC 8467).
+// A response may have been served from an HTTP cache: its TTLs are reduced
+// by the time it spent there, given by the Age header field (RFC 8484
+// section 5.1), and capped to its freshness lifetime.
+
+const dnsMessageContentType = "application/dns-message"
+
+const dnsURITemplateVariable = "{?dns}"
+
+// httpClientKey identifies the HTTP client for a server name and bootstrap
+// address: an HTTP transport pools its connections by URL host only, so each
+// bootstrap address needs its own.
+type httpClientKey struct {
+	serverName string
+	bootstrap  netip.AddrPort
+}
+
+// exchangeHTTPS sends a DNS request to the transport's HTTPS URL. If the
+// server address is valid, the connection is made to that address instead
+// of resolving the URL host (a bootstrap address).
+func (transport *Transport) exchangeHTTPS(ctx context.Context, serverAddrPort netip.AddrPort, dnsRequest []byte) (response []byte, err error) {
+	if transport.HTTPSURL == "" {
+		return nil, fmt.Errorf("%w: no HTTPS URL", ErrInvalidHTTPSURL)
+	}
+	if len(dnsRequest) < DNSHeaderLength {
+		return nil, fmt.Errorf("invalid DNS request: %w", ErrInvalidLengthTooShort)
+	}
+
+	client, err := transport.getHTTPClient(serverAddrPort)
+	if err != nil {
+		return nil, err
+	}
+
+	paddedRequest, err := padQuery(dnsRequest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DNS request: %w", err)
+	}
+
+	request, err := transport.newHTTPSRequest(ctx, paddedRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	httpResponse, err := client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send DNS request over HTTPS: %w", err)
+	}
+	defer httpResponse.Body.Close()
+
+	if httpResponse.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: HTTP status %s", ErrInvalidHTTPSResponse, httpResponse.Status)
+	}
+	if contentType := httpResponse.Header.Get("Content-Type"); contentType != dnsMessageContentType {
+		return nil, fmt.Errorf("%w: content type %q", ErrInvalidHTTPSResponse, contentType)
+	}
+
+	response, err = io.ReadAll(io.LimitReader(httpResponse.Body, MaxDNSMessageSizeOverTCP+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read DNS response over HTTPS: %w", err)
+	}
+	if len(response) > MaxDNSMessageSizeOverTCP {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidHTTPSResponse, ErrMessageTooLong)
+	}
+	if len(response) < DNSHeaderLength {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidHTTPSResponse, ErrInvalidLengthTooShort)
+	}
+
+	// Restore the original ID, which was zeroed for GET requests
+	copy(response[:2], dnsRequest[:2])
+
+	return adjustHTTPCachedTTLs(response, httpResponse.Header)
+}
+
+func (transport *Transport) newHTTPSRequest(ctx context.Context, dnsRequest []byte) (request *http.Request, err error) {
+	if transport.HTTPSUseGET {
+		// Use ID 0 to maximize HTTP cache hits
+		cacheFriendlyRequest := append([]byte{0, 0}, dnsRequest[2:]...)
+		encodedRequest := base64.RawURLEncoding.EncodeToString(cacheFriendlyRequest)
+
+		requestURL, err := expandDNSURITemplate(transport.HTTPSURL, encodedRequest)
+		if err != nil {
+			return nil, err
+		}
+		request, err = http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidHTTPSURL, err)
+		}
+	} else {
+		requestURL, err := expandDNSURITemplate(transport.HTTPSURL, "")
+		if err != nil {
+			return nil, err
+		}
+		request, err = http.NewRequestWithContext(ctx, http.MethodPost, requestURL, bytes.NewReader(dnsRequest))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidHTTPSURL, err)
+		}
+		request.Header.Set("Content-Type", dnsMessageContentType)
+	}
+
+	request.Header.Set("Accept", dnsMessageContentType)
+	return request, nil
+}
+
+// expandDNSURITemplate expands the "dns" variable of a DNS over HTTPS URI
+// template (RFC 6570 form-style query expansion) with the given value, or
+// removes it if the value is empty. A URL without the variable is treated
+// as if it ended with it.
+func expandDNSURITemplate(template string, value string) (requestURL string, err error) {
+	base := strings.Replace(template, dnsURITemplateVariable, "", 1)
+	if strings.ContainsAny(base, "{}") {
+		return "", fmt.Errorf("%w: unsupported URI template %s", ErrInvalidHTTPSURL, template)
+	}
+
+	parsedURL, err := url.Parse(base)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrInvalidHTTPSURL, err)
+	}
+	if parsedURL.Scheme != "https" || parsedURL.Host == "" {
+		return "", fmt.Errorf("%w: %s is not an https URL", ErrInvalidHTTPSURL, template)
+	}
+
+	if value != "" {
+		query := parsedURL.Query()
+		query.Set("dns", value)
+		parsedURL.RawQuery = query.Encode()
+	}
+	return parsedURL.String(), nil
+}
+
+// adjustHTTPCachedTTLs reduces the TTLs of the records in a response by the
+// value of the HTTP Age header field, and caps them to the response's
+// remaining freshness lifetime (Cache-Control max-age).
+func adjustHTTPCachedTTLs(response []byte, header http.Header) (adjustedResponse []byte, err error) {
+	age, _ := strconv.ParseUint(header.Get("Age"), 10, 32)
+	maxAge, hasMaxAge := parseCacheControlMaxAge(header.Get("Cache-Control"))
+	if age == 0 && !hasMaxAge {
+		return response, nil
+	}
+
+	message, err := DecodeMessage(response)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidHTTPSResponse, err)
+	}
+
+	adjustTTL := func(records []ResourceRecord) {
+		for i := range records {
+			if records[i].RType == OPT {
+				continue
+			}
+			ttl := uint64(records[i].TTL)
+			if hasMaxAge && ttl > maxAge {
+				ttl = maxAge
+			}
+			if ttl > age {
+				ttl -= age
+			} else {
+				ttl = 0
+			}
+			records[i].TTL = uint32(ttl)
+		}
+	}
+	adjustTTL(message.Answers)
+	adjustTTL(message.NameServers)
+	adjustTTL(message.Additionals)
+
+	return EncodeMessage(message)
+}
+
+func parseCacheControlMaxAge(cacheControl string) (maxAge uint64, found bool) {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if !strings.EqualFold(name, "max-age") {
+			continue
+		}
+		maxAge, err := strconv.ParseUint(strings.Trim(value, `"`), 10, 32)
+		if err != nil {
+			return 0, false
+		}
+		return maxAge, true
+	}
+	return 0, false
+}
+
+// getHTTPClient returns the transport's HTTP client for the host of its
+// HTTPS URL and a bootstrap address, creating it on first use.
+func (transport *Transport) getHTTPClient(bootstrap netip.AddrPort) (client *http.Client, err error) {
+	requestURL, err := expandDNSURITemplate(transport.HTTPSURL, "")
+	if err != nil {
+		return nil, err
+	}
+	parsedURL, _ := url.Parse(requestURL)
+	key := httpClientKey{serverName: parsedURL.Hostname(), bootstrap: bootstrap}
+
+	transport.mutex.Lock()
+	client = transport.httpClients[key]
+	transport.mutex.Unlock()
+	if client != nil {
+		return client, nil
+	}
+
+	tlsConfig, err := transport.getTLSConfig(key.serverName)
+	if err != nil {
+		return nil, err
+	}
+
+	httpTransport := &http.Transport{
+		DialContext: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			// Connect to the bootstrap address if there is one
+			if bootstrap.IsValid() {
+				return transport.dial(ctx, network, bootstrap)
+			}
+			dialer := net.Dialer{}
+			if transport.LocalAddr.IsValid() {
+				dialer.LocalAddr = net.TCPAddrFromAddrPort(transport.LocalAddr)
+			}
+			return dialer.DialContext(ctx, network, address)
+		},
+		TLSClientConfig:     tlsConfig,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: 2,
+		IdleConnTimeout:     90 * time.Second,
+	}
+
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	if transport.httpClients == nil {
+		transport.httpClients = make(map[httpClientKey]*http.Client)
+	}
+	if transport.httpClients[key] == nil {
+		transport.httpClients[key] = &http.Client{Transport: httpTransport}
+	}
+	return transport.httpClients[key], nil
+}
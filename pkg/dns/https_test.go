@@ -0,0 +1,257 @@
+package dns
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+type testHTTPSRequest struct {
+	method     string
+	protoMajor int
+	query      Message
+}
+
+// startTestHTTPSServer starts a local DNS over HTTPS server over HTTP/2 that
+// answers A queries with a record of the given TTL.
+func startTestHTTPSServer(t *testing.T, header http.Header) (*httptest.Server, chan testHTTPSRequest) {
+	t.Helper()
+
+	requests := make(chan testHTTPSRequest, 10)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		var data []byte
+		var err error
+
+		switch request.Method {
+		case http.MethodGet:
+			data, err = base64.RawURLEncoding.DecodeString(request.URL.Query().Get("dns"))
+		case http.MethodPost:
+			if request.Header.Get("Content-Type") != dnsMessageContentType {
+				http.Error(writer, "bad content type", http.StatusUnsupportedMediaType)
+				return
+			}
+			data, err = io.ReadAll(request.Body)
+		}
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		query, err := DecodeMessage(data)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+		requests <- testHTTPSRequest{method: request.Method, protoMajor: request.ProtoMajor, query: query}
+
+		reply := NewReply(query)
+		reply.Answers = []ResourceRecord{
+			{Name: query.Questions[0].Name, RType: A, RClass: IN, TTL: 300, RDLength: 4, RData: &RDataA{IP: netip.MustParseAddr("192.0.2.1")}},
+		}
+		reply.UpdateCounts()
+		response, _ := EncodeMessage(reply)
+
+		for name, values := range header {
+			writer.Header()[name] = values
+		}
+		writer.Header().Set("Content-Type", dnsMessageContentType)
+		writer.Write(response)
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	return server, requests
+}
+
+func TestTransportQueryHTTPS(t *testing.T) {
+	tests := []struct {
+		name       string
+		useGET     bool
+		uriSuffix  string
+		header     http.Header
+		wantMethod string
+		wantTTL    uint32
+	}{
+		{
+			name:       "POST request",
+			useGET:     false,
+			uriSuffix:  "/dns-query",
+			wantMethod: http.MethodPost,
+			wantTTL:    300,
+		},
+		{
+			name:       "GET request with URI template",
+			useGET:     true,
+			uriSuffix:  "/dns-query{?dns}",
+			wantMethod: http.MethodGet,
+			wantTTL:    300,
+		},
+		{
+			name:       "GET request served from HTTP cache",
+			useGET:     true,
+			uriSuffix:  "/dns-query?ct{?dns}",
+			header:     http.Header{"Age": {"100"}},
+			wantMethod: http.MethodGet,
+			wantTTL:    200,
+		},
+		{
+			name:       "Freshness lifetime shorter than TTL",
+			useGET:     false,
+			uriSuffix:  "/dns-query",
+			header:     http.Header{"Age": {"10"}, "Cache-Control": {"public, max-age=60"}},
+			wantMethod: http.MethodPost,
+			wantTTL:    50,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, requests := startTestHTTPSServer(t, tt.header)
+			transport := &Transport{
+				Timeout:     time.Second,
+				TLSConfig:   server.Client().Transport.(*http.Transport).TLSClientConfig,
+				HTTPSURL:    server.URL + tt.uriSuffix,
+				HTTPSUseGET: tt.useGET,
+			}
+			defer transport.CloseIdleConnections()
+
+			request, _ := CreateQuery("example.com.", A)
+			got, err := transport.Query("https", netip.AddrPort{}, request)
+			if err != nil {
+				t.Fatalf("Query() error = %v", err)
+			}
+
+			received := <-requests
+			if received.method != tt.wantMethod {
+				t.Errorf("server received %s request, want %s", received.method, tt.wantMethod)
+			}
+			if received.protoMajor != 2 {
+				t.Errorf("server received HTTP/%d request, want HTTP/2", received.protoMajor)
+			}
+			if tt.useGET && received.query.Header.Id != 0 {
+				t.Errorf("server received GET query with ID %d, want 0", received.query.Header.Id)
+			}
+
+			response, err := DecodeMessage(got)
+			if err != nil {
+				t.Fatalf("Query() response cannot be decoded: %v", err)
+			}
+			if request[0] != got[0] || request[1] != got[1] {
+				t.Errorf("Query() response ID %d does not match query", response.Header.Id)
+			}
+			if len(response.Answers) != 1 || response.Answers[0].TTL != tt.wantTTL {
+				t.Errorf("Query() answers got = %+v, want TTL %d", response.Answers, tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestTransportQueryHTTPSBootstrapAddress(t *testing.T) {
+	server, requests := startTestHTTPSServer(t, nil)
+	otherServer, otherRequests := startTestHTTPSServer(t, nil)
+
+	// The URL's host does not resolve: the bootstrap address is used instead
+	transport := &Transport{
+		Timeout:   time.Second,
+		TLSConfig: server.Client().Transport.(*http.Transport).TLSClientConfig.Clone(),
+		HTTPSURL:  "https://example.com/dns-query",
+	}
+	transport.TLSConfig.ServerName = "example.com"
+	defer transport.CloseIdleConnections()
+
+	// Each bootstrap address gets its own connections, though the URL's host
+	// is the same
+	request, _ := CreateQuery("example.com.", A)
+	for _, test := range []struct {
+		server   *httptest.Server
+		requests chan testHTTPSRequest
+	}{{server, requests}, {otherServer, otherRequests}, {server, requests}} {
+		bootstrap := netip.MustParseAddrPort(test.server.Listener.Addr().String())
+		if _, err := transport.Query("https", bootstrap, request); err != nil {
+			t.Fatalf("Query() error = %v", err)
+		}
+		select {
+		case <-test.requests:
+		default:
+			t.Errorf("Query() with bootstrap address %v was not sent to it", bootstrap)
+		}
+	}
+}
+
+func TestResolverQueryViaHTTPS(t *testing.T) {
+	server, requests := startTestHTTPSServer(t, nil)
+	bootstrap := netip.MustParseAddrPort(server.Listener.Addr().String())
+
+	transport := &Transport{
+		Timeout:   time.Second,
+		TLSConfig: server.Client().Transport.(*http.Transport).TLSClientConfig.Clone(),
+		HTTPSURL:  "https://example.com/dns-query",
+	}
+	transport.TLSConfig.ServerName = "example.com"
+	defer transport.CloseIdleConnections()
+
+	resolver, err := NewResolver("")
+	if err != nil {
+		t.Fatalf("NewResolver() error = %v", err)
+	}
+	// The resolver's queries to root servers on port 53 go to the upstream
+	resolver.QueryFunc = transport.QueryVia("https", bootstrap)
+
+	request, _ := CreateQuery("www.example.com.", A)
+	response, err := resolver.ResolveQuery(request)
+	if err != nil {
+		t.Fatalf("ResolveQuery() error = %v", err)
+	}
+	reply, err := DecodeMessage(response)
+	if err != nil {
+		t.Fatalf("ResolveQuery() response cannot be decoded: %v", err)
+	}
+	if len(reply.Answers) != 1 || reply.Answers[0].RData.String() != "192.0.2.1" {
+		t.Errorf("ResolveQuery() answers got = %v, want the upstream's answer", reply.Answers)
+	}
+	if received := <-requests; received.query.Questions[0].Name != "www.example.com." {
+		t.Errorf("upstream received a query for %s", received.query.Questions[0].Name)
+	}
+}
+
+func TestExpandDNSURITemplate(t *testing.T) {
+	tests := []struct {
+		name      string
+		template  string
+		value     string
+		want      string
+		wantError error
+	}{
+		{name: "Template without value", template: "https://dns.example/dns-query{?dns}", value: "", want: "https://dns.example/dns-query"},
+		{name: "Template with value", template: "https://dns.example/dns-query{?dns}", value: "AAAB", want: "https://dns.example/dns-query?dns=AAAB"},
+		{name: "URL without template", template: "https://dns.example/dns-query", value: "AAAB", want: "https://dns.example/dns-query?dns=AAAB"},
+		{name: "URL with existing query", template: "https://dns.example/q?a=1{?dns}", value: "AAAB", want: "https://dns.example/q?a=1&dns=AAAB"},
+		{name: "Plain HTTP URL", template: "http://dns.example/dns-query", wantError: ErrInvalidHTTPSURL},
+		{name: "Unsupported template", template: "https://dns.example/{path}", wantError: ErrInvalidHTTPSURL},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := expandDNSURITemplate(tt.template, tt.value)
+
+			if tt.wantError != nil {
+				if !errors.Is(err, tt.wantError) {
+					t.Fatalf("expandDNSURITemplate() error = %v, want error = %v", err, tt.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expandDNSURITemplate() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("expandDNSURITemplate() got = %s, want = %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -139,3 +139,91 @@ func (message *Message) ContainsAdditionalSectionWithIPAddresses() bool {
 func (message *Message) ContainsAuthoritySection() bool {
 	return message.Header.NameserverRRCount > 0
 }
+
+// NewReply creates a response to the given request. The reply mirrors the
+// request's ID, opcode, RD and CD flags and question section. If the request
+// carries an EDNS OPT record, the reply carries one with the same version
+// and UDP payload size.
+//
+// Parameters:
+//   - request: the request message to reply to
+//
+// Returns:
+//   - reply: the reply message with empty answer, authority and additional sections
+func NewReply(request Message) (reply Message) {
+	reply = Message{
+		Header: Header{
+			Id: request.Header.Id,
+			Flags: Flags{
+				Response:         true,
+				Opcode:           request.Header.Flags.Opcode,
+				RecursionDesired: request.Header.Flags.RecursionDesired,
+				CheckingDisabled: request.Header.Flags.CheckingDisabled,
+			},
+		},
+		Questions: append([]Question{}, request.Questions...),
+	}
+
+	if edns, found := request.GetEDNS(); found {
+		reply.SetEDNS(EDNS{
+			UDPSize: edns.UDPSize,
+			Version: edns.Version,
+		})
+	}
+
+	reply.UpdateCounts()
+	return reply
+}
+
+// NewErrorReply creates a response to the given request with the given
+// response code, as with NewReply. Extended response codes (above 15)
+// are stored in the reply's EDNS OPT record.
+//
+// Parameters:
+//   - request: the request message to reply to
+//   - responseCode: the response code to set (SERVFAIL, FORMERR, etc.)
+//
+// Returns:
+//   - reply: the error reply message
+func NewErrorReply(request Message, responseCode uint16) (reply Message) {
+	reply = NewReply(request)
+	reply.SetResponseCode(responseCode)
+	return reply
+}
+
+// SetResponseCode sets the message's response code. The lower 4 bits go in
+// the header, and the upper 8 bits of extended response codes go in the
+// EDNS OPT record, which is added if missing.
+func (message *Message) SetResponseCode(responseCode uint16) {
+	message.Header.Flags.ResponseCode = responseCode & RCodeMask
+
+	edns, found := message.GetEDNS()
+	extendedRCode := uint8(responseCode >> 4)
+	if !found && extendedRCode == 0 {
+		return
+	}
+	if !found {
+		edns.UDPSize = DefaultEDNSUDPSize
+	}
+	edns.ExtendedRCode = extendedRCode
+	message.SetEDNS(edns)
+}
+
+// GetResponseCode returns the message's full response code, combining the
+// header's response code with the EDNS extended response code if present.
+func (message *Message) GetResponseCode() uint16 {
+	responseCode := message.Header.Flags.ResponseCode
+	if edns, found := message.GetEDNS(); found {
+		responseCode |= uint16(edns.ExtendedRCode) << 4
+	}
+	return responseCode
+}
+
+// UpdateCounts sets the header's section counts to match the number of
+// questions and records in each section of the message.
+func (message *Message) UpdateCounts() {
+	message.Header.QuestionCount = uint16(len(message.Questions))
+	message.Header.AnswerRRCount = uint16(len(message.Answers))
+	message.Header.NameserverRRCount = uint16(len(message.NameServers))
+	message.Header.AdditionalRRCount = uint16(len(message.Additionals))
+}
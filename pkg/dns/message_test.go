@@ -210,3 +210,82 @@ func TestEncodeDNSMessage(t *testing.T) {
 		t.Errorf("encodeDNSMessage() bytes\n\tgot = %v,\n\twant = %v\n", got, want)
 	}
 }
+
+func TestNewReply(t *testing.T) {
+	request := Message{
+		Header: Header{
+			Id: 1234,
+			Flags: Flags{
+				Opcode:           QUERY,
+				RecursionDesired: true,
+				CheckingDisabled: true,
+				Authoritative:    true,
+			},
+		},
+		Questions: []Question{
+			{Name: "example.com.", QType: A, QClass: IN},
+		},
+	}
+	request.SetEDNS(EDNS{UDPSize: 4096, Version: 0, DnssecOk: true})
+
+	tests := []struct {
+		name         string
+		responseCode uint16
+		wantRCode    uint16
+		wantExtended uint8
+	}{
+		{name: "NOERROR reply", responseCode: NOERROR, wantRCode: NOERROR, wantExtended: 0},
+		{name: "SERVFAIL reply", responseCode: SERVFAIL, wantRCode: SERVFAIL, wantExtended: 0},
+		{name: "Extended BADVERS reply", responseCode: BADVERS, wantRCode: 0, wantExtended: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply := NewErrorReply(request, tt.responseCode)
+
+			wantFlags := Flags{
+				Response:         true,
+				Opcode:           QUERY,
+				RecursionDesired: true,
+				CheckingDisabled: true,
+				ResponseCode:     tt.wantRCode,
+			}
+			if reply.Header.Id != request.Header.Id {
+				t.Errorf("NewErrorReply() ID got = %d, want = %d\n", reply.Header.Id, request.Header.Id)
+			}
+			if reply.Header.Flags != wantFlags {
+				t.Errorf("NewErrorReply() flags got = %+v, want = %+v\n", reply.Header.Flags, wantFlags)
+			}
+			if !reflect.DeepEqual(reply.Questions, request.Questions) {
+				t.Errorf("NewErrorReply() questions got = %v, want = %v\n", reply.Questions, request.Questions)
+			}
+			if reply.Header.QuestionCount != 1 || reply.Header.AdditionalRRCount != 1 {
+				t.Errorf("NewErrorReply() counts got = %+v\n", reply.Header)
+			}
+
+			edns, found := reply.GetEDNS()
+			if !found {
+				t.Fatalf("NewErrorReply() reply has no EDNS record")
+			}
+			if edns.UDPSize != 4096 || edns.Version != 0 || edns.ExtendedRCode != tt.wantExtended {
+				t.Errorf("NewErrorReply() EDNS got = %+v\n", edns)
+			}
+			if got := reply.GetResponseCode(); got != tt.responseCode {
+				t.Errorf("GetResponseCode() got = %d, want = %d\n", got, tt.responseCode)
+			}
+
+			// The reply must survive an encoding round trip
+			data, err := EncodeMessage(reply)
+			if err != nil {
+				t.Fatalf("EncodeMessage() error = %v\n", err)
+			}
+			decoded, err := DecodeMessage(data)
+			if err != nil {
+				t.Fatalf("DecodeMessage() error = %v\n", err)
+			}
+			if got := decoded.GetResponseCode(); got != tt.responseCode {
+				t.Errorf("decoded GetResponseCode() got = %d, want = %d\n", got, tt.responseCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,209 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// net.Resolver integration:
+// Go's own resolver (net.Resolver with PreferGo) calls its Dial function to
+// get a connection to a name server, writes its DNS queries to it and reads
+// the responses. Instead of dialing the name servers of /etc/resolv.conf,
+// the Dial function here returns an in-memory connection which answers each
+// query with this package: through a Transport, or directly with a Resolver.
+// Code which uses net.LookupHost, http.Client and the like gets the same
+// answers as this package's tools without changes, other than setting
+// net.DefaultResolver or a net.Dialer's Resolver.
+//
+// The in-memory connection is a stream connection, so Go frames its queries
+// with a length prefix as over TCP, whatever the network it asked for.
+
+// NewNetResolver returns a net.Resolver which sends every query to a server
+// with a transport, instead of the name servers of /etc/resolv.conf. Over
+// UDP, Go's retries of truncated responses go over TCP.
+//
+// Parameters:
+//   - transport: the transport to send queries with
+//   - transmissionProtocol: "udp", "tcp", "tls", "https" or "quic"
+//   - serverAddrPort: the address and port of the server to query (for HTTPS,
+//     an optional bootstrap address to connect to instead of the URL's host)
+//
+// Returns:
+//   - resolver: a net.Resolver which uses Go's resolver with the transport
+func NewNetResolver(transport *Transport, transmissionProtocol string, serverAddrPort netip.AddrPort) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network string, _ string) (net.Conn, error) {
+			protocol := transmissionProtocol
+			if protocol == "udp" && strings.HasPrefix(network, "tcp") {
+				protocol = "tcp"
+			}
+
+			query := func(ctx context.Context, dnsRequest []byte) ([]byte, error) {
+				return transport.QueryContext(ctx, protocol, serverAddrPort, dnsRequest)
+			}
+			remoteAddr := netResolverAddr{network: protocol, address: serverAddrPort.String()}
+			return newNetResolverConn(ctx, query, remoteAddr), nil
+		},
+	}
+}
+
+// NewInProcessNetResolver returns a net.Resolver which answers every query
+// with a recursive resolver's ResolveQuery, in the same process, without
+// sending the query over a socket.
+//
+// Parameters:
+//   - resolver: the recursive resolver to answer queries with
+//
+// Returns:
+//   - netResolver: a net.Resolver which uses Go's resolver with the recursive resolver
+func NewInProcessNetResolver(resolver *Resolver) (netResolver *net.Resolver) {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _ string, _ string) (net.Conn, error) {
+			query := func(_ context.Context, dnsRequest []byte) ([]byte, error) {
+				// Replies are read from memory, not from a UDP socket
+				return resolver.resolveQuery(dnsRequest, false)
+			}
+			remoteAddr := netResolverAddr{network: "dns", address: "in-process"}
+			return newNetResolverConn(ctx, query, remoteAddr), nil
+		},
+	}
+}
+
+// netResolverAddr is the address of a net.Resolver's in-memory connection.
+type netResolverAddr struct {
+	network string
+	address string
+}
+
+func (addr netResolverAddr) Network() string { return addr.network }
+func (addr netResolverAddr) String() string  { return addr.address }
+
+// netResolverConn is the in-memory connection returned by a net.Resolver's
+// Dial function. Each length prefixed query written to it is answered with
+// the query function when the response is read.
+type netResolverConn struct {
+	ctx        context.Context
+	query      func(ctx context.Context, dnsRequest []byte) ([]byte, error)
+	remoteAddr net.Addr
+
+	mutex     sync.Mutex
+	requests  bytes.Buffer
+	responses bytes.Buffer
+	deadline  time.Time
+	closed    bool
+}
+
+func newNetResolverConn(ctx context.Context, query func(context.Context, []byte) ([]byte, error), remoteAddr net.Addr) *netResolverConn {
+	return &netResolverConn{
+		ctx:        ctx,
+		query:      query,
+		remoteAddr: remoteAddr,
+	}
+}
+
+// Read reads the responses to the queries written so far, answering the
+// next query if there is no response left to read.
+func (conn *netResolverConn) Read(b []byte) (n int, err error) {
+	conn.mutex.Lock()
+	if conn.closed {
+		conn.mutex.Unlock()
+		return 0, net.ErrClosed
+	}
+	if conn.responses.Len() > 0 {
+		defer conn.mutex.Unlock()
+		return conn.responses.Read(b)
+	}
+
+	dnsRequest, found := conn.nextRequest()
+	deadline := conn.deadline
+	conn.mutex.Unlock()
+	if !found {
+		return 0, io.EOF
+	}
+
+	ctx := conn.ctx
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	response, err := conn.query(ctx, dnsRequest)
+	if err != nil {
+		return 0, &net.OpError{Op: "read", Net: conn.remoteAddr.Network(), Addr: conn.remoteAddr, Err: err}
+	}
+
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	binary.Write(&conn.responses, binary.BigEndian, uint16(len(response)))
+	conn.responses.Write(response)
+	return conn.responses.Read(b)
+}
+
+// nextRequest removes the next length prefixed query from the written data,
+// if it has been written in full.
+func (conn *netResolverConn) nextRequest() (dnsRequest []byte, found bool) {
+	written := conn.requests.Bytes()
+	if len(written) < 2 {
+		return nil, false
+	}
+	length := int(binary.BigEndian.Uint16(written))
+	if len(written) < 2+length {
+		return nil, false
+	}
+
+	dnsRequest = bytes.Clone(written[2 : 2+length])
+	conn.requests.Next(2 + length)
+	return dnsRequest, true
+}
+
+// Write adds length prefixed queries to be answered.
+func (conn *netResolverConn) Write(b []byte) (n int, err error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	if conn.closed {
+		return 0, net.ErrClosed
+	}
+	return conn.requests.Write(b)
+}
+
+func (conn *netResolverConn) Close() error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	conn.closed = true
+	return nil
+}
+
+func (conn *netResolverConn) LocalAddr() net.Addr {
+	return netResolverAddr{network: conn.remoteAddr.Network(), address: "local"}
+}
+
+func (conn *netResolverConn) RemoteAddr() net.Addr {
+	return conn.remoteAddr
+}
+
+func (conn *netResolverConn) SetDeadline(deadline time.Time) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	conn.deadline = deadline
+	return nil
+}
+
+func (conn *netResolverConn) SetReadDeadline(deadline time.Time) error {
+	return conn.SetDeadline(deadline)
+}
+
+func (conn *netResolverConn) SetWriteDeadline(deadline time.Time) error {
+	return nil
+}
@@ -0,0 +1,119 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewNetResolver(t *testing.T) {
+	zone := []ResourceRecord{
+		newResourceRecord("host.example.com.", A, 300, &RDataA{IP: netip.MustParseAddr("192.0.2.1")}),
+		newResourceRecord("host.example.com.", AAAA, 300, &RDataAAAA{IP: netip.MustParseAddr("2001:db8::1")}),
+		newResourceRecord("example.com.", MX, 300, &RDataMX{Preference: 10, DomainName: "host.example.com."}),
+	}
+	server := startTestZoneServer(t, zone)
+	resolver := NewNetResolver(&Transport{Timeout: time.Second}, "udp", server)
+	ctx := context.Background()
+
+	addrs, err := resolver.LookupNetIP(ctx, "ip", "host.example.com.")
+	if err != nil {
+		t.Fatalf("LookupNetIP() error = %v", err)
+	}
+	slices.SortFunc(addrs, func(a, b netip.Addr) int { return a.Compare(b) })
+	if want := []netip.Addr{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1")}; !slices.Equal(addrs, want) {
+		t.Errorf("LookupNetIP() got = %v, want = %v", addrs, want)
+	}
+
+	mxs, err := resolver.LookupMX(ctx, "example.com.")
+	if err != nil {
+		t.Fatalf("LookupMX() error = %v", err)
+	}
+	if len(mxs) != 1 || mxs[0].Host != "host.example.com." || mxs[0].Pref != 10 {
+		t.Errorf("LookupMX() got = %v, want host.example.com. with preference 10", mxs)
+	}
+
+	_, err = resolver.LookupNetIP(ctx, "ip", "missing.example.com.")
+	var dnsError *net.DNSError
+	if !errors.As(err, &dnsError) || !dnsError.IsNotFound {
+		t.Errorf("LookupNetIP() error = %v, want not found", err)
+	}
+}
+
+func TestNewInProcessNetResolver(t *testing.T) {
+	resolver, err := NewResolver("")
+	if err != nil {
+		t.Fatalf("NewResolver() error = %v", err)
+	}
+
+	var queriedServers int
+	resolver.QueryFunc = func(_ string, _ netip.AddrPort, dnsRequest []byte) ([]byte, error) {
+		queriedServers++
+		request, err := DecodeMessage(dnsRequest)
+		if err != nil {
+			return nil, err
+		}
+
+		reply := NewReply(request)
+		reply.Header.Flags.Authoritative = true
+		if request.Questions[0].QType == A && strings.EqualFold(request.Questions[0].Name, "host.example.com.") {
+			reply.Answers = []ResourceRecord{
+				newResourceRecord(request.Questions[0].Name, A, 300, &RDataA{IP: netip.MustParseAddr("192.0.2.1")}),
+			}
+		}
+		reply.UpdateCounts()
+		return EncodeMessage(reply)
+	}
+
+	addrs, err := NewInProcessNetResolver(resolver).LookupNetIP(context.Background(), "ip4", "host.example.com.")
+	if err != nil {
+		t.Fatalf("LookupNetIP() error = %v", err)
+	}
+	if want := []netip.Addr{netip.MustParseAddr("192.0.2.1")}; !slices.Equal(addrs, want) {
+		t.Errorf("LookupNetIP() got = %v, want = %v", addrs, want)
+	}
+	if queriedServers != 1 {
+		t.Errorf("resolver queried %d servers, want 1", queriedServers)
+	}
+}
+
+func TestNetResolverConn(t *testing.T) {
+	var queries [][]byte
+	conn := newNetResolverConn(context.Background(), func(_ context.Context, dnsRequest []byte) ([]byte, error) {
+		queries = append(queries, dnsRequest)
+		return append([]byte("response to "), dnsRequest...), nil
+	}, netResolverAddr{network: "udp", address: "192.0.2.53:53"})
+
+	// A query written in several parts, followed by a second query
+	conn.Write([]byte{0, 3, 'o'})
+	conn.Write([]byte{'n', 'e', 0, 3, 't', 'w', 'o'})
+
+	for _, want := range []string{"response to one", "response to two"} {
+		buffer := make([]byte, 2+len(want))
+		if _, err := conn.Read(buffer[:2]); err != nil {
+			t.Fatalf("Read() error = %v", err)
+		}
+		if _, err := conn.Read(buffer[2:]); err != nil {
+			t.Fatalf("Read() error = %v", err)
+		}
+		if length := int(buffer[0])<<8 | int(buffer[1]); length != len(want) || string(buffer[2:]) != want {
+			t.Errorf("Read() got %d bytes %q, want %d bytes %q", length, buffer[2:], len(want), want)
+		}
+	}
+	if len(queries) != 2 {
+		t.Errorf("conn sent %d queries, want 2", len(queries))
+	}
+
+	if _, err := conn.Read(make([]byte, 2)); err == nil {
+		t.Errorf("Read() without a query expected error")
+	}
+	conn.Close()
+	if _, err := conn.Write([]byte{0, 1, 'x'}); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Write() after Close() error = %v, want %v", err, net.ErrClosed)
+	}
+}
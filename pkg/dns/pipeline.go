@@ -0,0 +1,360 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Connection reuse and pipelining (RFC 7766 section 6.2):
+// TCP and TLS connections are kept open per server and shared by all queries
+// to that server. Several queries can be in flight on a connection at once:
+// each is sent with an ID that is unique on the connection, and responses,
+// which may arrive in any order, are matched to their query by that ID.
+//
+// A connection is closed once it has been idle for the transport's idle
+// timeout, or for the timeout the server advertises in its responses with the
+// edns-tcp-keepalive option (RFC 7828). Queries carry that option to ask the
+// server to keep the connection open.
+
+const DefaultIdleTimeout = 10 * time.Second
+
+// keepaliveTimeoutUnit is the unit of the edns-tcp-keepalive TIMEOUT field
+const keepaliveTimeoutUnit = 100 * time.Millisecond
+
+var errIdleConnClosed = errors.New("idle connection closed")
+
+type streamConnKey struct {
+	transmissionProtocol string
+	serverAddrPort       netip.AddrPort
+}
+
+type pipelinedResponse struct {
+	message []byte
+	err     error
+}
+
+// pipelinedConn is a TCP or TLS connection shared by concurrent queries.
+type pipelinedConn struct {
+	// ready is closed once the connection is established, or dialErr is set
+	ready      chan struct{}
+	dialErr    error
+	conn       net.Conn
+	writeMutex sync.Mutex
+
+	mutex       sync.Mutex
+	pending     map[uint16]chan pipelinedResponse
+	nextID      uint16
+	idleTimeout time.Duration
+	idleTimer   *time.Timer
+	err         error // set once the connection is closed
+
+	// onClose is called once the connection is closed
+	onClose func()
+}
+
+// exchangePipelined sends a DNS request over a shared TCP or TLS connection
+// to the server, opening one if there is none.
+func (transport *Transport) exchangePipelined(ctx context.Context, transmissionProtocol string, serverAddrPort netip.AddrPort, dnsRequest []byte) (response []byte, err error) {
+	request, err := addTCPKeepalive(dnsRequest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DNS request: %w", err)
+	}
+	if transmissionProtocol == "tls" {
+		request, err = padQuery(request)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DNS request: %w", err)
+		}
+	}
+
+	key := streamConnKey{transmissionProtocol: transmissionProtocol, serverAddrPort: serverAddrPort}
+
+	conn, reused, err := transport.getPipelinedConn(ctx, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err = conn.exchange(ctx, request)
+	if err == nil || !reused || ctx.Err() != nil {
+		return response, err
+	}
+
+	// The server may have closed the connection since it was opened, in
+	// which case we start over with a new connection.
+	conn, _, err = transport.getPipelinedConn(ctx, key, conn)
+	if err != nil {
+		return nil, err
+	}
+	return conn.exchange(ctx, request)
+}
+
+// getPipelinedConn returns the open connection to the server, or opens a new
+// one if there is none or if it is the given failed connection. Concurrent
+// queries wait for the same new connection instead of each opening their own.
+func (transport *Transport) getPipelinedConn(ctx context.Context, key streamConnKey, failed *pipelinedConn) (conn *pipelinedConn, reused bool, err error) {
+	transport.mutex.Lock()
+	conn = transport.streamConns[key]
+	if conn != nil && conn != failed {
+		transport.mutex.Unlock()
+
+		select {
+		case <-conn.ready:
+		case <-ctx.Done():
+			return nil, false, fmt.Errorf("DNS query cancelled: %w", ctx.Err())
+		}
+		if conn.dialErr != nil {
+			return nil, false, conn.dialErr
+		}
+		return conn, true, nil
+	}
+
+	idleTimeout := transport.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultIdleTimeout
+	}
+	conn = &pipelinedConn{
+		ready:       make(chan struct{}),
+		pending:     make(map[uint16]chan pipelinedResponse),
+		nextID:      uint16(rand.N(1 << 16)),
+		idleTimeout: idleTimeout,
+	}
+	conn.onClose = func() {
+		transport.removePipelinedConn(key, conn)
+	}
+	if transport.streamConns == nil {
+		transport.streamConns = make(map[streamConnKey]*pipelinedConn)
+	}
+	transport.streamConns[key] = conn
+	transport.mutex.Unlock()
+
+	if failed != nil {
+		failed.closeWhenIdle()
+	}
+
+	conn.conn, conn.dialErr = transport.dialStream(ctx, key)
+	close(conn.ready)
+	if conn.dialErr != nil {
+		transport.removePipelinedConn(key, conn)
+		return nil, false, conn.dialErr
+	}
+
+	go conn.readResponses()
+	return conn, false, nil
+}
+
+func (transport *Transport) removePipelinedConn(key streamConnKey, conn *pipelinedConn) {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+
+	if transport.streamConns[key] == conn {
+		delete(transport.streamConns, key)
+	}
+}
+
+func (transport *Transport) dialStream(ctx context.Context, key streamConnKey) (conn net.Conn, err error) {
+	if key.transmissionProtocol == "tls" {
+		return transport.dialTLS(ctx, key.serverAddrPort)
+	}
+
+	conn, err = transport.dial(ctx, key.transmissionProtocol, key.serverAddrPort)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to DNS server: %w", err)
+	}
+	return conn, nil
+}
+
+// exchange sends a request on the connection and waits for the response with
+// the same ID. The request is sent with an ID that no other pending query on
+// the connection uses, and the response is given back the original ID.
+func (conn *pipelinedConn) exchange(ctx context.Context, dnsRequest []byte) (response []byte, err error) {
+	responses := make(chan pipelinedResponse, 1)
+
+	conn.mutex.Lock()
+	if conn.err != nil {
+		conn.mutex.Unlock()
+		return nil, conn.err
+	}
+	id := conn.nextID
+	for _, found := conn.pending[id]; found; _, found = conn.pending[id] {
+		id++
+	}
+	conn.nextID = id + 1
+	conn.pending[id] = responses
+	if conn.idleTimer != nil {
+		conn.idleTimer.Stop()
+	}
+	conn.mutex.Unlock()
+	defer conn.release(id)
+
+	request := make([]byte, len(dnsRequest))
+	copy(request, dnsRequest)
+	request[0], request[1] = byte(id>>8), byte(id)
+
+	err = conn.write(ctx, request)
+	if err != nil {
+		conn.close(err)
+		return nil, err
+	}
+
+	select {
+	case result := <-responses:
+		if result.err != nil {
+			return nil, result.err
+		}
+		return restoreMessageID(result.message, dnsRequest), nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("DNS query cancelled: %w", ctx.Err())
+	}
+}
+
+// write sends a request within the context's deadline. Writes are serialized
+// so that messages are not interleaved on the connection.
+func (conn *pipelinedConn) write(ctx context.Context, request []byte) error {
+	conn.writeMutex.Lock()
+	defer conn.writeMutex.Unlock()
+
+	deadline, _ := ctx.Deadline()
+	conn.conn.SetWriteDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() {
+		conn.conn.SetWriteDeadline(time.Now())
+	})
+	defer stop()
+
+	return writeTCPMessage(conn.conn, request)
+}
+
+// readResponses hands each response to the query with the same ID until the
+// connection is closed. Responses to queries that were cancelled are dropped.
+func (conn *pipelinedConn) readResponses() {
+	for {
+		message, err := readTCPMessage(conn.conn)
+		if err != nil {
+			conn.close(err)
+			return
+		}
+		id := uint16(message[0])<<8 | uint16(message[1])
+
+		conn.mutex.Lock()
+		responses, found := conn.pending[id]
+		delete(conn.pending, id)
+		if found {
+			if timeout, ok := getTCPKeepaliveTimeout(message); ok {
+				conn.idleTimeout = timeout
+			}
+		}
+		conn.mutex.Unlock()
+
+		if found {
+			responses <- pipelinedResponse{message: message}
+		}
+	}
+}
+
+// release forgets a query once it is answered or cancelled, and starts the
+// idle timer if it was the last one pending.
+func (conn *pipelinedConn) release(id uint16) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	delete(conn.pending, id)
+	if conn.err != nil || len(conn.pending) > 0 {
+		return
+	}
+	if conn.idleTimer != nil {
+		conn.idleTimer.Stop()
+	}
+	conn.idleTimer = time.AfterFunc(conn.idleTimeout, conn.closeWhenIdle)
+}
+
+// closeWhenIdle closes the connection if no query is pending on it.
+func (conn *pipelinedConn) closeWhenIdle() {
+	select {
+	case <-conn.ready:
+		if conn.dialErr != nil {
+			return
+		}
+	default:
+		// Still connecting: about to be used
+		return
+	}
+
+	conn.mutex.Lock()
+	idle := len(conn.pending) == 0
+	conn.mutex.Unlock()
+
+	if idle {
+		conn.close(errIdleConnClosed)
+	}
+}
+
+// close closes the connection and fails every pending query.
+func (conn *pipelinedConn) close(err error) {
+	conn.mutex.Lock()
+	if conn.err != nil {
+		conn.mutex.Unlock()
+		return
+	}
+	conn.err = fmt.Errorf("DNS server connection closed: %w", err)
+	for id, responses := range conn.pending {
+		responses <- pipelinedResponse{err: conn.err}
+		delete(conn.pending, id)
+	}
+	if conn.idleTimer != nil {
+		conn.idleTimer.Stop()
+	}
+	conn.mutex.Unlock()
+
+	conn.conn.Close()
+	conn.onClose()
+}
+
+// addTCPKeepalive adds an empty edns-tcp-keepalive option to an encoded
+// query, adding an OPT record if there isn't one (RFC 7828 section 3.2.1).
+func addTCPKeepalive(dnsRequest []byte) (request []byte, err error) {
+	message, err := DecodeMessage(dnsRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	edns, found := message.GetEDNS()
+	if !found {
+		edns = EDNS{UDPSize: DefaultEDNSUDPSize}
+	}
+	for _, option := range edns.Options {
+		if option.Code == EDNSOptionTCPKeepalive {
+			return dnsRequest, nil
+		}
+	}
+	edns.Options = append(edns.Options, EDNSOption{Code: EDNSOptionTCPKeepalive})
+
+	message.SetEDNS(edns)
+	return EncodeMessage(message)
+}
+
+// getTCPKeepaliveTimeout returns the idle timeout a server advertises in a
+// response's edns-tcp-keepalive option, if any.
+func getTCPKeepaliveTimeout(response []byte) (timeout time.Duration, found bool) {
+	// Skip decoding responses without additional records
+	if len(response) < DNSHeaderLength || response[10] == 0 && response[11] == 0 {
+		return 0, false
+	}
+
+	message, err := DecodeMessage(response)
+	if err != nil {
+		return 0, false
+	}
+	edns, found := message.GetEDNS()
+	if !found {
+		return 0, false
+	}
+	for _, option := range edns.Options {
+		if option.Code == EDNSOptionTCPKeepalive && len(option.Data) == 2 {
+			return time.Duration(uint16(option.Data[0])<<8|uint16(option.Data[1])) * keepaliveTimeoutUnit, true
+		}
+	}
+	return 0, false
+}
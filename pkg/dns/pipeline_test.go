@@ -0,0 +1,229 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testPipelineServer struct {
+	addrPort          netip.AddrPort
+	connections       atomic.Int32
+	keepaliveRequests atomic.Int32
+}
+
+// startTestPipelineServer starts a local TCP server which reads batchSize
+// queries at a time on a connection and answers them in reverse order. If
+// keepaliveTimeout is set, responses advertise it in an edns-tcp-keepalive
+// option. The server closes a connection after maxQueries queries.
+func startTestPipelineServer(t *testing.T, batchSize int, keepaliveTimeout []byte, maxQueries int) *testPipelineServer {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start test TCP server: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	server := &testPipelineServer{addrPort: listener.Addr().(*net.TCPAddr).AddrPort()}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server.connections.Add(1)
+
+			go func() {
+				defer conn.Close()
+				for queries := 0; queries < maxQueries; queries += batchSize {
+					var replies [][]byte
+					for i := 0; i < batchSize; i++ {
+						request, err := readTCPMessage(conn)
+						if err != nil {
+							return
+						}
+						replies = append(replies, server.createReply(t, request, keepaliveTimeout))
+					}
+					for i := len(replies) - 1; i >= 0; i-- {
+						writeTCPMessage(conn, replies[i])
+					}
+				}
+			}()
+		}
+	}()
+
+	return server
+}
+
+func (server *testPipelineServer) createReply(t *testing.T, request []byte, keepaliveTimeout []byte) []byte {
+	query, err := DecodeMessage(request)
+	if err != nil {
+		t.Errorf("failed to decode test request: %v", err)
+		return nil
+	}
+	if edns, found := query.GetEDNS(); found {
+		for _, option := range edns.Options {
+			if option.Code == EDNSOptionTCPKeepalive {
+				server.keepaliveRequests.Add(1)
+			}
+		}
+	}
+
+	reply := NewReply(query)
+	if keepaliveTimeout != nil {
+		reply.SetEDNS(EDNS{UDPSize: DefaultEDNSUDPSize, Options: []EDNSOption{{Code: EDNSOptionTCPKeepalive, Data: keepaliveTimeout}}})
+	}
+	response, err := EncodeMessage(reply)
+	if err != nil {
+		t.Errorf("failed to encode test reply: %v", err)
+	}
+	return response
+}
+
+func TestTransportQueryTCPPipelining(t *testing.T) {
+	names := []string{"a.example.com.", "b.example.com.", "c.example.com."}
+	server := startTestPipelineServer(t, len(names), nil, len(names))
+	transport := &Transport{Timeout: time.Second}
+	defer transport.CloseIdleConnections()
+
+	sharedID, _ := CreateQuery("example.com.", A)
+
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// Every query has the same ID: the transport must tell them apart
+			request, _ := CreateQuery(name, A)
+			request[0], request[1] = sharedID[0], sharedID[1]
+
+			got, err := transport.Query("tcp", server.addrPort, request)
+			if err != nil {
+				t.Errorf("Query(%s) error = %v", name, err)
+				return
+			}
+			response, err := DecodeMessage(got)
+			if err != nil {
+				t.Errorf("Query(%s) response cannot be decoded: %v", name, err)
+				return
+			}
+			if !bytes.Equal(got[:2], request[:2]) || response.Questions[0].Name != name {
+				t.Errorf("Query(%s) got response for %s with ID %d", name, response.Questions[0].Name, response.Header.Id)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := server.connections.Load(); got != 1 {
+		t.Errorf("server accepted %d connections, want 1", got)
+	}
+	if got := server.keepaliveRequests.Load(); got != int32(len(names)) {
+		t.Errorf("server received %d queries with edns-tcp-keepalive, want %d", got, len(names))
+	}
+}
+
+func TestTransportQueryTCPReuse(t *testing.T) {
+	tests := []struct {
+		name             string
+		transport        *Transport
+		keepaliveTimeout []byte
+		maxQueries       int
+		wait             time.Duration
+		wantConnections  int32
+	}{
+		{
+			name:            "Connection reused",
+			transport:       &Transport{Timeout: time.Second},
+			maxQueries:      10,
+			wantConnections: 1,
+		},
+		{
+			name:            "Connection closed by server",
+			transport:       &Transport{Timeout: time.Second},
+			maxQueries:      1,
+			wantConnections: 3,
+		},
+		{
+			name:            "Idle connection reaped",
+			transport:       &Transport{Timeout: time.Second, IdleTimeout: 20 * time.Millisecond},
+			maxQueries:      10,
+			wait:            100 * time.Millisecond,
+			wantConnections: 3,
+		},
+		{
+			name:             "Server keepalive timeout",
+			transport:        &Transport{Timeout: time.Second, IdleTimeout: time.Minute},
+			keepaliveTimeout: []byte{0, 1}, // 100ms
+			maxQueries:       10,
+			wait:             300 * time.Millisecond,
+			wantConnections:  3,
+		},
+		{
+			name:             "Server asks to close the connection",
+			transport:        &Transport{Timeout: time.Second},
+			keepaliveTimeout: []byte{0, 0},
+			maxQueries:       10,
+			wait:             10 * time.Millisecond,
+			wantConnections:  3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := startTestPipelineServer(t, 1, tt.keepaliveTimeout, tt.maxQueries)
+			defer tt.transport.CloseIdleConnections()
+
+			for i := 0; i < 3; i++ {
+				request, _ := CreateQuery("example.com.", A)
+				got, err := tt.transport.Query("tcp", server.addrPort, request)
+				if err != nil {
+					t.Fatalf("Query() %d error = %v", i, err)
+				}
+				if !bytes.Equal(got[:2], request[:2]) {
+					t.Errorf("Query() %d response ID does not match query ID", i)
+				}
+				time.Sleep(tt.wait)
+			}
+
+			if got := server.connections.Load(); got != tt.wantConnections {
+				t.Errorf("server accepted %d connections, want %d", got, tt.wantConnections)
+			}
+		})
+	}
+}
+
+func TestTransportQueryTCPCancelledQuery(t *testing.T) {
+	// The server never answers a lone query
+	server := startTestPipelineServer(t, 2, nil, 10)
+	transport := &Transport{}
+	defer transport.CloseIdleConnections()
+
+	request, _ := CreateQuery("example.com.", A)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, err := transport.QueryContext(ctx, "tcp", server.addrPort, request); err == nil {
+		t.Fatalf("QueryContext() expected error")
+	}
+
+	// The late response to the cancelled query is dropped, and the
+	// connection still serves the next query
+	got, err := transport.Query("tcp", server.addrPort, request)
+	if err != nil {
+		t.Fatalf("Query() error = %v", err)
+	}
+	if !bytes.Equal(got[:2], request[:2]) {
+		t.Errorf("Query() response ID does not match query ID")
+	}
+	if got := server.connections.Load(); got != 1 {
+		t.Errorf("server accepted %d connections, want 1", got)
+	}
+}
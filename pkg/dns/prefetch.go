@@ -0,0 +1,72 @@
+package dns
+
+import (
+	"log"
+	"time"
+)
+
+// Cache prefetch:
+// When a popular RRset expires, the next client to ask for it waits for a
+// whole resolution. To avoid this, lookups count the hits of each cached
+// RRset, and a lookup which finds a popular RRset within the last fraction
+// of its TTL refreshes it in the background, while answering from the cache.
+// The refreshed RRset replaces the cached one, with its hits counted anew.
+// Glue is never prefetched: it is only refreshed by the referrals it comes
+// from.
+
+// DefaultPrefetchFraction is a suggested fraction of its TTL left at which a
+// popular RRset is prefetched.
+const DefaultPrefetchFraction = 0.1
+
+// DefaultPrefetchHits is the default number of lookups which make a cached
+// RRset popular enough to prefetch.
+const DefaultPrefetchHits = 10
+
+// shouldPrefetch reports whether a cached RRset, found by a lookup with the
+// given hits, is popular and close enough to expiring to be prefetched.
+func (resolver *Resolver) shouldPrefetch(cached CachedRRset, hits uint32) bool {
+	if resolver.PrefetchFraction <= 0 || cached.Credibility < CredibilityNonAuthoritativeAnswer {
+		return false
+	}
+
+	minHits := resolver.PrefetchHits
+	if minHits == 0 {
+		minHits = DefaultPrefetchHits
+	}
+	if hits < minHits {
+		return false
+	}
+
+	window := time.Duration(float64(cached.TTL) * resolver.PrefetchFraction)
+	return time.Until(cached.ExpiresAt) <= window
+}
+
+// prefetch refreshes a cached RRset in the background by querying servers
+// from a root server, unless it is already being refreshed. The response is
+// cached by queryServers.
+func (resolver *Resolver) prefetch(key cacheKey) {
+	if key.rClass != IN || len(resolver.RootServers) == 0 {
+		return
+	}
+	if _, inFlight := resolver.prefetching.LoadOrStore(key, struct{}{}); inFlight {
+		return
+	}
+
+	go func() {
+		defer resolver.prefetching.Delete(key)
+
+		dnsRequest, err := CreateQuery(key.name, key.rType)
+		if err != nil {
+			log.Printf("Prefetch: failed to create query for %s: %v", key.name, err)
+			return
+		}
+
+		log.Printf("--> Prefetching %s %s", key.name, DNSType(key.rType))
+		_, err = resolver.queryServers([]Server{resolver.GetNextRootServer()}, ".", dnsRequest, key.name, 0)
+		if err != nil {
+			log.Printf("Prefetch: failed to refresh %s %s: %v", key.name, DNSType(key.rType), err)
+			return
+		}
+		resolver.prefetches.Add(1)
+	}()
+}
@@ -0,0 +1,98 @@
+package dns
+
+import (
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestResolverPrefetch(t *testing.T) {
+	resolver, err := NewResolver("")
+	if err != nil {
+		t.Fatalf("NewResolver() error = %v", err)
+	}
+	resolver.PrefetchFraction = 0.1
+	resolver.PrefetchHits = 3
+
+	var queriedServers atomic.Int32
+	resolver.QueryFunc = func(_ string, _ netip.AddrPort, dnsRequest []byte) ([]byte, error) {
+		queriedServers.Add(1)
+		request, err := DecodeMessage(dnsRequest)
+		if err != nil {
+			return nil, err
+		}
+		reply := NewReply(request)
+		reply.Header.Flags.Authoritative = true
+		reply.Answers = []ResourceRecord{newResourceRecord(request.Questions[0].Name, A, 300, &RDataA{IP: netip.MustParseAddr("192.0.2.2")})}
+		reply.UpdateCounts()
+		return EncodeMessage(reply)
+	}
+
+	cachedAddress := func(name string) string {
+		records, found := resolver.getCachedRRset(name, A, IN, CredibilityNonAuthoritativeAnswer)
+		if !found {
+			return ""
+		}
+		return records[0].RData.String()
+	}
+
+	for _, name := range []string{"popular.example.com.", "unpopular.example.com."} {
+		resolver.cacheRRsets([]ResourceRecord{newResourceRecord(name, A, 300, &RDataA{IP: netip.MustParseAddr("192.0.2.1")})}, CredibilityAuthoritativeAnswer)
+	}
+	resolver.cacheGlue([]ResourceRecord{newResourceRecord("glue.example.com.", A, 300, &RDataA{IP: netip.MustParseAddr("192.0.2.1")})})
+
+	// Prefetches start before getCachedRRset returns
+	prefetching := func(name string) bool {
+		_, found := resolver.prefetching.Load(rrsetCacheKey(name, A, IN))
+		return found
+	}
+
+	// Popular, but far from expiring
+	for range 5 {
+		cachedAddress("popular.example.com.")
+	}
+	if prefetching("popular.example.com.") {
+		t.Fatalf("RRset far from expiring is prefetched")
+	}
+
+	// Close to expiring, but not popular
+	setCacheExpiry(resolver, rrsetCacheKey("unpopular.example.com.", A, IN), time.Now().Add(10*time.Second))
+	cachedAddress("unpopular.example.com.")
+	if prefetching("unpopular.example.com.") {
+		t.Fatalf("unpopular RRset is prefetched")
+	}
+
+	// Glue is never prefetched
+	setCacheExpiry(resolver, rrsetCacheKey("glue.example.com.", A, IN), time.Now().Add(10*time.Second))
+	for range 5 {
+		resolver.getCachedRRset("glue.example.com.", A, IN, CredibilityAdditional)
+	}
+	if prefetching("glue.example.com.") {
+		t.Fatalf("glue is prefetched")
+	}
+
+	// Popular and close to expiring: the cached RRset is returned, and
+	// refreshed in the background
+	setCacheExpiry(resolver, rrsetCacheKey("popular.example.com.", A, IN), time.Now().Add(10*time.Second))
+	if ip := cachedAddress("popular.example.com."); ip != "192.0.2.1" {
+		t.Errorf("getCachedRRset() got = %s, want the cached address while prefetching", ip)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for cachedAddress("popular.example.com.") != "192.0.2.2" {
+		if time.Now().After(deadline) {
+			t.Fatalf("popular RRset was not prefetched")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if queries := queriedServers.Load(); queries != 1 {
+		t.Errorf("prefetch queried servers %d times, want 1", queries)
+	}
+	if stats := resolver.CacheStats(); stats.Prefetches != 1 {
+		t.Errorf("CacheStats() prefetches = %d, want 1", stats.Prefetches)
+	}
+	if records, _ := resolver.getCachedRRset("popular.example.com.", A, IN, CredibilityNonAuthoritativeAnswer); records[0].TTL != 300 {
+		t.Errorf("prefetched RRset TTL = %d, want 300", records[0].TTL)
+	}
+}
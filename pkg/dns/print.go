@@ -2,12 +2,62 @@ package dns
 
 import (
 	"fmt"
+	"io"
 	"net/netip"
+	"os"
+	"strconv"
 	"strings"
 	"time"
 )
 
-// PrintQueryInfo prints information about a DNS query.
+// Printer writes DNS messages and query information in a dig-like format
+// to any io.Writer.
+//
+// The zero value is not usable: create a Printer with NewPrinter, then
+// adjust its options before printing.
+type Printer struct {
+	Writer io.Writer
+
+	// Short only prints the RDATA of the answer section, like dig +short.
+	Short bool
+	// Multiline prints SOA records over several commented lines, like dig
+	// +multiline. Other records, DNSSEC records included, are printed on one
+	// line: their data isn't decoded.
+	Multiline bool
+	// TTLUnits prints TTLs as relative durations (1h30m) instead of
+	// seconds, like dig +ttlunits.
+	TTLUnits bool
+
+	// Section toggles, like dig +[no]question, +[no]answer, etc.
+	ShowHeader     bool
+	ShowQuestion   bool
+	ShowAnswer     bool
+	ShowAuthority  bool
+	ShowAdditional bool
+	ShowStats      bool
+}
+
+// NewPrinter creates a printer that writes to the given writer in full
+// dig style, with every section enabled.
+//
+// Parameters:
+//   - writer: The writer to print to (os.Stdout, a bytes.Buffer, etc.).
+//
+// Returns:
+//   - *Printer: The new printer.
+func NewPrinter(writer io.Writer) *Printer {
+	return &Printer{
+		Writer:         writer,
+		ShowHeader:     true,
+		ShowQuestion:   true,
+		ShowAnswer:     true,
+		ShowAuthority:  true,
+		ShowAdditional: true,
+		ShowStats:      true,
+	}
+}
+
+// PrintQueryInfo prints information about a DNS query to stdout.
 //
 // Parameters:
 //   - dnsServer: The DNS server the query is sent to.
@@ -15,64 +65,118 @@ import (
 //   - tcpQuery: Indicates if the query was over TCP (true) or UDP (false).
 //   - messageLength: The length of the message.
 func PrintQueryInfo(dnsServer netip.AddrPort, queryTime time.Duration, tcpQuery bool, messageLength int) {
-	fmt.Printf("\n;; Query time: %v\n", queryTime)
-	fmt.Printf(";; SERVER: %s ", dnsServer.String())
-	if tcpQuery {
-		fmt.Printf("(TCP)\n")
-	} else {
-		fmt.Printf("(UDP)\n")
-	}
-	fmt.Println(";; WHEN:", time.Now().Format(time.RFC1123))
-	fmt.Println(";; MSG SIZE recvd:", messageLength)
+	NewPrinter(os.Stdout).PrintQueryInfo(dnsServer, queryTime, tcpQuery, messageLength)
 }
 
-// PrintBasicQueryInfo prints the basic query information.
+// PrintBasicQueryInfo prints the basic query information to stdout.
 //
 // Parameters:
 //   - domainName: The domain name being queried.
 //   - questionType: The type of DNS query.
 func PrintBasicQueryInfo(domainName string, questionType uint16) {
-	fmt.Printf("; <<>> DNSTool <<>> %s %s\n", domainName, DNSType(questionType))
+	NewPrinter(os.Stdout).PrintBasicQueryInfo(domainName, questionType)
 }
 
-// PrintMessage prints the details of a DNS message.
+// PrintMessage prints the details of a DNS message to stdout.
 //
 // Parameters:
-//   - message: A pointer to the Message structure to print.
+//   - message: The Message structure to print.
 func PrintMessage(message Message) {
-	fmt.Println(";; Got answer:")
+	NewPrinter(os.Stdout).PrintMessage(message)
+}
 
-	printHeader(message.Header)
+// PrintQueryInfo prints information about a DNS query. Nothing is printed
+// in short mode or if stats are disabled.
+//
+// Parameters:
+//   - dnsServer: The DNS server the query is sent to.
+//   - queryTime: The duration of the query.
+//   - tcpQuery: Indicates if the query was over TCP (true) or UDP (false).
+//   - messageLength: The length of the message.
+func (printer *Printer) PrintQueryInfo(dnsServer netip.AddrPort, queryTime time.Duration, tcpQuery bool, messageLength int) {
+	protocol := "UDP"
+	if tcpQuery {
+		protocol = "TCP"
+	}
+	printer.PrintQueryStats(dnsServer.String(), protocol, queryTime, messageLength)
+}
 
-	if message.Header.QuestionCount > 0 {
-		printQuestions(message.Questions)
+// PrintQueryStats prints information about a DNS query sent over any
+// protocol. Nothing is printed in short mode or if stats are disabled.
+//
+// Parameters:
+//   - server: The DNS server the query is sent to (address or URL).
+//   - protocol: The protocol the query was sent over (UDP, TCP, TLS, etc.).
+//   - queryTime: The duration of the query.
+//   - messageLength: The length of the message.
+func (printer *Printer) PrintQueryStats(server string, protocol string, queryTime time.Duration, messageLength int) {
+	if printer.Short || !printer.ShowStats {
+		return
 	}
 
-	if message.Header.AnswerRRCount > 0 {
-		printResourceRecord(message.Answers, "Answer")
+	fmt.Fprintf(printer.Writer, "\n;; Query time: %v\n", queryTime)
+	fmt.Fprintf(printer.Writer, ";; SERVER: %s (%s)\n", server, protocol)
+	fmt.Fprintln(printer.Writer, ";; WHEN:", time.Now().Format(time.RFC1123))
+	fmt.Fprintln(printer.Writer, ";; MSG SIZE recvd:", messageLength)
+}
+
+// PrintBasicQueryInfo prints the basic query information. Nothing is printed
+// in short mode or if the header is disabled.
+//
+// Parameters:
+//   - domainName: The domain name being queried.
+//   - questionType: The type of DNS query.
+func (printer *Printer) PrintBasicQueryInfo(domainName string, questionType uint16) {
+	if printer.Short || !printer.ShowHeader {
+		return
 	}
+	fmt.Fprintf(printer.Writer, "; <<>> DNSTool <<>> %s %s\n", domainName, DNSType(questionType))
+}
 
-	if message.Header.NameserverRRCount > 0 {
-		printResourceRecord(message.NameServers, "Authority")
+// PrintMessage prints the details of a DNS message according to the
+// printer's options.
+//
+// Parameters:
+//   - message: The Message structure to print.
+func (printer *Printer) PrintMessage(message Message) {
+	if printer.Short {
+		printer.printShortAnswers(message.Answers)
+		return
 	}
 
-	if message.Header.AdditionalRRCount > 0 {
-		printResourceRecord(message.Additionals, "Additional")
+	if printer.ShowHeader {
+		fmt.Fprintln(printer.Writer, ";; Got answer:")
+		printer.printHeader(message.Header)
 	}
-}
 
-func printHeader(header Header) {
+	if printer.ShowQuestion && message.Header.QuestionCount > 0 {
+		printer.printQuestions(message.Questions)
+	}
 
-	fmt.Printf(";; ->>HEADER<<- ")
-	fmt.Printf("opcode: %s, ", DNSOpCode(header.Flags.Opcode))
-	fmt.Printf("status: %s, ", DNSRCode(header.Flags.ResponseCode))
-	fmt.Printf("id: %d\n", header.Id)
+	if printer.ShowAnswer && message.Header.AnswerRRCount > 0 {
+		printer.printResourceRecords(message.Answers, "Answer")
+	}
+
+	if printer.ShowAuthority && message.Header.NameserverRRCount > 0 {
+		printer.printResourceRecords(message.NameServers, "Authority")
+	}
+
+	if printer.ShowAdditional && message.Header.AdditionalRRCount > 0 {
+		printer.printResourceRecords(message.Additionals, "Additional")
+	}
+}
+
+func (printer *Printer) printHeader(header Header) {
+	fmt.Fprintf(printer.Writer, ";; ->>HEADER<<- ")
+	fmt.Fprintf(printer.Writer, "opcode: %s, ", DNSOpCode(header.Flags.Opcode))
+	fmt.Fprintf(printer.Writer, "status: %s, ", DNSRCode(header.Flags.ResponseCode))
+	fmt.Fprintf(printer.Writer, "id: %d\n", header.Id)
 
-	fmt.Printf(";; flags: %s; ", getFlagString(header.Flags))
-	fmt.Printf("QUERY: %d; ", header.QuestionCount)
-	fmt.Printf("ANSWER: %d; ", header.AnswerRRCount)
-	fmt.Printf("AUTHORITY: %d; ", header.NameserverRRCount)
-	fmt.Printf("ADDITIONAL: %d\n", header.AdditionalRRCount)
+	fmt.Fprintf(printer.Writer, ";; flags: %s; ", getFlagString(header.Flags))
+	fmt.Fprintf(printer.Writer, "QUERY: %d, ", header.QuestionCount)
+	fmt.Fprintf(printer.Writer, "ANSWER: %d, ", header.AnswerRRCount)
+	fmt.Fprintf(printer.Writer, "AUTHORITY: %d, ", header.NameserverRRCount)
+	fmt.Fprintf(printer.Writer, "ADDITIONAL: %d\n", header.AdditionalRRCount)
 }
 
 func getFlagString(flags Flags) string {
@@ -106,22 +210,116 @@ func getFlagString(flags Flags) string {
 	return strings.Join(flagStrings, " ")
 }
 
-func printQuestions(questions []Question) {
-	fmt.Printf("\n;; QUESTION SECTION:\n")
+func (printer *Printer) printQuestions(questions []Question) {
+	fmt.Fprintf(printer.Writer, "\n;; QUESTION SECTION:\n")
 	for _, question := range questions {
-		fmt.Printf(";%s\t\t", question.Name)
-		fmt.Printf("%s\t", DNSClass(question.QClass).String())
-		fmt.Printf("%s\n", DNSType(question.QType).String())
+		fmt.Fprintf(printer.Writer, ";%s\t\t", question.Name)
+		fmt.Fprintf(printer.Writer, "%s\t", DNSClass(question.QClass).String())
+		fmt.Fprintf(printer.Writer, "%s\n", DNSType(question.QType).String())
 	}
 }
 
-func printResourceRecord(records []ResourceRecord, title string) {
-	fmt.Printf("\n;; %s SECTION:\n", strings.ToUpper(title))
+func (printer *Printer) printResourceRecords(records []ResourceRecord, title string) {
+	fmt.Fprintf(printer.Writer, "\n;; %s SECTION:\n", strings.ToUpper(title))
 	for _, record := range records {
-		fmt.Printf(";%s\t", record.Name)
-		fmt.Printf("%d\t", record.TTL)
-		fmt.Printf("%s\t", DNSClass(record.RClass).String())
-		fmt.Printf("%s\t", DNSType(record.RType).String())
-		fmt.Printf("%s\n", record.RData.String())
+		fmt.Fprintf(printer.Writer, "%s\t", record.Name)
+		fmt.Fprintf(printer.Writer, "%s\t", printer.formatTTL(record.TTL))
+		fmt.Fprintf(printer.Writer, "%s\t", DNSClass(record.RClass).String())
+		fmt.Fprintf(printer.Writer, "%s\t", DNSType(record.RType).String())
+		fmt.Fprintf(printer.Writer, "%s\n", printer.formatRData(record))
+	}
+}
+
+func (printer *Printer) printShortAnswers(records []ResourceRecord) {
+	for _, record := range records {
+		fmt.Fprintln(printer.Writer, record.RData.String())
+	}
+}
+
+func (printer *Printer) formatTTL(ttl uint32) string {
+	if printer.TTLUnits {
+		return formatDuration(ttl)
+	}
+	return strconv.FormatUint(uint64(ttl), 10)
+}
+
+func (printer *Printer) formatRData(record ResourceRecord) string {
+	if !printer.Multiline {
+		return record.RData.String()
+	}
+
+	switch rdata := record.RData.(type) {
+	case *RDataSOA:
+		return formatMultilineSOA(rdata)
+	default:
+		return record.RData.String()
+	}
+}
+
+// formatMultilineSOA formats SOA record data over several lines, with each
+// numeric field commented, as dig +multiline does.
+func formatMultilineSOA(rdata *RDataSOA) string {
+	var builder strings.Builder
+
+	fmt.Fprintf(&builder, "%s %s (\n", rdata.MName, rdata.RName)
+	fmt.Fprintf(&builder, "\t\t\t\t%-10d ; serial\n", rdata.Serial)
+	fmt.Fprintf(&builder, "\t\t\t\t%-10d ; refresh (%s)\n", rdata.Refresh, formatLongDuration(rdata.Refresh))
+	fmt.Fprintf(&builder, "\t\t\t\t%-10d ; retry (%s)\n", rdata.Retry, formatLongDuration(rdata.Retry))
+	fmt.Fprintf(&builder, "\t\t\t\t%-10d ; expire (%s)\n", rdata.Expire, formatLongDuration(rdata.Expire))
+	fmt.Fprintf(&builder, "\t\t\t\t%-10d ; minimum (%s)\n", rdata.Minimum, formatLongDuration(rdata.Minimum))
+	builder.WriteString("\t\t\t\t)")
+
+	return builder.String()
+}
+
+type durationUnit struct {
+	seconds uint32
+	short   string
+	long    string
+}
+
+var durationUnits = []durationUnit{
+	{seconds: 7 * 24 * 3600, short: "w", long: "week"},
+	{seconds: 24 * 3600, short: "d", long: "day"},
+	{seconds: 3600, short: "h", long: "hour"},
+	{seconds: 60, short: "m", long: "minute"},
+	{seconds: 1, short: "s", long: "second"},
+}
+
+// formatDuration formats a number of seconds the way dig +ttlunits does:
+// 3600 -> "1h", 5430 -> "1h30m30s".
+func formatDuration(seconds uint32) string {
+	if seconds == 0 {
+		return "0s"
+	}
+
+	var builder strings.Builder
+	for _, unit := range durationUnits {
+		if count := seconds / unit.seconds; count > 0 {
+			fmt.Fprintf(&builder, "%d%s", count, unit.short)
+			seconds %= unit.seconds
+		}
+	}
+	return builder.String()
+}
+
+// formatLongDuration formats a number of seconds the way dig +multiline
+// comments SOA timers: 7200 -> "2 hours", 5430 -> "1 hour 30 minutes 30 seconds".
+func formatLongDuration(seconds uint32) string {
+	if seconds == 0 {
+		return "0 seconds"
+	}
+
+	parts := []string{}
+	for _, unit := range durationUnits {
+		if count := seconds / unit.seconds; count > 0 {
+			part := fmt.Sprintf("%d %s", count, unit.long)
+			if count > 1 {
+				part += "s"
+			}
+			parts = append(parts, part)
+			seconds %= unit.seconds
+		}
 	}
+	return strings.Join(parts, " ")
 }
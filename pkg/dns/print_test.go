@@ -1,6 +1,8 @@
 package dns
 
 import (
+	"bytes"
+	"net/netip"
 	"testing"
 )
 
@@ -92,3 +94,136 @@ func TestGetFlagString(t *testing.T) {
 		})
 	}
 }
+
+func TestPrinterPrintMessage(t *testing.T) {
+	message := Message{
+		Header: Header{
+			Id:                1234,
+			Flags:             Flags{Response: true, RecursionDesired: true, RecursionAvailable: true},
+			QuestionCount:     1,
+			AnswerRRCount:     2,
+			NameserverRRCount: 1,
+		},
+		Questions: []Question{
+			{Name: "example.com.", QType: A, QClass: IN},
+		},
+		Answers: []ResourceRecord{
+			{Name: "example.com.", RType: A, RClass: IN, TTL: 300, RData: &RDataA{IP: netip.MustParseAddr("192.0.2.1")}},
+			{Name: "example.com.", RType: A, RClass: IN, TTL: 5430, RData: &RDataA{IP: netip.MustParseAddr("192.0.2.2")}},
+		},
+		NameServers: []ResourceRecord{
+			{Name: "example.com.", RType: SOA, RClass: IN, TTL: 3600, RData: &RDataSOA{
+				MName:   "ns.example.com.",
+				RName:   "admin.example.com.",
+				Serial:  2024080901,
+				Refresh: 7200,
+				Retry:   3600,
+				Expire:  1209600,
+				Minimum: 90,
+			}},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		configure func(printer *Printer)
+		want      string
+	}{
+		{
+			name:      "Full dig style",
+			configure: func(printer *Printer) {},
+			want: ";; Got answer:\n" +
+				";; ->>HEADER<<- opcode: QUERY, status: NOERROR, id: 1234\n" +
+				";; flags: qr rd ra; QUERY: 1, ANSWER: 2, AUTHORITY: 1, ADDITIONAL: 0\n" +
+				"\n;; QUESTION SECTION:\n" +
+				";example.com.\t\tIN\tA\n" +
+				"\n;; ANSWER SECTION:\n" +
+				"example.com.\t300\tIN\tA\t192.0.2.1\n" +
+				"example.com.\t5430\tIN\tA\t192.0.2.2\n" +
+				"\n;; AUTHORITY SECTION:\n" +
+				"example.com.\t3600\tIN\tSOA\tns.example.com. admin.example.com. 2024080901 7200 3600 1209600 90\n",
+		},
+		{
+			name:      "Short",
+			configure: func(printer *Printer) { printer.Short = true },
+			want:      "192.0.2.1\n192.0.2.2\n",
+		},
+		{
+			name: "Answer section only with TTL units",
+			configure: func(printer *Printer) {
+				printer.ShowHeader = false
+				printer.ShowQuestion = false
+				printer.ShowAuthority = false
+				printer.TTLUnits = true
+			},
+			want: "\n;; ANSWER SECTION:\n" +
+				"example.com.\t5m\tIN\tA\t192.0.2.1\n" +
+				"example.com.\t1h30m30s\tIN\tA\t192.0.2.2\n",
+		},
+		{
+			name: "Multiline authority section",
+			configure: func(printer *Printer) {
+				printer.ShowHeader = false
+				printer.ShowQuestion = false
+				printer.ShowAnswer = false
+				printer.Multiline = true
+			},
+			want: "\n;; AUTHORITY SECTION:\n" +
+				"example.com.\t3600\tIN\tSOA\tns.example.com. admin.example.com. (\n" +
+				"\t\t\t\t2024080901 ; serial\n" +
+				"\t\t\t\t7200       ; refresh (2 hours)\n" +
+				"\t\t\t\t3600       ; retry (1 hour)\n" +
+				"\t\t\t\t1209600    ; expire (2 weeks)\n" +
+				"\t\t\t\t90         ; minimum (1 minute 30 seconds)\n" +
+				"\t\t\t\t)\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var output bytes.Buffer
+			printer := NewPrinter(&output)
+			tt.configure(printer)
+
+			printer.PrintMessage(message)
+
+			if got := output.String(); got != tt.want {
+				t.Errorf("PrintMessage()\n\tgot = %q,\n\twant = %q\n", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrinterMultilineUndecodedRecords(t *testing.T) {
+	// DNSSEC record data isn't decoded, so it stays on one line
+	printer := NewPrinter(&bytes.Buffer{})
+	printer.Multiline = true
+
+	for _, rType := range []uint16{RRSIG, DNSKEY} {
+		record := ResourceRecord{Name: "example.com.", RType: rType, RClass: IN, TTL: 300, RData: &RDataUnknown{Raw: []byte("raw data")}}
+		if got := printer.formatRData(record); got != "raw data" {
+			t.Errorf("formatRData(%s) got = %q, want = %q", DNSType(rType), got, "raw data")
+		}
+	}
+}
+
+func TestFormatDuration(t *testing.T) {
+	tests := []struct {
+		seconds uint32
+		want    string
+	}{
+		{seconds: 0, want: "0s"},
+		{seconds: 59, want: "59s"},
+		{seconds: 3600, want: "1h"},
+		{seconds: 86400 + 61, want: "1d1m1s"},
+		{seconds: 2*604800 + 3600, want: "2w1h"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := formatDuration(tt.seconds); got != tt.want {
+				t.Errorf("formatDuration(%d) got = %s, want = %s\n", tt.seconds, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package dns
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// DNS over QUIC (RFC 9250):
+// Each query is sent on its own bidirectional QUIC stream, with the same two
+// byte length prefix as DNS over TCP. The client closes the sending side of
+// the stream (STREAM FIN) after the query, and the server does the same after
+// the response. The message ID must be 0 on the wire, and queries are padded
+// as over TLS. The QUIC connection is kept open and shared between queries,
+// and the TLS session can be resumed with 0-RTT.
+//
+// QUIC connections are made with the quic-go library, unless the transport has
+// a QUICDialFunc of its own. Connections are dialed early: when the TLS
+// session is resumed, queries are sent as 0-RTT data, without waiting for the
+// handshake to complete. The transport handles everything on top of the
+// connection: TLS configuration, connection reuse and DNS message framing.
+
+const DefaultQUICPort = 853
+
+// doqALPN is the ALPN token that identifies DNS over QUIC connections
+const doqALPN = "doq"
+
+// doqNoError is the DOQ_NO_ERROR application error code, to close a
+// connection without error (RFC 9250 section 4.3).
+const doqNoError = 0
+
+// QUICStream is a bidirectional QUIC stream.
+type QUICStream interface {
+	io.Reader
+	io.Writer
+	// Close closes the sending side of the stream (STREAM FIN). The
+	// receiving side stays open to read the response.
+	Close() error
+	SetDeadline(t time.Time) error
+}
+
+// QUICConn is an established QUIC connection on which streams can be opened.
+type QUICConn interface {
+	OpenStream(ctx context.Context) (QUICStream, error)
+	Close() error
+}
+
+// QUICDialFunc establishes a QUIC connection to a server with the given TLS
+// configuration. The configuration carries the "doq" ALPN token and the
+// transport's session cache: a dialer that supports it should use 0-RTT when
+// resuming a session.
+type QUICDialFunc func(ctx context.Context, serverAddrPort netip.AddrPort, config *tls.Config) (QUICConn, error)
+
+func (transport *Transport) exchangeQUIC(ctx context.Context, serverAddrPort netip.AddrPort, dnsRequest []byte) (response []byte, err error) {
+	paddedRequest, err := padQuery(dnsRequest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DNS request: %w", err)
+	}
+	// The message ID must be 0 (RFC 9250 section 4.2.1)
+	paddedRequest[0], paddedRequest[1] = 0, 0
+
+	// Try the open connection first: the server may have closed it since,
+	// in which case we start over with a new connection.
+	if conn := transport.getQUICConn(serverAddrPort); conn != nil {
+		response, err = exchangeQUICStream(ctx, conn, paddedRequest)
+		if err == nil {
+			return restoreMessageID(response, dnsRequest), nil
+		}
+		transport.removeQUICConn(serverAddrPort, conn)
+		if ctx.Err() != nil {
+			return nil, err
+		}
+	}
+
+	conn, err := transport.dialQUIC(ctx, serverAddrPort)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err = exchangeQUICStream(ctx, conn, paddedRequest)
+	if err != nil {
+		transport.removeQUICConn(serverAddrPort, conn)
+		return nil, err
+	}
+	return restoreMessageID(response, dnsRequest), nil
+}
+
+// dialQUIC connects to a server and keeps the connection for the following
+// queries. If another query connected to the server in the meantime, its
+// connection is kept and used instead, as it may have queries in flight.
+func (transport *Transport) dialQUIC(ctx context.Context, serverAddrPort netip.AddrPort) (conn QUICConn, err error) {
+	config, err := transport.getTLSConfig(serverAddrPort.Addr().Unmap().String())
+	if err != nil {
+		return nil, err
+	}
+	config.NextProtos = []string{doqALPN}
+
+	dial := transport.QUICDial
+	if dial == nil {
+		dial = transport.dialQUICGo
+	}
+	conn, err = dial(ctx, serverAddrPort, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to DNS server over QUIC: %w", err)
+	}
+
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+
+	if transport.quicConns == nil {
+		transport.quicConns = make(map[netip.AddrPort]QUICConn)
+	}
+	if existing, found := transport.quicConns[serverAddrPort]; found {
+		conn.Close()
+		return existing, nil
+	}
+	transport.quicConns[serverAddrPort] = conn
+	return conn, nil
+}
+
+// quicGoConn is a QUIC connection made with quic-go, on its own UDP socket.
+type quicGoConn struct {
+	conn      quic.EarlyConnection
+	transport *quic.Transport
+}
+
+// dialQUICGo is the default QUICDialFunc. It dials an early connection, so
+// that queries go out as 0-RTT data when the TLS session is resumed. The
+// connection has its own UDP socket, bound to the transport's local address
+// if set.
+func (transport *Transport) dialQUICGo(ctx context.Context, serverAddrPort netip.AddrPort, config *tls.Config) (QUICConn, error) {
+	localAddr := &net.UDPAddr{}
+	if transport.LocalAddr.IsValid() {
+		localAddr = net.UDPAddrFromAddrPort(transport.LocalAddr)
+	}
+	udpConn, err := net.ListenUDP("udp", localAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	quicTransport := &quic.Transport{Conn: udpConn}
+	conn, err := quicTransport.DialEarly(ctx, net.UDPAddrFromAddrPort(serverAddrPort), config, &quic.Config{})
+	if err != nil {
+		quicTransport.Close()
+		udpConn.Close()
+		return nil, err
+	}
+	return &quicGoConn{conn: conn, transport: quicTransport}, nil
+}
+
+func (conn *quicGoConn) OpenStream(ctx context.Context) (QUICStream, error) {
+	return conn.conn.OpenStreamSync(ctx)
+}
+
+func (conn *quicGoConn) Close() error {
+	err := conn.conn.CloseWithError(doqNoError, "")
+	conn.transport.Close()
+	conn.transport.Conn.Close()
+	return err
+}
+
+// exchangeQUICStream sends a request and reads its response on a new stream
+// of the connection, within the context's deadline.
+func exchangeQUICStream(ctx context.Context, conn QUICConn, dnsRequest []byte) (response []byte, err error) {
+	stream, err := conn.OpenStream(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open QUIC stream: %w", err)
+	}
+
+	stop := setDeadlineFromContext(ctx, stream)
+	defer stop()
+
+	err = writeTCPMessage(stream, dnsRequest)
+	if err != nil {
+		return nil, err
+	}
+	err = stream.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to close QUIC stream: %w", err)
+	}
+
+	return readTCPMessage(stream)
+}
+
+// restoreMessageID sets the response's message ID back to the request's.
+func restoreMessageID(response []byte, dnsRequest []byte) []byte {
+	copy(response[:2], dnsRequest[:2])
+	return response
+}
+
+func (transport *Transport) getQUICConn(serverAddrPort netip.AddrPort) QUICConn {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+
+	return transport.quicConns[serverAddrPort]
+}
+
+// removeQUICConn closes a failed connection and forgets it, unless it has
+// already been replaced by a new one.
+func (transport *Transport) removeQUICConn(serverAddrPort netip.AddrPort, conn QUICConn) {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+
+	if transport.quicConns[serverAddrPort] == conn {
+		delete(transport.quicConns, serverAddrPort)
+	}
+	conn.Close()
+}
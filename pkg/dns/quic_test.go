@@ -0,0 +1,323 @@
+package dns
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// testQUICStream is an in-memory QUIC stream: closing it only closes the
+// sending side, as a STREAM FIN does.
+type testQUICStream struct {
+	io.Reader
+	writer *io.PipeWriter
+}
+
+func (stream *testQUICStream) Write(data []byte) (int, error) { return stream.writer.Write(data) }
+func (stream *testQUICStream) Close() error                   { return stream.writer.Close() }
+func (stream *testQUICStream) SetDeadline(time.Time) error    { return nil }
+
+// testQUICServer is an in-memory DNS over QUIC server that records what it
+// receives on each stream.
+type testQUICServer struct {
+	t       *testing.T
+	mutex   sync.Mutex
+	dials   int
+	configs []*tls.Config
+	ids     []uint16
+}
+
+type testQUICConn struct {
+	server *testQUICServer
+	closed bool
+}
+
+func (server *testQUICServer) dial(ctx context.Context, serverAddrPort netip.AddrPort, config *tls.Config) (QUICConn, error) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	server.dials++
+	server.configs = append(server.configs, config)
+	return &testQUICConn{server: server}, nil
+}
+
+func (conn *testQUICConn) OpenStream(ctx context.Context) (QUICStream, error) {
+	if conn.closed {
+		return nil, errors.New("connection closed")
+	}
+
+	requestReader, requestWriter := io.Pipe()
+	responseReader, responseWriter := io.Pipe()
+	go conn.server.serveStream(&testQUICStream{Reader: requestReader, writer: responseWriter})
+
+	return &testQUICStream{Reader: responseReader, writer: requestWriter}, nil
+}
+
+func (conn *testQUICConn) Close() error {
+	conn.closed = true
+	return nil
+}
+
+func (server *testQUICServer) serveStream(stream *testQUICStream) {
+	defer stream.Close()
+
+	request, err := readTCPMessage(stream)
+	if err != nil {
+		server.t.Errorf("server failed to read query: %v", err)
+		return
+	}
+	// The client must close its side of the stream after the query
+	if rest, err := io.ReadAll(stream); err != nil || len(rest) != 0 {
+		server.t.Errorf("server got data after query: %v, %v", rest, err)
+		return
+	}
+
+	server.mutex.Lock()
+	server.ids = append(server.ids, uint16(request[0])<<8|uint16(request[1]))
+	server.mutex.Unlock()
+
+	writeTCPMessage(stream, createTestReply(server.t, request))
+}
+
+func TestTransportQueryQUIC(t *testing.T) {
+	server := &testQUICServer{t: t}
+	transport := &Transport{Timeout: time.Second, QUICDial: server.dial}
+	defer transport.CloseIdleConnections()
+	serverAddrPort := netip.MustParseAddrPort("127.0.0.1:853")
+
+	for i := 0; i < 3; i++ {
+		request, _ := CreateQuery("example.com.", A)
+		response, err := transport.Query("quic", serverAddrPort, request)
+		if err != nil {
+			t.Fatalf("Query() error = %v", err)
+		}
+		if request[0] != response[0] || request[1] != response[1] {
+			t.Errorf("Query() response ID does not match query ID")
+		}
+		if len(response) <= DNSHeaderLength {
+			t.Errorf("Query() response too short: %v", response)
+		}
+	}
+
+	if server.dials != 1 {
+		t.Errorf("QUIC connections got = %d, want 1", server.dials)
+	}
+	if !slices.Equal(server.ids, []uint16{0, 0, 0}) {
+		t.Errorf("server received message IDs %v, want 0", server.ids)
+	}
+	if config := server.configs[0]; !slices.Equal(config.NextProtos, []string{"doq"}) || config.ClientSessionCache == nil {
+		t.Errorf("QUIC TLS config got ALPN %v and session cache %v, want doq and a session cache", config.NextProtos, config.ClientSessionCache)
+	}
+	if config := server.configs[0]; config.ServerName != "127.0.0.1" {
+		t.Errorf("QUIC TLS config server name got = %s, want 127.0.0.1", config.ServerName)
+	}
+}
+
+func TestTransportQueryQUICReconnect(t *testing.T) {
+	server := &testQUICServer{t: t}
+	transport := &Transport{Timeout: time.Second, QUICDial: server.dial}
+	defer transport.CloseIdleConnections()
+	serverAddrPort := netip.MustParseAddrPort("127.0.0.1:853")
+
+	request, _ := CreateQuery("example.com.", A)
+	if _, err := transport.Query("quic", serverAddrPort, request); err != nil {
+		t.Fatalf("Query() error = %v", err)
+	}
+
+	// The server closes the connection: the next query dials a new one
+	transport.mutex.Lock()
+	transport.quicConns[serverAddrPort].(*testQUICConn).closed = true
+	transport.mutex.Unlock()
+
+	if _, err := transport.Query("quic", serverAddrPort, request); err != nil {
+		t.Fatalf("Query() after reconnect error = %v", err)
+	}
+	if server.dials != 2 {
+		t.Errorf("QUIC connections got = %d, want 2", server.dials)
+	}
+}
+
+func TestTransportQueryQUICConcurrentDials(t *testing.T) {
+	server := &testQUICServer{t: t}
+	serverAddrPort := netip.MustParseAddrPort("127.0.0.1:853")
+	transport := &Transport{Timeout: time.Second}
+	defer transport.CloseIdleConnections()
+
+	// The second query dials while the first one dials, and connects once
+	// the first connection is kept
+	var conns []QUICConn
+	var connsMutex sync.Mutex
+	secondDialing := make(chan struct{})
+	transport.QUICDial = func(ctx context.Context, serverAddrPort netip.AddrPort, config *tls.Config) (QUICConn, error) {
+		conn, err := server.dial(ctx, serverAddrPort, config)
+		connsMutex.Lock()
+		conns = append(conns, conn)
+		first := len(conns) == 1
+		connsMutex.Unlock()
+
+		if first {
+			<-secondDialing
+			return conn, err
+		}
+		close(secondDialing)
+		for transport.getQUICConn(serverAddrPort) == nil {
+			time.Sleep(time.Millisecond)
+		}
+		return conn, err
+	}
+
+	var queries sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		queries.Add(1)
+		go func() {
+			defer queries.Done()
+			request, _ := CreateQuery("example.com.", A)
+			if _, err := transport.Query("quic", serverAddrPort, request); err != nil {
+				t.Errorf("Query() error = %v", err)
+			}
+		}()
+	}
+	queries.Wait()
+
+	// The first connection is kept, and the second one is closed
+	if kept := transport.getQUICConn(serverAddrPort); kept != conns[0] {
+		t.Errorf("kept QUIC connection is the second one, want the first one")
+	}
+	if !conns[1].(*testQUICConn).closed {
+		t.Errorf("second QUIC connection is open, want it closed")
+	}
+}
+
+// testDoQServer is a local DNS over QUIC server, with quic-go, which accepts
+// 0-RTT data.
+type testDoQServer struct {
+	addrPort    netip.AddrPort
+	connections atomic.Int32
+	used0RTT    atomic.Int32
+	ids         chan uint16
+}
+
+func startTestDoQServer(t *testing.T, cert tls.Certificate) *testDoQServer {
+	t.Helper()
+
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{doqALPN}}
+	listener, err := quic.ListenAddrEarly("127.0.0.1:0", config, &quic.Config{Allow0RTT: true})
+	if err != nil {
+		t.Fatalf("failed to start test QUIC server: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	server := &testDoQServer{addrPort: listener.Addr().(*net.UDPAddr).AddrPort(), ids: make(chan uint16, 10)}
+
+	go func() {
+		for {
+			conn, err := listener.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			server.connections.Add(1)
+
+			go func() {
+				<-conn.HandshakeComplete()
+				if conn.ConnectionState().Used0RTT {
+					server.used0RTT.Add(1)
+				}
+			}()
+
+			go func() {
+				for {
+					stream, err := conn.AcceptStream(context.Background())
+					if err != nil {
+						return
+					}
+					go func() {
+						defer stream.Close()
+						request, err := readTCPMessage(stream)
+						if err != nil {
+							t.Errorf("server failed to read query: %v", err)
+							return
+						}
+						// The client must close its side of the stream after the query
+						if rest, err := io.ReadAll(stream); err != nil || len(rest) != 0 {
+							t.Errorf("server got data after query: %v, %v", rest, err)
+							return
+						}
+						server.ids <- uint16(request[0])<<8 | uint16(request[1])
+						writeTCPMessage(stream, createTestReply(t, request))
+					}()
+				}
+			}()
+		}
+	}()
+
+	return server
+}
+
+func TestTransportQueryQUICListener(t *testing.T) {
+	cert, parsedCert := createTestCertificate(t)
+	trustedRoots := x509.NewCertPool()
+	trustedRoots.AddCert(parsedCert)
+	server := startTestDoQServer(t, cert)
+
+	transport := &Transport{Timeout: 5 * time.Second, TLSConfig: &tls.Config{RootCAs: trustedRoots}}
+	defer transport.CloseIdleConnections()
+
+	for range 3 {
+		request, _ := CreateQuery("example.com.", A)
+		response, err := transport.Query("quic", server.addrPort, request)
+		if err != nil {
+			t.Fatalf("Query() error = %v", err)
+		}
+		if request[0] != response[0] || request[1] != response[1] {
+			t.Errorf("Query() response ID does not match query ID")
+		}
+		if id := <-server.ids; id != 0 {
+			t.Errorf("server received message ID %d, want 0", id)
+		}
+	}
+	if connections := server.connections.Load(); connections != 1 {
+		t.Errorf("QUIC connections got = %d, want 1", connections)
+	}
+
+	// A new connection resumes the TLS session with 0-RTT
+	transport.CloseIdleConnections()
+	request, _ := CreateQuery("example.com.", A)
+	if _, err := transport.Query("quic", server.addrPort, request); err != nil {
+		t.Fatalf("Query() after reconnect error = %v", err)
+	}
+	<-server.ids
+	deadline := time.Now().Add(5 * time.Second)
+	for server.used0RTT.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("new QUIC connection didn't use 0-RTT")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if connections := server.connections.Load(); connections != 2 {
+		t.Errorf("QUIC connections got = %d, want 2", connections)
+	}
+}
+
+func TestTransportQueryQUICUntrusted(t *testing.T) {
+	cert, _ := createTestCertificate(t)
+	server := startTestDoQServer(t, cert)
+
+	transport := &Transport{Timeout: 5 * time.Second}
+	defer transport.CloseIdleConnections()
+
+	request, _ := CreateQuery("example.com.", A)
+	if _, err := transport.Query("quic", server.addrPort, request); err == nil {
+		t.Errorf("Query() to a server with an untrusted certificate succeeded")
+	}
+}
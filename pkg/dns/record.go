@@ -100,6 +100,8 @@ func getRDataStruct(rtype uint16) (RData, error) {
 		rdata = &RDataAAAA{}
 	case CNAME:
 		rdata = &RDataCNAME{}
+	case DNAME:
+		rdata = &RDataDNAME{}
 	case PTR:
 		rdata = &RDataPTR{}
 	case NS:
@@ -108,14 +110,34 @@ func getRDataStruct(rtype uint16) (RData, error) {
 		rdata = &RDataTXT{}
 	case MX:
 		rdata = &RDataMX{}
+	case SRV:
+		rdata = &RDataSRV{}
 	case SOA:
 		rdata = &RDataSOA{}
+	case OPT:
+		rdata = &RDataOPT{}
 	default:
 		rdata = &RDataUnknown{}
 	}
 	return rdata, nil
 }
 
+// newResourceRecord creates an IN class resource record, computing its data
+// length from the record data.
+func newResourceRecord(name string, rtype uint16, ttl uint32, rdata RData) ResourceRecord {
+	writer := &dnsWriter{}
+	rdata.WriteRecordData(writer)
+
+	return ResourceRecord{
+		Name:     name,
+		RType:    rtype,
+		RClass:   IN,
+		TTL:      ttl,
+		RDLength: uint16(len(writer.data)),
+		RData:    rdata,
+	}
+}
+
 func (writer *dnsWriter) writeResourceRecords(resourceRecords []ResourceRecord) {
 	for _, record := range resourceRecords {
 		writer.writeResourceRecord(record)
@@ -121,6 +121,31 @@ func (rdata *RDataCNAME) ReadRecordData(reader *dnsReader, length uint16) (err e
 	return nil
 }
 
+// -------------- DNAME
+// DNAME RDATA format [RFC6672]
+// Target:	A <domain-name> which replaces the owner name as a suffix of the names below the owner.  It is never compressed.
+
+type RDataDNAME struct {
+	DomainName string
+}
+
+func (rdata *RDataDNAME) String() string {
+	return rdata.DomainName
+}
+
+func (rdata *RDataDNAME) WriteRecordData(writer *dnsWriter) error {
+	writer.writeDomainName(rdata.DomainName)
+	return nil
+}
+
+func (rdata *RDataDNAME) ReadRecordData(reader *dnsReader, length uint16) (err error) {
+	rdata.DomainName, err = reader.readDomainName()
+	if err != nil {
+		return fmt.Errorf("invalid DNAME record data: %w", err)
+	}
+	return nil
+}
+
 // -------------- PTR
 // PTR RDATA format
 // PTRDNAME:	A <domain-name> which points to some location in the domain name space.
@@ -189,10 +214,29 @@ func (rdata *RDataTXT) WriteRecordData(writer *dnsWriter) error {
 }
 
 func (rdata *RDataTXT) ReadRecordData(reader *dnsReader, length uint16) (err error) {
-	rdata.Text = string(reader.data[reader.offset : reader.offset+int(length)])
+	text, err := reader.readUntil(int(length))
+	if err != nil {
+		return fmt.Errorf("invalid TXT record data: %w", err)
+	}
+	rdata.Text = string(text)
 	return nil
 }
 
+// Strings splits the record data into its <character-string>s: each is a
+// length byte followed by that many bytes of text.
+func (rdata *RDataTXT) Strings() (strs []string) {
+	text := rdata.Text
+	for len(text) > 0 {
+		length := int(text[0])
+		if 1+length > len(text) {
+			length = len(text) - 1
+		}
+		strs = append(strs, text[1:1+length])
+		text = text[1+length:]
+	}
+	return strs
+}
+
 // -------------- MX
 // MX RDATA format
 // PREFERENCE:	A 16 bit integer which specifies the preference given to this RR among others at the same owner.  Lower values are preferred.
@@ -222,6 +266,54 @@ func (rdata *RDataMX) ReadRecordData(reader *dnsReader, length uint16) (err erro
 	return nil
 }
 
+// -------------- SRV
+// SRV RDATA format [RFC2782]
+// PRIORITY:	A 16 bit integer. A client MUST attempt to contact the target host with the lowest-numbered priority it can reach.
+// WEIGHT:	A 16 bit integer which specifies a relative weight for entries with the same priority. Larger weights SHOULD be given a proportionately higher probability of being selected.
+// PORT:	A 16 bit integer which specifies the port on this target host of this service.
+// TARGET:	A <domain-name> which specifies the domain name of the target host. A target of "." means that the service is decidedly not available at this domain.
+
+type RDataSRV struct {
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+	Target   string
+}
+
+func (rdata *RDataSRV) String() string {
+	srv := []string{
+		strconv.Itoa(int(rdata.Priority)),
+		strconv.Itoa(int(rdata.Weight)),
+		strconv.Itoa(int(rdata.Port)),
+		rdata.Target,
+	}
+
+	return strings.Join(srv, " ")
+}
+
+func (rdata *RDataSRV) WriteRecordData(writer *dnsWriter) error {
+	writer.writeUint16(rdata.Priority)
+	writer.writeUint16(rdata.Weight)
+	writer.writeUint16(rdata.Port)
+	writer.writeDomainName(rdata.Target)
+	return nil
+}
+
+func (rdata *RDataSRV) ReadRecordData(reader *dnsReader, length uint16) (err error) {
+	if length < 7 || len(reader.data) < reader.offset+6 {
+		return fmt.Errorf("invalid SRV record data: %w", ErrInvalidLengthTooShort)
+	}
+
+	rdata.Priority = reader.readUint16()
+	rdata.Weight = reader.readUint16()
+	rdata.Port = reader.readUint16()
+	rdata.Target, err = reader.readDomainName()
+	if err != nil {
+		return fmt.Errorf("invalid SRV record data: %w", err)
+	}
+	return nil
+}
+
 // -------------- SOA
 // SOA RDATA format
 // MNAME:	The <domain-name> of the name server that was the original or primary source of data for this zone.
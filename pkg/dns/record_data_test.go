@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"errors"
 	"net/netip"
+	"reflect"
 	"strconv"
 	"testing"
 )
@@ -217,6 +218,57 @@ func TestRDataCNAME(t *testing.T) {
 	}
 }
 
+func TestRDataDNAME(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      []byte
+		want      string
+		wantError error
+	}{
+		{
+			name: "DNAME record",
+			data: []byte{7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'n', 'e', 't', 0},
+			want: "example.net.",
+		},
+		{
+			name:      "Invalid DNAME record",
+			data:      []byte{7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'n', 'e', 't'},
+			wantError: ErrOffsetOutOfBounds,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got RDataDNAME
+			reader := &dnsReader{data: tt.data}
+
+			err := got.ReadRecordData(reader, uint16(len(tt.data)))
+
+			if tt.wantError != nil {
+				if err == nil || !errors.Is(err, tt.wantError) {
+					t.Fatalf("Decode() error = %v, want error = %v, data = %v\n", err, tt.wantError, tt.data)
+				}
+				return
+			}
+
+			// Test Decode and String
+			if got.DomainName != tt.want || got.String() != tt.want {
+				t.Errorf("Decode() domain name got = %s, want = %s, data = %v\n", got.DomainName, tt.want, tt.data)
+			}
+
+			// Test Encode: the target is never compressed
+			writer := &dnsWriter{}
+			if err := got.WriteRecordData(writer); err != nil {
+				t.Fatalf("Encode() error = %v, data = %v\n", err, tt.data)
+			}
+
+			if !bytes.Equal(writer.data, tt.data) {
+				t.Errorf("Encode() got = %v, want = %v\n", writer.data, tt.data)
+			}
+		})
+	}
+}
+
 func TestRDataTXT(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -376,6 +428,118 @@ func TestRDataMX(t *testing.T) {
 	}
 }
 
+func TestRDataSRV(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      []byte
+		want      RData
+		wantError error
+	}{
+		{
+			name: "SRV record",
+			data: []byte{
+				0, 10, // Priority
+				0, 60, // Weight
+				0x13, 0xc4, // Port: 5060
+				3, 's', 'i', 'p', 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0,
+			},
+			want: &RDataSRV{
+				Priority: 10,
+				Weight:   60,
+				Port:     5060,
+				Target:   "sip.example.com.",
+			},
+			wantError: nil,
+		},
+		{
+			name: "Invalid SRV record: bad domain name",
+			data: []byte{
+				0, 10,
+				0, 60,
+				0x13, 0xc4,
+				3, 's', 'i', 'p', 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm',
+			},
+			wantError: ErrOffsetOutOfBounds,
+		},
+		{
+			name: "Invalid SRV record: missing fields",
+			data: []byte{
+				0, 10,
+				0, 60,
+			},
+			wantError: ErrInvalidLengthTooShort,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got RDataSRV
+			reader := &dnsReader{data: tt.data}
+
+			err := got.ReadRecordData(reader, uint16(len(tt.data)))
+
+			if tt.wantError != nil {
+				if err == nil || !errors.Is(err, tt.wantError) {
+					t.Fatalf("Decode() error = %v, want error = %v, data = %v\n", err, tt.wantError.Error(), tt.data)
+				}
+				return
+			}
+
+			want, ok := tt.want.(*RDataSRV)
+			if !ok {
+				t.Fatalf("want is not of type *RDataSRV, got %T", tt.want)
+			}
+
+			// Test Decode
+			if got != *want {
+				t.Errorf("Decode() got = %+v, want = %+v, data = %v\n", got, *want, tt.data)
+			}
+
+			// Test String
+			gotString := got.String()
+			wantString := "10 60 5060 sip.example.com."
+			if gotString != wantString {
+				t.Errorf("String() got = \"%s\", want = \"%s\", data = %v\n", gotString, wantString, tt.data)
+			}
+
+			// Test Encode
+			writer := &dnsWriter{
+				data:   make([]byte, 1),
+				offset: 0,
+			}
+			if err := got.WriteRecordData(writer); err != nil {
+				t.Fatalf("Encode() error = %v, data = %v\n", err, tt.data)
+			}
+
+			if !bytes.Equal(writer.data, tt.data) {
+				t.Errorf("Encode() got = %v, want = %v\n", writer.data, tt.data)
+			}
+		})
+	}
+}
+
+func TestRDataTXTStrings(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want []string
+	}{
+		{name: "Single string", text: "\x05hello", want: []string{"hello"}},
+		{name: "Several strings", text: "\x05hello\x00\x05world", want: []string{"hello", "", "world"}},
+		{name: "Truncated string", text: "\x05hel", want: []string{"hel"}},
+		{name: "No string", text: "", want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rdata := RDataTXT{Text: tt.text}
+			if got := rdata.Strings(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Strings() got = %q, want = %q", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestRDataSOA(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -485,3 +649,79 @@ func TestRDataSOA(t *testing.T) {
 		})
 	}
 }
+
+func TestRDataOPT(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      []byte
+		want      []EDNSOption
+		wantError error
+	}{
+		{
+			name: "OPT record with two options",
+			data: []byte{
+				0, 10, 0, 8, 1, 2, 3, 4, 5, 6, 7, 8, // COOKIE option
+				0, 12, 0, 2, 0, 0, // Padding option
+			},
+			want: []EDNSOption{
+				{Code: 10, Data: []byte{1, 2, 3, 4, 5, 6, 7, 8}},
+				{Code: 12, Data: []byte{0, 0}},
+			},
+			wantError: nil,
+		},
+		{
+			name:      "Empty OPT record",
+			data:      []byte{},
+			want:      nil,
+			wantError: nil,
+		},
+		{
+			name:      "Invalid OPT record: option too long",
+			data:      []byte{0, 10, 0, 8, 1, 2},
+			want:      nil,
+			wantError: ErrInvalidLengthTooShort,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got RDataOPT
+			reader := &dnsReader{data: tt.data}
+
+			err := got.ReadRecordData(reader, uint16(len(tt.data)))
+
+			if tt.wantError != nil {
+				if err == nil || !errors.Is(err, tt.wantError) {
+					t.Fatalf("Decode() error = %v, want error = %v, data = %v\n", err, tt.wantError, tt.data)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Decode() error = %v, data = %v\n", err, tt.data)
+			}
+
+			// Test Decode
+			if len(got.Options) != len(tt.want) {
+				t.Fatalf("Decode() options got = %v, want = %v\n", got.Options, tt.want)
+			}
+			for i := range tt.want {
+				if got.Options[i].Code != tt.want[i].Code || !bytes.Equal(got.Options[i].Data, tt.want[i].Data) {
+					t.Errorf("Decode() option %d got = %v, want = %v\n", i, got.Options[i], tt.want[i])
+				}
+			}
+
+			// Test Encode
+			writer := &dnsWriter{
+				data:   make([]byte, 0),
+				offset: 0,
+			}
+			if err := got.WriteRecordData(writer); err != nil {
+				t.Fatalf("Encode() error = %v, data = %v\n", err, tt.data)
+			}
+
+			if !bytes.Equal(writer.data, tt.data) {
+				t.Errorf("Encode() got = %v, want = %v\n", writer.data, tt.data)
+			}
+		})
+	}
+}
@@ -5,20 +5,74 @@ import (
 	"fmt"
 	"log"
 	"net/netip"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Resolver struct {
 	MaxRecursionDepth int
 	RootServers       []Server
-	NameServerCache   map[string]CachedServer
-	AnswerCache       map[string]CachedAnswer
-	CacheMutex        sync.RWMutex
+
+	// AddressFamily restricts queries to IPv4 or IPv6 servers, for hosts
+	// with a single stack. Both are used by default.
+	AddressFamily AddressFamily
+	// HappyEyeballsDelay is the delay before racing the next address of a
+	// server. DefaultHappyEyeballsDelay if zero.
+	HappyEyeballsDelay time.Duration
+	// MaxCacheSize bounds the approximate memory used by the cache, in
+	// bytes. DefaultMaxCacheSize if zero. It is read on the first use of the
+	// cache.
+	MaxCacheSize int64
+	// MinCacheTTL and MaxCacheTTL bound the time RRsets and negative answers
+	// are cached, whatever their TTL. MaxCacheTTL is DefaultMaxCacheTTL if zero.
+	MinCacheTTL time.Duration
+	MaxCacheTTL time.Duration
+	// PrefetchFraction is the fraction of its TTL left at which a popular
+	// RRset is refreshed in the background, before it expires. No RRset is
+	// prefetched if zero.
+	PrefetchFraction float64
+	// PrefetchHits is the number of lookups which make a cached RRset
+	// popular. DefaultPrefetchHits if zero.
+	PrefetchHits uint32
+	// StaleWindow is how long expired answers are kept in the cache, to be
+	// served when servers can't be reached (RFC 8767). Expired answers are
+	// removed at once if zero. It is read on the first use of the cache.
+	StaleWindow time.Duration
+	// StaleAnswerTimeout is how long a client waits for the resolution of an
+	// expired answer before it is served stale, while resolution goes on in
+	// the background. Stale answers are only served when resolution fails if
+	// zero.
+	StaleAnswerTimeout time.Duration
+	// Hosts answers queries for the names and addresses of a hosts file
+	// before any resolution. Not used if nil.
+	Hosts *Hosts
 
 	// Query function reference for testing mock injection: default is QueryResponse()
 	QueryFunc func(string, netip.AddrPort, []byte) ([]byte, error)
+
+	cacheOnce  sync.Once
+	cacheStore *shardedCache
+
+	// prefetching holds the cache keys of the RRsets being prefetched
+	prefetching  sync.Map
+	prefetches   atomic.Uint64
+	staleAnswers atomic.Uint64
+	// staleFailures holds the time of the last failed resolution of the
+	// cache keys with a stale answer
+	staleFailures sync.Map
+
+	// resolutions and nameServerLookups coalesce identical resolutions in
+	// flight
+	resolutions       flightGroup[Message]
+	nameServerLookups flightGroup[[]Server]
+
+	// preferIPv4 is set when an IPv4 address was the last to respond
+	preferIPv4 atomic.Bool
+	// serverRTTs are the smoothed RTTs of the server addresses queried
+	serverRTTs serverRTTTracker
 }
 
 // NewResolver creates a resolver structure given a root server hints file
@@ -40,8 +94,6 @@ func NewResolver(rootServerHintsFilePath string) (resolver *Resolver, err error)
 	resolver = &Resolver{
 		MaxRecursionDepth: 10,
 		RootServers:       rootServers,
-		NameServerCache:   make(map[string]CachedServer),
-		AnswerCache:       make(map[string]CachedAnswer),
 		QueryFunc:         QueryResponse,
 	}
 
@@ -50,7 +102,10 @@ func NewResolver(rootServerHintsFilePath string) (resolver *Resolver, err error)
 
 // ResolveQuery resolves a DNS query by querying servers, starting with the root servers
 // until an authoritative answer is found. It may return SERFAIL reply to client if
-// there was no satifactory resolution.
+// there was no satifactory resolution. The reply is for a client over UDP: if
+// it is longer than the client's EDNS UDP payload size, or 512 bytes without
+// EDNS, it is truncated and has the TC flag set, so that the client retries
+// over TCP.
 //
 // Parameters:
 //   - rootServers: the list of root servers to start querying
@@ -60,43 +115,237 @@ func NewResolver(rootServerHintsFilePath string) (resolver *Resolver, err error)
 //   - response: the DNS message containing the authoritative answer
 //   - err: an error if no response was found
 func (resolver *Resolver) ResolveQuery(dnsRequest []byte) (response []byte, err error) {
+	return resolver.resolveQuery(dnsRequest, true)
+}
 
+// resolveQuery resolves a DNS query as ResolveQuery does. The reply is only
+// truncated to the client's UDP payload size over UDP.
+func (resolver *Resolver) resolveQuery(dnsRequest []byte, overUDP bool) (response []byte, err error) {
 	dnsParsedRequest, err := DecodeMessage(dnsRequest)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse client request: %w", err)
 	}
 
-	queryDomain := dnsParsedRequest.Questions[0].Name
-	queryType := dnsParsedRequest.Questions[0].QType
-	log.Printf("\n-----------------\nQuestion: %s: Start resolution\n-----------------", queryDomain)
+	maxLength := MaxDNSMessageSizeOverTCP
+	if overUDP {
+		maxLength = udpPayloadSize(dnsParsedRequest)
+	}
 
-	// Check cache before attempting to query servers
-	if cachedAnswerRecords, found := resolver.getCachedAnswerRecords(queryDomain, queryType); found {
-		log.Printf("--> Found cached answer for %s", queryDomain)
+	if len(dnsParsedRequest.Questions) != 1 {
+		log.Printf("invalid request: %d questions, responding with FORMERR", len(dnsParsedRequest.Questions))
+		return resolver.encodeReply(NewErrorReply(dnsParsedRequest, FORMERR), maxLength)
+	}
 
-		dnsParsedRequest.Header.AnswerRRCount = uint16(len(cachedAnswerRecords))
-		dnsParsedRequest.Answers = cachedAnswerRecords
+	queryDomain := dnsParsedRequest.Questions[0].Name
+	log.Printf("\n-----------------\nQuestion: %s: Start resolution\n-----------------", queryDomain)
 
-		return EncodeMessage(dnsParsedRequest)
+	// Check the hosts file before the cache and the servers
+	if resolver.Hosts != nil {
+		if reply, found := resolver.Hosts.Answer(dnsParsedRequest); found {
+			log.Printf("--> Found hosts file answer for %s", queryDomain)
+			return resolver.encodeReply(reply, maxLength)
+		}
 	}
 
-	// TODO: ping root server here to check if it's alive and if not get next root server again?
-	rootServer := resolver.GetNextRootServer()
-
-	response, err = resolver.queryServers([]Server{rootServer}, dnsRequest, queryDomain, 0)
+	reply, err := resolver.resolveCNAMEChain(dnsParsedRequest, dnsRequest)
 	if err != nil {
 		if errors.Is(err, ErrServFailToResolveQuery) {
 			log.Printf("failed to resolve query, responding with SERVFAIL: %v", err)
-			dnsParsedRequest.Header.Flags.ResponseCode = SERVFAIL
-			return EncodeMessage(dnsParsedRequest)
+			return resolver.encodeReply(NewErrorReply(dnsParsedRequest, SERVFAIL), maxLength)
 		}
 		log.Printf("failed to resolve query: %v", err)
 		return nil, err
 	}
 
+	return resolver.encodeReply(reply, maxLength)
+}
+
+// resolveCNAMEChain resolves the request's question. If the answer is a CNAME
+// chain which doesn't end with records of the question type, resolution
+// restarts at the last name of the chain, which may be in another zone. The
+// reply's answer section holds the answers for each name of the chain in
+// turn: the whole chain, followed by the records of the canonical name. Other
+// records of the responses aren't passed on.
+// CNAME records are synthesized from DNAME records, and the reply is
+// YXDOMAIN if a DNAME makes a name too long.
+//
+// Parameters:
+//   - dnsParsedRequest: the client's request
+//   - dnsRequest: the encoded client's request, sent to servers for the first name of the chain
+//
+// Returns:
+//   - reply: the reply to the client, with the response code of the last name of the chain
+//   - err: an error if resolution failed (wrapping ErrServFailToResolveQuery
+//     if the chain loops or is too long)
+func (resolver *Resolver) resolveCNAMEChain(dnsParsedRequest Message, dnsRequest []byte) (reply Message, err error) {
+	name := dnsParsedRequest.Questions[0].Name
+	questionType := dnsParsedRequest.Questions[0].QType
+	questionClass := dnsParsedRequest.Questions[0].QClass
+	visited := map[string]bool{strings.ToLower(name): true}
+
+	var answers []ResourceRecord
+	for {
+		response, err := resolver.resolveName(name, questionType, questionClass, dnsRequest)
+		if err != nil {
+			return Message{}, err
+		}
+		responseAnswers, err := synthesizeDNAMECNAMEs(response.Answers, name)
+		if errors.Is(err, ErrDNAMEOverflow) {
+			log.Printf("--> Responding with YXDOMAIN: %v", err)
+			reply = NewErrorReply(dnsParsedRequest, YXDOMAIN)
+			reply.Answers = append(answers, chainAnswers(response.Answers, name, ".")...)
+			return reply, nil
+		}
+
+		records, canonicalName, err := followCNAMEs(responseAnswers, name, questionType, visited)
+		if err != nil {
+			return Message{}, fmt.Errorf("%w: %w", ErrServFailToResolveQuery, err)
+		}
+
+		// Only the links of the chain and the canonical name's records are
+		// passed on
+		for _, answer := range chainAnswers(responseAnswers, name, ".") {
+			if answer.RType == CNAME || answer.RType == DNAME ||
+				(answer.RType == questionType && strings.EqualFold(answer.Name, canonicalName)) {
+				answers = append(answers, answer)
+			}
+		}
+
+		if len(records) > 0 || canonicalName == name {
+			reply = NewErrorReply(dnsParsedRequest, response.GetResponseCode())
+			reply.Answers = answers
+			reply.NameServers = response.NameServers
+			return reply, nil
+		}
+
+		log.Printf("--> Following CNAME chain from %s to %s", name, canonicalName)
+		name = canonicalName
+		dnsRequest, err = CreateQuery(name, questionType)
+		if err != nil {
+			return Message{}, err
+		}
+	}
+}
+
+// resolveName finds the answer to a question in the cache or by querying
+// servers, starting with a root server. An expired answer still in the cache
+// may be served stale. Resolutions of the same question in flight at the same
+// time are coalesced.
+func (resolver *Resolver) resolveName(name string, questionType uint16, questionClass uint16, dnsRequest []byte) (response Message, err error) {
+	key := rrsetCacheKey(name, questionType, questionClass)
+
+	// Check cache before attempting to query servers. The question counts as
+	// a single cache hit or miss, however many entries were looked up.
+	response, found := resolver.getCachedAnswer(name, questionType, questionClass)
+	resolver.cache().countLookup(key, found)
+	if found {
+		return response, nil
+	}
+
+	response, err, shared := resolver.resolutions.do(key, 0, func() (Message, error) {
+		if staleResponse, found := resolver.getStaleAnswer(name, questionType, questionClass); found {
+			return resolver.resolveOrServeStale(key, name, dnsRequest, staleResponse)
+		}
+		return resolver.queryRootServer(name, dnsRequest)
+	})
+	if shared {
+		log.Printf("--> Shared resolution in flight for %s", name)
+		// The sections are the waiters' own to append to
+		response.Answers = slices.Clone(response.Answers)
+		response.NameServers = slices.Clone(response.NameServers)
+		response.Additionals = slices.Clone(response.Additionals)
+	}
+	return response, err
+}
+
+// getCachedAnswer returns the answer to a question found in the cache: its
+// records, or a CNAME record for the name or DNAME record for a name above
+// it, which answer any question type, or a negative answer.
+func (resolver *Resolver) getCachedAnswer(name string, questionType uint16, questionClass uint16) (response Message, found bool) {
+	if cachedAnswerRecords, found := resolver.getCachedRRset(name, questionType, questionClass, CredibilityNonAuthoritativeAnswer); found {
+		log.Printf("--> Found cached answer for %s", name)
+		return Message{Answers: cachedAnswerRecords}, true
+	}
+	if questionType != CNAME {
+		if cachedAliases, found := resolver.getCachedRRset(name, CNAME, questionClass, CredibilityNonAuthoritativeAnswer); found {
+			log.Printf("--> Found cached CNAME for %s", name)
+			return Message{Answers: cachedAliases}, true
+		}
+	}
+	if cachedNegativeAnswer, found := resolver.getCachedNegativeAnswer(name, questionType, questionClass); found {
+		log.Printf("--> Found cached %s for %s", DNSRCode(cachedNegativeAnswer.ResponseCode), name)
+		response = Message{NameServers: []ResourceRecord{cachedNegativeAnswer.SOA}}
+		response.SetResponseCode(cachedNegativeAnswer.ResponseCode)
+		return response, true
+	}
+	for _, ancestor := range ancestorNames(name) {
+		if cachedRedirections, found := resolver.getCachedRRset(ancestor, DNAME, questionClass, CredibilityNonAuthoritativeAnswer); found {
+			log.Printf("--> Found cached DNAME for %s at %s", name, ancestor)
+			return Message{Answers: cachedRedirections}, true
+		}
+	}
+	return Message{}, false
+}
+
+// queryRootServer queries servers for a name, starting with a root server.
+func (resolver *Resolver) queryRootServer(name string, dnsRequest []byte) (response Message, err error) {
+	// TODO: ping root server here to check if it's alive and if not get next root server again?
+	rootServer := resolver.GetNextRootServer()
+
+	rawResponse, err := resolver.queryServers([]Server{rootServer}, ".", dnsRequest, name, 0)
+	if err != nil {
+		return Message{}, err
+	}
+
+	response, err = DecodeMessage(rawResponse)
+	if err != nil {
+		return Message{}, fmt.Errorf("failed to parse server response: %w", err)
+	}
 	return response, nil
 }
 
+// encodeReply marks a reply to a client as coming from a recursive resolver
+// and encodes it. A reply longer than the maximum length loses its additional
+// records first, which the client can do without. If it is still too long,
+// it is sent without records and with the TC flag set (RFC 2181 section 9):
+// a partial answer would be taken for the whole.
+func (resolver *Resolver) encodeReply(reply Message, maxLength int) (response []byte, err error) {
+	reply.Header.Flags.RecursionAvailable = true
+	reply.UpdateCounts()
+	response, err = EncodeMessage(reply)
+	if err != nil || len(response) <= maxLength {
+		return response, err
+	}
+
+	// The OPT record is kept, as it holds the extended response code
+	edns, hasEDNS := reply.GetEDNS()
+	reply.Additionals = nil
+	if hasEDNS {
+		reply.SetEDNS(edns)
+	}
+	reply.UpdateCounts()
+	response, err = EncodeMessage(reply)
+	if err != nil || len(response) <= maxLength {
+		return response, err
+	}
+
+	reply.Header.Flags.Truncated = true
+	reply.Answers = nil
+	reply.NameServers = nil
+	reply.UpdateCounts()
+	return EncodeMessage(reply)
+}
+
+// udpPayloadSize returns the length of the longest reply a client can receive
+// over UDP: its EDNS UDP payload size, or 512 bytes without EDNS. Sizes below
+// 512 bytes are taken as 512 bytes (RFC 6891 section 6.2.5).
+func udpPayloadSize(request Message) int {
+	if edns, found := request.GetEDNS(); found {
+		return max(int(edns.UDPSize), MaxUDPMessageLength)
+	}
+	return MaxUDPMessageLength
+}
+
 // QueryServers is a recursive function that queries a list of servers until
 // it encounters a satisfactory answer from an authoritative nameserver.
 // If the response it receives contains to answer but a reference to a nameserver,
@@ -105,6 +354,7 @@ func (resolver *Resolver) ResolveQuery(dnsRequest []byte) (response []byte, err
 //
 // Parameters:
 //   - serverList: a list of servers to query (usually starts with the root servers)
+//   - zone: the zone the servers serve, whose records they are trusted for
 //   - dnsRequest: the request containing the question to resolve
 //   - queryDomain: the domain that is being queried for (used for more readable logs)
 //   - depth: the current recursion depth
@@ -113,29 +363,32 @@ func (resolver *Resolver) ResolveQuery(dnsRequest []byte) (response []byte, err
 //   - response: the response (authoritative) as a slice of bytes
 //   - err: an error if an error was encountered (the ErrServFailToResolveQuery error indicates
 //     the caller should answer the client with a SERVFAIL message)
-func (resolver *Resolver) queryServers(serverList []Server, dnsRequest []byte, queryDomain string, depth int) (response []byte, err error) {
+func (resolver *Resolver) queryServers(serverList []Server, zone string, dnsRequest []byte, queryDomain string, depth int) (response []byte, err error) {
 
 	if depth >= resolver.MaxRecursionDepth {
 		return nil, fmt.Errorf("recursion depth exceeded")
 	}
 
-	for _, server := range serverList {
+	// Try the fastest servers first
+	for _, server := range resolver.orderServers(serverList, shouldExplore()) {
 
-		// TODO: If IPv6 doesn't work, fall back to IPv4
-		serverAddrPort, err := server.getValidIPAddress()
-		if err != nil {
-			log.Printf("[depth %d]==> Question: %s: Moving on: server has no valid IP address: %v", depth, queryDomain, err)
+		if !server.hasAddrs() {
+			log.Printf("[depth %d]==> Question: %s: Moving on: server has no valid IP address", depth, queryDomain)
 			continue
 		}
 
-		log.Printf("[depth %d]==> Question: %s: Querying server %s (IP: %v)", depth, queryDomain, server.Fqdn, serverAddrPort)
-
-		response, err := resolver.QueryFunc("udp", serverAddrPort, dnsRequest)
+		response, serverAddrPort, err := resolver.queryServer(server, dnsRequest)
+		if errors.Is(err, ErrInvalidIP) {
+			log.Printf("[depth %d]==> Question: %s: Moving on: server %s has no address in the allowed family", depth, queryDomain, server.Fqdn)
+			continue
+		}
 		if err != nil {
-			log.Printf("failed to query server %s: %v", server, err)
+			log.Printf("failed to query server %s: %v", server.Fqdn, err)
 			continue
 		}
 
+		log.Printf("[depth %d]==> Question: %s: Queried server %s (IP: %v)", depth, queryDomain, server.Fqdn, serverAddrPort)
+
 		dnsParsedResponse, err := DecodeMessage(response)
 		if err != nil {
 			log.Printf("Failed to parse response from server %s: %v", server, err)
@@ -146,9 +399,25 @@ func (resolver *Resolver) queryServers(serverList []Server, dnsRequest []byte, q
 			log.Printf("==>[depth %d] Question: %s: Got authoritative answer from server %s", depth, queryDomain, server)
 			for i, answer := range dnsParsedResponse.Answers {
 				log.Printf("[depth %d]=============> Question: %s: [ANSWER %d] %s: %s", depth, queryDomain, i, DNSType(answer.RType).String(), answer.RData.String())
-				// Cache the authoritative answer
-				resolver.cacheAnswerRecord(queryDomain, answer)
 			}
+
+			// Records the server isn't trusted for are neither cached nor
+			// passed on
+			if len(dnsParsedResponse.Questions) == 1 {
+				answers := chainAnswers(dnsParsedResponse.Answers, dnsParsedResponse.Questions[0].Name, zone)
+				if len(answers) < len(dnsParsedResponse.Answers) {
+					log.Printf("[depth %d]==> Question: %s: Dropped %d answers out of the chain or of zone %s", depth, queryDomain, len(dnsParsedResponse.Answers)-len(answers), zone)
+					dnsParsedResponse.Answers = answers
+					dnsParsedResponse.UpdateCounts()
+					if response, err = EncodeMessage(dnsParsedResponse); err != nil {
+						return nil, err
+					}
+				}
+			}
+
+			resolver.cacheResponseAnswers(dnsParsedResponse)
+			// A response without answers is cached as a negative answer
+			resolver.cacheNegativeAnswer(dnsParsedResponse)
 			// log.Println("-------------------")
 			// PrintMessage(dnsParsedResponse)
 			// log.Println("-------------------")
@@ -156,34 +425,35 @@ func (resolver *Resolver) queryServers(serverList []Server, dnsRequest []byte, q
 			return response, nil
 		}
 
-		if dnsParsedResponse.ContainsAdditionalSectionWithIPAddresses() {
-			log.Printf("[depth %d]==> Got additional records response from server %s for %s", depth, server, queryDomain)
+		if !dnsParsedResponse.ContainsAuthoritySection() {
+			continue
+		}
+		delegatedZone, found := referralZone(dnsParsedResponse, zone, queryDomain)
+		if !found {
+			log.Printf("[depth %d]==> Question: %s: Moving on: server %s sent a referral outside of zone %s", depth, queryDomain, server.Fqdn, zone)
+			continue
+		}
 
-			authorityServers := resolver.extractNameServerIPs(dnsParsedResponse.Additionals)
+		// Glue is only trusted for the delegated zone's name servers, within
+		// the server's zone
+		if glue := referralGlue(dnsParsedResponse, delegatedZone, zone); len(glue) > 0 {
+			log.Printf("[depth %d]==> Got additional records response from server %s for %s", depth, server, queryDomain)
 
-			if len(authorityServers) > 0 {
-				return resolver.queryServers(authorityServers, dnsRequest, queryDomain, depth+1)
-			} else {
-				log.Println("------------------- ADDITIONAL SECTION IS EMPTY?")
-				PrintMessage(dnsParsedResponse)
-				log.Println("-------------------")
-				return nil, fmt.Errorf("%w: could not parse additional section in response from server %s", ErrServFailToResolveQuery, server)
-			}
+			resolver.cacheGlue(glue)
+			return resolver.queryServers(resolver.extractNameServerIPs(glue), delegatedZone, dnsRequest, queryDomain, depth+1)
 		}
 
-		if dnsParsedResponse.ContainsAuthoritySection() {
-			log.Printf("[depth %d]==> Got NS records from server %s for %s", depth, server, queryDomain)
+		log.Printf("[depth %d]==> Got NS records from server %s for %s", depth, server, queryDomain)
 
-			authorityServers := resolver.resolveNameServerRecords(dnsParsedResponse, server, depth+1)
+		authorityServers := resolver.resolveNameServerRecords(dnsParsedResponse, delegatedZone, server, zone, depth+1)
 
-			if len(authorityServers) > 0 {
-				return resolver.queryServers(authorityServers, dnsRequest, queryDomain, depth+1)
-			} else {
-				log.Println("------------------- AUTHORITY SECTION IS EMPTY?")
-				PrintMessage(dnsParsedResponse)
-				log.Println("-------------------")
-				return nil, fmt.Errorf("%w: could not parse authority section in response from server %s", ErrServFailToResolveQuery, server)
-			}
+		if len(authorityServers) > 0 {
+			return resolver.queryServers(authorityServers, delegatedZone, dnsRequest, queryDomain, depth+1)
+		} else {
+			log.Println("------------------- AUTHORITY SECTION IS EMPTY?")
+			PrintMessage(dnsParsedResponse)
+			log.Println("-------------------")
+			return nil, fmt.Errorf("%w: could not parse authority section in response from server %s", ErrServFailToResolveQuery, server)
 		}
 	}
 
@@ -191,12 +461,13 @@ func (resolver *Resolver) queryServers(serverList []Server, dnsRequest []byte, q
 }
 
 // resolveNameServerRecords resolves and returns a list of DNS servers for the NS records
-// in the provided DNS message. It first checks the cache and then queries the original
-// server or root servers if necessary. The function handles recursive queries and
-// returns a list of servers with the resolved IP addresses.
-func (resolver *Resolver) resolveNameServerRecords(dnsMessage Message, originalServer Server, depth int) (serverList []Server) {
+// of the delegated zone in the provided DNS message. It first checks the cache and then
+// queries the original server, which serves the given zone, or root servers if necessary.
+// The function handles recursive queries and returns a list of servers with the resolved
+// IP addresses.
+func (resolver *Resolver) resolveNameServerRecords(dnsMessage Message, delegatedZone string, originalServer Server, zone string, depth int) (serverList []Server) {
 	for _, nameServerRecord := range dnsMessage.NameServers {
-		if nameServerRecord.RType == NS {
+		if nameServerRecord.RType == NS && strings.EqualFold(nameServerRecord.Name, delegatedZone) {
 			nsRecord := nameServerRecord.RData.String()
 
 			// Check cache before attempting to query servers
@@ -206,40 +477,77 @@ func (resolver *Resolver) resolveNameServerRecords(dnsMessage Message, originalS
 				continue
 			}
 
-			nameServerQuery, err := CreateQuery(nsRecord, A)
-			if err != nil {
+			// Cached addresses, even glue, save a query
+			var cachedAddresses []ResourceRecord
+			for _, rType := range []uint16{A, AAAA} {
+				records, _ := resolver.getCachedRRset(nsRecord, rType, IN, CredibilityAdditional)
+				cachedAddresses = append(cachedAddresses, records...)
+			}
+			if len(cachedAddresses) > 0 {
+				log.Printf("--> Found cached addresses for %s", nsRecord)
+				serverList = append(serverList, resolver.extractNameServerIPs(cachedAddresses)...)
 				continue
 			}
 
-			// Query the server the response came from instead of going back up to root
-			response, err := resolver.queryServers([]Server{originalServer}, nameServerQuery, nsRecord, depth)
+			// Lookups of the same name server in flight at the same time are coalesced
+			servers, err, shared := resolver.nameServerLookups.do(nameServerCacheKey(nsRecord), depth, func() ([]Server, error) {
+				return resolver.lookupNameServer(nsRecord, originalServer, zone, depth)
+			})
 			if err != nil {
-				log.Printf("Failed to query original server %v for %s: %v", originalServer, nsRecord, err)
+				continue
+			}
+			if shared {
+				log.Printf("--> Shared lookup in flight for %s", nsRecord)
+			}
 
-				// If original server refuses the request, query root server
-				if err == ErrServFailToResolveQueryRefused {
-					rootServer := resolver.GetNextRootServer()
+			serverList = append(serverList, servers...)
+		}
+	}
+	return serverList
+}
 
-					response, err = resolver.queryServers([]Server{rootServer}, nameServerQuery, nsRecord, depth)
-					if err != nil {
-						log.Printf("Failed to query root server %v for %s: %v", originalServer, nsRecord, err)
-						continue
-					}
-				}
-			}
+// lookupNameServer queries the addresses of a name server, from the server
+// which referred to it, or from a root server if that server refuses or the
+// name server is out of its zone.
+func (resolver *Resolver) lookupNameServer(nsRecord string, originalServer Server, zone string, depth int) (serverList []Server, err error) {
+	nameServerQuery, err := CreateQuery(nsRecord, A)
+	if err != nil {
+		return nil, err
+	}
 
-			parsedResponse, err := DecodeMessage(response)
-			if err != nil {
-				log.Printf("Failed to decode message from server %v for %s: %v", originalServer, nsRecord, err)
-				continue
-			}
+	// Query the server the response came from instead of going back up to
+	// root, if it is trusted for the name server's name
+	if !inZone(nsRecord, zone) {
+		originalServer, zone = resolver.GetNextRootServer(), "."
+	}
+	response, err := resolver.queryServers([]Server{originalServer}, zone, nameServerQuery, nsRecord, depth)
+	if err != nil {
+		log.Printf("Failed to query original server %v for %s: %v", originalServer, nsRecord, err)
 
-			log.Printf("--> got response from servers for nsRecord: %s: %s\n", nsRecord, parsedResponse.Answers[0].RData.String())
+		// If original server refuses the request, query root server
+		if err == ErrServFailToResolveQueryRefused {
+			rootServer := resolver.GetNextRootServer()
 
-			serverList = append(serverList, resolver.extractNameServerIPs(parsedResponse.Answers)...)
+			response, err = resolver.queryServers([]Server{rootServer}, ".", nameServerQuery, nsRecord, depth)
+			if err != nil {
+				log.Printf("Failed to query root server %v for %s: %v", originalServer, nsRecord, err)
+				return nil, err
+			}
 		}
 	}
-	return serverList
+
+	parsedResponse, err := DecodeMessage(response)
+	if err != nil {
+		log.Printf("Failed to decode message from server %v for %s: %v", originalServer, nsRecord, err)
+		return nil, err
+	}
+	if len(parsedResponse.Answers) == 0 {
+		return nil, fmt.Errorf("no address for name server %s", nsRecord)
+	}
+
+	log.Printf("--> got response from servers for nsRecord: %s: %s\n", nsRecord, parsedResponse.Answers[0].RData.String())
+
+	return resolver.extractNameServerIPs(parsedResponse.Answers), nil
 }
 
 // extractNameServerIPs processes DNS resource records to extract server names and their
@@ -260,15 +568,10 @@ func (resolver *Resolver) extractNameServerIPs(dnsResourceRecord []ResourceRecor
 		}
 
 		switch record.RType {
-		case A:
-			serverAddr, err := netip.ParseAddr(ipString)
-			if err == nil {
-				serverList[index].IPv4 = serverAddr
-			}
-		case AAAA:
+		case A, AAAA:
 			serverAddr, err := netip.ParseAddr(ipString)
 			if err == nil {
-				serverList[index].IPv6 = serverAddr
+				serverList[index].addAddr(serverAddr)
 			}
 		}
 
@@ -3,6 +3,7 @@ package dns_test
 import (
 	"fmt"
 	"net/netip"
+	"strings"
 
 	"github.com/mcombeau/dns-tools/pkg/dns"
 )
@@ -68,9 +69,10 @@ var mockResponseAdditionalSectionToNoErrorAnswer = func(transmissionProtocol str
 
 	switch mockFunctionCalledCount {
 	case 0:
-		response = createARecordAdditionalResponse(parsedRequest, "abc.example.com.", "192.0.0.1")
+		response = createARecordAdditionalResponse(parsedRequest, "example.com.", "abc.example.com.", "192.0.0.1")
 	case 1:
-		response = createARecordAdditionalResponse(parsedRequest, "def.example.com.", "192.0.0.2")
+		zone := parsedRequest.Questions[0].Name
+		response = createARecordAdditionalResponse(parsedRequest, zone, "def."+zone, "192.0.0.2")
 	case 2:
 		response = createNoErrorAuthoritativeAnswer(parsedRequest, authoritativeAnswerIP)
 	default:
@@ -90,11 +92,12 @@ var mockResponseAuthoritySectionToNoErrorAnswer = func(transmissionProtocol stri
 
 	switch mockFunctionCalledCount {
 	case 0:
-		response = createNSResponse(parsedRequest, "ghi.example.com.")
+		response = createNSResponse(parsedRequest, "example.com.", "ghi.example.com.")
 	case 1:
 		response = createNoErrorAuthoritativeAnswer(parsedRequest, "192.0.0.1")
 	case 2:
-		response = createARecordAdditionalResponse(parsedRequest, "jkl.example.com.", "192.0.0.2")
+		zone := parsedRequest.Questions[0].Name
+		response = createARecordAdditionalResponse(parsedRequest, zone, "jkl."+zone, "192.0.0.2")
 	case 3:
 		response = createNoErrorAuthoritativeAnswer(parsedRequest, authoritativeAnswerIP)
 	default:
@@ -141,25 +144,139 @@ var mockResponseImmediateNxDomainAnswer = func(transmissionProtocol string, serv
 	return dns.EncodeMessage(response)
 }
 
-// -------------- Helper functions for response creation
+var cnameTarget = "cdn.example.net."
+
+// Simulate a response chain such as:
+// query -> CNAME answer to another zone -> authoritative answer for the CNAME target
+var mockResponseCNAMEToNoErrorAnswer = func(transmissionProtocol string, serverAddrPort netip.AddrPort, dnsRequest []byte) ([]byte, error) {
+	parsedRequest, err := dns.DecodeMessage(dnsRequest)
+	if err != nil {
+		return nil, err
+	}
 
-func resetResourceRecords(message *dns.Message) {
-	message.Header.AnswerRRCount = 0
-	message.Header.AdditionalRRCount = 0
-	message.Header.NameserverRRCount = 0
-	message.Answers = []dns.ResourceRecord{}
-	message.Additionals = []dns.ResourceRecord{}
-	message.NameServers = []dns.ResourceRecord{}
+	var response dns.Message
+
+	switch mockFunctionCalledCount {
+	case 0:
+		response = createCNAMEAuthoritativeAnswer(parsedRequest, cnameTarget)
+	case 1:
+		if parsedRequest.Questions[0].Name != cnameTarget {
+			return nil, fmt.Errorf("unexpected question %s", parsedRequest.Questions[0].Name)
+		}
+		response = createNoErrorAuthoritativeAnswer(parsedRequest, authoritativeAnswerIP)
+	default:
+		return nil, fmt.Errorf("exceeded max call count")
+	}
+	return dns.EncodeMessage(response)
 }
 
-func createNoErrorAuthoritativeAnswer(message dns.Message, ip string) dns.Message {
-	resetResourceRecords(&message)
+// Simulate a response chain such as:
+// query -> CNAME chain answer with records of other types and names
+var mockResponseCNAMEChainWithOtherRecords = func(transmissionProtocol string, serverAddrPort netip.AddrPort, dnsRequest []byte) ([]byte, error) {
+	parsedRequest, err := dns.DecodeMessage(dnsRequest)
+	if err != nil {
+		return nil, err
+	}
+	if mockFunctionCalledCount > 0 {
+		return nil, fmt.Errorf("exceeded max call count")
+	}
+
+	response := createCNAMEChainAnswer(parsedRequest, "target.example.com.", authoritativeAnswerIP)
+	response.Answers = append(response.Answers,
+		dns.ResourceRecord{Name: "target.example.com.", RType: dns.AAAA, RClass: dns.IN, TTL: 300, RDLength: 16, RData: &dns.RDataAAAA{IP: netip.MustParseAddr("2001:db8::1")}},
+		dns.ResourceRecord{Name: "unrelated.example.com.", RType: dns.A, RClass: dns.IN, TTL: 300, RDLength: 4, RData: &dns.RDataA{IP: netip.MustParseAddr("192.0.2.66")}},
+	)
+	response.UpdateCounts()
+	return dns.EncodeMessage(response)
+}
 
-	message.Header.Flags.ResponseCode = dns.NOERROR
-	message.Header.AnswerRRCount = 1
+// Simulate a response chain such as:
+// query -> CNAME answer to another zone -> CNAME answer back to the query name
+var mockResponseCNAMELoop = func(transmissionProtocol string, serverAddrPort netip.AddrPort, dnsRequest []byte) ([]byte, error) {
+	parsedRequest, err := dns.DecodeMessage(dnsRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	var response dns.Message
+
+	switch mockFunctionCalledCount {
+	case 0:
+		response = createCNAMEAuthoritativeAnswer(parsedRequest, "loop.example.net.")
+	case 1:
+		response = createCNAMEAuthoritativeAnswer(parsedRequest, "loop.example.com.")
+	default:
+		return nil, fmt.Errorf("exceeded max call count")
+	}
+	return dns.EncodeMessage(response)
+}
+
+var dnameOwner = "partner.com."
+var dnameTarget = "partner.net."
+
+// Simulate a response chain such as:
+// query -> DNAME answer without a CNAME -> authoritative answer for the substituted name
+var mockResponseDNAMEToNoErrorAnswer = func(transmissionProtocol string, serverAddrPort netip.AddrPort, dnsRequest []byte) ([]byte, error) {
+	parsedRequest, err := dns.DecodeMessage(dnsRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	var response dns.Message
+
+	switch mockFunctionCalledCount {
+	case 0:
+		response = createDNAMEAuthoritativeAnswer(parsedRequest, dnameOwner, dnameTarget)
+	case 1:
+		if !strings.HasSuffix(parsedRequest.Questions[0].Name, "."+dnameTarget) {
+			return nil, fmt.Errorf("unexpected question %s", parsedRequest.Questions[0].Name)
+		}
+		response = createNoErrorAuthoritativeAnswer(parsedRequest, authoritativeAnswerIP)
+	default:
+		return nil, fmt.Errorf("exceeded max call count")
+	}
+	return dns.EncodeMessage(response)
+}
+
+// Simulate an authoritative answer for a name substituted with a cached DNAME
+var mockResponseDNAMETargetNoErrorAnswer = func(transmissionProtocol string, serverAddrPort netip.AddrPort, dnsRequest []byte) ([]byte, error) {
+	parsedRequest, err := dns.DecodeMessage(dnsRequest)
+	if err != nil {
+		return nil, err
+	}
+	if mockFunctionCalledCount > 0 || !strings.HasSuffix(parsedRequest.Questions[0].Name, "."+dnameTarget) {
+		return nil, fmt.Errorf("unexpected question %s", parsedRequest.Questions[0].Name)
+	}
+	return dns.EncodeMessage(createNoErrorAuthoritativeAnswer(parsedRequest, authoritativeAnswerIP))
+}
+
+var longDNAMEOwner = "long.example.org."
+var longDNAMETarget = strings.Repeat("c", 63) + "." + strings.Repeat("d", 63) + ".example.net."
+
+// Simulate a DNAME answer which makes the query name too long
+var mockResponseDNAMEOverflow = func(transmissionProtocol string, serverAddrPort netip.AddrPort, dnsRequest []byte) ([]byte, error) {
+	parsedRequest, err := dns.DecodeMessage(dnsRequest)
+	if err != nil {
+		return nil, err
+	}
+	if mockFunctionCalledCount > 0 {
+		return nil, fmt.Errorf("exceeded max call count")
+	}
+	return dns.EncodeMessage(createDNAMEAuthoritativeAnswer(parsedRequest, longDNAMEOwner, longDNAMETarget))
+}
+
+// Simulate a resolution that must be answered from the cache
+var mockResponseNoQuery = func(transmissionProtocol string, serverAddrPort netip.AddrPort, dnsRequest []byte) ([]byte, error) {
+	return nil, fmt.Errorf("unexpected query: answer should be cached")
+}
+
+// -------------- Helper functions for response creation
+
+func createNoErrorAuthoritativeAnswer(request dns.Message, ip string) dns.Message {
+	message := dns.NewErrorReply(request, dns.NOERROR)
 	message.Answers = []dns.ResourceRecord{
 		{
-			Name:     message.Questions[0].Name,
+			Name:     request.Questions[0].Name,
 			RType:    dns.A,
 			RClass:   dns.IN,
 			TTL:      300,
@@ -167,16 +284,85 @@ func createNoErrorAuthoritativeAnswer(message dns.Message, ip string) dns.Messag
 			RData:    &dns.RDataA{IP: netip.MustParseAddr(ip)},
 		},
 	}
+	message.UpdateCounts()
+	return message
+}
+
+func createCNAMEAuthoritativeAnswer(request dns.Message, target string) dns.Message {
+	message := dns.NewErrorReply(request, dns.NOERROR)
+	message.Answers = []dns.ResourceRecord{
+		{
+			Name:     request.Questions[0].Name,
+			RType:    dns.CNAME,
+			RClass:   dns.IN,
+			TTL:      300,
+			RDLength: uint16(len(target) + 1),
+			RData:    &dns.RDataCNAME{DomainName: target},
+		},
+	}
+	message.UpdateCounts()
+	return message
+}
+
+// createCNAMEChainAnswer creates the answer to a query for an alias: the
+// CNAME record followed by the address of its target
+func createCNAMEChainAnswer(request dns.Message, target string, ip string) dns.Message {
+	message := createCNAMEAuthoritativeAnswer(request, target)
+	message.Answers = append(message.Answers, dns.ResourceRecord{
+		Name:     target,
+		RType:    dns.A,
+		RClass:   dns.IN,
+		TTL:      300,
+		RDLength: 4,
+		RData:    &dns.RDataA{IP: netip.MustParseAddr(ip)},
+	})
+	message.UpdateCounts()
+	return message
+}
+
+func createDNAMERecord(owner string, target string) dns.ResourceRecord {
+	return dns.ResourceRecord{
+		Name:     owner,
+		RType:    dns.DNAME,
+		RClass:   dns.IN,
+		TTL:      300,
+		RDLength: uint16(len(target) + 1),
+		RData:    &dns.RDataDNAME{DomainName: target},
+	}
+}
+
+func createDNAMEAuthoritativeAnswer(request dns.Message, owner string, target string) dns.Message {
+	message := dns.NewErrorReply(request, dns.NOERROR)
+	message.Answers = []dns.ResourceRecord{createDNAMERecord(owner, target)}
+	message.UpdateCounts()
 	return message
 }
 
-func createARecordAdditionalResponse(message dns.Message, name string, ip string) dns.Message {
-	resetResourceRecords(&message)
+// createDNAMEChainAnswer creates the answer to a query for a name below a
+// DNAME's owner: the DNAME record, the CNAME record synthesized from it and
+// the address of the substituted name
+func createDNAMEChainAnswer(request dns.Message, owner string, target string, ip string) dns.Message {
+	substitutedName := strings.TrimSuffix(request.Questions[0].Name, owner) + target
+	message := createCNAMEChainAnswer(request, substitutedName, ip)
+	message.Answers = append([]dns.ResourceRecord{createDNAMERecord(owner, target)}, message.Answers...)
+	message.UpdateCounts()
+	return message
+}
+
+func createDNAMEYXDomainReply(request dns.Message) dns.Message {
+	message := dns.NewErrorReply(request, dns.YXDOMAIN)
+	message.Answers = []dns.ResourceRecord{createDNAMERecord(longDNAMEOwner, longDNAMETarget)}
+	message.UpdateCounts()
+	return message
+}
 
-	message.Header.AdditionalRRCount = 1
+// createARecordAdditionalResponse creates a referral to a zone: the NS record
+// of its name server and the name server's address as glue
+func createARecordAdditionalResponse(request dns.Message, zone string, name string, ip string) dns.Message {
+	message := createNSResponse(request, zone, name)
 	message.Additionals = []dns.ResourceRecord{
 		{
-			Name:     "ns0.example.com",
+			Name:     name,
 			RType:    dns.A,
 			RClass:   dns.IN,
 			TTL:      300,
@@ -184,31 +370,29 @@ func createARecordAdditionalResponse(message dns.Message, name string, ip string
 			RData:    &dns.RDataA{IP: netip.MustParseAddr(ip)},
 		},
 	}
+	message.UpdateCounts()
 	return message
 }
 
-func createNSResponse(message dns.Message, name string) dns.Message {
-	resetResourceRecords(&message)
-
-	message.Header.NameserverRRCount = 1
+// createNSResponse creates a referral to a zone without glue
+func createNSResponse(request dns.Message, zone string, name string) dns.Message {
+	message := dns.NewReply(request)
 	message.NameServers = []dns.ResourceRecord{
 		{
-			Name:     "example",
+			Name:     zone,
 			RType:    dns.NS,
 			RClass:   dns.IN,
 			TTL:      300,
-			RDLength: 4,
+			RDLength: uint16(len(name) + 1),
 			RData:    &dns.RDataNS{DomainName: name},
 		},
 	}
+	message.UpdateCounts()
 	return message
 }
 
-func createSOAAuthoritativeAnswer(message dns.Message, rCode uint16) dns.Message {
-	resetResourceRecords(&message)
-
-	message.Header.Flags.ResponseCode = rCode
-	message.Header.NameserverRRCount = 1
+func createSOAAuthoritativeAnswer(request dns.Message, rCode uint16) dns.Message {
+	message := dns.NewErrorReply(request, rCode)
 	message.NameServers = []dns.ResourceRecord{
 		{
 			Name:     "ns0.example.com",
@@ -227,5 +411,13 @@ func createSOAAuthoritativeAnswer(message dns.Message, rCode uint16) dns.Message
 			},
 		},
 	}
+	message.UpdateCounts()
+	return message
+}
+
+// createRecursiveReply turns a mock server response into the reply
+// the resolver is expected to send back to its client.
+func createRecursiveReply(message dns.Message) dns.Message {
+	message.Header.Flags.RecursionAvailable = true
 	return message
 }
@@ -3,6 +3,9 @@ package dns_test
 import (
 	"net/netip"
 	"reflect"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/mcombeau/dns-tools/pkg/dns"
@@ -23,35 +26,98 @@ func TestResolveQuery(t *testing.T) {
 			name:         "Test immediate NoError answer",
 			mockFunction: mockResponseImmediateNoErrorAnswer,
 			queryFqdn:    "example.com.",
-			wantResponse: createNoErrorAuthoritativeAnswer(updateTestQueryDomain("example.com."), authoritativeAnswerIP),
+			wantResponse: createRecursiveReply(createNoErrorAuthoritativeAnswer(updateTestQueryDomain("example.com."), authoritativeAnswerIP)),
 			wantError:    nil,
 		},
 		{
 			name:         "Test response: additional -> NoError answer",
 			mockFunction: mockResponseAdditionalSectionToNoErrorAnswer,
 			queryFqdn:    "toto.example.com.",
-			wantResponse: createNoErrorAuthoritativeAnswer(updateTestQueryDomain("toto.example.com."), authoritativeAnswerIP),
+			wantResponse: createRecursiveReply(createNoErrorAuthoritativeAnswer(updateTestQueryDomain("toto.example.com."), authoritativeAnswerIP)),
 			wantError:    nil,
 		},
 		{
 			name:         "Test response: authority NS -> NoError answer -> NoError answer",
 			mockFunction: mockResponseAuthoritySectionToNoErrorAnswer,
 			queryFqdn:    "titi.example.com.",
-			wantResponse: createNoErrorAuthoritativeAnswer(updateTestQueryDomain("titi.example.com."), authoritativeAnswerIP),
+			wantResponse: createRecursiveReply(createNoErrorAuthoritativeAnswer(updateTestQueryDomain("titi.example.com."), authoritativeAnswerIP)),
 			wantError:    nil,
 		},
 		{
 			name:         "Test immediate SOA answer",
 			mockFunction: mockResponseImmediateSOAAnswer,
 			queryFqdn:    "tata.example.com.",
-			wantResponse: createSOAAuthoritativeAnswer(updateTestQueryDomain("tata.example.com."), dns.NOERROR),
+			wantResponse: createRecursiveReply(createSOAAuthoritativeAnswer(updateTestQueryDomain("tata.example.com."), dns.NOERROR)),
 			wantError:    nil,
 		},
 		{
 			name:         "Test immediate NXDOMAIN answer",
 			mockFunction: mockResponseImmediateNxDomainAnswer,
 			queryFqdn:    "tutu.example.com.",
-			wantResponse: createSOAAuthoritativeAnswer(updateTestQueryDomain("tutu.example.com."), dns.NXDOMAIN),
+			wantResponse: createRecursiveReply(createSOAAuthoritativeAnswer(updateTestQueryDomain("tutu.example.com."), dns.NXDOMAIN)),
+			wantError:    nil,
+		},
+		{
+			name:         "Test cached SOA answer",
+			mockFunction: mockResponseNoQuery,
+			queryFqdn:    "tata.example.com.",
+			wantResponse: createRecursiveReply(createSOAAuthoritativeAnswer(updateTestQueryDomain("tata.example.com."), dns.NOERROR)),
+			wantError:    nil,
+		},
+		{
+			name:         "Test cached NXDOMAIN answer",
+			mockFunction: mockResponseNoQuery,
+			queryFqdn:    "tutu.example.com.",
+			wantResponse: createRecursiveReply(createSOAAuthoritativeAnswer(updateTestQueryDomain("tutu.example.com."), dns.NXDOMAIN)),
+			wantError:    nil,
+		},
+		{
+			name:         "Test response: CNAME -> NoError answer for the CNAME target",
+			mockFunction: mockResponseCNAMEToNoErrorAnswer,
+			queryFqdn:    "alias.example.com.",
+			wantResponse: createRecursiveReply(createCNAMEChainAnswer(updateTestQueryDomain("alias.example.com."), cnameTarget, authoritativeAnswerIP)),
+			wantError:    nil,
+		},
+		{
+			name:         "Test cached CNAME chain",
+			mockFunction: mockResponseNoQuery,
+			queryFqdn:    "alias.example.com.",
+			wantResponse: createRecursiveReply(createCNAMEChainAnswer(updateTestQueryDomain("alias.example.com."), cnameTarget, authoritativeAnswerIP)),
+			wantError:    nil,
+		},
+		{
+			name:         "Test CNAME chain with other records",
+			mockFunction: mockResponseCNAMEChainWithOtherRecords,
+			queryFqdn:    "chain.example.com.",
+			wantResponse: createRecursiveReply(createCNAMEChainAnswer(updateTestQueryDomain("chain.example.com."), "target.example.com.", authoritativeAnswerIP)),
+			wantError:    nil,
+		},
+		{
+			name:         "Test response: DNAME -> NoError answer for the substituted name",
+			mockFunction: mockResponseDNAMEToNoErrorAnswer,
+			queryFqdn:    "www." + dnameOwner,
+			wantResponse: createRecursiveReply(createDNAMEChainAnswer(updateTestQueryDomain("www."+dnameOwner), dnameOwner, dnameTarget, authoritativeAnswerIP)),
+			wantError:    nil,
+		},
+		{
+			name:         "Test cached DNAME -> NoError answer for the substituted name",
+			mockFunction: mockResponseDNAMETargetNoErrorAnswer,
+			queryFqdn:    "mail." + dnameOwner,
+			wantResponse: createRecursiveReply(createDNAMEChainAnswer(updateTestQueryDomain("mail."+dnameOwner), dnameOwner, dnameTarget, authoritativeAnswerIP)),
+			wantError:    nil,
+		},
+		{
+			name:         "Test DNAME substitution too long",
+			mockFunction: mockResponseDNAMEOverflow,
+			queryFqdn:    strings.Repeat("a", 63) + "." + strings.Repeat("b", 63) + "." + longDNAMEOwner,
+			wantResponse: createRecursiveReply(createDNAMEYXDomainReply(updateTestQueryDomain(strings.Repeat("a", 63) + "." + strings.Repeat("b", 63) + "." + longDNAMEOwner))),
+			wantError:    nil,
+		},
+		{
+			name:         "Test CNAME loop",
+			mockFunction: mockResponseCNAMELoop,
+			queryFqdn:    "loop.example.com.",
+			wantResponse: createRecursiveReply(dns.NewErrorReply(updateTestQueryDomain("loop.example.com."), dns.SERVFAIL)),
 			wantError:    nil,
 		},
 	}
@@ -105,3 +171,181 @@ func updateTestQueryDomain(fqdn string) dns.Message {
 	testQuery.Questions[0].Name = fqdn
 	return testQuery
 }
+
+func TestResolveQueryUntrustedRecords(t *testing.T) {
+	resolver, err := dns.NewResolver(testRootServerHintsFile)
+	if err != nil {
+		t.Fatalf("NewResolver() error = %v", err)
+	}
+	nameServerAddr := netip.MustParseAddr("192.0.2.53")
+
+	// Root servers answer for any name, except shop.example.com., which they
+	// delegate to the example.com. name server. That server answers with an
+	// address for a name out of its zone.
+	queried := make(map[string]int)
+	var mutex sync.Mutex
+	resolver.QueryFunc = func(_ string, serverAddrPort netip.AddrPort, dnsRequest []byte) ([]byte, error) {
+		request, err := dns.DecodeMessage(dnsRequest)
+		if err != nil {
+			return nil, err
+		}
+		name := request.Questions[0].Name
+		mutex.Lock()
+		queried[name]++
+		mutex.Unlock()
+
+		var response dns.Message
+		switch {
+		case serverAddrPort.Addr() == nameServerAddr:
+			response = createCNAMEChainAnswer(request, "shop.example.org.", "192.0.2.66")
+		case name == "shop.example.com.":
+			response = createARecordAdditionalResponse(request, "example.com.", "ns.example.com.", nameServerAddr.String())
+		case name == "www.example.com.":
+			response = createNoErrorAuthoritativeAnswer(request, authoritativeAnswerIP)
+			response.Answers = append(response.Answers, createNoErrorAuthoritativeAnswer(updateTestQueryDomain("bank.example.org."), "192.0.2.66").Answers...)
+			response.UpdateCounts()
+		default:
+			response = createNoErrorAuthoritativeAnswer(request, authoritativeAnswerIP)
+		}
+		return dns.EncodeMessage(response)
+	}
+
+	resolve := func(name string) (answers []string) {
+		t.Helper()
+		request, _ := dns.EncodeMessage(updateTestQueryDomain(name))
+		response, err := resolver.ResolveQuery(request)
+		if err != nil {
+			t.Fatalf("ResolveQuery() error = %v", err)
+		}
+		reply, err := dns.DecodeMessage(response)
+		if err != nil {
+			t.Fatalf("ResolveQuery() response cannot be decoded: %v", err)
+		}
+		for _, answer := range reply.Answers {
+			answers = append(answers, answer.Name+" "+answer.RData.String())
+		}
+		return answers
+	}
+
+	t.Run("Unrelated record", func(t *testing.T) {
+		if answers := resolve("www.example.com."); !slices.Equal(answers, []string{"www.example.com. " + authoritativeAnswerIP}) {
+			t.Errorf("ResolveQuery() answers got = %v, want the question's address only", answers)
+		}
+		if answers := resolve("bank.example.org."); !slices.Equal(answers, []string{"bank.example.org. " + authoritativeAnswerIP}) || queried["bank.example.org."] == 0 {
+			t.Errorf("ResolveQuery() answers got = %v after %d queries, want the address from the servers", answers, queried["bank.example.org."])
+		}
+	})
+
+	t.Run("Record out of the zone", func(t *testing.T) {
+		want := []string{"shop.example.com. shop.example.org.", "shop.example.org. " + authoritativeAnswerIP}
+		if answers := resolve("shop.example.com."); !slices.Equal(answers, want) || queried["shop.example.org."] == 0 {
+			t.Errorf("ResolveQuery() answers got = %v after %d queries for the CNAME target, want = %v", answers, queried["shop.example.org."], want)
+		}
+	})
+}
+
+func TestResolveQueryGlueOutOfDelegatedZone(t *testing.T) {
+	resolver, err := dns.NewResolver(testRootServerHintsFile)
+	if err != nil {
+		t.Fatalf("NewResolver() error = %v", err)
+	}
+	tldServerAddr := netip.MustParseAddr("192.0.2.30")
+
+	// Root servers delegate com. to a name server in net., with its address
+	// as glue, and that server answers
+	var mutex sync.Mutex
+	var queried []string
+	resolver.QueryFunc = func(_ string, serverAddrPort netip.AddrPort, dnsRequest []byte) ([]byte, error) {
+		request, err := dns.DecodeMessage(dnsRequest)
+		if err != nil {
+			return nil, err
+		}
+		mutex.Lock()
+		queried = append(queried, request.Questions[0].Name)
+		mutex.Unlock()
+
+		if serverAddrPort.Addr() == tldServerAddr {
+			return dns.EncodeMessage(createNoErrorAuthoritativeAnswer(request, authoritativeAnswerIP))
+		}
+		return dns.EncodeMessage(createARecordAdditionalResponse(request, "com.", "a.gtld-servers.net.", tldServerAddr.String()))
+	}
+
+	request, _ := dns.EncodeMessage(updateTestQueryDomain("glue.example.com."))
+	response, err := resolver.ResolveQuery(request)
+	if err != nil {
+		t.Fatalf("ResolveQuery() error = %v", err)
+	}
+	reply, err := dns.DecodeMessage(response)
+	if err != nil || len(reply.Answers) != 1 || reply.Answers[0].RData.String() != authoritativeAnswerIP {
+		t.Fatalf("ResolveQuery() got %+v, %v, want the address from the com. name server", reply.Answers, err)
+	}
+	if !slices.Equal(queried, []string{"glue.example.com.", "glue.example.com."}) {
+		t.Errorf("servers were queried for %v, want the question only, using the glue", queried)
+	}
+}
+
+func TestResolveQueryTruncation(t *testing.T) {
+	resolver, err := dns.NewResolver(testRootServerHintsFile)
+	if err != nil {
+		t.Fatalf("NewResolver() error = %v", err)
+	}
+
+	// The answer has 30 addresses, too many for 512 bytes
+	resolver.QueryFunc = func(_ string, _ netip.AddrPort, dnsRequest []byte) ([]byte, error) {
+		request, err := dns.DecodeMessage(dnsRequest)
+		if err != nil {
+			return nil, err
+		}
+		response := createNoErrorAuthoritativeAnswer(request, authoritativeAnswerIP)
+		for i := 1; i < 30; i++ {
+			answer := response.Answers[0]
+			answer.RData = &dns.RDataA{IP: netip.AddrFrom4([4]byte{192, 0, 2, byte(i)})}
+			response.Answers = append(response.Answers, answer)
+		}
+		response.UpdateCounts()
+		return dns.EncodeMessage(response)
+	}
+
+	tests := []struct {
+		name          string
+		edns          bool
+		udpSize       uint16
+		wantTruncated bool
+		wantAnswers   int
+	}{
+		{name: "Without EDNS", wantTruncated: true},
+		{name: "EDNS UDP size below 512", edns: true, udpSize: 256, wantTruncated: true},
+		{name: "EDNS UDP size", edns: true, udpSize: 1232, wantAnswers: 30},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := updateTestQueryDomain("big.example.com.")
+			request.Additionals = nil
+			if tt.edns {
+				request.SetEDNS(dns.EDNS{UDPSize: tt.udpSize})
+			}
+			request.UpdateCounts()
+			dnsRequest, _ := dns.EncodeMessage(request)
+
+			response, err := resolver.ResolveQuery(dnsRequest)
+			if err != nil {
+				t.Fatalf("ResolveQuery() error = %v", err)
+			}
+			if len(response) > max(int(tt.udpSize), dns.MaxUDPMessageLength) {
+				t.Errorf("ResolveQuery() response length = %d, want at most the UDP payload size", len(response))
+			}
+			reply, err := dns.DecodeMessage(response)
+			if err != nil {
+				t.Fatalf("DecodeMessage() error = %v", err)
+			}
+			if reply.Header.Flags.Truncated != tt.wantTruncated || len(reply.Answers) != tt.wantAnswers {
+				t.Errorf("ResolveQuery() got TC = %t with %d answers, want TC = %t with %d answers",
+					reply.Header.Flags.Truncated, len(reply.Answers), tt.wantTruncated, tt.wantAnswers)
+			}
+			if _, found := reply.GetEDNS(); found != tt.edns {
+				t.Errorf("ResolveQuery() reply has EDNS = %t, want %t", found, tt.edns)
+			}
+		})
+	}
+}
@@ -0,0 +1,335 @@
+package dns
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// resolv.conf (resolv.conf(5)):
+// The stub resolver configuration file lists the name servers to query, the
+// search list used to complete short names, and resolver options:
+//
+//	nameserver 192.0.2.53
+//	nameserver fe80::1%eth0
+//	search example.com example.net
+//	options ndots:2 timeout:3 attempts:2 rotate edns0 use-vc
+//
+// As with glibc, queries are sent to each name server in turn, for the
+// configured number of attempts, until one of them answers.
+
+const DefaultResolvConfPath = "/etc/resolv.conf"
+
+// Defaults and limits of resolv.conf options, as in glibc
+const (
+	DefaultResolvConfNdots    = 1
+	DefaultResolvConfTimeout  = 5 * time.Second
+	DefaultResolvConfAttempts = 2
+
+	maxResolvConfNdots    = 15
+	maxResolvConfTimeout  = 30 * time.Second
+	maxResolvConfAttempts = 5
+)
+
+// ResolvConf is a stub resolver configuration, as read from /etc/resolv.conf.
+type ResolvConf struct {
+	// Nameservers are the servers to query, in order. IPv6 addresses may
+	// have a zone (fe80::1%eth0).
+	Nameservers []netip.AddrPort
+	// Search is the list of domains (FQDNs) used to complete names with
+	// fewer than Ndots dots.
+	Search []string
+	// Ndots is the number of dots a name must have to be tried as an
+	// absolute name before the search list.
+	Ndots int
+	// Timeout is the time to wait for a response from a name server.
+	Timeout time.Duration
+	// Attempts is the number of times every name server is tried.
+	Attempts int
+	// Rotate spreads the load between name servers by starting with the
+	// next one on each query, instead of always starting with the first.
+	Rotate bool
+	// EDNS0 adds an OPT record to queries to advertise a larger UDP size.
+	EDNS0 bool
+	// UseVC sends queries over TCP instead of UDP.
+	UseVC bool
+
+	nextServer atomic.Uint32
+}
+
+// NewResolvConf creates a configuration with glibc's defaults and the given
+// name servers.
+func NewResolvConf(nameservers ...netip.AddrPort) *ResolvConf {
+	return &ResolvConf{
+		Nameservers: nameservers,
+		Ndots:       DefaultResolvConfNdots,
+		Timeout:     DefaultResolvConfTimeout,
+		Attempts:    DefaultResolvConfAttempts,
+	}
+}
+
+// ReadResolvConf reads a resolv.conf file. If the file lists no name server,
+// the local name server is used (127.0.0.1 and ::1). If it has no search
+// list, the domain of the host name is used, if any.
+//
+// Parameters:
+//   - path: the path of the file, usually DefaultResolvConfPath
+//
+// Returns:
+//   - conf: the parsed configuration
+//   - err: an error if the file could not be read
+func ReadResolvConf(path string) (conf *ResolvConf, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open %s: %w", path, err)
+	}
+	defer file.Close()
+
+	conf, err = ParseResolvConf(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", path, err)
+	}
+
+	if len(conf.Search) == 0 {
+		if hostname, err := os.Hostname(); err == nil {
+			if _, domain, found := strings.Cut(hostname, "."); found && domain != "" {
+				conf.Search = []string{MakeFQDN(domain)}
+			}
+		}
+	}
+	return conf, nil
+}
+
+// ParseResolvConf parses resolv.conf contents. Unknown keywords and options
+// and invalid lines are ignored, as glibc does. The "domain" and "search"
+// keywords override each other: the last one wins.
+//
+// Parameters:
+//   - reader: the resolv.conf contents
+//
+// Returns:
+//   - conf: the parsed configuration, with defaults for missing options
+//   - err: an error if the contents could not be read
+func ParseResolvConf(reader io.Reader) (conf *ResolvConf, err error) {
+	conf = NewResolvConf()
+	scanner := bufio.NewScanner(reader)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		switch fields[0] {
+		case "nameserver":
+			addr, err := netip.ParseAddr(fields[1])
+			if err != nil {
+				continue
+			}
+			conf.Nameservers = append(conf.Nameservers, netip.AddrPortFrom(addr, DefaultPort))
+		case "domain":
+			conf.Search = []string{MakeFQDN(fields[1])}
+		case "search":
+			conf.Search = nil
+			for _, domain := range fields[1:] {
+				conf.Search = append(conf.Search, MakeFQDN(domain))
+			}
+		case "options":
+			for _, option := range fields[1:] {
+				conf.parseOption(option)
+			}
+		}
+	}
+
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(conf.Nameservers) == 0 {
+		conf.Nameservers = []netip.AddrPort{
+			netip.MustParseAddrPort("127.0.0.1:53"),
+			netip.MustParseAddrPort("[::1]:53"),
+		}
+	}
+	return conf, nil
+}
+
+// parseOption applies a single resolv.conf option, capping values as glibc
+// does.
+func (conf *ResolvConf) parseOption(option string) {
+	name, value, _ := strings.Cut(option, ":")
+	number, err := strconv.Atoi(value)
+	hasNumber := err == nil && number >= 0
+
+	switch name {
+	case "ndots":
+		if hasNumber {
+			conf.Ndots = min(number, maxResolvConfNdots)
+		}
+	case "timeout":
+		if hasNumber && number > 0 {
+			conf.Timeout = min(time.Duration(number)*time.Second, maxResolvConfTimeout)
+		}
+	case "attempts":
+		if hasNumber && number > 0 {
+			conf.Attempts = min(number, maxResolvConfAttempts)
+		}
+	case "rotate":
+		conf.Rotate = true
+	case "edns0":
+		conf.EDNS0 = true
+	case "use-vc", "usevc", "tcp":
+		conf.UseVC = true
+	}
+}
+
+// searchNames returns the names to try, in order, to resolve a name with the
+// search list. An absolute name (with a trailing dot) is tried as is. A name
+// with at least Ndots dots is tried as is before the search list, otherwise
+// after it.
+func (conf *ResolvConf) searchNames(name string) (names []string) {
+	if IsFQDN(name) {
+		return []string{name}
+	}
+
+	absolute := MakeFQDN(name)
+	hasNdots := strings.Count(name, ".") >= conf.Ndots
+	if hasNdots {
+		names = append(names, absolute)
+	}
+	for _, domain := range conf.Search {
+		if domain == "." {
+			continue
+		}
+		names = append(names, name+"."+domain)
+	}
+	if !hasNdots {
+		names = append(names, absolute)
+	}
+	return names
+}
+
+// Query sends a DNS query to the configured name servers in turn until one of
+// them answers, for the configured number of attempts. Each attempt is
+// limited to the configured timeout. A server that answers with SERVFAIL,
+// NOTIMP or REFUSED is skipped, but its response is returned if no other
+// server gives a better one.
+//
+// Over UDP, a truncated response is retried over TCP with the same server,
+// and all queries go over TCP if UseVC is set.
+//
+// Parameters:
+//   - ctx: the context, which cancels the query when done
+//   - transport: the transport to send queries with
+//   - transmissionProtocol: "udp", "tcp", "tls", "https" or "quic"
+//   - dnsRequest: the encoded DNS request
+//
+// Returns:
+//   - response: the encoded DNS response
+//   - serverAddrPort: the server the response came from
+//   - usedProtocol: the protocol the response came over
+//   - err: an error if no server answered
+func (conf *ResolvConf) Query(ctx context.Context, transport *Transport, transmissionProtocol string, dnsRequest []byte) (response []byte, serverAddrPort netip.AddrPort, usedProtocol string, err error) {
+	if len(conf.Nameservers) == 0 {
+		return nil, serverAddrPort, "", ErrNoNameservers
+	}
+
+	if conf.EDNS0 {
+		dnsRequest, err = addEDNS(dnsRequest)
+		if err != nil {
+			return nil, serverAddrPort, "", fmt.Errorf("invalid DNS request: %w", err)
+		}
+	}
+	if transmissionProtocol == "udp" && conf.UseVC {
+		transmissionProtocol = "tcp"
+	}
+
+	attempts := max(conf.Attempts, 1)
+	first := 0
+	if conf.Rotate {
+		first = int(conf.nextServer.Add(1)-1) % len(conf.Nameservers)
+	}
+
+	var lastResponse []byte
+	var lastServer netip.AddrPort
+	var lastProtocol string
+	for attempt := 0; attempt < attempts; attempt++ {
+		for i := range conf.Nameservers {
+			serverAddrPort = conf.Nameservers[(first+i)%len(conf.Nameservers)]
+
+			response, usedProtocol, err = conf.queryServer(ctx, transport, transmissionProtocol, serverAddrPort, dnsRequest)
+			if ctx.Err() != nil {
+				return nil, serverAddrPort, usedProtocol, fmt.Errorf("DNS query cancelled: %w", ctx.Err())
+			}
+			if err != nil {
+				continue
+			}
+
+			message, decodeErr := DecodeMessage(response)
+			if decodeErr != nil {
+				err = fmt.Errorf("invalid response from %v: %w", serverAddrPort, decodeErr)
+				continue
+			}
+			switch message.GetResponseCode() {
+			case SERVFAIL, NOTIMP, REFUSED:
+				lastResponse, lastServer, lastProtocol = response, serverAddrPort, usedProtocol
+				continue
+			}
+			return response, serverAddrPort, usedProtocol, nil
+		}
+	}
+
+	if lastResponse != nil {
+		return lastResponse, lastServer, lastProtocol, nil
+	}
+	return nil, serverAddrPort, usedProtocol, fmt.Errorf("no name server answered: %w", err)
+}
+
+// queryServer sends a query to a single name server within the configured
+// timeout, falling back to TCP if a UDP response is truncated.
+func (conf *ResolvConf) queryServer(ctx context.Context, transport *Transport, transmissionProtocol string, serverAddrPort netip.AddrPort, dnsRequest []byte) (response []byte, usedProtocol string, err error) {
+	if conf.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, conf.Timeout)
+		defer cancel()
+	}
+
+	response, err = transport.QueryContext(ctx, transmissionProtocol, serverAddrPort, dnsRequest)
+	if err != nil || transmissionProtocol != "udp" {
+		return response, transmissionProtocol, err
+	}
+
+	// If the UDP response is truncated, fall back to TCP
+	if len(response) > 2 && response[2]&byte(TCMask>>8) != 0 {
+		response, err = transport.QueryContext(ctx, "tcp", serverAddrPort, dnsRequest)
+		return response, "tcp", err
+	}
+	return response, transmissionProtocol, nil
+}
+
+// addEDNS adds an OPT record advertising the default EDNS UDP size to an
+// encoded query, unless it already has one.
+func addEDNS(dnsRequest []byte) (request []byte, err error) {
+	message, err := DecodeMessage(dnsRequest)
+	if err != nil {
+		return nil, err
+	}
+	if _, found := message.GetEDNS(); found {
+		return dnsRequest, nil
+	}
+
+	message.SetEDNS(EDNS{UDPSize: DefaultEDNSUDPSize})
+	return EncodeMessage(message)
+}
@@ -0,0 +1,331 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseResolvConf(t *testing.T) {
+	localNameservers := []netip.AddrPort{
+		netip.MustParseAddrPort("127.0.0.1:53"),
+		netip.MustParseAddrPort("[::1]:53"),
+	}
+
+	tests := []struct {
+		name  string
+		input string
+		want  *ResolvConf
+	}{
+		{
+			name: "Every name server and option",
+			input: `
+# Generated by NetworkManager
+nameserver 192.0.2.53
+nameserver 2001:db8::53
+nameserver fe80::1%eth0
+search example.com example.net.
+options ndots:2 timeout:3 attempts:4 rotate edns0 use-vc
+`,
+			want: &ResolvConf{
+				Nameservers: []netip.AddrPort{
+					netip.MustParseAddrPort("192.0.2.53:53"),
+					netip.MustParseAddrPort("[2001:db8::53]:53"),
+					netip.MustParseAddrPort("[fe80::1%eth0]:53"),
+				},
+				Search:   []string{"example.com.", "example.net."},
+				Ndots:    2,
+				Timeout:  3 * time.Second,
+				Attempts: 4,
+				Rotate:   true,
+				EDNS0:    true,
+				UseVC:    true,
+			},
+		},
+		{
+			name: "Defaults without name servers",
+			input: `
+; nothing here
+`,
+			want: &ResolvConf{
+				Nameservers: localNameservers,
+				Ndots:       DefaultResolvConfNdots,
+				Timeout:     DefaultResolvConfTimeout,
+				Attempts:    DefaultResolvConfAttempts,
+			},
+		},
+		{
+			name: "Last of domain and search wins",
+			input: `
+search example.com example.net
+domain example.org
+nameserver 192.0.2.53
+`,
+			want: &ResolvConf{
+				Nameservers: []netip.AddrPort{netip.MustParseAddrPort("192.0.2.53:53")},
+				Search:      []string{"example.org."},
+				Ndots:       DefaultResolvConfNdots,
+				Timeout:     DefaultResolvConfTimeout,
+				Attempts:    DefaultResolvConfAttempts,
+			},
+		},
+		{
+			name: "Invalid lines and options are ignored, values are capped",
+			input: `
+nameserver not-an-ip
+nameserver
+options ndots:20 timeout:60 attempts:10 unknown
+options timeout:-1 attempts:zero
+`,
+			want: &ResolvConf{
+				Nameservers: localNameservers,
+				Ndots:       maxResolvConfNdots,
+				Timeout:     maxResolvConfTimeout,
+				Attempts:    maxResolvConfAttempts,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseResolvConf(strings.NewReader(tt.input))
+			if err != nil {
+				t.Fatalf("ParseResolvConf() error = %v", err)
+			}
+
+			if !reflect.DeepEqual(got.Nameservers, tt.want.Nameservers) {
+				t.Errorf("ParseResolvConf() nameservers got = %v, want = %v", got.Nameservers, tt.want.Nameservers)
+			}
+			if !reflect.DeepEqual(got.Search, tt.want.Search) {
+				t.Errorf("ParseResolvConf() search got = %v, want = %v", got.Search, tt.want.Search)
+			}
+			if got.Ndots != tt.want.Ndots || got.Timeout != tt.want.Timeout || got.Attempts != tt.want.Attempts {
+				t.Errorf("ParseResolvConf() got ndots:%d timeout:%v attempts:%d, want ndots:%d timeout:%v attempts:%d",
+					got.Ndots, got.Timeout, got.Attempts, tt.want.Ndots, tt.want.Timeout, tt.want.Attempts)
+			}
+			if got.Rotate != tt.want.Rotate || got.EDNS0 != tt.want.EDNS0 || got.UseVC != tt.want.UseVC {
+				t.Errorf("ParseResolvConf() got rotate:%t edns0:%t use-vc:%t, want rotate:%t edns0:%t use-vc:%t",
+					got.Rotate, got.EDNS0, got.UseVC, tt.want.Rotate, tt.want.EDNS0, tt.want.UseVC)
+			}
+		})
+	}
+}
+
+func TestParseIPToAddrPort(t *testing.T) {
+	tests := []struct {
+		input     string
+		want      netip.AddrPort
+		wantError bool
+	}{
+		{input: "192.0.2.1", want: netip.MustParseAddrPort("192.0.2.1:53")},
+		{input: "127.0.0.1:5553", want: netip.MustParseAddrPort("127.0.0.1:5553")},
+		{input: "2001:db8::1", want: netip.MustParseAddrPort("[2001:db8::1]:53")},
+		{input: "[2001:db8::1]:5553", want: netip.MustParseAddrPort("[2001:db8::1]:5553")},
+		{input: "fe80::1%eth0", want: netip.MustParseAddrPort("[fe80::1%eth0]:53")},
+		{input: "192.0.2.1:99999", wantError: true},
+		{input: "dns.example.com", wantError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseIPToAddrPort(tt.input)
+
+			if tt.wantError {
+				if err == nil {
+					t.Fatalf("ParseIPToAddrPort() expected error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseIPToAddrPort() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("ParseIPToAddrPort() got = %v, want = %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolvConfQueryFailover(t *testing.T) {
+	var silentQueries, refusedQueries, answeredQueries, ednsQueries atomic.Int32
+
+	silentServer := startTestUDPServer(t, func(request []byte, _ netip.AddrPort) []byte {
+		silentQueries.Add(1)
+		return nil
+	})
+	refusingServer := startTestUDPServer(t, func(request []byte, _ netip.AddrPort) []byte {
+		refusedQueries.Add(1)
+		parsedRequest, _ := DecodeMessage(request)
+		reply, _ := EncodeMessage(NewErrorReply(parsedRequest, REFUSED))
+		return reply
+	})
+	answeringServer := startTestUDPServer(t, func(request []byte, _ netip.AddrPort) []byte {
+		answeredQueries.Add(1)
+		parsedRequest, _ := DecodeMessage(request)
+		if _, found := parsedRequest.GetEDNS(); found {
+			ednsQueries.Add(1)
+		}
+		return createTestReply(t, request)
+	})
+
+	tests := []struct {
+		name         string
+		conf         *ResolvConf
+		wantServer   netip.AddrPort
+		wantRCode    uint16
+		wantSilent   int32
+		wantRefused  int32
+		wantAnswered int32
+		wantError    bool
+	}{
+		{
+			name:         "Fail over to the answering server",
+			conf:         &ResolvConf{Nameservers: []netip.AddrPort{silentServer, refusingServer, answeringServer}, Timeout: 50 * time.Millisecond, Attempts: 2},
+			wantServer:   answeringServer,
+			wantRCode:    NOERROR,
+			wantSilent:   1,
+			wantRefused:  1,
+			wantAnswered: 1,
+		},
+		{
+			name:        "Refused response returned if nothing better",
+			conf:        &ResolvConf{Nameservers: []netip.AddrPort{refusingServer, silentServer}, Timeout: 50 * time.Millisecond, Attempts: 2},
+			wantServer:  refusingServer,
+			wantRCode:   REFUSED,
+			wantSilent:  2,
+			wantRefused: 2,
+		},
+		{
+			name:       "Every attempt times out",
+			conf:       &ResolvConf{Nameservers: []netip.AddrPort{silentServer}, Timeout: 50 * time.Millisecond, Attempts: 3},
+			wantSilent: 3,
+			wantError:  true,
+		},
+		{
+			name:         "EDNS0 option",
+			conf:         &ResolvConf{Nameservers: []netip.AddrPort{answeringServer}, Timeout: 50 * time.Millisecond, Attempts: 1, EDNS0: true},
+			wantServer:   answeringServer,
+			wantRCode:    NOERROR,
+			wantAnswered: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			silentQueries.Store(0)
+			refusedQueries.Store(0)
+			answeredQueries.Store(0)
+			ednsQueries.Store(0)
+
+			request, _ := CreateQuery("example.com.", A)
+			response, server, protocol, err := tt.conf.Query(context.Background(), NewTransport(), "udp", request)
+
+			if tt.wantError {
+				if err == nil {
+					t.Fatalf("Query() expected error, got response from %v", server)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("Query() error = %v", err)
+				}
+				if server != tt.wantServer || protocol != "udp" {
+					t.Errorf("Query() got response from %v over %s, want %v over udp", server, protocol, tt.wantServer)
+				}
+				message, _ := DecodeMessage(response)
+				if message.GetResponseCode() != tt.wantRCode {
+					t.Errorf("Query() got response code %d, want %d", message.GetResponseCode(), tt.wantRCode)
+				}
+			}
+
+			if silentQueries.Load() != tt.wantSilent || refusedQueries.Load() != tt.wantRefused || answeredQueries.Load() != tt.wantAnswered {
+				t.Errorf("Query() sent %d, %d, %d queries, want %d, %d, %d", silentQueries.Load(), refusedQueries.Load(), answeredQueries.Load(), tt.wantSilent, tt.wantRefused, tt.wantAnswered)
+			}
+			if tt.conf.EDNS0 && ednsQueries.Load() != answeredQueries.Load() {
+				t.Errorf("Query() sent %d queries without EDNS", answeredQueries.Load()-ednsQueries.Load())
+			}
+		})
+	}
+}
+
+func TestResolvConfQueryRotate(t *testing.T) {
+	var queried [2]atomic.Int32
+	servers := make([]netip.AddrPort, 2)
+	for i := range servers {
+		servers[i] = startTestUDPServer(t, func(request []byte, _ netip.AddrPort) []byte {
+			queried[i].Add(1)
+			return createTestReply(t, request)
+		})
+	}
+	conf := &ResolvConf{Nameservers: servers, Timeout: time.Second, Attempts: 1, Rotate: true}
+
+	for i := 0; i < 4; i++ {
+		request, _ := CreateQuery("example.com.", A)
+		if _, _, _, err := conf.Query(context.Background(), NewTransport(), "udp", request); err != nil {
+			t.Fatalf("Query() error = %v", err)
+		}
+	}
+	if queried[0].Load() != 2 || queried[1].Load() != 2 {
+		t.Errorf("Query() sent %d and %d queries, want 2 each", queried[0].Load(), queried[1].Load())
+	}
+}
+
+func TestResolvConfQueryNoNameservers(t *testing.T) {
+	request, _ := CreateQuery("example.com.", A)
+	_, _, _, err := (&ResolvConf{}).Query(context.Background(), NewTransport(), "udp", request)
+	if !errors.Is(err, ErrNoNameservers) {
+		t.Errorf("Query() error = %v, want %v", err, ErrNoNameservers)
+	}
+}
+
+func TestResolvConfSearchNames(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		ndots  int
+		search []string
+		want   []string
+	}{
+		{
+			name:   "Short name: search list first",
+			input:  "host",
+			ndots:  1,
+			search: []string{"example.com.", "example.net."},
+			want:   []string{"host.example.com.", "host.example.net.", "host."},
+		},
+		{
+			name:   "Name with ndots dots: absolute name first",
+			input:  "host.example.org",
+			ndots:  1,
+			search: []string{"example.com."},
+			want:   []string{"host.example.org.", "host.example.org.example.com."},
+		},
+		{
+			name:   "Absolute name: no search list",
+			input:  "host.",
+			ndots:  1,
+			search: []string{"example.com."},
+			want:   []string{"host."},
+		},
+		{
+			name:   "Root search domain ignored",
+			input:  "host.example.org",
+			ndots:  2,
+			search: []string{"."},
+			want:   []string{"host.example.org."},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := &ResolvConf{Ndots: tt.ndots, Search: tt.search}
+			if got := conf.searchNames(tt.input); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("searchNames(%s) got = %v, want = %v", tt.input, got, tt.want)
+			}
+		})
+	}
+}
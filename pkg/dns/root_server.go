@@ -6,6 +6,7 @@ import (
 	"io"
 	"log"
 	"net/netip"
+	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -17,6 +18,10 @@ var rootServerHintsFile string
 var (
 	serverIndex uint32
 	once        sync.Once
+
+	// The root servers parsed on first use, shared by all resolvers
+	parsedRootServers    []Server
+	parsedRootServersErr error
 )
 
 // initializeRootServers initializes extracts the IPs of the root servers from the embeded rootServerHintsFile.
@@ -24,19 +29,27 @@ var (
 func initializeRootServers(file io.Reader) (rootServers []Server, err error) {
 
 	once.Do(func() {
-		rootServers, err = ParseRootServerHints(file)
+		parsedRootServers, parsedRootServersErr = ParseRootServerHints(file)
 	})
 
-	return rootServers, err
+	return slices.Clone(parsedRootServers), parsedRootServersErr
 }
 
-// GetNextRootServer returns the next root server using round-robin selection
+// GetNextRootServer returns the root server with the lowest smoothed RTT.
+// Root servers ranked the same, such as those never queried, are taken in
+// turn, and a small share of calls explore by returning the next one in turn
+// whatever its RTT.
 func (resolver *Resolver) GetNextRootServer() Server {
 	// Atomically increment the serverIndex and get the new value
 	// prevents race conditions if called in goroutine
 	index := atomic.AddUint32(&serverIndex, 1)
+	start := int(index % uint32(len(resolver.RootServers)))
 
-	return resolver.RootServers[index%uint32(len(resolver.RootServers))]
+	inTurn := append(slices.Clone(resolver.RootServers[start:]), resolver.RootServers[:start]...)
+	if shouldExplore() {
+		return inTurn[0]
+	}
+	return resolver.orderServers(inTurn, false)[0]
 }
 
 func ParseRootServerHints(file io.Reader) (rootServers []Server, err error) {
@@ -59,28 +72,23 @@ func ParseRootServerHints(file io.Reader) (rootServers []Server, err error) {
 		fieldType := GetRecordTypeFromTypeString(fields[2])
 		switch fieldType {
 		case NS:
-			if currentServer.Fqdn != "" && (currentServer.IPv4.IsValid() || currentServer.IPv6.IsValid()) {
+			if currentServer.Fqdn != "" && currentServer.hasAddrs() {
 				rootServers = append(rootServers, currentServer)
 			}
 			currentServer = Server{Fqdn: MakeFQDN(fields[3])}
-		case A:
-			currentServer.IPv4, err = netip.ParseAddr(fields[3])
-			if err != nil {
-				log.Printf("invalid IP: %s: %v\n", fields[3], err)
-				continue
-			}
-		case AAAA:
-			currentServer.IPv6, err = netip.ParseAddr(fields[3])
+		case A, AAAA:
+			addr, err := netip.ParseAddr(fields[3])
 			if err != nil {
 				log.Printf("invalid IP: %s: %v\n", fields[3], err)
 				continue
 			}
+			currentServer.addAddr(addr)
 		default:
 			continue
 		}
 	}
 
-	if currentServer.Fqdn != "" && (currentServer.IPv4.IsValid() || currentServer.IPv6.IsValid()) {
+	if currentServer.Fqdn != "" && currentServer.hasAddrs() {
 		rootServers = append(rootServers, currentServer)
 	}
 
@@ -2,6 +2,7 @@ package dns
 
 import (
 	"net/netip"
+	"slices"
 	"strings"
 	"testing"
 )
@@ -22,9 +23,8 @@ A.ROOT-SERVERS.NET.      3600000      AAAA  2001:503:ba3e::2:30
       `,
 			want: []Server{
 				{
-					Fqdn: "A.ROOT-SERVERS.NET.",
-					IPv4: netip.MustParseAddr("198.41.0.4"),
-					IPv6: netip.MustParseAddr("2001:503:ba3e::2:30"),
+					Fqdn:  "A.ROOT-SERVERS.NET.",
+					Addrs: []netip.Addr{netip.MustParseAddr("198.41.0.4"), netip.MustParseAddr("2001:503:ba3e::2:30")},
 				},
 			},
 			wantError: nil,
@@ -42,9 +42,8 @@ A.ROOT-SERVERS.NET.      3600000      AAAA  2001:503:ba3e::2:30
       `,
 			want: []Server{
 				{
-					Fqdn: "A.ROOT-SERVERS.NET.",
-					IPv4: netip.MustParseAddr("198.41.0.4"),
-					IPv6: netip.MustParseAddr("2001:503:ba3e::2:30"),
+					Fqdn:  "A.ROOT-SERVERS.NET.",
+					Addrs: []netip.Addr{netip.MustParseAddr("198.41.0.4"), netip.MustParseAddr("2001:503:ba3e::2:30")},
 				},
 			},
 			wantError: nil,
@@ -61,8 +60,8 @@ A.ROOT-SERVERS.NET.      3600000      A     198.41.0.4
       `,
 			want: []Server{
 				{
-					Fqdn: "A.ROOT-SERVERS.NET.",
-					IPv4: netip.MustParseAddr("198.41.0.4"),
+					Fqdn:  "A.ROOT-SERVERS.NET.",
+					Addrs: []netip.Addr{netip.MustParseAddr("198.41.0.4")},
 				},
 			},
 			wantError: nil,
@@ -75,8 +74,8 @@ A.ROOT-SERVERS.NET.      3600000      AAAA  2001:503:ba3e::2:30
       `,
 			want: []Server{
 				{
-					Fqdn: "A.ROOT-SERVERS.NET.",
-					IPv6: netip.MustParseAddr("2001:503:ba3e::2:30"),
+					Fqdn:  "A.ROOT-SERVERS.NET.",
+					Addrs: []netip.Addr{netip.MustParseAddr("2001:503:ba3e::2:30")},
 				},
 			},
 			wantError: nil,
@@ -90,8 +89,8 @@ A.ROOT-SERVERS.NET.      3600000      AAAA
       `,
 			want: []Server{
 				{
-					Fqdn: "A.ROOT-SERVERS.NET.",
-					IPv4: netip.MustParseAddr("198.41.0.4"),
+					Fqdn:  "A.ROOT-SERVERS.NET.",
+					Addrs: []netip.Addr{netip.MustParseAddr("198.41.0.4")},
 				},
 			},
 			wantError: nil,
@@ -143,11 +142,8 @@ A.ROOT-SERVERS.NET.      3600000      198.41.0.4
 				if got[i].Fqdn != want.Fqdn {
 					t.Errorf("ParseRootServerHints () got fqdn: %s, want %s, input: %s", got[i].Fqdn, want.Fqdn, tt.input)
 				}
-				if got[i].IPv4 != want.IPv4 {
-					t.Errorf("ParseRootServerHints () got IPv4: %v, want %v, input: %s", got[i].IPv4, want.IPv4, tt.input)
-				}
-				if got[i].IPv6 != want.IPv6 {
-					t.Errorf("ParseRootServerHints () got IPv4: %v, want %v, input: %s", got[i].IPv6, want.IPv6, tt.input)
+				if !slices.Equal(got[i].Addrs, want.Addrs) {
+					t.Errorf("ParseRootServerHints () got addresses: %v, want %v, input: %s", got[i].Addrs, want.Addrs, tt.input)
 				}
 			}
 		})
@@ -203,7 +199,7 @@ M.ROOT-SERVERS.NET.      3600000      AAAA  2001:dc3::35
 			if server.Fqdn == "" {
 				t.Errorf("ParseRootServerHints() returned a server with an empty FQDN")
 			}
-			if !server.IPv4.IsValid() && !server.IPv6.IsValid() {
+			if !server.hasAddrs() {
 				t.Errorf("ParseRootServerHints() returned a server with no valid IP addresses")
 			}
 		}
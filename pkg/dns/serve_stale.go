@@ -0,0 +1,117 @@
+package dns
+
+import (
+	"log"
+	"time"
+)
+
+// Serve-stale (RFC 8767):
+// Expired answers are kept in the cache for a stale window. When a name has
+// to be resolved again and an expired answer is still there, it is served
+// stale, with a short TTL, if resolution fails, or if the client response
+// timer fires first. In that case, resolution goes on in the background and
+// caches the fresh answer for the next client.
+//
+// When resolution fails, the failure is remembered for a while (the failure
+// recheck timer of RFC 8767 section 4): until then, the stale answer is served
+// at once, without querying the servers again.
+
+// StaleTTL is the TTL of the records of a stale answer, in seconds.
+const StaleTTL = 30
+
+// DefaultStaleWindow is a suggested time to keep expired answers for.
+const DefaultStaleWindow = 24 * time.Hour
+
+// DefaultStaleAnswerTimeout is a suggested client response timer: the time
+// to wait for resolution before serving a stale answer.
+const DefaultStaleAnswerTimeout = 1800 * time.Millisecond
+
+// staleFailureRecheckInterval is the time after a failed resolution during
+// which a stale answer is served without resolving again.
+const staleFailureRecheckInterval = 30 * time.Second
+
+// getStaleAnswer returns an expired answer to a question which is still in
+// the cache: records of the question type, a CNAME record or a negative
+// answer, with StaleTTL as their TTL.
+func (resolver *Resolver) getStaleAnswer(name string, questionType uint16, questionClass uint16) (response Message, found bool) {
+	if resolver.StaleWindow <= 0 {
+		return Message{}, false
+	}
+
+	rTypes := []uint16{questionType}
+	if questionType != CNAME {
+		rTypes = append(rTypes, CNAME)
+	}
+	for _, rType := range rTypes {
+		value, found := resolver.cache().getStale(rrsetCacheKey(name, rType, questionClass))
+		if !found || value.(CachedRRset).Credibility < CredibilityNonAuthoritativeAnswer {
+			continue
+		}
+		for _, record := range value.(CachedRRset).Records {
+			record.TTL = StaleTTL
+			response.Answers = append(response.Answers, record)
+		}
+		return response, true
+	}
+
+	for _, key := range []cacheKey{negativeCacheKey(name, 0, questionClass), negativeCacheKey(name, questionType, questionClass)} {
+		if value, found := resolver.cache().getStale(key); found {
+			cached := value.(CachedNegativeAnswer)
+			cached.SOA.TTL = StaleTTL
+			response.NameServers = []ResourceRecord{cached.SOA}
+			response.SetResponseCode(cached.ResponseCode)
+			return response, true
+		}
+	}
+	return Message{}, false
+}
+
+// resolveOrServeStale queries servers for a name which has a stale answer.
+// The stale answer is returned if resolution fails, or if it takes longer
+// than the StaleAnswerTimeout, in which case it goes on in the background.
+// It is returned at once if resolution failed recently.
+func (resolver *Resolver) resolveOrServeStale(key cacheKey, name string, dnsRequest []byte, staleResponse Message) (response Message, err error) {
+	if failedAt, found := resolver.staleFailures.Load(key); found {
+		if time.Since(failedAt.(time.Time)) < staleFailureRecheckInterval {
+			log.Printf("--> Serving stale answer for %s: resolution failed recently", name)
+			resolver.staleAnswers.Add(1)
+			return staleResponse, nil
+		}
+		resolver.staleFailures.Delete(key)
+	}
+
+	type result struct {
+		response Message
+		err      error
+	}
+	// Buffered, so that a background resolution doesn't block once the
+	// stale answer has been served
+	results := make(chan result, 1)
+	go func() {
+		response, err := resolver.queryRootServer(name, dnsRequest)
+		if err != nil {
+			resolver.staleFailures.Store(key, time.Now())
+		}
+		results <- result{response: response, err: err}
+	}()
+
+	var timeout <-chan time.Time
+	if resolver.StaleAnswerTimeout > 0 {
+		timer := time.NewTimer(resolver.StaleAnswerTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case result := <-results:
+		if result.err == nil {
+			return result.response, nil
+		}
+		log.Printf("--> Serving stale answer for %s: %v", name, result.err)
+	case <-timeout:
+		log.Printf("--> Serving stale answer for %s while resolving it in the background", name)
+	}
+
+	resolver.staleAnswers.Add(1)
+	return staleResponse, nil
+}
@@ -0,0 +1,165 @@
+package dns
+
+import (
+	"errors"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestResolverServeStale(t *testing.T) {
+	resolver, err := NewResolver("")
+	if err != nil {
+		t.Fatalf("NewResolver() error = %v", err)
+	}
+	resolver.StaleWindow = time.Hour
+
+	// The servers are unreachable until unblocked, then answer with a new address
+	var unreachable bool
+	var unblock chan struct{}
+	var queries atomic.Int32
+	resolver.QueryFunc = func(_ string, _ netip.AddrPort, dnsRequest []byte) ([]byte, error) {
+		queries.Add(1)
+		if unreachable {
+			return nil, errors.New("network is unreachable")
+		}
+		if unblock != nil {
+			<-unblock
+		}
+		request, err := DecodeMessage(dnsRequest)
+		if err != nil {
+			return nil, err
+		}
+		reply := NewReply(request)
+		reply.Header.Flags.Authoritative = true
+		reply.Answers = []ResourceRecord{newResourceRecord(request.Questions[0].Name, A, 300, &RDataA{IP: netip.MustParseAddr("192.0.2.2")})}
+		reply.UpdateCounts()
+		return EncodeMessage(reply)
+	}
+
+	resolve := func(name string) (reply Message) {
+		t.Helper()
+		request, _ := CreateQuery(name, A)
+		response, err := resolver.ResolveQuery(request)
+		if err != nil {
+			t.Fatalf("ResolveQuery() error = %v", err)
+		}
+		reply, err = DecodeMessage(response)
+		if err != nil {
+			t.Fatalf("ResolveQuery() response cannot be decoded: %v", err)
+		}
+		return reply
+	}
+	cacheExpired := func(name string, expiredFor time.Duration) {
+		resolver.cacheRRsets([]ResourceRecord{newResourceRecord(name, A, 300, &RDataA{IP: netip.MustParseAddr("192.0.2.1")})}, CredibilityAuthoritativeAnswer)
+		setCacheExpiry(resolver, rrsetCacheKey(name, A, IN), time.Now().Add(-expiredFor))
+	}
+
+	t.Run("Resolution fails", func(t *testing.T) {
+		unreachable = true
+		defer func() { unreachable = false }()
+
+		cacheExpired("stale.example.com.", time.Minute)
+		reply := resolve("stale.example.com.")
+		if reply.GetResponseCode() != NOERROR || len(reply.Answers) != 1 || reply.Answers[0].RData.String() != "192.0.2.1" || reply.Answers[0].TTL != StaleTTL {
+			t.Errorf("ResolveQuery() got %s with answers %v, want the stale answer with a TTL of %d", DNSRCode(reply.GetResponseCode()), reply.Answers, StaleTTL)
+		}
+
+		// Beyond the stale window
+		cacheExpired("dead.example.com.", 2*time.Hour)
+		if reply := resolve("dead.example.com."); reply.GetResponseCode() != SERVFAIL {
+			t.Errorf("ResolveQuery() got %s, want SERVFAIL beyond the stale window", DNSRCode(reply.GetResponseCode()))
+		}
+	})
+
+	t.Run("Failure recheck timer", func(t *testing.T) {
+		unreachable = true
+		defer func() { unreachable = false }()
+
+		cacheExpired("failing.example.com.", time.Minute)
+		resolve("failing.example.com.")
+
+		// The failure is remembered: the servers aren't queried again
+		queries.Store(0)
+		if reply := resolve("failing.example.com."); len(reply.Answers) != 1 || reply.Answers[0].RData.String() != "192.0.2.1" {
+			t.Errorf("ResolveQuery() got answers %v, want the stale answer", reply.Answers)
+		}
+		if queries.Load() != 0 {
+			t.Errorf("servers were queried %d times after a recent failure, want 0", queries.Load())
+		}
+
+		// Once the failure recheck timer has expired, they are
+		resolver.staleFailures.Store(rrsetCacheKey("failing.example.com.", A, IN), time.Now().Add(-staleFailureRecheckInterval))
+		resolve("failing.example.com.")
+		if queries.Load() == 0 {
+			t.Errorf("servers were not queried once the failure recheck timer expired")
+		}
+	})
+
+	t.Run("Resolution succeeds", func(t *testing.T) {
+		cacheExpired("refreshed.example.com.", time.Minute)
+		if reply := resolve("refreshed.example.com."); len(reply.Answers) != 1 || reply.Answers[0].RData.String() != "192.0.2.2" {
+			t.Errorf("ResolveQuery() got answers %v, want the fresh answer", reply.Answers)
+		}
+	})
+
+	t.Run("Client response timer", func(t *testing.T) {
+		resolver.StaleAnswerTimeout = 10 * time.Millisecond
+		unblock = make(chan struct{})
+		defer func() { resolver.StaleAnswerTimeout = 0 }()
+
+		cacheExpired("slow.example.com.", time.Minute)
+		if reply := resolve("slow.example.com."); len(reply.Answers) != 1 || reply.Answers[0].RData.String() != "192.0.2.1" {
+			t.Errorf("ResolveQuery() got answers %v, want the stale answer", reply.Answers)
+		}
+
+		// Resolution goes on in the background
+		close(unblock)
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if records, found := resolver.getCachedRRset("slow.example.com.", A, IN, CredibilityNonAuthoritativeAnswer); found && records[0].RData.String() == "192.0.2.2" {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("stale answer was not refreshed in the background")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	if stats := resolver.CacheStats(); stats.StaleAnswers != 5 {
+		t.Errorf("CacheStats() stale answers = %d, want 5", stats.StaleAnswers)
+	}
+}
+
+func TestGetStaleAnswer(t *testing.T) {
+	resolver := &Resolver{StaleWindow: time.Hour}
+
+	resolver.cacheRRsets([]ResourceRecord{newResourceRecord("alias.example.com.", CNAME, 300, &RDataCNAME{DomainName: "www.example.com."})}, CredibilityAuthoritativeAnswer)
+	setCacheExpiry(resolver, rrsetCacheKey("alias.example.com.", CNAME, IN), time.Now().Add(-time.Minute))
+
+	response := NewErrorReply(Message{Questions: []Question{{Name: "missing.example.com.", QType: A, QClass: IN}}}, NXDOMAIN)
+	response.NameServers = []ResourceRecord{newResourceRecord("example.com.", SOA, 300, &RDataSOA{MName: "ns.example.com.", RName: "admin.example.com.", Minimum: 300})}
+	resolver.cacheNegativeAnswer(response)
+	setCacheExpiry(resolver, negativeCacheKey("missing.example.com.", 0, IN), time.Now().Add(-time.Minute))
+
+	resolver.cacheGlue([]ResourceRecord{newResourceRecord("ns.example.com.", A, 300, &RDataA{IP: netip.MustParseAddr("192.0.2.53")})})
+	setCacheExpiry(resolver, rrsetCacheKey("ns.example.com.", A, IN), time.Now().Add(-time.Minute))
+
+	if stale, found := resolver.getStaleAnswer("alias.example.com.", A, IN); !found || len(stale.Answers) != 1 || stale.Answers[0].RType != CNAME || stale.Answers[0].TTL != StaleTTL {
+		t.Errorf("getStaleAnswer() got %v, want the stale CNAME", stale.Answers)
+	}
+	if stale, found := resolver.getStaleAnswer("missing.example.com.", AAAA, IN); !found || stale.GetResponseCode() != NXDOMAIN || stale.NameServers[0].TTL != StaleTTL {
+		t.Errorf("getStaleAnswer() got %+v, want the stale NXDOMAIN", stale)
+	}
+	if _, found := resolver.getStaleAnswer("ns.example.com.", A, IN); found {
+		t.Errorf("getStaleAnswer() returned glue as an answer")
+	}
+
+	// Answers which haven't expired aren't stale
+	resolver.cacheRRsets([]ResourceRecord{newResourceRecord("www.example.com.", A, 300, &RDataA{IP: netip.MustParseAddr("192.0.2.1")})}, CredibilityAuthoritativeAnswer)
+	if _, found := resolver.getStaleAnswer("www.example.com.", A, IN); found {
+		t.Errorf("getStaleAnswer() returned an answer which hasn't expired")
+	}
+}
@@ -1,23 +1,180 @@
 package dns
 
 import (
+	"fmt"
 	"net/netip"
+	"time"
 )
 
 const MaxUDPMessageLength = 512
 
+// Happy eyeballs (RFC 8305):
+// A server may have several IPv4 and IPv6 addresses. Instead of waiting for
+// a query to an unreachable address to time out before trying the next one,
+// queries to the server's addresses are raced: the first starts right away,
+// and each following one starts after a short delay or as soon as the
+// previous one fails. The first response wins. Addresses alternate between
+// families, starting with the family that last worked (IPv6 at first), so
+// that a host with a broken IPv6 or IPv4 network quickly settles on the
+// other family.
+
+// DefaultHappyEyeballsDelay is the delay before racing the next address of
+// a server [RFC8305 section 5: Connection Attempt Delay]
+const DefaultHappyEyeballsDelay = 250 * time.Millisecond
+
+// AddressFamily restricts the addresses the resolver sends queries to.
+type AddressFamily uint8
+
+const (
+	DualStack AddressFamily = iota // IPv4 and IPv6
+	IPv4Only
+	IPv6Only
+)
+
 type Server struct {
-	Fqdn string
-	IPv4 netip.Addr
-	IPv6 netip.Addr
+	Fqdn  string
+	Addrs []netip.Addr
+}
+
+// addAddr adds an address to the server's list if it isn't already in it.
+func (server *Server) addAddr(addr netip.Addr) {
+	for _, existing := range server.Addrs {
+		if existing == addr {
+			return
+		}
+	}
+	server.Addrs = append(server.Addrs, addr)
 }
 
-func (server Server) getValidIPAddress() (ip netip.AddrPort, err error) {
-	if server.IPv4.IsValid() {
-		return netip.AddrPortFrom(server.IPv4, DefaultPort), nil
-	} else if server.IPv6.IsValid() {
-		return netip.AddrPortFrom(server.IPv6, DefaultPort), nil
-	} else {
-		return ip, ErrInvalidIP
+// hasAddrs returns true if the server has at least one valid address.
+func (server Server) hasAddrs() bool {
+	for _, addr := range server.Addrs {
+		if addr.IsValid() {
+			return true
+		}
+	}
+	return false
+}
+
+// getAddrPorts returns the addresses to try for a server, in the order they
+// should be tried: only those of the allowed family, alternating between
+// families and starting with the preferred one.
+//
+// Parameters:
+//   - family: the allowed address family
+//   - preferIPv4: true to start with an IPv4 address when both families are allowed
+//
+// Returns:
+//   - addrPorts: the server's addresses with the DNS port
+//   - err: ErrInvalidIP if the server has no usable address
+func (server Server) getAddrPorts(family AddressFamily, preferIPv4 bool) (addrPorts []netip.AddrPort, err error) {
+	var ipv4, ipv6 []netip.AddrPort
+	for _, addr := range server.Addrs {
+		switch {
+		case !addr.IsValid():
+			continue
+		case addr.Unmap().Is4() && family != IPv6Only:
+			ipv4 = append(ipv4, netip.AddrPortFrom(addr.Unmap(), DefaultPort))
+		case addr.Is6() && !addr.Is4In6() && family != IPv4Only:
+			ipv6 = append(ipv6, netip.AddrPortFrom(addr, DefaultPort))
+		}
+	}
+
+	preferred, other := ipv6, ipv4
+	if preferIPv4 {
+		preferred, other = ipv4, ipv6
+	}
+	for i := 0; i < len(preferred) || i < len(other); i++ {
+		if i < len(preferred) {
+			addrPorts = append(addrPorts, preferred[i])
+		}
+		if i < len(other) {
+			addrPorts = append(addrPorts, other[i])
+		}
+	}
+
+	if len(addrPorts) == 0 {
+		return nil, ErrInvalidIP
+	}
+	return addrPorts, nil
+}
+
+type raceResult struct {
+	response []byte
+	addrPort netip.AddrPort
+	err      error
+}
+
+// queryServer sends a request to a server over UDP, racing its addresses with
+// a staggered start, fastest first. It remembers the address family of the
+// first address to respond so that it is tried first next time, and the RTT
+// of each address.
+//
+// Parameters:
+//   - server: the server to query
+//   - dnsRequest: the encoded DNS request
+//
+// Returns:
+//   - response: the first response received
+//   - serverAddrPort: the address that sent the response
+//   - err: an error if the server has no usable address or none responded
+func (resolver *Resolver) queryServer(server Server, dnsRequest []byte) (response []byte, serverAddrPort netip.AddrPort, err error) {
+	addrPorts, err := server.getAddrPorts(resolver.AddressFamily, resolver.preferIPv4.Load())
+	if err != nil {
+		return nil, serverAddrPort, err
+	}
+	resolver.sortAddrPorts(addrPorts)
+
+	delay := resolver.HappyEyeballsDelay
+	if delay <= 0 {
+		delay = DefaultHappyEyeballsDelay
+	}
+
+	// Buffered so that late attempts never block once a winner is found
+	results := make(chan raceResult, len(addrPorts))
+	startAttempt := func(addrPort netip.AddrPort) {
+		go func() {
+			start := time.Now()
+			response, err := resolver.QueryFunc("udp", addrPort, dnsRequest)
+			if err != nil {
+				resolver.serverRTTs.recordFailure(addrPort.Addr())
+			} else {
+				resolver.serverRTTs.recordResponse(addrPort.Addr(), time.Since(start))
+			}
+			results <- raceResult{response: response, addrPort: addrPort, err: err}
+		}()
+	}
+
+	startAttempt(addrPorts[0])
+	started, failed := 1, 0
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	for {
+		select {
+		case result := <-results:
+			if result.err == nil {
+				resolver.preferIPv4.Store(result.addrPort.Addr().Is4())
+				return result.response, result.addrPort, nil
+			}
+			err = fmt.Errorf("%v: %w", result.addrPort, result.err)
+			failed++
+			if failed == len(addrPorts) {
+				return nil, serverAddrPort, err
+			}
+			// Don't wait for the delay to try the next address
+			if started < len(addrPorts) {
+				startAttempt(addrPorts[started])
+				started++
+				timer.Reset(delay)
+			}
+
+		case <-timer.C:
+			if started < len(addrPorts) {
+				startAttempt(addrPorts[started])
+				started++
+				timer.Reset(delay)
+			}
+		}
 	}
 }
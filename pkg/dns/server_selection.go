@@ -0,0 +1,231 @@
+package dns
+
+import (
+	"cmp"
+	"math/rand/v2"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Server selection:
+// Like BIND's SRTT and Unbound's infrastructure cache, the resolver keeps a
+// smoothed round-trip time for each server address it queries (RFC 6298,
+// with a gain of 1/8). Servers are tried fastest first, and a server's
+// addresses are raced fastest first. Addresses never queried are estimated
+// at unknownServerRTT, so that they are tried before slow servers and after
+// fast ones.
+//
+// A query which fails doubles the address's smoothed RTT and backs off from
+// it: it is tried last, for a time which doubles with each consecutive
+// failure. To keep finding out about servers other than the fastest, a
+// small share of selections explores: a random server is tried first.
+// Measurements older than serverRTTLifetime are forgotten.
+
+const (
+	// unknownServerRTT is the estimated RTT of an address never queried.
+	unknownServerRTT = 300 * time.Millisecond
+	// maxServerRTT bounds the smoothed RTT of an address which keeps failing.
+	maxServerRTT = 10 * time.Second
+	// serverBackoff is the time the resolver backs off from an address after
+	// a failure, doubling with each consecutive failure up to maxServerBackoff.
+	serverBackoff    = time.Second
+	maxServerBackoff = 2 * time.Minute
+	// serverRTTLifetime is how long the measurements of an address are kept
+	// after the last query to it.
+	serverRTTLifetime = 15 * time.Minute
+	// maxTrackedServerAddrs is the number of addresses above which the
+	// measurements which have outlived serverRTTLifetime are removed.
+	maxTrackedServerAddrs = 10000
+	// serverExploreProbability is the share of selections which try a random
+	// server first.
+	serverExploreProbability = 0.05
+)
+
+type serverRTT struct {
+	srtt         time.Duration
+	failures     int // consecutive failures
+	backoffUntil time.Time
+	updatedAt    time.Time
+}
+
+// serverRTTTracker keeps the smoothed RTTs of server addresses. The zero
+// value is ready to use, and it is safe for concurrent use.
+type serverRTTTracker struct {
+	mutex sync.Mutex
+	addrs map[netip.Addr]*serverRTT
+}
+
+// entry returns the measurements of an address to update, creating them if
+// needed. The tracker must be locked.
+func (tracker *serverRTTTracker) entry(addr netip.Addr, now time.Time) *serverRTT {
+	if tracker.addrs == nil {
+		tracker.addrs = make(map[netip.Addr]*serverRTT)
+	}
+
+	stats, found := tracker.addrs[addr]
+	if !found || now.Sub(stats.updatedAt) > serverRTTLifetime {
+		if !found && len(tracker.addrs) >= maxTrackedServerAddrs {
+			tracker.prune(now)
+		}
+		stats = &serverRTT{}
+		tracker.addrs[addr] = stats
+	}
+	stats.updatedAt = now
+	return stats
+}
+
+// prune removes the measurements which have outlived serverRTTLifetime. The
+// tracker must be locked.
+func (tracker *serverRTTTracker) prune(now time.Time) {
+	for addr, stats := range tracker.addrs {
+		if now.Sub(stats.updatedAt) > serverRTTLifetime {
+			delete(tracker.addrs, addr)
+		}
+	}
+}
+
+// recordResponse updates the smoothed RTT of an address which responded.
+func (tracker *serverRTTTracker) recordResponse(addr netip.Addr, rtt time.Duration) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	stats := tracker.entry(addr, time.Now())
+	if stats.srtt == 0 {
+		stats.srtt = rtt
+	} else {
+		stats.srtt += (rtt - stats.srtt) / 8
+	}
+	stats.failures = 0
+	stats.backoffUntil = time.Time{}
+}
+
+// recordFailure doubles the smoothed RTT of an address which didn't respond,
+// and backs off from it.
+func (tracker *serverRTTTracker) recordFailure(addr netip.Addr) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	now := time.Now()
+	stats := tracker.entry(addr, now)
+	if stats.srtt == 0 {
+		stats.srtt = unknownServerRTT
+	}
+	stats.srtt = min(2*stats.srtt, maxServerRTT)
+	stats.failures++
+	backoff := maxServerBackoff
+	if stats.failures <= 8 {
+		backoff = min(serverBackoff<<(stats.failures-1), maxServerBackoff)
+	}
+	stats.backoffUntil = now.Add(backoff)
+}
+
+// rank returns the estimated RTT of an address, and whether the resolver is
+// backing off from it.
+func (tracker *serverRTTTracker) rank(addr netip.Addr, now time.Time) (srtt time.Duration, backedOff bool) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	stats, found := tracker.addrs[addr]
+	if !found || now.Sub(stats.updatedAt) > serverRTTLifetime {
+		return unknownServerRTT, false
+	}
+	return stats.srtt, now.Before(stats.backoffUntil)
+}
+
+// compareRanks orders ranks: addresses the resolver isn't backing off from
+// first, then the fastest.
+func compareRanks(srttA time.Duration, backedOffA bool, srttB time.Duration, backedOffB bool) int {
+	if backedOffA != backedOffB {
+		if backedOffA {
+			return 1
+		}
+		return -1
+	}
+	return cmp.Compare(srttA, srttB)
+}
+
+// sortAddrPorts sorts a server's addresses fastest first, keeping the order
+// of addresses ranked the same.
+func (resolver *Resolver) sortAddrPorts(addrPorts []netip.AddrPort) {
+	now := time.Now()
+	type rankedAddrPort struct {
+		addrPort  netip.AddrPort
+		srtt      time.Duration
+		backedOff bool
+	}
+	ranked := make([]rankedAddrPort, len(addrPorts))
+	for i, addrPort := range addrPorts {
+		srtt, backedOff := resolver.serverRTTs.rank(addrPort.Addr(), now)
+		ranked[i] = rankedAddrPort{addrPort: addrPort, srtt: srtt, backedOff: backedOff}
+	}
+	slices.SortStableFunc(ranked, func(a, b rankedAddrPort) int {
+		return compareRanks(a.srtt, a.backedOff, b.srtt, b.backedOff)
+	})
+	for i := range ranked {
+		addrPorts[i] = ranked[i].addrPort
+	}
+}
+
+// serverRank returns the rank of a server's best address in the allowed
+// family: servers without one are ranked last.
+func (resolver *Resolver) serverRank(server Server, now time.Time) (srtt time.Duration, backedOff bool) {
+	addrPorts, err := server.getAddrPorts(resolver.AddressFamily, resolver.preferIPv4.Load())
+	if err != nil {
+		return maxServerRTT, true
+	}
+
+	srtt, backedOff = resolver.serverRTTs.rank(addrPorts[0].Addr(), now)
+	for _, addrPort := range addrPorts[1:] {
+		addrSRTT, addrBackedOff := resolver.serverRTTs.rank(addrPort.Addr(), now)
+		if compareRanks(addrSRTT, addrBackedOff, srtt, backedOff) < 0 {
+			srtt, backedOff = addrSRTT, addrBackedOff
+		}
+	}
+	return srtt, backedOff
+}
+
+// orderServers returns servers in the order to try them: fastest first,
+// servers the resolver is backing off from last. Servers ranked the same
+// keep their order.
+//
+// Parameters:
+//   - servers: the servers to order
+//   - explore: true to try a random server first instead
+//
+// Returns:
+//   - ordered: a sorted copy of the servers
+func (resolver *Resolver) orderServers(servers []Server, explore bool) (ordered []Server) {
+	now := time.Now()
+	type rankedServer struct {
+		server    Server
+		srtt      time.Duration
+		backedOff bool
+	}
+	ranked := make([]rankedServer, len(servers))
+	for i, server := range servers {
+		srtt, backedOff := resolver.serverRank(server, now)
+		ranked[i] = rankedServer{server: server, srtt: srtt, backedOff: backedOff}
+	}
+	slices.SortStableFunc(ranked, func(a, b rankedServer) int {
+		return compareRanks(a.srtt, a.backedOff, b.srtt, b.backedOff)
+	})
+
+	ordered = make([]Server, len(ranked))
+	for i := range ranked {
+		ordered[i] = ranked[i].server
+	}
+	if explore && len(ordered) > 1 {
+		i := 1 + rand.IntN(len(ordered)-1)
+		explored := ordered[i]
+		copy(ordered[1:i+1], ordered[:i])
+		ordered[0] = explored
+	}
+	return ordered
+}
+
+// shouldExplore reports whether a selection should try a random server.
+func shouldExplore() bool {
+	return rand.Float64() < serverExploreProbability
+}
@@ -0,0 +1,138 @@
+package dns
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestServerRTTTracker(t *testing.T) {
+	var tracker serverRTTTracker
+	addr := netip.MustParseAddr("192.0.2.1")
+
+	if srtt, backedOff := tracker.rank(addr, time.Now()); srtt != unknownServerRTT || backedOff {
+		t.Errorf("rank() of an unknown address got = %v, %t, want %v", srtt, backedOff, unknownServerRTT)
+	}
+
+	tracker.recordResponse(addr, 80*time.Millisecond)
+	tracker.recordResponse(addr, 160*time.Millisecond)
+	if srtt, _ := tracker.rank(addr, time.Now()); srtt != 90*time.Millisecond {
+		t.Errorf("rank() got = %v, want the smoothed RTT of 90ms", srtt)
+	}
+
+	tracker.recordFailure(addr)
+	tracker.recordFailure(addr)
+	srtt, backedOff := tracker.rank(addr, time.Now())
+	if srtt != 360*time.Millisecond || !backedOff {
+		t.Errorf("rank() after failures got = %v, %t, want 360ms backed off", srtt, backedOff)
+	}
+	if _, backedOff := tracker.rank(addr, time.Now().Add(3*time.Second)); backedOff {
+		t.Errorf("rank() is still backed off after 2 failures and 3s")
+	}
+
+	tracker.recordResponse(addr, 40*time.Millisecond)
+	if _, backedOff := tracker.rank(addr, time.Now()); backedOff {
+		t.Errorf("rank() is still backed off after a response")
+	}
+
+	// Old measurements are forgotten
+	if srtt, _ := tracker.rank(addr, time.Now().Add(serverRTTLifetime+time.Minute)); srtt != unknownServerRTT {
+		t.Errorf("rank() of an old measurement got = %v, want %v", srtt, unknownServerRTT)
+	}
+
+	for range 20 {
+		tracker.recordFailure(addr)
+	}
+	if srtt, _ := tracker.rank(addr, time.Now()); srtt != maxServerRTT {
+		t.Errorf("rank() after many failures got = %v, want %v", srtt, maxServerRTT)
+	}
+}
+
+func TestOrderServers(t *testing.T) {
+	resolver := &Resolver{}
+	server := func(name string, addrs ...string) Server {
+		server := Server{Fqdn: name}
+		for _, addr := range addrs {
+			server.Addrs = append(server.Addrs, netip.MustParseAddr(addr))
+		}
+		return server
+	}
+	servers := []Server{
+		server("failing.", "192.0.2.1"),
+		server("unknown.", "192.0.2.2"),
+		server("slow.", "192.0.2.3"),
+		server("fast.", "192.0.2.4", "2001:db8::4"),
+		server("unknown-too.", "192.0.2.5"),
+		server("no-address."),
+	}
+	resolver.serverRTTs.recordFailure(netip.MustParseAddr("192.0.2.1"))
+	resolver.serverRTTs.recordResponse(netip.MustParseAddr("192.0.2.3"), time.Second)
+	resolver.serverRTTs.recordResponse(netip.MustParseAddr("2001:db8::4"), 20*time.Millisecond)
+
+	names := func(servers []Server) (names []string) {
+		for _, server := range servers {
+			names = append(names, server.Fqdn)
+		}
+		return names
+	}
+
+	want := []string{"fast.", "unknown.", "unknown-too.", "slow.", "failing.", "no-address."}
+	if got := names(resolver.orderServers(servers, false)); !slices.Equal(got, want) {
+		t.Errorf("orderServers() got = %v, want %v", got, want)
+	}
+
+	// Exploring tries another server first, then the others in order
+	for range 20 {
+		got := names(resolver.orderServers(servers, true))
+		explored := slices.Index(want, got[0])
+		if explored < 1 || !slices.Equal(got[1:], slices.Delete(slices.Clone(want), explored, explored+1)) {
+			t.Fatalf("orderServers() exploring got = %v", got)
+		}
+	}
+
+	// The servers' addresses are raced fastest first
+	addrPorts, _ := servers[3].getAddrPorts(DualStack, true)
+	resolver.sortAddrPorts(addrPorts)
+	if addrPorts[0].Addr() != netip.MustParseAddr("2001:db8::4") {
+		t.Errorf("sortAddrPorts() got = %v, want the fastest address first", addrPorts)
+	}
+}
+
+func TestGetNextRootServer(t *testing.T) {
+	resolver, err := NewResolver("")
+	if err != nil {
+		t.Fatalf("NewResolver() error = %v", err)
+	}
+	resolver.AddressFamily = IPv4Only
+
+	// Root servers never queried are taken in turn
+	seen := make(map[string]bool)
+	for range len(resolver.RootServers) {
+		seen[resolver.GetNextRootServer().Fqdn] = true
+	}
+	if len(seen) < len(resolver.RootServers)/2 {
+		t.Errorf("GetNextRootServer() returned %d different root servers, want them in turn", len(seen))
+	}
+
+	// Then the fastest, but for the odd exploration
+	fastest := resolver.RootServers[3]
+	for _, rootServer := range resolver.RootServers {
+		rtt := 100 * time.Millisecond
+		if rootServer.Fqdn == fastest.Fqdn {
+			rtt = 10 * time.Millisecond
+		}
+		for _, addr := range rootServer.Addrs {
+			resolver.serverRTTs.recordResponse(addr, rtt)
+		}
+	}
+	fastestCount := 0
+	for range 100 {
+		if resolver.GetNextRootServer().Fqdn == fastest.Fqdn {
+			fastestCount++
+		}
+	}
+	if fastestCount < 80 {
+		t.Errorf("GetNextRootServer() returned the fastest root server %d times out of 100", fastestCount)
+	}
+}
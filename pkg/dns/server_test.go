@@ -0,0 +1,196 @@
+package dns
+
+import (
+	"errors"
+	"net/netip"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServerGetAddrPorts(t *testing.T) {
+	server := Server{
+		Fqdn: "ns.example.com.",
+		Addrs: []netip.Addr{
+			netip.MustParseAddr("192.0.2.1"),
+			netip.MustParseAddr("192.0.2.2"),
+			netip.MustParseAddr("2001:db8::1"),
+			netip.MustParseAddr("::ffff:192.0.2.3"),
+		},
+	}
+	addrPorts := func(addrs ...string) (addrPorts []netip.AddrPort) {
+		for _, addr := range addrs {
+			addrPorts = append(addrPorts, netip.AddrPortFrom(netip.MustParseAddr(addr), DefaultPort))
+		}
+		return addrPorts
+	}
+
+	tests := []struct {
+		name       string
+		server     Server
+		family     AddressFamily
+		preferIPv4 bool
+		want       []netip.AddrPort
+		wantError  error
+	}{
+		{
+			name:   "Dual stack, IPv6 first",
+			server: server,
+			family: DualStack,
+			want:   addrPorts("2001:db8::1", "192.0.2.1", "192.0.2.2", "192.0.2.3"),
+		},
+		{
+			name:       "Dual stack, IPv4 first",
+			server:     server,
+			family:     DualStack,
+			preferIPv4: true,
+			want:       addrPorts("192.0.2.1", "2001:db8::1", "192.0.2.2", "192.0.2.3"),
+		},
+		{
+			name:   "IPv4 only",
+			server: server,
+			family: IPv4Only,
+			want:   addrPorts("192.0.2.1", "192.0.2.2", "192.0.2.3"),
+		},
+		{
+			name:       "IPv6 only",
+			server:     server,
+			family:     IPv6Only,
+			preferIPv4: true,
+			want:       addrPorts("2001:db8::1"),
+		},
+		{
+			name:      "No address in family",
+			server:    Server{Fqdn: "ns.example.com.", Addrs: []netip.Addr{netip.MustParseAddr("192.0.2.1")}},
+			family:    IPv6Only,
+			wantError: ErrInvalidIP,
+		},
+		{
+			name:      "No address",
+			server:    Server{Fqdn: "ns.example.com."},
+			family:    DualStack,
+			wantError: ErrInvalidIP,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.server.getAddrPorts(tt.family, tt.preferIPv4)
+
+			if tt.wantError != nil {
+				if !errors.Is(err, tt.wantError) {
+					t.Fatalf("getAddrPorts() error = %v, want error = %v", err, tt.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getAddrPorts() error = %v", err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("getAddrPorts() got = %v, want = %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolverQueryServerHappyEyeballs(t *testing.T) {
+	server := Server{
+		Fqdn:  "ns.example.com.",
+		Addrs: []netip.Addr{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1")},
+	}
+	ipv4 := netip.AddrPortFrom(netip.MustParseAddr("192.0.2.1"), DefaultPort)
+	ipv6 := netip.AddrPortFrom(netip.MustParseAddr("2001:db8::1"), DefaultPort)
+	errUnreachable := errors.New("network unreachable")
+
+	tests := []struct {
+		name        string
+		delay       time.Duration
+		ipv6Latency time.Duration
+		ipv6Error   error
+		ipv4Error   error
+		wantAddr    netip.AddrPort
+		wantError   bool
+		maxDuration time.Duration
+	}{
+		{
+			name:        "IPv6 answers first",
+			delay:       time.Second,
+			wantAddr:    ipv6,
+			maxDuration: 500 * time.Millisecond,
+		},
+		{
+			name:        "IPv6 hangs, IPv4 races after delay",
+			delay:       20 * time.Millisecond,
+			ipv6Latency: time.Second,
+			ipv6Error:   errUnreachable,
+			wantAddr:    ipv4,
+			maxDuration: 500 * time.Millisecond,
+		},
+		{
+			name:        "IPv6 fails, IPv4 tried without delay",
+			delay:       time.Second,
+			ipv6Error:   errUnreachable,
+			wantAddr:    ipv4,
+			maxDuration: 500 * time.Millisecond,
+		},
+		{
+			name:        "Every address fails",
+			delay:       20 * time.Millisecond,
+			ipv6Error:   errUnreachable,
+			ipv4Error:   errUnreachable,
+			wantError:   true,
+			maxDuration: 500 * time.Millisecond,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mutex sync.Mutex
+			var queried []netip.AddrPort
+
+			resolver := &Resolver{HappyEyeballsDelay: tt.delay}
+			resolver.QueryFunc = func(_ string, serverAddrPort netip.AddrPort, dnsRequest []byte) ([]byte, error) {
+				mutex.Lock()
+				queried = append(queried, serverAddrPort)
+				mutex.Unlock()
+
+				if serverAddrPort == ipv6 {
+					time.Sleep(tt.ipv6Latency)
+					return dnsRequest, tt.ipv6Error
+				}
+				return dnsRequest, tt.ipv4Error
+			}
+
+			start := time.Now()
+			_, got, err := resolver.queryServer(server, []byte("query"))
+			if elapsed := time.Since(start); elapsed > tt.maxDuration {
+				t.Errorf("queryServer() took %v, want less than %v", elapsed, tt.maxDuration)
+			}
+
+			if tt.wantError {
+				if err == nil {
+					t.Fatalf("queryServer() expected error, got response from %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("queryServer() error = %v", err)
+			}
+			if got != tt.wantAddr {
+				t.Errorf("queryServer() got response from %v, want %v", got, tt.wantAddr)
+			}
+
+			// The family that worked is tried first next time
+			mutex.Lock()
+			queried = nil
+			mutex.Unlock()
+			resolver.queryServer(server, []byte("query"))
+			mutex.Lock()
+			defer mutex.Unlock()
+			if len(queried) == 0 || queried[0] != tt.wantAddr {
+				t.Errorf("queryServer() next query tried %v first, want %v", queried, tt.wantAddr)
+			}
+		})
+	}
+}
@@ -0,0 +1,366 @@
+package dns
+
+import (
+	"container/list"
+	"context"
+	"hash/maphash"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Resolver cache bounds:
+// The resolver's cached RRsets, negative answers and name servers share a
+// single cache, bounded by an approximate memory size. When a new entry
+// doesn't fit, entries which haven't been used recently are evicted. Expired
+// entries are removed when they are replaced or reached by eviction, and by a
+// background sweeper. With serve-stale, expired entries are only removed once
+// they have been stale for longer than the stale window.
+//
+// The cache is split into shards by key, each with its own lock, so that
+// lookups of different names don't wait on each other. Lookups only take a
+// shard's read lock: instead of moving entries in a least recently used
+// list, they set the entry's referenced bit, and eviction follows the CLOCK
+// algorithm, an approximation of least recently used eviction. The hand goes
+// round the shard's entries, clearing referenced bits, and evicts the first
+// entry it finds without one.
+
+// DefaultMaxCacheSize is the default bound of the resolver's cache, in bytes.
+const DefaultMaxCacheSize = 64 << 20
+
+// DefaultCacheSweepInterval is how often the background sweeper removes
+// expired entries from the cache.
+const DefaultCacheSweepInterval = time.Minute
+
+// cacheShardCount is the number of shards of the resolver's cache. It is a
+// power of two.
+const cacheShardCount = 64
+
+// cacheEntryOverhead approximates the memory used by a cache entry besides
+// its data: the map and list elements, the key and the entry itself.
+const cacheEntryOverhead = 160
+
+// CacheStats are the counters of a resolver's cache, for monitoring.
+type CacheStats struct {
+	Entries      int    // entries in the cache
+	Size         int64  // approximate memory used by the entries, in bytes
+	Hits         uint64 // questions answered from the cache
+	Misses       uint64 // questions not in the cache, or only expired
+	Evictions    uint64 // entries removed to make room for new ones
+	Expirations  uint64 // expired entries removed
+	Prefetches   uint64 // popular RRsets refreshed before they expired
+	StaleAnswers uint64 // answers served from expired entries
+	Coalesced    uint64 // resolutions which shared an identical one in flight
+}
+
+type cacheKind uint8
+
+const (
+	cachedRRsetKind cacheKind = iota
+	cachedNegativeAnswerKind
+	cachedServerKind
+)
+
+type cacheKey struct {
+	kind   cacheKind
+	name   string // lowercase FQDN
+	rType  uint16
+	rClass uint16
+}
+
+// cacheValue is a value of the resolver's cache.
+type cacheValue interface {
+	// cacheSize approximates the memory used by the value, in bytes.
+	cacheSize() int
+	// cacheExpiresAt is the time the value expires at.
+	cacheExpiresAt() time.Time
+}
+
+type cacheEntry struct {
+	key        cacheKey
+	value      cacheValue
+	size       int64
+	referenced atomic.Bool   // set by lookups, cleared by the CLOCK hand
+	hits       atomic.Uint32 // lookups which found the entry
+}
+
+// shardedCache is a cache bounded by the approximate memory size of its
+// entries, split into shards. It is safe for concurrent use.
+type shardedCache struct {
+	seed   maphash.Seed
+	shards []*cacheShard
+}
+
+type cacheShard struct {
+	maxSize     int64
+	staleWindow time.Duration // how long expired entries are kept
+
+	mutex   sync.RWMutex
+	entries map[cacheKey]*list.Element
+	clock   *list.List // of *cacheEntry, in the order the hand goes round
+	hand    *list.Element
+	size    int64
+
+	hits        atomic.Uint64
+	misses      atomic.Uint64
+	evictions   atomic.Uint64
+	expirations atomic.Uint64
+}
+
+func newShardedCache(maxSize int64, shardCount int, staleWindow time.Duration) *shardedCache {
+	cache := &shardedCache{
+		seed:   maphash.MakeSeed(),
+		shards: make([]*cacheShard, shardCount),
+	}
+	for i := range cache.shards {
+		cache.shards[i] = &cacheShard{
+			maxSize:     max(maxSize/int64(shardCount), 1),
+			staleWindow: staleWindow,
+			entries:     make(map[cacheKey]*list.Element),
+			clock:       list.New(),
+		}
+	}
+	return cache
+}
+
+func (cache *shardedCache) shard(key cacheKey) *cacheShard {
+	hash := maphash.String(cache.seed, key.name) ^ uint64(key.kind)<<32 ^ uint64(key.rType)<<16 ^ uint64(key.rClass)
+	return cache.shards[hash&uint64(len(cache.shards)-1)]
+}
+
+// get returns the value of an entry which hasn't expired, and marks it as
+// referenced. It only takes the shard's read lock.
+func (cache *shardedCache) get(key cacheKey) (value cacheValue, found bool) {
+	value, _, found = cache.getCounted(key)
+	return value, found
+}
+
+// getCounted is get, also returning the number of lookups which have found
+// the entry since it was set, this one included.
+func (cache *shardedCache) getCounted(key cacheKey) (value cacheValue, hits uint32, found bool) {
+	shard := cache.shard(key)
+
+	shard.mutex.RLock()
+	element, found := shard.entries[key]
+	var entry *cacheEntry
+	if found {
+		entry = element.Value.(*cacheEntry)
+		value = entry.value
+	}
+	shard.mutex.RUnlock()
+
+	// Expired entries are left for the sweeper, or for eviction
+	if !found || !time.Now().Before(value.cacheExpiresAt()) {
+		return nil, 0, false
+	}
+
+	// Avoid writing to the entry's cache line when it is already referenced
+	if !entry.referenced.Load() {
+		entry.referenced.Store(true)
+	}
+	return value, entry.hits.Add(1), true
+}
+
+// countLookup counts a cache hit or miss for a key. Lookups aren't counted by
+// get, as answering a question may take several.
+func (cache *shardedCache) countLookup(key cacheKey, found bool) {
+	shard := cache.shard(key)
+	if found {
+		shard.hits.Add(1)
+	} else {
+		shard.misses.Add(1)
+	}
+}
+
+// getStale returns the value of an entry which has expired, but for no longer
+// than the stale window. It doesn't count as a hit or a miss.
+func (cache *shardedCache) getStale(key cacheKey) (value cacheValue, found bool) {
+	shard := cache.shard(key)
+
+	shard.mutex.RLock()
+	element, found := shard.entries[key]
+	if found {
+		value = element.Value.(*cacheEntry).value
+	}
+	shard.mutex.RUnlock()
+
+	now := time.Now()
+	if !found || now.Before(value.cacheExpiresAt()) || shard.isDead(value, now) {
+		return nil, false
+	}
+	return value, true
+}
+
+// set adds or replaces an entry, then evicts entries until the shard fits in
+// its size. If keep is set and returns true for the value of an entry which
+// hasn't expired, the entry is kept as is.
+func (cache *shardedCache) set(key cacheKey, value cacheValue, keep func(cached cacheValue) bool) {
+	size := int64(value.cacheSize() + cacheEntryOverhead)
+	shard := cache.shard(key)
+
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	if element, found := shard.entries[key]; found {
+		entry := element.Value.(*cacheEntry)
+		if keep != nil && time.Now().Before(entry.value.cacheExpiresAt()) && keep(entry.value) {
+			return
+		}
+		shard.remove(element)
+	}
+
+	// New entries go just behind the hand, to be the last it reaches
+	entry := &cacheEntry{key: key, value: value, size: size}
+	var element *list.Element
+	if shard.hand != nil {
+		element = shard.clock.InsertBefore(entry, shard.hand)
+	} else {
+		element = shard.clock.PushBack(entry)
+	}
+	shard.entries[key] = element
+	shard.size += size
+
+	shard.evict(element)
+}
+
+// isDead reports whether a value has expired for longer than the stale
+// window, and can be removed.
+func (shard *cacheShard) isDead(value cacheValue, now time.Time) bool {
+	return !now.Before(value.cacheExpiresAt().Add(shard.staleWindow))
+}
+
+// evict moves the hand round the shard, evicting the entries which have
+// expired beyond the stale window or weren't referenced since it last went
+// by, until the shard fits in its size. The new entry is never evicted. The
+// shard must be locked.
+func (shard *cacheShard) evict(newElement *list.Element) {
+	now := time.Now()
+	for shard.size > shard.maxSize && shard.clock.Len() > 1 {
+		if shard.hand == nil {
+			shard.hand = shard.clock.Front()
+		}
+
+		element := shard.hand
+		entry := element.Value.(*cacheEntry)
+		if element != newElement && shard.isDead(entry.value, now) {
+			shard.remove(element)
+			shard.expirations.Add(1)
+			continue
+		}
+		if element == newElement || entry.referenced.Load() {
+			entry.referenced.Store(false)
+			shard.hand = element.Next()
+			continue
+		}
+
+		shard.remove(element)
+		shard.evictions.Add(1)
+	}
+}
+
+// remove removes an entry, moving the hand on if it points to it. The shard
+// must be locked.
+func (shard *cacheShard) remove(element *list.Element) {
+	if shard.hand == element {
+		shard.hand = element.Next()
+	}
+	entry := shard.clock.Remove(element).(*cacheEntry)
+	delete(shard.entries, entry.key)
+	shard.size -= entry.size
+}
+
+// sweep removes all entries which have expired beyond the stale window.
+func (cache *shardedCache) sweep() (removed int) {
+	now := time.Now()
+	for _, shard := range cache.shards {
+		shard.mutex.Lock()
+		shardRemoved := 0
+		for element := shard.clock.Front(); element != nil; {
+			next := element.Next()
+			if shard.isDead(element.Value.(*cacheEntry).value, now) {
+				shard.remove(element)
+				shardRemoved++
+			}
+			element = next
+		}
+		shard.mutex.Unlock()
+
+		shard.expirations.Add(uint64(shardRemoved))
+		removed += shardRemoved
+	}
+	return removed
+}
+
+func (cache *shardedCache) stats() (stats CacheStats) {
+	for _, shard := range cache.shards {
+		shard.mutex.RLock()
+		stats.Entries += len(shard.entries)
+		stats.Size += shard.size
+		shard.mutex.RUnlock()
+
+		stats.Hits += shard.hits.Load()
+		stats.Misses += shard.misses.Load()
+		stats.Evictions += shard.evictions.Load()
+		stats.Expirations += shard.expirations.Load()
+	}
+	return stats
+}
+
+// cache returns the resolver's cache, created on first use with the
+// resolver's MaxCacheSize and StaleWindow.
+func (resolver *Resolver) cache() *shardedCache {
+	resolver.cacheOnce.Do(func() {
+		maxSize := resolver.MaxCacheSize
+		if maxSize <= 0 {
+			maxSize = DefaultMaxCacheSize
+		}
+		resolver.cacheStore = newShardedCache(maxSize, cacheShardCount, resolver.StaleWindow)
+	})
+	return resolver.cacheStore
+}
+
+// CacheStats returns the counters of the resolver's cache.
+func (resolver *Resolver) CacheStats() CacheStats {
+	stats := resolver.cache().stats()
+	stats.Prefetches = resolver.prefetches.Load()
+	stats.StaleAnswers = resolver.staleAnswers.Load()
+	stats.Coalesced = resolver.resolutions.coalesced.Load() + resolver.nameServerLookups.coalesced.Load()
+	return stats
+}
+
+// SweepCache removes the expired entries of the resolver's cache, once they
+// are beyond the stale window.
+//
+// Returns:
+//   - removed: the number of entries removed
+func (resolver *Resolver) SweepCache() (removed int) {
+	return resolver.cache().sweep()
+}
+
+// RunCacheSweeper removes the expired entries of the resolver's cache at an
+// interval, and logs the cache's counters, until the context is done.
+//
+// Parameters:
+//   - ctx: the context which stops the sweeper
+//   - interval: the time between sweeps, DefaultCacheSweepInterval if zero
+func (resolver *Resolver) RunCacheSweeper(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultCacheSweepInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			removed := resolver.SweepCache()
+			stats := resolver.CacheStats()
+			log.Printf("Cache: removed %d expired entries: %d entries (%d bytes), %d hits, %d misses, %d evictions",
+				removed, stats.Entries, stats.Size, stats.Hits, stats.Misses, stats.Evictions)
+		}
+	}
+}
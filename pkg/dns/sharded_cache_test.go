@@ -0,0 +1,264 @@
+package dns
+
+import (
+	"context"
+	"math/rand/v2"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testCacheValue struct {
+	size      int
+	expiresAt time.Time
+}
+
+func (value testCacheValue) cacheSize() int {
+	return value.size
+}
+
+func (value testCacheValue) cacheExpiresAt() time.Time {
+	return value.expiresAt
+}
+
+func testCacheKey(name string) cacheKey {
+	return cacheKey{kind: cachedRRsetKind, name: name, rType: A, rClass: IN}
+}
+
+func TestShardedCacheEviction(t *testing.T) {
+	// Room for three entries of 40 bytes
+	cache := newShardedCache(3*(40+cacheEntryOverhead), 1, 0)
+	value := testCacheValue{size: 40, expiresAt: time.Now().Add(time.Hour)}
+
+	cache.set(testCacheKey("a."), value, nil)
+	cache.set(testCacheKey("b."), value, nil)
+	cache.set(testCacheKey("c."), value, nil)
+
+	// a. is now referenced, so the hand passes it and evicts b.
+	if _, found := cache.get(testCacheKey("a.")); !found {
+		t.Fatalf("get(a.) found = false, want true")
+	}
+	cache.set(testCacheKey("d."), value, nil)
+
+	for name, want := range map[string]bool{"a.": true, "b.": false, "c.": true, "d.": true} {
+		_, found := cache.get(testCacheKey(name))
+		if found != want {
+			t.Errorf("get(%s) found = %t, want %t", name, found, want)
+		}
+		cache.countLookup(testCacheKey(name), found)
+	}
+
+	// A larger entry evicts as many entries as needed, but not itself
+	cache.set(testCacheKey("e."), testCacheValue{size: 2*40 + cacheEntryOverhead, expiresAt: value.expiresAt}, nil)
+
+	stats := cache.stats()
+	want := CacheStats{Entries: 2, Size: 3 * (40 + cacheEntryOverhead), Hits: 3, Misses: 1, Evictions: 3}
+	if stats != want {
+		t.Errorf("stats() got = %+v, want %+v", stats, want)
+	}
+}
+
+func TestShardedCacheReplace(t *testing.T) {
+	cache := newShardedCache(DefaultMaxCacheSize, 1, 0)
+	key := testCacheKey("a.")
+	keepLarger := func(cached cacheValue) bool {
+		return cached.cacheSize() > 10
+	}
+
+	cache.set(key, testCacheValue{size: 20, expiresAt: time.Now().Add(time.Hour)}, nil)
+	cache.set(key, testCacheValue{size: 10, expiresAt: time.Now().Add(time.Hour)}, keepLarger)
+	if value, _ := cache.get(key); value.cacheSize() != 20 {
+		t.Errorf("set() replaced an entry which should be kept")
+	}
+
+	cache.set(key, testCacheValue{size: 30, expiresAt: time.Now().Add(-time.Second)}, nil)
+	cache.set(key, testCacheValue{size: 10, expiresAt: time.Now().Add(time.Hour)}, keepLarger)
+	if value, _ := cache.get(key); value.cacheSize() != 10 {
+		t.Errorf("set() kept an expired entry")
+	}
+
+	if stats := cache.stats(); stats.Entries != 1 || stats.Size != 10+cacheEntryOverhead {
+		t.Errorf("stats() got = %+v, want a single entry of %d bytes", stats, 10+cacheEntryOverhead)
+	}
+}
+
+func TestShardedCacheSweep(t *testing.T) {
+	cache := newShardedCache(DefaultMaxCacheSize, 1, 0)
+	cache.set(testCacheKey("expired."), testCacheValue{expiresAt: time.Now().Add(-time.Second)}, nil)
+	cache.set(testCacheKey("valid."), testCacheValue{expiresAt: time.Now().Add(time.Hour)}, nil)
+	cache.set(testCacheKey("expired-too."), testCacheValue{expiresAt: time.Now().Add(-time.Second)}, nil)
+
+	if removed := cache.sweep(); removed != 2 {
+		t.Errorf("sweep() removed = %d, want 2", removed)
+	}
+	if stats := cache.stats(); stats.Entries != 1 || stats.Expirations != 2 {
+		t.Errorf("stats() got = %+v, want 1 entry and 2 expirations", stats)
+	}
+}
+
+func TestShardedCacheStaleWindow(t *testing.T) {
+	cache := newShardedCache(DefaultMaxCacheSize, 1, time.Hour)
+	cache.set(testCacheKey("stale."), testCacheValue{expiresAt: time.Now().Add(-time.Minute)}, nil)
+	cache.set(testCacheKey("dead."), testCacheValue{expiresAt: time.Now().Add(-2 * time.Hour)}, nil)
+	cache.set(testCacheKey("valid."), testCacheValue{expiresAt: time.Now().Add(time.Hour)}, nil)
+
+	if _, found := cache.get(testCacheKey("stale.")); found {
+		t.Errorf("get() found a stale entry")
+	}
+	if _, found := cache.getStale(testCacheKey("stale.")); !found {
+		t.Errorf("getStale() didn't find the stale entry")
+	}
+	if _, found := cache.getStale(testCacheKey("valid.")); found {
+		t.Errorf("getStale() found an entry which hasn't expired")
+	}
+	if removed := cache.sweep(); removed != 1 {
+		t.Errorf("sweep() removed = %d, want the entry beyond the stale window only", removed)
+	}
+	if _, found := cache.getStale(testCacheKey("dead.")); found {
+		t.Errorf("getStale() found an entry beyond the stale window")
+	}
+}
+
+func TestResolverRunCacheSweeper(t *testing.T) {
+	resolver := &Resolver{}
+	resolver.cacheNameserver(Server{Fqdn: "ns.example.com."}, 10*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		resolver.RunCacheSweeper(ctx, 5*time.Millisecond)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for resolver.CacheStats().Entries > 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	if stats := resolver.CacheStats(); stats.Entries != 0 || stats.Expirations != 1 {
+		t.Errorf("CacheStats() got = %+v, want the expired name server swept", stats)
+	}
+}
+
+func TestShardedCacheShards(t *testing.T) {
+	cache := newShardedCache(DefaultMaxCacheSize, cacheShardCount, 0)
+	value := testCacheValue{size: 40, expiresAt: time.Now().Add(time.Hour)}
+
+	for i := range 1000 {
+		cache.set(testCacheKey(strconv.Itoa(i)+".example.com."), value, nil)
+	}
+
+	usedShards := 0
+	for _, shard := range cache.shards {
+		if len(shard.entries) > 0 {
+			usedShards++
+		}
+	}
+	if usedShards < cacheShardCount/2 {
+		t.Errorf("entries spread over %d shards, want most of the %d shards", usedShards, cacheShardCount)
+	}
+	for i := range 1000 {
+		key := testCacheKey(strconv.Itoa(i) + ".example.com.")
+		_, found := cache.get(key)
+		if !found {
+			t.Fatalf("get(%d.example.com.) found = false, want true", i)
+		}
+		cache.countLookup(key, found)
+	}
+	if stats := cache.stats(); stats.Entries != 1000 || stats.Hits != 1000 {
+		t.Errorf("stats() got = %+v, want 1000 entries and hits", stats)
+	}
+}
+
+func TestShardedCacheConcurrent(t *testing.T) {
+	cache := newShardedCache(64*(100+cacheEntryOverhead), 4, 0)
+	value := testCacheValue{size: 100, expiresAt: time.Now().Add(time.Hour)}
+	expired := testCacheValue{size: 100, expiresAt: time.Now().Add(-time.Second)}
+
+	var wg sync.WaitGroup
+	for worker := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 1000 {
+				key := testCacheKey(strconv.Itoa((worker*i)%200) + ".example.com.")
+				switch i % 4 {
+				case 0:
+					cache.set(key, value, nil)
+				case 1:
+					cache.set(key, expired, nil)
+				case 2:
+					cache.sweep()
+				default:
+					cache.get(key)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if stats := cache.stats(); stats.Size > 64*(100+cacheEntryOverhead) || stats.Size != int64(stats.Entries)*(100+cacheEntryOverhead) {
+		t.Errorf("stats() got = %+v, want the cache within its size", stats)
+	}
+}
+
+// The benchmarks compare a single shard, the equivalent of a single lock for
+// the whole cache, with the resolver's shards. Run them with several CPUs to
+// see how they scale:
+//
+//	go test -run '^$' -bench ShardedCache -cpu 1,2,4,8 ./pkg/dns
+
+const benchmarkCacheKeys = 10000
+
+func newBenchmarkCache(shardCount int) (cache *shardedCache, keys []cacheKey) {
+	cache = newShardedCache(DefaultMaxCacheSize, shardCount, 0)
+	value := testCacheValue{size: 100, expiresAt: time.Now().Add(time.Hour)}
+	for i := range benchmarkCacheKeys {
+		key := testCacheKey("host-" + strconv.Itoa(i) + ".example.com.")
+		keys = append(keys, key)
+		cache.set(key, value, nil)
+	}
+	return cache, keys
+}
+
+func BenchmarkShardedCacheGet(b *testing.B) {
+	for _, shardCount := range []int{1, cacheShardCount} {
+		b.Run("shards="+strconv.Itoa(shardCount), func(b *testing.B) {
+			cache, keys := newBenchmarkCache(shardCount)
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+				random := rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+				for pb.Next() {
+					cache.get(keys[random.IntN(len(keys))])
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkShardedCacheGetSet(b *testing.B) {
+	for _, shardCount := range []int{1, cacheShardCount} {
+		b.Run("shards="+strconv.Itoa(shardCount), func(b *testing.B) {
+			cache, keys := newBenchmarkCache(shardCount)
+			value := testCacheValue{size: 100, expiresAt: time.Now().Add(time.Hour)}
+			b.ResetTimer()
+
+			// One write for nine reads, as with a warm resolver cache
+			b.RunParallel(func(pb *testing.PB) {
+				random := rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+				for pb.Next() {
+					key := keys[random.IntN(len(keys))]
+					if random.IntN(10) == 0 {
+						cache.set(key, value, nil)
+					} else {
+						cache.get(key)
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,360 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// Stub resolver:
+// A stub resolver doesn't resolve names itself: it asks the name servers of
+// its configuration (usually /etc/resolv.conf), which are recursive resolvers,
+// and interprets their answers. Names are completed with the search list,
+// CNAME records are followed to the canonical name, and answers are returned
+// as Go values rather than DNS messages.
+
+// StubResolver looks up names by querying the name servers of a resolv.conf
+// configuration.
+type StubResolver struct {
+	// Config holds the name servers, search list and options.
+	Config *ResolvConf
+	// Transport sends the queries. DefaultTransport if nil.
+	Transport *Transport
+	// TransmissionProtocol is "udp", "tcp", "tls", "https" or "quic".
+	// "udp" if empty.
+	TransmissionProtocol string
+}
+
+// NewStubResolver creates a stub resolver which queries the name servers of
+// the given configuration over UDP, falling back to TCP for truncated
+// responses.
+func NewStubResolver(conf *ResolvConf) *StubResolver {
+	return &StubResolver{
+		Config:               conf,
+		Transport:            NewTransport(),
+		TransmissionProtocol: "udp",
+	}
+}
+
+// LookupError is the error returned by the stub resolver's lookups. It wraps
+// ErrNXDomain if the name doesn't exist, or ErrNoData if it exists but has no
+// record of the requested type.
+type LookupError struct {
+	Name string
+	Err  error
+}
+
+func (err *LookupError) Error() string {
+	return "lookup " + err.Name + ": " + err.Err.Error()
+}
+
+func (err *LookupError) Unwrap() error {
+	return err.Err
+}
+
+// MXRecord is a mail exchange, as returned by LookupMX.
+type MXRecord struct {
+	Host       string
+	Preference uint16
+}
+
+// SRVRecord is a service location, as returned by LookupSRV.
+type SRVRecord struct {
+	Target   string
+	Port     uint16
+	Priority uint16
+	Weight   uint16
+}
+
+// LookupHost returns the IPv4 and IPv6 addresses of a host, IPv4 addresses
+// first. If the host is an IP address, it is returned as is.
+//
+// Parameters:
+//   - ctx: the context, which cancels the lookup when done
+//   - host: the host name, completed with the search list if not absolute
+//
+// Returns:
+//   - addrs: the host's addresses
+//   - err: a *LookupError if the host has no address
+func (stub *StubResolver) LookupHost(ctx context.Context, host string) (addrs []netip.Addr, err error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr}, nil
+	}
+
+	records, err := stub.lookup(ctx, host, A, AAAA)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, record := range records {
+		switch rdata := record.RData.(type) {
+		case *RDataA:
+			addrs = append(addrs, rdata.IP)
+		case *RDataAAAA:
+			addrs = append(addrs, rdata.IP)
+		}
+	}
+	return addrs, nil
+}
+
+// LookupMX returns the mail exchanges of a domain, sorted by preference.
+// Mail exchanges with the same preference are in random order, to spread
+// the load between them.
+//
+// Parameters:
+//   - ctx: the context, which cancels the lookup when done
+//   - name: the domain name, completed with the search list if not absolute
+//
+// Returns:
+//   - mxs: the domain's mail exchanges
+//   - err: a *LookupError if the domain has no MX record
+func (stub *StubResolver) LookupMX(ctx context.Context, name string) (mxs []MXRecord, err error) {
+	records, err := stub.lookup(ctx, name, MX)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, record := range records {
+		if rdata, ok := record.RData.(*RDataMX); ok {
+			mxs = append(mxs, MXRecord{Host: rdata.DomainName, Preference: rdata.Preference})
+		}
+	}
+
+	rand.Shuffle(len(mxs), func(i, j int) { mxs[i], mxs[j] = mxs[j], mxs[i] })
+	slices.SortStableFunc(mxs, func(a, b MXRecord) int {
+		return int(a.Preference) - int(b.Preference)
+	})
+	return mxs, nil
+}
+
+// LookupSRV returns the locations of a service, in the order they should be
+// tried [RFC2782]: by priority, then in a random order weighted by weight
+// within each priority.
+//
+// Parameters:
+//   - ctx: the context, which cancels the lookup when done
+//   - service: the symbolic name of the service, such as "sip"
+//   - proto: the protocol of the service, such as "tcp"
+//   - name: the domain name, completed with the search list if not absolute
+//
+// Returns:
+//   - srvs: the service's locations
+//   - err: a *LookupError if the service has no SRV record
+func (stub *StubResolver) LookupSRV(ctx context.Context, service string, proto string, name string) (srvs []SRVRecord, err error) {
+	records, err := stub.lookup(ctx, "_"+service+"._"+proto+"."+name, SRV)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, record := range records {
+		if rdata, ok := record.RData.(*RDataSRV); ok {
+			srvs = append(srvs, SRVRecord{Target: rdata.Target, Port: rdata.Port, Priority: rdata.Priority, Weight: rdata.Weight})
+		}
+	}
+
+	slices.SortStableFunc(srvs, func(a, b SRVRecord) int {
+		return int(a.Priority) - int(b.Priority)
+	})
+	for start := 0; start < len(srvs); {
+		end := start + 1
+		for end < len(srvs) && srvs[end].Priority == srvs[start].Priority {
+			end++
+		}
+		shuffleSRVByWeight(srvs[start:end])
+		start = end
+	}
+	return srvs, nil
+}
+
+// shuffleSRVByWeight orders records of the same priority as described in
+// RFC 2782: records with a weight of 0 go first, then each record is picked
+// in turn with a probability proportional to its weight.
+func shuffleSRVByWeight(srvs []SRVRecord) {
+	slices.SortStableFunc(srvs, func(a, b SRVRecord) int {
+		if a.Weight == 0 && b.Weight != 0 {
+			return -1
+		}
+		if a.Weight != 0 && b.Weight == 0 {
+			return 1
+		}
+		return 0
+	})
+
+	totalWeight := 0
+	for _, srv := range srvs {
+		totalWeight += int(srv.Weight)
+	}
+
+	for i := range srvs {
+		pick := rand.IntN(totalWeight + 1)
+		runningSum := 0
+		for j := i; j < len(srvs); j++ {
+			runningSum += int(srvs[j].Weight)
+			if runningSum >= pick {
+				srvs[i], srvs[j] = srvs[j], srvs[i]
+				break
+			}
+		}
+		totalWeight -= int(srvs[i].Weight)
+	}
+}
+
+// LookupTXT returns the text records of a domain. The <character-string>s of
+// each record are joined into a single string.
+//
+// Parameters:
+//   - ctx: the context, which cancels the lookup when done
+//   - name: the domain name, completed with the search list if not absolute
+//
+// Returns:
+//   - txts: the domain's text records
+//   - err: a *LookupError if the domain has no TXT record
+func (stub *StubResolver) LookupTXT(ctx context.Context, name string) (txts []string, err error) {
+	records, err := stub.lookup(ctx, name, TXT)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, record := range records {
+		if rdata, ok := record.RData.(*RDataTXT); ok {
+			txts = append(txts, strings.Join(rdata.Strings(), ""))
+		}
+	}
+	return txts, nil
+}
+
+// lookup tries each name of the search list in turn until one of them has
+// records of the requested types. Like glibc, it moves on to the next name
+// if a name doesn't exist or has no record of the requested types, and
+// reports NODATA rather than NXDOMAIN if any of the names exist.
+func (stub *StubResolver) lookup(ctx context.Context, name string, questionTypes ...uint16) (records []ResourceRecord, err error) {
+	if stub.Config == nil {
+		return nil, &LookupError{Name: name, Err: ErrNoNameservers}
+	}
+
+	gotNoData := false
+	for _, fqdn := range stub.Config.searchNames(name) {
+		records, err = stub.resolveTypes(ctx, fqdn, questionTypes)
+		if len(records) > 0 {
+			return records, nil
+		}
+
+		switch {
+		case errors.Is(err, ErrNoData):
+			gotNoData = true
+		case errors.Is(err, ErrNXDomain):
+		default:
+			return nil, &LookupError{Name: name, Err: err}
+		}
+	}
+
+	if gotNoData {
+		return nil, &LookupError{Name: name, Err: ErrNoData}
+	}
+	return nil, &LookupError{Name: name, Err: ErrNXDomain}
+}
+
+// resolveTypes resolves a name for several question types in parallel and
+// returns the records of all of them, in the order of the question types.
+// The error is only set if none of the types has records: it is ErrNoData
+// if the name exists, ErrNXDomain if it doesn't, or the first other error.
+func (stub *StubResolver) resolveTypes(ctx context.Context, fqdn string, questionTypes []uint16) (records []ResourceRecord, err error) {
+	results := make([][]ResourceRecord, len(questionTypes))
+	errs := make([]error, len(questionTypes))
+	done := make(chan struct{}, len(questionTypes))
+
+	for i, questionType := range questionTypes {
+		go func() {
+			results[i], errs[i] = stub.resolveName(ctx, fqdn, questionType)
+			done <- struct{}{}
+		}()
+	}
+	for range questionTypes {
+		<-done
+	}
+
+	for i := range questionTypes {
+		records = append(records, results[i]...)
+	}
+	if len(records) > 0 {
+		return records, nil
+	}
+
+	for _, err := range errs {
+		if !errors.Is(err, ErrNXDomain) && !errors.Is(err, ErrNoData) {
+			return nil, err
+		}
+	}
+	for _, err := range errs {
+		if errors.Is(err, ErrNoData) {
+			return nil, err
+		}
+	}
+	return nil, errs[0]
+}
+
+// resolveName resolves a name for a question type, following CNAME records,
+// and those synthesized from DNAME records, to the canonical name. The name
+// servers usually answer with the whole chain, but if the chain stops at a name
+// with no records, that name is queried in turn.
+func (stub *StubResolver) resolveName(ctx context.Context, fqdn string, questionType uint16) (records []ResourceRecord, err error) {
+	visited := map[string]bool{strings.ToLower(fqdn): true}
+	name := fqdn
+
+	for {
+		response, err := stub.query(ctx, name, questionType)
+		if err != nil {
+			return nil, err
+		}
+
+		switch responseCode := response.GetResponseCode(); responseCode {
+		case NOERROR:
+		case NXDOMAIN:
+			return nil, ErrNXDomain
+		default:
+			return nil, fmt.Errorf("%w: %s", ErrLookupFailed, DNSRCode(responseCode))
+		}
+
+		answers, err := synthesizeDNAMECNAMEs(response.Answers, name)
+		if err != nil {
+			return nil, err
+		}
+
+		records, canonicalName, err := followCNAMEs(answers, name, questionType, visited)
+		if err != nil || len(records) > 0 {
+			return records, err
+		}
+		if canonicalName == name {
+			return nil, ErrNoData
+		}
+		name = canonicalName
+	}
+}
+
+// query sends a query for a name to the configured name servers and decodes
+// the response.
+func (stub *StubResolver) query(ctx context.Context, fqdn string, questionType uint16) (response Message, err error) {
+	dnsRequest, err := CreateQuery(fqdn, questionType)
+	if err != nil {
+		return Message{}, err
+	}
+
+	transport := stub.Transport
+	if transport == nil {
+		transport = DefaultTransport
+	}
+	transmissionProtocol := stub.TransmissionProtocol
+	if transmissionProtocol == "" {
+		transmissionProtocol = "udp"
+	}
+
+	rawResponse, _, _, err := stub.Config.Query(ctx, transport, transmissionProtocol, dnsRequest)
+	if err != nil {
+		return Message{}, err
+	}
+	return DecodeMessage(rawResponse)
+}
@@ -0,0 +1,197 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTestZoneServer starts a local UDP server which answers from a zone:
+// with the records of the question's name and type, or with its CNAME record
+// (without following it). Names that aren't in the zone get NXDOMAIN.
+func startTestZoneServer(t *testing.T, zone []ResourceRecord) netip.AddrPort {
+	t.Helper()
+
+	return startTestUDPServer(t, func(request []byte, _ netip.AddrPort) []byte {
+		parsedRequest, err := DecodeMessage(request)
+		if err != nil {
+			return nil
+		}
+		question := parsedRequest.Questions[0]
+
+		reply := NewReply(parsedRequest)
+		exists := false
+		for _, record := range zone {
+			if !strings.EqualFold(record.Name, question.Name) {
+				continue
+			}
+			exists = true
+			if record.RType == question.QType || record.RType == CNAME {
+				reply.Answers = append(reply.Answers, record)
+			}
+		}
+		if !exists {
+			reply.SetResponseCode(NXDOMAIN)
+		}
+
+		reply.UpdateCounts()
+		response, err := EncodeMessage(reply)
+		if err != nil {
+			t.Errorf("failed to encode test reply: %v", err)
+		}
+		return response
+	})
+}
+
+func newTestStubResolver(t *testing.T, zone []ResourceRecord) *StubResolver {
+	conf := NewResolvConf(startTestZoneServer(t, zone))
+	conf.Search = []string{"example.com."}
+	conf.Timeout = time.Second
+	return NewStubResolver(conf)
+}
+
+func TestStubResolverLookupHost(t *testing.T) {
+	zone := []ResourceRecord{
+		newResourceRecord("host.example.com.", A, 300, &RDataA{IP: netip.MustParseAddr("192.0.2.1")}),
+		newResourceRecord("host.example.com.", AAAA, 300, &RDataAAAA{IP: netip.MustParseAddr("2001:db8::1")}),
+		newResourceRecord("host.example.com.", MX, 300, &RDataMX{Preference: 10, DomainName: "mail.example.com."}),
+		newResourceRecord("www.example.net.", CNAME, 300, &RDataCNAME{DomainName: "alias.example.org."}),
+		newResourceRecord("alias.example.org.", CNAME, 300, &RDataCNAME{DomainName: "host.example.com."}),
+		newResourceRecord("mail.example.com.", MX, 300, &RDataMX{Preference: 10, DomainName: "host.example.com."}),
+		newResourceRecord("loop1.example.com.", CNAME, 300, &RDataCNAME{DomainName: "loop2.example.com."}),
+		newResourceRecord("loop2.example.com.", CNAME, 300, &RDataCNAME{DomainName: "loop1.example.com."}),
+		newResourceRecord("dangling.example.com.", CNAME, 300, &RDataCNAME{DomainName: "missing.example.com."}),
+	}
+	stub := newTestStubResolver(t, zone)
+	hostAddrs := []netip.Addr{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1")}
+
+	tests := []struct {
+		name      string
+		host      string
+		want      []netip.Addr
+		wantError error
+	}{
+		{name: "Name completed with the search list", host: "host", want: hostAddrs},
+		{name: "Absolute name", host: "host.example.com.", want: hostAddrs},
+		{name: "CNAME chain followed", host: "www.example.net", want: hostAddrs},
+		{name: "IP address", host: "2001:db8::2", want: []netip.Addr{netip.MustParseAddr("2001:db8::2")}},
+		{name: "Name does not exist", host: "missing", wantError: ErrNXDomain},
+		{name: "Name has no address", host: "mail", wantError: ErrNoData},
+		{name: "CNAME to a name that does not exist", host: "dangling.example.com.", wantError: ErrNXDomain},
+		{name: "CNAME loop", host: "loop1.example.com.", wantError: ErrCNAMELoop},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := stub.LookupHost(context.Background(), tt.host)
+
+			if tt.wantError != nil {
+				var lookupError *LookupError
+				if !errors.Is(err, tt.wantError) || !errors.As(err, &lookupError) || lookupError.Name != tt.host {
+					t.Fatalf("LookupHost() error = %v, want *LookupError for %s wrapping %v", err, tt.host, tt.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LookupHost() error = %v", err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("LookupHost() got = %v, want = %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStubResolverLookupMX(t *testing.T) {
+	zone := []ResourceRecord{
+		newResourceRecord("example.com.", MX, 300, &RDataMX{Preference: 20, DomainName: "mx3.example.com."}),
+		newResourceRecord("example.com.", MX, 300, &RDataMX{Preference: 10, DomainName: "mx1.example.com."}),
+		newResourceRecord("example.com.", MX, 300, &RDataMX{Preference: 10, DomainName: "mx2.example.com."}),
+	}
+	stub := newTestStubResolver(t, zone)
+
+	got, err := stub.LookupMX(context.Background(), "example.com")
+	if err != nil {
+		t.Fatalf("LookupMX() error = %v", err)
+	}
+
+	gotPreferences := []uint16{}
+	for _, mx := range got {
+		gotPreferences = append(gotPreferences, mx.Preference)
+	}
+	if !slices.Equal(gotPreferences, []uint16{10, 10, 20}) || got[2].Host != "mx3.example.com." {
+		t.Errorf("LookupMX() got = %v, want sorted by preference", got)
+	}
+}
+
+func TestStubResolverLookupSRV(t *testing.T) {
+	zone := []ResourceRecord{
+		newResourceRecord("_sip._udp.example.com.", SRV, 300, &RDataSRV{Priority: 20, Weight: 0, Port: 5060, Target: "backup.example.com."}),
+		newResourceRecord("_sip._udp.example.com.", SRV, 300, &RDataSRV{Priority: 10, Weight: 60, Port: 5060, Target: "sip1.example.com."}),
+		newResourceRecord("_sip._udp.example.com.", SRV, 300, &RDataSRV{Priority: 10, Weight: 40, Port: 5060, Target: "sip2.example.com."}),
+	}
+	stub := newTestStubResolver(t, zone)
+
+	got, err := stub.LookupSRV(context.Background(), "sip", "udp", "example.com")
+	if err != nil {
+		t.Fatalf("LookupSRV() error = %v", err)
+	}
+	if len(got) != 3 || got[0].Priority != 10 || got[1].Priority != 10 || got[2].Target != "backup.example.com." {
+		t.Errorf("LookupSRV() got = %v, want sorted by priority", got)
+	}
+
+	if _, err := stub.LookupSRV(context.Background(), "xmpp", "tcp", "example.com"); !errors.Is(err, ErrNXDomain) {
+		t.Errorf("LookupSRV() error = %v, want %v", err, ErrNXDomain)
+	}
+}
+
+func TestShuffleSRVByWeight(t *testing.T) {
+	const runs = 2000
+	firstCounts := map[string]int{}
+
+	for range runs {
+		srvs := []SRVRecord{
+			{Target: "light.example.com.", Weight: 1},
+			{Target: "zero.example.com.", Weight: 0},
+			{Target: "heavy.example.com.", Weight: 3},
+		}
+		shuffleSRVByWeight(srvs)
+		firstCounts[srvs[0].Target]++
+
+		targets := []string{srvs[0].Target, srvs[1].Target, srvs[2].Target}
+		slices.Sort(targets)
+		if !slices.Equal(targets, []string{"heavy.example.com.", "light.example.com.", "zero.example.com."}) {
+			t.Fatalf("shuffleSRVByWeight() got = %v, want the same records", srvs)
+		}
+	}
+
+	// Heavy is picked first with a probability of 3/5, light 1/5, and zero
+	// only when the random pick is 0: 1/5
+	if heavy := float64(firstCounts["heavy.example.com."]) / runs; heavy < 0.5 || heavy > 0.7 {
+		t.Errorf("shuffleSRVByWeight() picked the heaviest record first %.2f of the time, want about 0.6", heavy)
+	}
+	if light := float64(firstCounts["light.example.com."]) / runs; light < 0.1 || light > 0.3 {
+		t.Errorf("shuffleSRVByWeight() picked the lightest record first %.2f of the time, want about 0.2", light)
+	}
+}
+
+func TestStubResolverLookupTXT(t *testing.T) {
+	zone := []ResourceRecord{
+		newResourceRecord("example.com.", TXT, 300, &RDataTXT{Text: "\x0dv=spf1 -all"}),
+		newResourceRecord("example.com.", TXT, 300, &RDataTXT{Text: "\x05hello\x06 world"}),
+	}
+	stub := newTestStubResolver(t, zone)
+
+	got, err := stub.LookupTXT(context.Background(), "example.com.")
+	if err != nil {
+		t.Fatalf("LookupTXT() error = %v", err)
+	}
+	if want := []string{"v=spf1 -all", "hello world"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("LookupTXT() got = %q, want = %q", got, want)
+	}
+}
@@ -0,0 +1,89 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+)
+
+// DNS over TCP (RFC 1035 section 4.2.2, RFC 7766 section 8):
+// Each message is prefixed with a two byte length field which gives the
+// message length, excluding the two byte length field. Several messages
+// may be sent over the same connection, in either direction.
+
+//     +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+//     |                    LENGTH                     |
+//     +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+//     /                    MESSAGE                    /
+//     /                                               /
+//     +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+
+const MaxDNSMessageSizeOverTCP = 65535
+
+// TCPConn is a stream connection that sends and receives length-prefixed
+// DNS messages. It can carry several messages, such as the many responses
+// to a zone transfer (AXFR) query.
+type TCPConn struct {
+	net.Conn
+}
+
+// DialTCP opens a TCP connection to a DNS server with the transport's
+// local address, cancelled if the context is done before it is established.
+func (transport *Transport) DialTCP(ctx context.Context, serverAddrPort netip.AddrPort) (conn *TCPConn, err error) {
+	netConn, err := transport.dial(ctx, "tcp", serverAddrPort)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to DNS server: %w", err)
+	}
+	return &TCPConn{Conn: netConn}, nil
+}
+
+// WriteMessage sends a DNS message prefixed with its length.
+func (conn *TCPConn) WriteMessage(message []byte) error {
+	return writeTCPMessage(conn.Conn, message)
+}
+
+// ReadMessage reads the next length-prefixed DNS message, however many
+// reads it takes to receive it.
+func (conn *TCPConn) ReadMessage() (message []byte, err error) {
+	return readTCPMessage(conn.Conn)
+}
+
+func writeTCPMessage(writer io.Writer, message []byte) error {
+	if len(message) > MaxDNSMessageSizeOverTCP {
+		return fmt.Errorf("failed to send DNS message: %d bytes exceeds %d: %w", len(message), MaxDNSMessageSizeOverTCP, ErrMessageTooLong)
+	}
+
+	// Send the length prefix and the message in a single write
+	length := uint16(len(message))
+	data := make([]byte, 0, 2+len(message))
+	data = append(data, byte(length>>8), byte(length&0xFF))
+	data = append(data, message...)
+
+	_, err := writer.Write(data)
+	if err != nil {
+		return fmt.Errorf("failed to send DNS message: %w", err)
+	}
+	return nil
+}
+
+func readTCPMessage(reader io.Reader) (message []byte, err error) {
+	lengthPrefix := [2]byte{}
+	_, err = io.ReadFull(reader, lengthPrefix[:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to read DNS message length: %w", err)
+	}
+
+	length := int(lengthPrefix[0])<<8 | int(lengthPrefix[1])
+	if length < DNSHeaderLength {
+		return nil, fmt.Errorf("invalid DNS message length %d: %w", length, ErrInvalidLengthTooShort)
+	}
+
+	message = make([]byte, length)
+	_, err = io.ReadFull(reader, message)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read DNS message: %w", err)
+	}
+	return message, nil
+}
@@ -0,0 +1,170 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestReadTCPMessage(t *testing.T) {
+	largeMessage := bytes.Repeat([]byte{0xAB}, 20000)
+
+	tests := []struct {
+		name      string
+		data      []byte
+		want      []byte
+		wantError error
+	}{
+		{
+			name:      "Small message",
+			data:      append([]byte{0, 12}, make([]byte, 12)...),
+			want:      make([]byte, 12),
+			wantError: nil,
+		},
+		{
+			name:      "Message larger than 4096 bytes",
+			data:      append([]byte{0x4E, 0x20}, largeMessage...),
+			want:      largeMessage,
+			wantError: nil,
+		},
+		{
+			name:      "Truncated message",
+			data:      append([]byte{0, 20}, make([]byte, 12)...),
+			want:      nil,
+			wantError: io.ErrUnexpectedEOF,
+		},
+		{
+			name:      "Length shorter than a header",
+			data:      []byte{0, 2, 0, 0},
+			want:      nil,
+			wantError: ErrInvalidLengthTooShort,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Return a single byte per read to simulate a message split over many segments
+			got, err := readTCPMessage(iotest.OneByteReader(bytes.NewReader(tt.data)))
+
+			if tt.wantError != nil {
+				if err == nil || !errors.Is(err, tt.wantError) {
+					t.Fatalf("readTCPMessage() error = %v, want error = %v", err, tt.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readTCPMessage() error = %v", err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("readTCPMessage() got %d bytes, want %d bytes", len(got), len(tt.want))
+			}
+		})
+	}
+}
+
+func TestWriteTCPMessage(t *testing.T) {
+	var buffer bytes.Buffer
+	message := bytes.Repeat([]byte{1}, 300)
+
+	if err := writeTCPMessage(&buffer, message); err != nil {
+		t.Fatalf("writeTCPMessage() error = %v", err)
+	}
+	if want := append([]byte{0x01, 0x2C}, message...); !bytes.Equal(buffer.Bytes(), want) {
+		t.Errorf("writeTCPMessage() got = %v, want = %v", buffer.Bytes(), want)
+	}
+
+	if err := writeTCPMessage(&buffer, make([]byte, MaxDNSMessageSizeOverTCP+1)); !errors.Is(err, ErrMessageTooLong) {
+		t.Errorf("writeTCPMessage() error = %v, want error = %v", err, ErrMessageTooLong)
+	}
+}
+
+// startTestTCPServer starts a local TCP server that answers each connection's
+// first request with the responses respond returns for it, each written in
+// small chunks.
+func startTestTCPServer(t *testing.T, respond func(request []byte) [][]byte) netip.AddrPort {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start test TCP server: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				request, err := readTCPMessage(conn)
+				if err != nil {
+					return
+				}
+				var buffer bytes.Buffer
+				for _, response := range respond(request) {
+					writeTCPMessage(&buffer, response)
+				}
+				for buffer.Len() > 0 {
+					conn.Write(buffer.Next(1000))
+					time.Sleep(time.Millisecond)
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().(*net.TCPAddr).AddrPort()
+}
+
+func TestTransportQueryTCP(t *testing.T) {
+	request, _ := CreateQuery("example.com.", A)
+	largeResponse := append([]byte{request[0], request[1]}, bytes.Repeat([]byte{0xCD}, 10000)...)
+	server := startTestTCPServer(t, func(wireRequest []byte) [][]byte {
+		// Answer with the ID the query was sent with on the connection
+		return [][]byte{append([]byte{wireRequest[0], wireRequest[1]}, largeResponse[2:]...)}
+	})
+
+	got, err := NewTransport().Query("tcp", server, request)
+	if err != nil {
+		t.Fatalf("Query() error = %v", err)
+	}
+	if !bytes.Equal(got, largeResponse) {
+		t.Errorf("Query() got %d bytes, want %d bytes", len(got), len(largeResponse))
+	}
+}
+
+func TestTCPConnMultipleMessages(t *testing.T) {
+	responses := [][]byte{
+		bytes.Repeat([]byte{1}, 5000),
+		bytes.Repeat([]byte{2}, 12),
+		bytes.Repeat([]byte{3}, 65535),
+	}
+	server := startTestTCPServer(t, func([]byte) [][]byte { return responses })
+	request, _ := CreateQuery("example.com.", AXFR)
+
+	conn, err := NewTransport().DialTCP(context.Background(), server)
+	if err != nil {
+		t.Fatalf("DialTCP() error = %v", err)
+	}
+	defer conn.Close()
+
+	if err := conn.WriteMessage(request); err != nil {
+		t.Fatalf("WriteMessage() error = %v", err)
+	}
+	for i, want := range responses {
+		got, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage() %d error = %v", i, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("ReadMessage() %d got %d bytes, want %d bytes", i, len(got), len(want))
+		}
+	}
+}
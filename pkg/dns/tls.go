@@ -0,0 +1,150 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net/netip"
+)
+
+// DNS over TLS (RFC 7858):
+// Messages are sent over a TLS connection to port 853 with the same two byte
+// length prefix as DNS over TCP. Connections are kept open and shared by
+// following queries like TCP connections (see pipeline.go), and TLS sessions
+// are resumed when a new connection is needed. Queries are padded (RFC 7830,
+// RFC 8467) so that their length does not reveal the name being queried.
+
+const DefaultTLSPort = 853
+
+const tlsSessionCacheSize = 64
+
+// getTLSConfig returns the TLS configuration for a connection to a server,
+// creating the transport's session cache on first use.
+//
+// The server's certificate is verified against the configured server name,
+// or against the given default server name (the server's IP address for DNS
+// over TLS and QUIC, the URL host for DNS over HTTPS) if none is set. If SPKI
+// pins are set, the certificate chain must also contain a pinned public key.
+// If only SPKI pins are set and no server name, only the pins are verified
+// (RFC 7858 section 4.2 out-of-band key-pinned privacy profile).
+func (transport *Transport) getTLSConfig(defaultServerName string) (config *tls.Config, err error) {
+	transport.mutex.Lock()
+	if transport.tlsSessionCache == nil {
+		transport.tlsSessionCache = tls.NewLRUClientSessionCache(tlsSessionCacheSize)
+	}
+	sessionCache := transport.tlsSessionCache
+	transport.mutex.Unlock()
+
+	if transport.TLSConfig != nil {
+		config = transport.TLSConfig.Clone()
+	} else {
+		config = &tls.Config{}
+	}
+	if config.ClientSessionCache == nil {
+		config.ClientSessionCache = sessionCache
+	}
+	if config.MinVersion == 0 {
+		config.MinVersion = tls.VersionTLS12
+	}
+
+	hasServerName := config.ServerName != ""
+	if !hasServerName {
+		config.ServerName = defaultServerName
+	}
+
+	if len(transport.SPKIPins) == 0 {
+		return config, nil
+	}
+
+	pins := make([][]byte, 0, len(transport.SPKIPins))
+	for _, pin := range transport.SPKIPins {
+		decoded, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(decoded) != sha256.Size {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidSPKIPin, pin)
+		}
+		pins = append(pins, decoded)
+	}
+
+	if !hasServerName {
+		// Only the pins authenticate the server
+		config.InsecureSkipVerify = true
+	}
+	// Unlike VerifyPeerCertificate, VerifyConnection is also called on resumed sessions
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		return verifySPKIPins(state.PeerCertificates, pins)
+	}
+
+	return config, nil
+}
+
+// verifySPKIPins checks that one of the certificates presented by the server
+// has a public key whose SHA-256 hash matches one of the pins.
+func verifySPKIPins(certs []*x509.Certificate, pins [][]byte) error {
+	for _, cert := range certs {
+		hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if bytes.Equal(hash[:], pin) {
+				return nil
+			}
+		}
+	}
+	return ErrSPKIPinMismatch
+}
+
+// SPKIPin returns the base64 encoded SHA-256 hash of a certificate's
+// SubjectPublicKeyInfo, to use in a Transport's SPKIPins.
+func SPKIPin(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func (transport *Transport) dialTLS(ctx context.Context, serverAddrPort netip.AddrPort) (conn *tls.Conn, err error) {
+	config, err := transport.getTLSConfig(serverAddrPort.Addr().Unmap().String())
+	if err != nil {
+		return nil, err
+	}
+
+	netConn, err := transport.dial(ctx, "tcp", serverAddrPort)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to DNS server: %w", err)
+	}
+
+	conn = tls.Client(netConn, config)
+	err = conn.HandshakeContext(ctx)
+	if err != nil {
+		netConn.Close()
+		return nil, fmt.Errorf("TLS handshake with DNS server %v failed: %w", serverAddrPort, err)
+	}
+	return conn, nil
+}
+
+// CloseIdleConnections closes the connections kept open for reuse that no
+// query is waiting on.
+func (transport *Transport) CloseIdleConnections() {
+	transport.mutex.Lock()
+	streamConns := make([]*pipelinedConn, 0, len(transport.streamConns))
+	for _, conn := range transport.streamConns {
+		streamConns = append(streamConns, conn)
+	}
+	transport.mutex.Unlock()
+
+	// Closing a connection removes it from the transport
+	for _, conn := range streamConns {
+		conn.closeWhenIdle()
+	}
+
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+
+	for _, client := range transport.httpClients {
+		client.CloseIdleConnections()
+	}
+	for serverAddrPort, conn := range transport.quicConns {
+		conn.Close()
+		delete(transport.quicConns, serverAddrPort)
+	}
+}
@@ -0,0 +1,292 @@
+package dns
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// createTestCertificate creates a self-signed certificate for 127.0.0.1
+// and the name dns.example.test.
+func createTestCertificate(t *testing.T) (tls.Certificate, *x509.Certificate) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate test key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "dns.example.test"},
+		DNSNames:              []string{"dns.example.test"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create test certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse test certificate: %v", err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert
+}
+
+type testTLSServer struct {
+	addrPort        netip.AddrPort
+	connections     atomic.Int32
+	resumedSessions atomic.Int32
+	unpaddedQueries atomic.Int32
+}
+
+// startTestTLSServer starts a local DNS over TLS server which answers every
+// query on a connection until the client closes it.
+func startTestTLSServer(t *testing.T, cert tls.Certificate) *testTLSServer {
+	t.Helper()
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("failed to start test TLS server: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	server := &testTLSServer{addrPort: listener.Addr().(*net.TCPAddr).AddrPort()}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server.connections.Add(1)
+
+			go func() {
+				defer conn.Close()
+				tlsConn := conn.(*tls.Conn)
+				if err := tlsConn.Handshake(); err != nil {
+					return
+				}
+				if tlsConn.ConnectionState().DidResume {
+					server.resumedSessions.Add(1)
+				}
+
+				for {
+					request, err := readTCPMessage(conn)
+					if err != nil {
+						return
+					}
+					if len(request)%queryPaddingBlockSize != 0 {
+						server.unpaddedQueries.Add(1)
+					}
+					writeTCPMessage(conn, createTestReply(t, request))
+				}
+			}()
+		}
+	}()
+
+	return server
+}
+
+func TestTransportQueryTLS(t *testing.T) {
+	cert, parsedCert := createTestCertificate(t)
+	trustedRoots := x509.NewCertPool()
+	trustedRoots.AddCert(parsedCert)
+
+	_, otherCert := createTestCertificate(t)
+
+	tests := []struct {
+		name      string
+		transport *Transport
+		wantError error
+	}{
+		{
+			name:      "Verified server IP address",
+			transport: &Transport{Timeout: time.Second, TLSConfig: &tls.Config{RootCAs: trustedRoots}},
+			wantError: nil,
+		},
+		{
+			name:      "Verified server name",
+			transport: &Transport{Timeout: time.Second, TLSConfig: &tls.Config{RootCAs: trustedRoots, ServerName: "dns.example.test"}},
+			wantError: nil,
+		},
+		{
+			name:      "Untrusted certificate",
+			transport: &Transport{Timeout: time.Second},
+			wantError: &tls.CertificateVerificationError{},
+		},
+		{
+			name:      "Wrong server name",
+			transport: &Transport{Timeout: time.Second, TLSConfig: &tls.Config{RootCAs: trustedRoots, ServerName: "other.example.test"}},
+			wantError: &tls.CertificateVerificationError{},
+		},
+		{
+			name:      "Matching SPKI pin",
+			transport: &Transport{Timeout: time.Second, SPKIPins: []string{SPKIPin(otherCert), SPKIPin(parsedCert)}},
+			wantError: nil,
+		},
+		{
+			name:      "Mismatched SPKI pin",
+			transport: &Transport{Timeout: time.Second, SPKIPins: []string{SPKIPin(otherCert)}},
+			wantError: ErrSPKIPinMismatch,
+		},
+		{
+			name:      "Invalid SPKI pin",
+			transport: &Transport{Timeout: time.Second, SPKIPins: []string{"not a pin"}},
+			wantError: ErrInvalidSPKIPin,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := startTestTLSServer(t, cert)
+			defer tt.transport.CloseIdleConnections()
+
+			request, _ := CreateQuery("example.com.", A)
+			got, err := tt.transport.Query("tls", server.addrPort, request)
+
+			if tt.wantError != nil {
+				if err == nil {
+					t.Fatalf("Query() expected error %v, got response %v", tt.wantError, got)
+				}
+				if verificationError, ok := tt.wantError.(*tls.CertificateVerificationError); ok {
+					if !errors.As(err, &verificationError) {
+						t.Fatalf("Query() error = %v, want certificate verification error", err)
+					}
+				} else if !errors.Is(err, tt.wantError) {
+					t.Fatalf("Query() error = %v, want error = %v", err, tt.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Query() error = %v", err)
+			}
+
+			response, err := DecodeMessage(got)
+			if err != nil {
+				t.Fatalf("Query() response cannot be decoded: %v", err)
+			}
+			if request[0] != got[0] || request[1] != got[1] || response.Questions[0].Name != "example.com." {
+				t.Errorf("Query() response does not match request: %+v", response)
+			}
+		})
+	}
+}
+
+func TestTransportQueryTLSReuse(t *testing.T) {
+	cert, parsedCert := createTestCertificate(t)
+	server := startTestTLSServer(t, cert)
+	transport := &Transport{Timeout: time.Second, SPKIPins: []string{SPKIPin(parsedCert)}}
+	defer transport.CloseIdleConnections()
+
+	request, _ := CreateQuery("example.com.", A)
+
+	// Queries over the same idle connection
+	for i := 0; i < 3; i++ {
+		if _, err := transport.Query("tls", server.addrPort, request); err != nil {
+			t.Fatalf("Query() %d error = %v", i, err)
+		}
+	}
+	if got := server.connections.Load(); got != 1 {
+		t.Errorf("server accepted %d connections, want 1", got)
+	}
+
+	// A new connection resumes the TLS session
+	transport.CloseIdleConnections()
+	if _, err := transport.Query("tls", server.addrPort, request); err != nil {
+		t.Fatalf("Query() after closing idle connections error = %v", err)
+	}
+	if got := server.connections.Load(); got != 2 {
+		t.Errorf("server accepted %d connections, want 2", got)
+	}
+	if got := server.resumedSessions.Load(); got != 1 {
+		t.Errorf("server resumed %d sessions, want 1", got)
+	}
+
+	if got := server.unpaddedQueries.Load(); got != 0 {
+		t.Errorf("server received %d unpadded queries", got)
+	}
+}
+
+func TestResolverQueryViaTLS(t *testing.T) {
+	cert, parsedCert := createTestCertificate(t)
+	trustedRoots := x509.NewCertPool()
+	trustedRoots.AddCert(parsedCert)
+	server := startTestTLSServer(t, cert)
+
+	transport := &Transport{Timeout: time.Second, TLSConfig: &tls.Config{RootCAs: trustedRoots}}
+	defer transport.CloseIdleConnections()
+
+	resolver, err := NewResolver("")
+	if err != nil {
+		t.Fatalf("NewResolver() error = %v", err)
+	}
+	resolver.AddressFamily = IPv4Only
+	// The resolver's queries to root servers on port 53 go to the upstream
+	resolver.QueryFunc = transport.QueryVia("tls", server.addrPort)
+
+	var queried []netip.AddrPort
+	queryFunc := resolver.QueryFunc
+	resolver.QueryFunc = func(transmissionProtocol string, serverAddrPort netip.AddrPort, dnsRequest []byte) ([]byte, error) {
+		queried = append(queried, serverAddrPort)
+		response, err := queryFunc(transmissionProtocol, serverAddrPort, dnsRequest)
+		if err != nil {
+			t.Errorf("query for root server %v error = %v", serverAddrPort, err)
+		}
+		return response, err
+	}
+
+	request, _ := CreateQuery("www.example.com.", A)
+	if _, err := resolver.ResolveQuery(request); err != nil {
+		t.Fatalf("ResolveQuery() error = %v", err)
+	}
+	if len(queried) == 0 || queried[0].Port() != DefaultPort {
+		t.Errorf("resolver queried %v, want a root server", queried)
+	}
+	if server.connections.Load() != 1 {
+		t.Errorf("upstream got %d connections, want 1", server.connections.Load())
+	}
+}
+
+func TestPadQuery(t *testing.T) {
+	names := []string{"a.", "example.com.", "a-very-long-label-to-go-over-the-first-padding-block.example.com."}
+
+	for _, name := range names {
+		t.Run(name, func(t *testing.T) {
+			request, _ := CreateQuery(name, A)
+
+			got, err := padQuery(request)
+			if err != nil {
+				t.Fatalf("padQuery() error = %v", err)
+			}
+			if len(got)%queryPaddingBlockSize != 0 {
+				t.Errorf("padQuery() length = %d, want a multiple of %d", len(got), queryPaddingBlockSize)
+			}
+
+			message, err := DecodeMessage(got)
+			if err != nil {
+				t.Fatalf("padQuery() result cannot be decoded: %v", err)
+			}
+			edns, found := message.GetEDNS()
+			if !found || len(edns.Options) != 1 || edns.Options[0].Code != EDNSOptionPadding {
+				t.Errorf("padQuery() EDNS got = %+v, want a single padding option", edns)
+			}
+		})
+	}
+}
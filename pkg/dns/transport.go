@@ -1,61 +1,209 @@
 package dns
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
+	"net/http"
 	"net/netip"
+	"sync"
 	"time"
 )
 
-// QueryResponse sends a DNS query to the specified server using either TCP or UDP.
+const (
+	DefaultTimeout      = 5 * time.Second
+	DefaultRetryBackoff = 100 * time.Millisecond
+)
+
+// Transport sends DNS queries to a server over UDP, TCP, TLS, HTTPS or QUIC,
+// with timeouts, retries and cancellation through a context. A Transport keeps
+// its connections open for reuse, so it should not be copied after first use.
+//
+// A Transport's Query method has the same signature as QueryResponse, so it
+// can be injected into a Resolver:
+//
+//	resolver.QueryFunc = transport.Query
+type Transport struct {
+	// Timeout limits each attempt: dialing, sending and receiving.
+	// No limit if zero.
+	Timeout time.Duration
+	// TotalTimeout limits the whole exchange, all attempts included.
+	// No limit if zero.
+	TotalTimeout time.Duration
+	// Retries is the number of additional attempts after a failed one.
+	Retries int
+	// RetryBackoff is the wait before the first retry. It doubles on each
+	// following retry.
+	RetryBackoff time.Duration
+	// LocalAddr is the local source address to send queries from. If the
+	// port is 0, a random port is chosen. Any local address if invalid.
+	LocalAddr netip.AddrPort
+	// Use0x20 randomizes the case of the question name in UDP queries and
+	// requires replies to echo it exactly (draft-vixie-dnsext-dns0x20).
+	Use0x20 bool
+	// IdleTimeout is how long an idle TCP or TLS connection is kept open for
+	// following queries, unless the server advertises another timeout.
+	// DefaultIdleTimeout if zero.
+	IdleTimeout time.Duration
+
+	// TLSConfig configures DNS over TLS connections. If nil, the server's
+	// certificate is verified against its IP address.
+	TLSConfig *tls.Config
+	// SPKIPins are base64 encoded SHA-256 hashes of the DNS over TLS server's
+	// SubjectPublicKeyInfo. If set, the server must present a pinned key.
+	SPKIPins []string
+
+	// HTTPSURL is the URI template of the DNS over HTTPS server, such as
+	// https://dns.example/dns-query{?dns}.
+	HTTPSURL string
+	// HTTPSUseGET sends DNS over HTTPS queries with GET requests instead
+	// of POST requests.
+	HTTPSUseGET bool
+
+	// QUICDial establishes the QUIC connections for DNS over QUIC, to use
+	// another QUIC implementation. Connections are made with quic-go if nil.
+	QUICDial QUICDialFunc
+
+	mutex           sync.Mutex
+	tlsSessionCache tls.ClientSessionCache
+	streamConns     map[streamConnKey]*pipelinedConn
+	httpClients     map[httpClientKey]*http.Client
+	quicConns       map[netip.AddrPort]QUICConn
+}
+
+// DefaultTransport is the transport used by QueryResponse: a single attempt
+// with a 5 second timeout.
+var DefaultTransport = NewTransport()
+
+// NewTransport creates a transport with the default timeout, no retries
+// and no local source address.
+func NewTransport() *Transport {
+	return &Transport{
+		Timeout:      DefaultTimeout,
+		RetryBackoff: DefaultRetryBackoff,
+	}
+}
+
+// QueryResponse sends a DNS query to the specified server using either TCP or UDP,
+// with the DefaultTransport.
 func QueryResponse(transmissionProtocol string, serverAddrPort netip.AddrPort, dnsRequest []byte) (response []byte, err error) {
-	var conn net.Conn
+	return DefaultTransport.Query(transmissionProtocol, serverAddrPort, dnsRequest)
+}
+
+// Query sends a DNS query to the specified server using UDP, TCP, TLS, HTTPS or QUIC.
+// It can be used as a Resolver's QueryFunc.
+func (transport *Transport) Query(transmissionProtocol string, serverAddrPort netip.AddrPort, dnsRequest []byte) (response []byte, err error) {
+	return transport.QueryContext(context.Background(), transmissionProtocol, serverAddrPort, dnsRequest)
+}
+
+// QueryVia returns a query function that forwards every query to a single
+// upstream server over the given protocol, whichever server and protocol it
+// is called with. It can be used as a Resolver's QueryFunc to send all of its
+// queries to a DNS over TLS or HTTPS server instead of the root and
+// authoritative servers:
+//
+//	resolver.QueryFunc = transport.QueryVia("https", netip.AddrPort{})
+//
+// Parameters:
+//   - transmissionProtocol: "udp", "tcp", "tls", "https" or "quic"
+//   - upstream: the address and port of the upstream server (for HTTPS,
+//     an optional bootstrap address to connect to instead of the URL's host)
+//
+// Returns:
+//   - query: the query function
+func (transport *Transport) QueryVia(transmissionProtocol string, upstream netip.AddrPort) (query func(string, netip.AddrPort, []byte) ([]byte, error)) {
+	return func(_ string, _ netip.AddrPort, dnsRequest []byte) ([]byte, error) {
+		return transport.Query(transmissionProtocol, upstream, dnsRequest)
+	}
+}
 
-	// Dial the server using the specified protocol
+// QueryContext sends a DNS query to the specified server using UDP, TCP, TLS, HTTPS or QUIC,
+// retrying failed attempts according to the transport's settings.
+//
+// Parameters:
+//   - ctx: the context, which cancels the exchange when done
+//   - transmissionProtocol: "udp", "tcp", "tls", "https" or "quic"
+//   - serverAddrPort: the address and port of the server to query (for HTTPS,
+//     an optional bootstrap address to connect to instead of the URL's host)
+//   - dnsRequest: the encoded DNS request
+//
+// Returns:
+//   - response: the encoded DNS response
+//   - err: an error if every attempt failed or the context is done
+func (transport *Transport) QueryContext(ctx context.Context, transmissionProtocol string, serverAddrPort netip.AddrPort, dnsRequest []byte) (response []byte, err error) {
 	switch transmissionProtocol {
-	case "tcp":
-		conn, err = net.DialTCP("tcp", nil, net.TCPAddrFromAddrPort(serverAddrPort))
-	case "udp":
-		conn, err = net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(serverAddrPort))
+	case "udp", "tcp", "tls", "https", "quic":
 	default:
-		return nil, fmt.Errorf("unsupported transmission protocol: %s", transmissionProtocol)
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedTransmissionProtocol, transmissionProtocol)
 	}
 
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to DNS server: %v", err)
+	if transport.TotalTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, transport.TotalTimeout)
+		defer cancel()
 	}
-	defer conn.Close()
 
-	if transmissionProtocol == "tcp" {
-		// Add length prefix for TCP
-		length := uint16(len(dnsRequest))
-		highByte := byte(length >> 8)
-		lowByte := byte(length & 0xFF)
-		dnsRequest = append([]byte{highByte, lowByte}, dnsRequest...)
+	backoff := transport.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		response, err = transport.exchange(ctx, transmissionProtocol, serverAddrPort, dnsRequest)
+		if err == nil {
+			return response, nil
+		}
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("DNS query to %v cancelled: %w", serverAddrPort, ctx.Err())
+		}
+		if attempt >= transport.Retries {
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("DNS query to %v cancelled: %w", serverAddrPort, ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
 	}
+}
 
-	// Send the DNS request
-	_, err = conn.Write(dnsRequest)
-	if err != nil {
-		return nil, fmt.Errorf("failed to send DNS request: %v", err)
+// exchange makes a single attempt at sending a DNS request and reading its response.
+func (transport *Transport) exchange(ctx context.Context, transmissionProtocol string, serverAddrPort netip.AddrPort, dnsRequest []byte) (response []byte, err error) {
+	if transport.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, transport.Timeout)
+		defer cancel()
 	}
 
-	// Set a read deadline
-	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	switch transmissionProtocol {
+	case "udp":
+		return transport.exchangeUDP(ctx, serverAddrPort, dnsRequest)
+	case "https":
+		return transport.exchangeHTTPS(ctx, serverAddrPort, dnsRequest)
+	case "quic":
+		return transport.exchangeQUIC(ctx, serverAddrPort, dnsRequest)
+	default:
+		return transport.exchangePipelined(ctx, transmissionProtocol, serverAddrPort, dnsRequest)
+	}
+}
 
-	// Read the response
-	receivedResponse := [4096]byte{}
-	n, err := conn.Read(receivedResponse[:])
-	if err != nil {
-		return nil, fmt.Errorf("failed to read DNS response: %v", err)
+// setDeadlineFromContext sets the connection's deadline to the context's
+// deadline, and unblocks reads and writes as soon as the context is cancelled.
+// The returned function stops watching the context.
+func setDeadlineFromContext(ctx context.Context, conn interface{ SetDeadline(time.Time) error }) (stop func() bool) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
 	}
+	return context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+}
+
+func (transport *Transport) dial(ctx context.Context, transmissionProtocol string, serverAddrPort netip.AddrPort) (conn net.Conn, err error) {
+	dialer := net.Dialer{}
 
-	if transmissionProtocol == "tcp" {
-		// Skip the first two length prefix bytes for TCP
-		response = receivedResponse[2:n]
-	} else {
-		response = receivedResponse[:n]
+	if transport.LocalAddr.IsValid() {
+		dialer.LocalAddr = net.TCPAddrFromAddrPort(transport.LocalAddr)
 	}
 
-	return response, nil
+	return dialer.DialContext(ctx, transmissionProtocol, serverAddrPort.String())
 }
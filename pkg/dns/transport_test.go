@@ -0,0 +1,165 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startTestUDPServer starts a local UDP server that answers each request with
+// the handler's return value, or drops it if the handler returns nil.
+func startTestUDPServer(t *testing.T, handler func(request []byte, clientAddr netip.AddrPort) []byte) netip.AddrPort {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:0")))
+	if err != nil {
+		t.Fatalf("failed to start test UDP server: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buffer := [MaxDNSMessageSize]byte{}
+		for {
+			n, clientAddr, err := conn.ReadFromUDPAddrPort(buffer[:])
+			if err != nil {
+				return
+			}
+			if response := handler(buffer[:n], clientAddr); response != nil {
+				conn.WriteToUDPAddrPort(response, clientAddr)
+			}
+		}
+	}()
+
+	return conn.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+// createTestReply creates an encoded reply to the given encoded request.
+func createTestReply(t *testing.T, request []byte) []byte {
+	t.Helper()
+
+	parsedRequest, err := DecodeMessage(request)
+	if err != nil {
+		t.Errorf("failed to decode test request: %v", err)
+		return nil
+	}
+	reply, err := EncodeMessage(NewReply(parsedRequest))
+	if err != nil {
+		t.Errorf("failed to encode test reply: %v", err)
+		return nil
+	}
+	return reply
+}
+
+func TestTransportQueryContext(t *testing.T) {
+	request, err := CreateQuery("example.com.", A)
+	if err != nil {
+		t.Fatalf("CreateQuery() error = %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		transport    *Transport
+		dropRequests int32
+		wantError    bool
+	}{
+		{
+			name:         "Immediate answer",
+			transport:    &Transport{Timeout: time.Second},
+			dropRequests: 0,
+			wantError:    false,
+		},
+		{
+			name:         "Answer after retry",
+			transport:    &Transport{Timeout: 50 * time.Millisecond, Retries: 2, RetryBackoff: time.Millisecond},
+			dropRequests: 2,
+			wantError:    false,
+		},
+		{
+			name:         "No answer without retries",
+			transport:    &Transport{Timeout: 50 * time.Millisecond},
+			dropRequests: 1,
+			wantError:    true,
+		},
+		{
+			name:         "Total timeout before retries are exhausted",
+			transport:    &Transport{Timeout: 50 * time.Millisecond, TotalTimeout: 80 * time.Millisecond, Retries: 5},
+			dropRequests: 5,
+			wantError:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var received atomic.Int32
+			server := startTestUDPServer(t, func(request []byte, clientAddr netip.AddrPort) []byte {
+				if received.Add(1) <= tt.dropRequests {
+					return nil
+				}
+				return createTestReply(t, request)
+			})
+
+			got, err := tt.transport.QueryContext(context.Background(), "udp", server, request)
+
+			if tt.wantError {
+				if err == nil {
+					t.Fatalf("QueryContext() expected error, got response %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("QueryContext() error = %v", err)
+			}
+			if want := createTestReply(t, request); !bytes.Equal(got, want) {
+				t.Errorf("QueryContext() got = %v, want = %v", got, want)
+			}
+		})
+	}
+}
+
+func TestTransportQueryContextCancel(t *testing.T) {
+	server := startTestUDPServer(t, func(request []byte, clientAddr netip.AddrPort) []byte {
+		return nil
+	})
+	request, _ := CreateQuery("example.com.", A)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	transport := Transport{Timeout: 10 * time.Second, Retries: 3}
+	start := time.Now()
+	_, err := transport.QueryContext(ctx, "udp", server, request)
+
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("QueryContext() error = %v, want = %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("QueryContext() took %v after cancellation", elapsed)
+	}
+}
+
+func TestTransportLocalAddr(t *testing.T) {
+	clientAddrs := make(chan netip.AddrPort, 1)
+	server := startTestUDPServer(t, func(request []byte, clientAddr netip.AddrPort) []byte {
+		clientAddrs <- clientAddr
+		return createTestReply(t, request)
+	})
+	request, _ := CreateQuery("example.com.", A)
+
+	transport := Transport{Timeout: time.Second, LocalAddr: netip.MustParseAddrPort("127.0.0.1:0")}
+	if _, err := transport.Query("udp", server, request); err != nil {
+		t.Fatalf("Query() error = %v", err)
+	}
+
+	if got := <-clientAddrs; got.Addr() != netip.MustParseAddr("127.0.0.1") {
+		t.Errorf("Query() sent from %v, want 127.0.0.1", got)
+	}
+
+	if _, err := transport.Query("sctp", server, request); !errors.Is(err, ErrUnsupportedTransmissionProtocol) {
+		t.Errorf("Query() error = %v, want = %v", err, ErrUnsupportedTransmissionProtocol)
+	}
+}
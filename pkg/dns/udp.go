@@ -0,0 +1,214 @@
+package dns
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// UDP exchanges are hardened against spoofed responses (RFC 5452):
+//   - queries are sent from a random source port on an unconnected socket,
+//   - datagrams that don't come from the queried server, or that don't match
+//     the query's ID, question name, type and class, are discarded while we
+//     keep waiting for the real response until the deadline,
+//   - optionally, the question name's case is randomized (0x20 encoding)
+//     and must be echoed exactly.
+
+const (
+	minRandomSourcePort   = 1024
+	maxRandomSourcePort   = 65535
+	randomSourcePortTries = 10
+)
+
+func (transport *Transport) exchangeUDP(ctx context.Context, serverAddrPort netip.AddrPort, dnsRequest []byte) (response []byte, err error) {
+	parsedRequest, err := DecodeMessage(dnsRequest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DNS request: %w", err)
+	}
+	if len(parsedRequest.Questions) != 1 {
+		return nil, fmt.Errorf("invalid DNS request: expected 1 question, has %d", len(parsedRequest.Questions))
+	}
+
+	sentRequest := dnsRequest
+	if transport.Use0x20 {
+		parsedRequest.Questions[0].Name = randomizeCase(parsedRequest.Questions[0].Name)
+		sentRequest, err = EncodeMessage(parsedRequest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DNS request: %w", err)
+		}
+	}
+
+	conn, err := transport.listenUDP(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open UDP socket: %w", err)
+	}
+	defer conn.Close()
+
+	stop := setDeadlineFromContext(ctx, conn)
+	defer stop()
+
+	_, err = conn.WriteToUDPAddrPort(sentRequest, serverAddrPort)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send DNS request: %w", err)
+	}
+
+	receivedResponse := [MaxDNSMessageSize]byte{}
+	for {
+		n, sourceAddrPort, err := conn.ReadFromUDPAddrPort(receivedResponse[:])
+		if err != nil {
+			return nil, fmt.Errorf("failed to read DNS response: %w", err)
+		}
+
+		if !isSameAddrPort(sourceAddrPort, serverAddrPort) {
+			continue
+		}
+
+		response = receivedResponse[:n]
+		if err := validateResponse(parsedRequest, response, transport.Use0x20); err != nil {
+			continue
+		}
+
+		if transport.Use0x20 {
+			restoreQuestionName(response, dnsRequest)
+		}
+		return append([]byte{}, response...), nil
+	}
+}
+
+// listenUDP opens an unconnected UDP socket bound to a random source port,
+// unless the transport's local address specifies one.
+func (transport *Transport) listenUDP(ctx context.Context) (conn *net.UDPConn, err error) {
+	listenConfig := net.ListenConfig{}
+	localAddr := transport.LocalAddr.Addr()
+
+	if transport.LocalAddr.Port() != 0 {
+		return listenUDPAddrPort(ctx, listenConfig, netip.AddrPortFrom(localAddr, transport.LocalAddr.Port()))
+	}
+
+	// Choose the port ourselves rather than rely on the OS's ephemeral port
+	// allocation, which may be sequential or restricted to a small range.
+	for i := 0; i < randomSourcePortTries; i++ {
+		conn, err = listenUDPAddrPort(ctx, listenConfig, netip.AddrPortFrom(localAddr, randomSourcePort()))
+		if err == nil {
+			return conn, nil
+		}
+	}
+
+	return listenUDPAddrPort(ctx, listenConfig, netip.AddrPortFrom(localAddr, 0))
+}
+
+func listenUDPAddrPort(ctx context.Context, listenConfig net.ListenConfig, localAddrPort netip.AddrPort) (conn *net.UDPConn, err error) {
+	address := ":" + fmt.Sprint(localAddrPort.Port())
+	if localAddrPort.Addr().IsValid() {
+		address = localAddrPort.String()
+	}
+
+	packetConn, err := listenConfig.ListenPacket(ctx, "udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return packetConn.(*net.UDPConn), nil
+}
+
+func randomSourcePort() uint16 {
+	bytes := [2]byte{}
+	_, err := rand.Read(bytes[:])
+	if err != nil {
+		panic(err)
+	}
+
+	portRange := uint16(maxRandomSourcePort - minRandomSourcePort + 1)
+	return minRandomSourcePort + binary.BigEndian.Uint16(bytes[:])%portRange
+}
+
+func isSameAddrPort(a netip.AddrPort, b netip.AddrPort) bool {
+	return a.Addr().Unmap() == b.Addr().Unmap() && a.Port() == b.Port()
+}
+
+// validateResponse checks that a response answers the given request: it must
+// be a response with the same ID and the same question. The question name is
+// compared case-sensitively if caseSensitive is set (0x20 encoding).
+//
+// Servers which can't parse or don't implement a request may reply without a
+// question section, so an empty question section is accepted for FORMERR and
+// NOTIMP. Any other response must have the question, so that a forged reply
+// has to guess more than the ID.
+func validateResponse(request Message, responseData []byte, caseSensitive bool) error {
+	response, err := DecodeMessage(responseData)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrResponseMismatch, err)
+	}
+
+	if !response.Header.Flags.Response {
+		return fmt.Errorf("%w: not a response", ErrResponseMismatch)
+	}
+	if response.Header.Id != request.Header.Id {
+		return fmt.Errorf("%w: ID %d, expected %d", ErrResponseMismatch, response.Header.Id, request.Header.Id)
+	}
+
+	responseCode := response.GetResponseCode()
+	if len(response.Questions) == 0 && (responseCode == FORMERR || responseCode == NOTIMP) {
+		return nil
+	}
+	if len(response.Questions) != 1 {
+		return fmt.Errorf("%w: %d questions", ErrResponseMismatch, len(response.Questions))
+	}
+
+	want := request.Questions[0]
+	got := response.Questions[0]
+
+	if caseSensitive && got.Name != want.Name {
+		return fmt.Errorf("%w: question name %s, expected %s", ErrResponseMismatch, got.Name, want.Name)
+	}
+	if !strings.EqualFold(got.Name, want.Name) {
+		return fmt.Errorf("%w: question name %s, expected %s", ErrResponseMismatch, got.Name, want.Name)
+	}
+	if got.QType != want.QType || got.QClass != want.QClass {
+		return fmt.Errorf("%w: question type %s class %s, expected type %s class %s", ErrResponseMismatch,
+			DNSType(got.QType), DNSClass(got.QClass), DNSType(want.QType), DNSClass(want.QClass))
+	}
+
+	return nil
+}
+
+// randomizeCase randomly switches the case of each letter in a domain name.
+func randomizeCase(name string) string {
+	randomBits := make([]byte, len(name))
+	_, err := rand.Read(randomBits)
+	if err != nil {
+		panic(err)
+	}
+
+	randomized := []byte(name)
+	for i, char := range randomized {
+		if randomBits[i]&1 == 0 {
+			continue
+		}
+		switch {
+		case 'a' <= char && char <= 'z':
+			randomized[i] = char - 'a' + 'A'
+		case 'A' <= char && char <= 'Z':
+			randomized[i] = char - 'A' + 'a'
+		}
+	}
+	return string(randomized)
+}
+
+// restoreQuestionName overwrites the question name in a response with the
+// original request's, undoing 0x20 case randomization. The question name
+// directly follows the header in both messages and is never compressed,
+// so it has the same length and position in each.
+func restoreQuestionName(response []byte, request []byte) {
+	reader := &dnsReader{data: request, offset: DNSHeaderLength}
+	if _, err := reader.readDomainName(); err != nil {
+		return
+	}
+	if len(response) < reader.offset {
+		return
+	}
+	copy(response[DNSHeaderLength:reader.offset], request[DNSHeaderLength:reader.offset])
+}
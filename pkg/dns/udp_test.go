@@ -0,0 +1,261 @@
+package dns
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateResponse(t *testing.T) {
+	request := Message{
+		Header:    Header{Id: 1234, QuestionCount: 1},
+		Questions: []Question{{Name: "www.Example.com.", QType: A, QClass: IN}},
+	}
+
+	tests := []struct {
+		name          string
+		modify        func(response *Message)
+		caseSensitive bool
+		wantError     error
+	}{
+		{
+			name:      "Matching response",
+			modify:    func(response *Message) {},
+			wantError: nil,
+		},
+		{
+			name:      "Matching response with different case",
+			modify:    func(response *Message) { response.Questions[0].Name = "www.example.com." },
+			wantError: nil,
+		},
+		{
+			name:          "0x20 response with different case",
+			modify:        func(response *Message) { response.Questions[0].Name = "www.example.com." },
+			caseSensitive: true,
+			wantError:     ErrResponseMismatch,
+		},
+		{
+			name:      "Not a response",
+			modify:    func(response *Message) { response.Header.Flags.Response = false },
+			wantError: ErrResponseMismatch,
+		},
+		{
+			name:      "Wrong ID",
+			modify:    func(response *Message) { response.Header.Id = 4321 },
+			wantError: ErrResponseMismatch,
+		},
+		{
+			name:      "Wrong question name",
+			modify:    func(response *Message) { response.Questions[0].Name = "www.example.net." },
+			wantError: ErrResponseMismatch,
+		},
+		{
+			name:      "Wrong question type",
+			modify:    func(response *Message) { response.Questions[0].QType = AAAA },
+			wantError: ErrResponseMismatch,
+		},
+		{
+			name:      "Wrong question class",
+			modify:    func(response *Message) { response.Questions[0].QClass = CH },
+			wantError: ErrResponseMismatch,
+		},
+		{
+			name:      "NOERROR response without question",
+			modify:    func(response *Message) { response.Questions = nil; response.UpdateCounts() },
+			wantError: ErrResponseMismatch,
+		},
+		{
+			name: "FORMERR response without question",
+			modify: func(response *Message) {
+				response.Questions = nil
+				response.SetResponseCode(FORMERR)
+				response.UpdateCounts()
+			},
+			wantError: nil,
+		},
+		{
+			name: "NOTIMP response without question",
+			modify: func(response *Message) {
+				response.Questions = nil
+				response.SetResponseCode(NOTIMP)
+				response.UpdateCounts()
+			},
+			wantError: nil,
+		},
+		{
+			name: "SERVFAIL response without question",
+			modify: func(response *Message) {
+				response.Questions = nil
+				response.SetResponseCode(SERVFAIL)
+				response.UpdateCounts()
+			},
+			wantError: ErrResponseMismatch,
+		},
+		{
+			name: "NXDOMAIN response without question",
+			modify: func(response *Message) {
+				response.Questions = nil
+				response.SetResponseCode(NXDOMAIN)
+				response.UpdateCounts()
+			},
+			wantError: ErrResponseMismatch,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := NewReply(request)
+			tt.modify(&response)
+			data, _ := EncodeMessage(response)
+
+			err := validateResponse(request, data, tt.caseSensitive)
+
+			if tt.wantError != nil {
+				if err == nil || !errors.Is(err, tt.wantError) {
+					t.Fatalf("validateResponse() error = %v, want error = %v", err, tt.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("validateResponse() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestTransportQueryDiscardsSpoofedResponses(t *testing.T) {
+	serverConn, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:0")))
+	if err != nil {
+		t.Fatalf("failed to start test UDP server: %v", err)
+	}
+	defer serverConn.Close()
+
+	spoofer, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:0")))
+	if err != nil {
+		t.Fatalf("failed to open spoofing socket: %v", err)
+	}
+	defer spoofer.Close()
+
+	go func() {
+		buffer := [MaxDNSMessageSize]byte{}
+		n, clientAddr, err := serverConn.ReadFromUDPAddrPort(buffer[:])
+		if err != nil {
+			return
+		}
+		request := buffer[:n]
+		parsedRequest, _ := DecodeMessage(request)
+
+		// A correct reply, but from the wrong source address
+		spoofer.WriteToUDPAddrPort(createTestReply(t, request), clientAddr)
+
+		// Replies from the right source address, but with the wrong ID or question
+		wrongID := NewReply(parsedRequest)
+		wrongID.Header.Id++
+		wrongQuestion := NewReply(parsedRequest)
+		wrongQuestion.Questions[0].Name = "evil.example.com."
+
+		for _, spoofed := range []Message{wrongID, wrongQuestion} {
+			data, _ := EncodeMessage(spoofed)
+			serverConn.WriteToUDPAddrPort(data, clientAddr)
+		}
+		serverConn.WriteToUDPAddrPort([]byte("garbage"), clientAddr)
+
+		time.Sleep(10 * time.Millisecond)
+		serverConn.WriteToUDPAddrPort(createTestReply(t, request), clientAddr)
+	}()
+
+	server := serverConn.LocalAddr().(*net.UDPAddr).AddrPort()
+	request, _ := CreateQuery("www.example.com.", A)
+	transport := Transport{Timeout: time.Second}
+
+	got, err := transport.Query("udp", server, request)
+	if err != nil {
+		t.Fatalf("Query() error = %v", err)
+	}
+	if want := createTestReply(t, request); !bytes.Equal(got, want) {
+		t.Errorf("Query() got = %v, want = %v", got, want)
+	}
+}
+
+func TestTransportQuery0x20(t *testing.T) {
+	tests := []struct {
+		name      string
+		preserve  bool
+		wantError bool
+	}{
+		{name: "Server preserves question case", preserve: true, wantError: false},
+		{name: "Server lowercases question", preserve: false, wantError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receivedNames := make(chan string, 1)
+			server := startTestUDPServer(t, func(request []byte, clientAddr netip.AddrPort) []byte {
+				parsedRequest, _ := DecodeMessage(request)
+				receivedNames <- parsedRequest.Questions[0].Name
+
+				reply := NewReply(parsedRequest)
+				if !tt.preserve {
+					reply.Questions[0].Name = strings.ToLower(reply.Questions[0].Name)
+				}
+				data, _ := EncodeMessage(reply)
+				return data
+			})
+
+			// A long name makes it very unlikely that the randomized name is all lowercase
+			name := "abcdefghijklmnopqrstuvwxyz.example.com."
+			request, _ := CreateQuery(name, A)
+			transport := Transport{Timeout: 100 * time.Millisecond, Use0x20: true}
+
+			got, err := transport.Query("udp", server, request)
+
+			if sent := <-receivedNames; sent == name || !strings.EqualFold(sent, name) {
+				t.Errorf("Query() sent question name %s, want randomized case of %s", sent, name)
+			}
+			if tt.wantError {
+				if err == nil {
+					t.Fatalf("Query() expected error, got response %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Query() error = %v", err)
+			}
+
+			parsedResponse, _ := DecodeMessage(got)
+			if parsedResponse.Questions[0].Name != name {
+				t.Errorf("Query() response question name = %s, want restored %s", parsedResponse.Questions[0].Name, name)
+			}
+		})
+	}
+}
+
+func TestTransportQueryRandomSourcePort(t *testing.T) {
+	sourcePorts := make(chan uint16, 3)
+	server := startTestUDPServer(t, func(request []byte, clientAddr netip.AddrPort) []byte {
+		sourcePorts <- clientAddr.Port()
+		return createTestReply(t, request)
+	})
+	request, _ := CreateQuery("example.com.", A)
+	transport := Transport{Timeout: time.Second}
+
+	seen := make(map[uint16]bool)
+	for i := 0; i < 3; i++ {
+		if _, err := transport.Query("udp", server, request); err != nil {
+			t.Fatalf("Query() error = %v", err)
+		}
+		port := <-sourcePorts
+		if port < minRandomSourcePort {
+			t.Errorf("Query() sent from privileged port %d", port)
+		}
+		seen[port] = true
+	}
+
+	if len(seen) < 2 {
+		t.Errorf("Query() sent 3 queries from the same source port: %v", seen)
+	}
+}